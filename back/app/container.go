@@ -0,0 +1,123 @@
+package app
+
+import (
+	"back/blob"
+	"back/config"
+	"back/prompts"
+	"back/ratelimit"
+	"back/realtime"
+	"back/services"
+	"context"
+	"database/sql"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Container はプロセス全体で共有する依存先とサービスをまとめたもの。main で1つだけ作り、ハンドラーに注入する
+type Container struct {
+	DB     *sql.DB
+	Dynamo *dynamodb.Client
+
+	// Events はプロセス内のイベントバス。通知の配信キューへの登録が購読している
+	Events        *services.EventBus
+	Conversations *services.ConversationStore
+	Usage         *services.UsageService
+	Chat          *services.ChatService
+	RAG           *services.RAGService
+	Research      *services.ResearchService
+	Reminders     *services.ReminderService
+	Notifications *services.NotificationService
+	Attachments   *services.AttachmentService
+	Documents     *services.DocumentService
+	Retention     *services.RetentionService
+	Prompts       *services.PromptService
+	Settings      *services.SettingsService
+	Health        *services.HealthChecker
+
+	// Realtime はWebSocket接続への新着の通知。アシスタントのメッセージのイベントを購読している
+	Realtime *realtime.Hub
+
+	// RateLimits はレート制限の状態。複数インスタンスで共有する場合は共有ストアに差し替える
+	RateLimits ratelimit.Store
+}
+
+// NewContainer は接続プールとクライアントを開き、サービスを組み立てる
+func NewContainer(ctx context.Context) (*Container, error) {
+	db, err := services.OpenPostgres(ctx, config.GetPostgresURI())
+	if err != nil {
+		return nil, err
+	}
+
+	events := services.NewEventBus()
+	notifications := services.NewNotificationService(db)
+	events.Subscribe(notifications.Publish)
+	hub := realtime.NewHub()
+	events.Subscribe(func(_ context.Context, event services.Event) {
+		if event.Type == services.EventMessageCreated {
+			hub.Notify(event.UserID)
+		}
+	})
+
+	dynamo := services.GetDynamoDBClient()
+	conversations := services.NewConversationStore(dynamo, events)
+	conversations.EnsureTable(ctx)
+
+	health := services.NewHealthChecker(config.GetHealthCheckTimeout())
+	health.Register("dynamodb", true, services.DynamoDBHealthCheck(dynamo))
+	health.Register("postgres", true, services.PostgresHealthCheck(db))
+	health.Register("openai", false, services.ProviderHealthCheck(services.ProviderOpenAI, "https://api.openai.com/v1/models", config.GetOpenAIKey(), config.GetProviderHealthTTL()))
+
+	// プロンプトのテンプレート。ディレクトリの指定があれば組み込みのものを上書き・追加する
+	registry, err := prompts.Load(config.GetPromptTemplateDir())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	promptService := services.NewPromptService(db, registry)
+
+	usage := services.NewUsageService(db)
+	settings := services.NewSettingsService(db)
+	rag := services.NewRAGService(db, config.GetOpenAIKey(), usage, promptService)
+	research := services.NewResearchService(db, conversations, usage, promptService, settings)
+	reminders := services.NewReminderService(db, conversations, settings)
+
+	blobs, err := blob.NewLocalStore(config.GetBlobStoreDir())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// チャットアシスタントが使えるツール
+	tools := services.NewToolRegistry(
+		services.NewCurrentTimeTool(),
+		services.NewMemorySearchTool(rag),
+		services.NewResearchTool(research),
+		services.NewCreateReminderTool(reminders),
+	)
+
+	return &Container{
+		DB:            db,
+		Dynamo:        dynamo,
+		Events:        events,
+		Conversations: conversations,
+		Usage:         usage,
+		Chat:          services.NewChatService(conversations, usage, tools, promptService),
+		RAG:           rag,
+		Research:      research,
+		Reminders:     reminders,
+		Notifications: notifications,
+		Attachments:   services.NewAttachmentService(db, blobs, usage, promptService, settings),
+		Documents:     services.NewDocumentService(db, usage),
+		Retention:     services.NewRetentionService(db),
+		Prompts:       promptService,
+		Settings:      settings,
+		Health:        health,
+		Realtime:      hub,
+		RateLimits:    ratelimit.NewMemoryStore(),
+	}, nil
+}
+
+// Close は接続プールを閉じる
+func (c *Container) Close() error {
+	return c.DB.Close()
+}
@@ -0,0 +1,42 @@
+// Package blob は添付ファイルなどのバイナリを保存するストア
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrNotFound は指定したキーのオブジェクトがないことを表す
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey はキーに使えない文字や ".." が含まれることを表す
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Store はキーでバイナリを保存・取得するストア。S3などに差し替えられるようにインターフェースにしている
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get はオブジェクトを開く。呼び出し元が Close すること
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete はオブジェクトを削除する。存在しなくてもエラーにしない
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidateKey はキーが "a/b/c" 形式で、各要素が英数字と - _ . だけからなることを確認する
+func ValidateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidKey
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return ErrInvalidKey
+			}
+		}
+	}
+	return nil
+}
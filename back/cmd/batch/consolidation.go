@@ -0,0 +1,29 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runConsolidationWorker は一定間隔で要約を日・週・話題ごとにまとめる。ctx がキャンセルされるまで戻らない
+func runConsolidationWorker(ctx context.Context, processor *services.BatchProcessor) {
+	ticker := time.NewTicker(config.GetConsolidationInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		slog.InfoContext(ctx, "Starting summary consolidation")
+		if err := processor.Consolidate(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error consolidating summaries", "error", err)
+		}
+		slog.InfoContext(ctx, "Summary consolidation completed")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runDigestScheduler は毎日決まった時刻(UTC)にリサーチダイジェストを作成する。ctx がキャンセルされるまで戻らない
+func runDigestScheduler(ctx context.Context, research *services.ResearchService) {
+	hour := config.GetResearchDigestHour()
+	for {
+		next := nextDigestTime(time.Now().UTC(), hour)
+		slog.InfoContext(ctx, "Next research digest scheduled", "at", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		slog.InfoContext(ctx, "Starting research digests")
+		since := time.Now().Add(-config.GetResearchDigestActiveWindow())
+		if err := research.RunDigests(ctx, since); err != nil {
+			slog.ErrorContext(ctx, "Error creating research digests", "error", err)
+		}
+		slog.InfoContext(ctx, "Research digests completed")
+	}
+}
+
+// nextDigestTime は now より後で最初に来る hour 時ちょうどを返す
+func nextDigestTime(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newHTTPServer はメトリクスとヘルスチェックを公開するHTTPサーバーを作成する
+func newHTTPServer(addr string, processor *services.BatchProcessor, checker *services.HealthChecker) *http.Server {
+	startedAt := time.Now()
+	maxAge := config.GetBatchHealthMaxAge()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// 最後に成功した実行が古すぎる場合と、実行中のまま maxAge を過ぎた(止まっている)場合は異常とみなす
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := processor.Status()
+
+		healthy := (status.Running && time.Since(status.StartedAt) < maxAge) || time.Since(status.LastSuccessAt) < maxAge
+		if status.LastSuccessAt.IsZero() && time.Since(startedAt) < maxAge {
+			healthy = true
+		}
+
+		code := http.StatusOK
+		overall := services.HealthStatusUp
+		if !healthy {
+			code = http.StatusServiceUnavailable
+			overall = services.HealthStatusDown
+		}
+		writeJSON(w, code, map[string]interface{}{
+			"status": overall,
+			"batch":  status,
+		})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, components := checker.Check(r.Context())
+
+		code := http.StatusOK
+		overall := services.HealthStatusUp
+		if !ready {
+			code = http.StatusServiceUnavailable
+			overall = services.HealthStatusDown
+		}
+		writeJSON(w, code, map[string]interface{}{
+			"status":     overall,
+			"components": components,
+		})
+	})
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -2,51 +2,145 @@
 package main
 
 import (
+	"back/app"
+	"back/config"
+	"back/logging"
 	"back/services"
-	"log"
+	"back/tracing"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 func main() {
-	// 明示的な接続文字列の指定
-	postgresURI := "host=localhost port=5432 user=postgres password=postgres dbname=memorai sslmode=disable"
+	logging.Setup()
 
-	// DynamoDBクライアントの取得
-	dynamoClient := services.GetDynamoDBClient()
+	// SIGINT/SIGTERMで新しいバッチの開始を止める
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "memorai-batch")
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}()
 
 	// 数回リトライを試みる
-	var processor *services.BatchProcessor
-	var err error
+	var container *app.Container
 
 	for i := 0; i < 3; i++ {
-		processor, err = services.NewBatchProcessor(postgresURI, dynamoClient)
+		container, err = app.NewContainer(ctx)
 		if err == nil {
 			break
 		}
-		log.Printf("Attempt %d: Failed to create batch processor: %v", i+1, err)
-		time.Sleep(2 * time.Second)
+		slog.Warn("Failed to initialize dependencies", "attempt", i+1, "error", err)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			slog.Info("Shutdown requested before batch processor was ready")
+			return
+		}
 	}
 
 	if err != nil {
-		log.Fatalf("Failed to create batch processor after retries: %v", err)
+		slog.Error("Failed to initialize dependencies after retries", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := container.Close(); err != nil {
+			slog.Error("Error closing dependencies", "error", err)
+		}
+	}()
+
+	processor := services.NewBatchProcessor(container.DB, container.Conversations, container.Usage, container.Events, container.Retention, container.Prompts, container.Settings)
+
+	// メトリクス・ヘルスチェック公開用のHTTPサーバー
+	httpServer := newHTTPServer(config.GetBatchHTTPAddr(), processor, container.Health)
+	go func() {
+		slog.Info("Batch HTTP server starting", "addr", httpServer.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Batch HTTP server failed", "error", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	// 定期実行のワーカー。接続を閉じる前に処理中の作業を待つ
+	var workers sync.WaitGroup
+	defer workers.Wait()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runReminderWorker(ctx, container.Reminders)
+	}()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runNotificationWorker(ctx, container.Notifications)
+	}()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runConsolidationWorker(ctx, processor)
+	}()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		runRetentionWorker(ctx, container.Retention)
+	}()
+
+	// 日次のリサーチダイジェスト(任意)
+	if config.GetResearchDigestEnabled() {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			runDigestScheduler(ctx, container.Research)
+		}()
 	}
 
-	log.Println("Starting batch processing service...")
+	slog.Info("Starting batch processing service")
 
 	// 初回実行
-	if err := processor.ProcessConversations(); err != nil {
-		log.Printf("Error in initial processing: %v", err)
+	if err := processor.ProcessConversations(ctx); err != nil {
+		slog.Error("Error in initial processing", "error", err)
 	}
 
 	// 定期実行の設定
 	ticker := time.NewTicker(10 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		log.Println("Starting scheduled batch processing...")
-		if err := processor.ProcessConversations(); err != nil {
-			log.Printf("Error processing conversations: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			// 処理中のユーザーは ProcessConversations 内で猶予期間まで完了を待っている
+			slog.Info("Batch processing service stopped")
+			return
+		case <-ticker.C:
+			slog.Info("Starting scheduled batch processing")
+			if err := processor.ProcessConversations(ctx); err != nil {
+				slog.Error("Error processing conversations", "error", err)
+			}
+			slog.Info("Batch processing completed")
 		}
-		log.Println("Batch processing completed")
 	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runNotificationWorker は一定間隔で送信待ちの通知を送る。ctx がキャンセルされるまで戻らない
+func runNotificationWorker(ctx context.Context, notifications *services.NotificationService) {
+	ticker := time.NewTicker(config.GetNotificationPollInterval())
+	defer ticker.Stop()
+
+	batchSize := config.GetNotificationBatchSize()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		delivered, err := notifications.DeliverPending(ctx, batchSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error delivering notifications", "error", err)
+			continue
+		}
+		if delivered > 0 {
+			slog.InfoContext(ctx, "Delivered notifications", "count", delivered)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runReminderWorker は一定間隔で期限の来たリマインダーを配信する。ctx がキャンセルされるまで戻らない
+func runReminderWorker(ctx context.Context, reminders *services.ReminderService) {
+	ticker := time.NewTicker(config.GetReminderPollInterval())
+	defer ticker.Stop()
+
+	batchSize := config.GetReminderBatchSize()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 1回で配信しきれなかった分は続けて処理する
+		for {
+			delivered, err := reminders.DeliverDue(ctx, batchSize)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error delivering reminders", "error", err)
+				break
+			}
+			if delivered > 0 {
+				slog.InfoContext(ctx, "Delivered reminders", "count", delivered)
+			}
+			if delivered < batchSize || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"back/config"
+	"back/services"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runRetentionWorker は一定間隔で保持期間を過ぎた要約を削除する。ctx がキャンセルされるまで戻らない
+func runRetentionWorker(ctx context.Context, retention *services.RetentionService) {
+	ticker := time.NewTicker(config.GetRetentionInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		slog.InfoContext(ctx, "Starting retention enforcement")
+		if err := retention.Enforce(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error enforcing retention", "error", err)
+		}
+		slog.InfoContext(ctx, "Retention enforcement completed")
+	}
+}
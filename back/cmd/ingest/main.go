@@ -0,0 +1,132 @@
+// cmd/ingest/main.go
+// ナレッジベースに資料を取り込むCLI。ディレクトリを指定すると配下のテキスト・Markdownを再帰的に取り込む
+//
+//	go run ./cmd/ingest -user <userID> docs/ notes/meeting.md
+package main
+
+import (
+	"back/config"
+	"back/logging"
+	"back/services"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ingestExtensions は取り込む拡張子
+var ingestExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".txt":      true,
+}
+
+func main() {
+	userID := flag.String("user", "", "資料を取り込むユーザーID (必須)")
+	title := flag.String("title", "", "資料のタイトル。ファイルを1つだけ指定したときに使える (省略時はファイル名)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -user <userID> [-title <title>] <file or directory>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *userID == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logging.Setup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	paths, err := collectFiles(flag.Args())
+	if err != nil {
+		slog.Error("Failed to collect files", "error", err)
+		os.Exit(1)
+	}
+	if *title != "" && len(paths) != 1 {
+		slog.Error("-title can only be used with a single file", "files", len(paths))
+		os.Exit(2)
+	}
+
+	db, err := services.OpenPostgres(ctx, config.GetPostgresURI())
+	if err != nil {
+		slog.Error("Failed to connect to postgres", "error", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	documents := services.NewDocumentService(db, services.NewUsageService(db))
+
+	failed := 0
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			slog.Info("Ingestion interrupted")
+			break
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Failed to read file", "path", path, "error", err)
+			failed++
+			continue
+		}
+
+		result, err := documents.Ingest(ctx, *userID, services.DocumentInput{
+			Title:   *title,
+			Source:  filepath.ToSlash(path),
+			Content: string(content),
+		})
+		if err != nil {
+			slog.Error("Failed to ingest document", "path", path, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("Document ingested", "path", path, "status", result.Status, "id", result.Document.ID, "chunks", result.Document.ChunkCount)
+	}
+
+	slog.Info("Ingestion finished", "files", len(paths), "failed", failed)
+	if failed > 0 || ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// collectFiles は引数のファイルと、ディレクトリ配下の対象拡張子のファイルを返す
+func collectFiles(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, filepath.Clean(arg))
+			continue
+		}
+
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// 隠しディレクトリ (.git など) は読まない
+			if d.IsDir() && path != arg && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && ingestExtensions[strings.ToLower(filepath.Ext(path))] {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,104 @@
+// cmd/reindex/main.go
+// 埋め込みのバージョンが古い要約・添付ファイル・資料のチャンクを作り直すCLI。
+// EMBEDDING_MODEL / EMBEDDING_VERSION を変えたら実行する。-resummarize を付けると、
+// ユーザーに今使う要約のプロンプトと違うバージョンで作った要約も元から作り直す。
+// 作り直した行から順に保存するため、中断しても再実行すれば残りから続けられる
+//
+//	go run ./cmd/reindex -target summaries -resummarize
+package main
+
+import (
+	"back/app"
+	"back/config"
+	"back/logging"
+	"back/services"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	target := flag.String("target", "all", "作り直す対象 ("+strings.Join(services.ReindexTargets, ", ")+", all)")
+	userID := flag.String("user", "", "対象のユーザーID (省略時は全ユーザー)")
+	batchSize := flag.Int("batch", config.GetReindexBatchSize(), "1回に作り直す行数")
+	resummarize := flag.Bool("resummarize", false, "要約のプロンプトのバージョンが違う要約を、元のメッセージや下位の要約から作り直す")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-target <target>] [-user <userID>] [-batch <n>] [-resummarize]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	targets := services.ReindexTargets
+	if *target != "all" {
+		targets = []string{*target}
+	}
+	for _, t := range targets {
+		if !validTarget(t) {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	if *batchSize <= 0 || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logging.Setup()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Reindex started", "embedding_model", config.GetEmbeddingModel(), "embedding_version", config.GetEmbeddingVersion(),
+		"targets", targets, "resummarize", *resummarize)
+
+	// 要約の作り直しに会話履歴 (DynamoDB) を使うため、サーバーと同じ依存先を使う
+	container, err := app.NewContainer(ctx)
+	if err != nil {
+		slog.Error("Failed to initialize dependencies", "error", err)
+		os.Exit(1)
+	}
+	defer container.Close()
+
+	processor := services.NewBatchProcessor(container.DB, container.Conversations, container.Usage, container.Events, container.Retention, container.Prompts, container.Settings)
+	reindexer := services.NewReindexer(container.DB, processor, container.Usage)
+
+	opts := services.ReindexOptions{
+		UserID:      *userID,
+		BatchSize:   *batchSize,
+		Resummarize: *resummarize,
+	}
+	failed := false
+	for _, t := range targets {
+		stats, err := reindexer.Reindex(ctx, t, opts)
+		slog.Info("Reindex finished", "target", t, "reembedded", stats.Reembedded, "resummarized", stats.Resummarized,
+			"skipped", stats.Skipped, "failed", stats.Failed)
+		if err != nil {
+			// 作り直した分は保存済み。再実行すると残りから続ける
+			slog.Error("Reindex interrupted", "target", t, "error", err)
+			failed = true
+			break
+		}
+		if stats.Failed > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// validTarget は作り直せる対象かどうか
+func validTarget(target string) bool {
+	for _, t := range services.ReindexTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+// cmd/webhook-stub/main.go
+// 通知の送信を手元で確認するためのスタブ受信サーバー。受け取った通知をログに出す
+package main
+
+import (
+	"back/logging"
+	"back/webhook"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+func main() {
+	logging.Setup()
+
+	addr := os.Getenv("WEBHOOK_STUB_ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+
+	// 登録時に返されたシークレットを渡すと署名も検証する
+	receiver := webhook.NewStubReceiver(os.Getenv("WEBHOOK_STUB_SECRET"))
+
+	slog.Info("Webhook stub receiver starting", "addr", addr, "verify_signature", receiver.Secret != "")
+	if err := http.ListenAndServe(addr, receiver); err != nil {
+		slog.Error("Webhook stub receiver failed", "error", err)
+		os.Exit(1)
+	}
+}
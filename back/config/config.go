@@ -2,8 +2,480 @@ package config
 
 import (
     "os"
+    "strconv"
+    "strings"
+    "time"
 )
 
 func GetOpenAIKey() string {
     return os.Getenv("OPENAI_API_KEY")
 }
+
+func GetPerplexityKey() string {
+    return os.Getenv("PERPLEXITY_API_KEY")
+}
+
+// GetPostgresURI はPostgreSQLの接続文字列
+func GetPostgresURI() string {
+    if uri := os.Getenv("POSTGRES_URI"); uri != "" {
+        return uri
+    }
+    return "host=localhost port=5432 user=postgres password=postgres dbname=memorai sslmode=disable"
+}
+
+// GetDynamoDBEndpoint はDynamoDBのエンドポイント(ローカルではDynamoDB Local)
+func GetDynamoDBEndpoint() string {
+    if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+        return endpoint
+    }
+    return "http://localhost:8000"
+}
+
+// GetPostgresMaxOpenConns はPostgreSQL接続プールの最大接続数
+func GetPostgresMaxOpenConns() int {
+    return getEnvInt("POSTGRES_MAX_OPEN_CONNS", 20)
+}
+
+// GetPostgresMaxIdleConns はPostgreSQL接続プールで保持するアイドル接続数
+func GetPostgresMaxIdleConns() int {
+    return getEnvInt("POSTGRES_MAX_IDLE_CONNS", 10)
+}
+
+// GetPostgresConnMaxLifetime は1接続を使い回す最大時間
+func GetPostgresConnMaxLifetime() time.Duration {
+    return getEnvDuration("POSTGRES_CONN_MAX_LIFETIME", 30*time.Minute)
+}
+
+// GetPostgresConnMaxIdleTime はアイドル接続を閉じるまでの時間
+func GetPostgresConnMaxIdleTime() time.Duration {
+    return getEnvDuration("POSTGRES_CONN_MAX_IDLE_TIME", 5*time.Minute)
+}
+
+// GetExternalCallTimeout は外部API呼び出し1回あたりの、レスポンスヘッダーが届くまでのタイムアウト
+func GetExternalCallTimeout() time.Duration {
+    return getEnvDuration("EXTERNAL_CALL_TIMEOUT", 60*time.Second)
+}
+
+// GetExternalCallIdleTimeout は外部APIのレスポンスボディ(ストリーミングを含む)でデータが届かない間の許容時間
+func GetExternalCallIdleTimeout() time.Duration {
+    return getEnvDuration("EXTERNAL_CALL_IDLE_TIMEOUT", 30*time.Second)
+}
+
+// GetExternalCallMaxRetries は429/5xx時の最大リトライ回数
+func GetExternalCallMaxRetries() int {
+    return getEnvInt("EXTERNAL_CALL_MAX_RETRIES", 3)
+}
+
+// GetCircuitBreakerThreshold はサーキットブレーカーが開くまでの連続失敗回数
+func GetCircuitBreakerThreshold() int {
+    return getEnvInt("CIRCUIT_BREAKER_THRESHOLD", 5)
+}
+
+// GetCircuitBreakerCooldown はサーキットブレーカーが開いている時間
+func GetCircuitBreakerCooldown() time.Duration {
+    return getEnvDuration("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+}
+
+// GetStorageTimeout はDynamoDB/Postgresへの1操作あたりのタイムアウト
+func GetStorageTimeout() time.Duration {
+    return getEnvDuration("STORAGE_TIMEOUT", 5*time.Second)
+}
+
+// GetRAGTimeout はRAGによるプロンプト拡張(埋め込み+類似検索)全体の期限
+func GetRAGTimeout() time.Duration {
+    return getEnvDuration("RAG_TIMEOUT", 15*time.Second)
+}
+
+// GetCompletionTimeout は応答生成(履歴取得+LLM呼び出し)全体の期限
+func GetCompletionTimeout() time.Duration {
+    return getEnvDuration("COMPLETION_TIMEOUT", 2*time.Minute)
+}
+
+// GetResearchTimeout はリサーチAPI呼び出し全体の期限
+func GetResearchTimeout() time.Duration {
+    return getEnvDuration("RESEARCH_TIMEOUT", 2*time.Minute)
+}
+
+// GetChatMaxToolSteps はチャット1回あたりにツールを呼び出せる最大ステップ数
+func GetChatMaxToolSteps() int {
+    return getEnvInt("CHAT_MAX_TOOL_STEPS", 5)
+}
+
+// GetChatModels はユーザーが選べるチャットのモデル。先頭を既定のモデルにする
+func GetChatModels() []string {
+    return getEnvList("CHAT_MODELS", []string{"gpt-4o-mini", "gpt-4o"})
+}
+
+// GetChatHistoryWindow は応答の生成に送る直近のメッセージ数の既定値
+func GetChatHistoryWindow() int {
+    return getEnvInt("CHAT_HISTORY_WINDOW", 10)
+}
+
+// GetChatMaxHistoryWindow はユーザーが設定できる直近のメッセージ数の上限
+func GetChatMaxHistoryWindow() int {
+    return getEnvInt("CHAT_MAX_HISTORY_WINDOW", 50)
+}
+
+// GetToolCallTimeout はツール1回の実行の期限
+func GetToolCallTimeout() time.Duration {
+    return getEnvDuration("TOOL_CALL_TIMEOUT", 30*time.Second)
+}
+
+// GetBatchUserTimeout はバッチで1ユーザー分を処理する期限
+func GetBatchUserTimeout() time.Duration {
+    return getEnvDuration("BATCH_USER_TIMEOUT", 5*time.Minute)
+}
+
+// GetConsolidationInterval はバッチが要約を日・週・話題ごとにまとめる間隔
+func GetConsolidationInterval() time.Duration {
+    return getEnvDuration("CONSOLIDATION_INTERVAL", time.Hour)
+}
+
+// GetConsolidationUserTimeout は要約のまとめで1ユーザー分を処理する期限
+func GetConsolidationUserTimeout() time.Duration {
+    return getEnvDuration("CONSOLIDATION_USER_TIMEOUT", 10*time.Minute)
+}
+
+// GetShutdownGracePeriod は終了シグナル受信後に処理中のリクエスト・バッチを待つ時間
+func GetShutdownGracePeriod() time.Duration {
+    return getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second)
+}
+
+// GetBatchHTTPAddr はバッチデーモンがメトリクス等を公開するアドレス
+func GetBatchHTTPAddr() string {
+    if addr := os.Getenv("BATCH_HTTP_ADDR"); addr != "" {
+        return addr
+    }
+    return ":9091"
+}
+
+// GetResearchDigestEnabled はバッチデーモンで日次のリサーチダイジェストを作成するか
+func GetResearchDigestEnabled() bool {
+    return os.Getenv("RESEARCH_DIGEST_ENABLED") == "true"
+}
+
+// GetResearchDigestHour はダイジェストを作成する時刻(UTCの時)
+func GetResearchDigestHour() int {
+    hour := getEnvInt("RESEARCH_DIGEST_HOUR", 22)
+    if hour < 0 || hour > 23 {
+        return 22
+    }
+    return hour
+}
+
+// GetResearchDigestActiveWindow はこの期間内に発言のあったユーザーにダイジェストを作成する
+func GetResearchDigestActiveWindow() time.Duration {
+    return getEnvDuration("RESEARCH_DIGEST_ACTIVE_WINDOW", 7*24*time.Hour)
+}
+
+// GetReminderPollInterval はバッチデーモンが期限の来たリマインダーを確認する間隔
+func GetReminderPollInterval() time.Duration {
+    return getEnvDuration("REMINDER_POLL_INTERVAL", time.Minute)
+}
+
+// GetReminderBatchSize は1回の確認で配信するリマインダーの最大数
+func GetReminderBatchSize() int {
+    return getEnvInt("REMINDER_BATCH_SIZE", 100)
+}
+
+// GetNotificationPollInterval はバッチデーモンが送信待ちの通知を確認する間隔
+func GetNotificationPollInterval() time.Duration {
+    return getEnvDuration("NOTIFICATION_POLL_INTERVAL", 10*time.Second)
+}
+
+// GetNotificationBatchSize は1回の確認で送信する通知の最大数
+func GetNotificationBatchSize() int {
+    return getEnvInt("NOTIFICATION_BATCH_SIZE", 50)
+}
+
+// GetNotificationTimeout は通知1件の送信のタイムアウト
+func GetNotificationTimeout() time.Duration {
+    return getEnvDuration("NOTIFICATION_TIMEOUT", 10*time.Second)
+}
+
+// GetNotificationMaxAttempts は通知の最大送信回数。超えたらデッドレターにする
+func GetNotificationMaxAttempts() int {
+    return getEnvInt("NOTIFICATION_MAX_ATTEMPTS", 8)
+}
+
+// GetNotificationRetryBaseDelay は再送間隔の初期値。失敗するたびに倍にする
+func GetNotificationRetryBaseDelay() time.Duration {
+    return getEnvDuration("NOTIFICATION_RETRY_BASE_DELAY", 30*time.Second)
+}
+
+// GetWebhookAllowInsecure はhttpのURLやプライベートアドレスへのWebhookを許可するか(ローカル開発用)
+func GetWebhookAllowInsecure() bool {
+    return os.Getenv("WEBHOOK_ALLOW_INSECURE") == "true"
+}
+
+// GetPushGatewayURL はプッシュ通知を中継するゲートウェイのURL。未設定ならデバイストークンは登録できない
+func GetPushGatewayURL() string {
+    return os.Getenv("PUSH_GATEWAY_URL")
+}
+
+// GetPushGatewaySecret はプッシュ通知ゲートウェイへのリクエストの署名に使う鍵
+func GetPushGatewaySecret() string {
+    return os.Getenv("PUSH_GATEWAY_SECRET")
+}
+
+// GetWebSocketPollInterval はWebSocket接続が他のプロセス(バッチ)が投稿したメッセージを確認する間隔
+func GetWebSocketPollInterval() time.Duration {
+    return getEnvDuration("WEBSOCKET_POLL_INTERVAL", 15*time.Second)
+}
+
+// GetWebSocketResumeLimit は再接続時に再送するメッセージの最大数
+func GetWebSocketResumeLimit() int {
+    return getEnvInt("WEBSOCKET_RESUME_LIMIT", 200)
+}
+
+// GetBlobStoreDir は添付ファイルを保存するディレクトリ
+func GetBlobStoreDir() string {
+    if dir := os.Getenv("BLOB_STORE_DIR"); dir != "" {
+        return dir
+    }
+    return "./data/blobs"
+}
+
+// GetAttachmentMaxBytes は添付ファイル1つあたりの最大サイズ
+func GetAttachmentMaxBytes() int64 {
+    return int64(getEnvInt("ATTACHMENT_MAX_BYTES", 20<<20))
+}
+
+// GetAttachmentMaxFiles は1メッセージに添付できるファイル数
+func GetAttachmentMaxFiles() int {
+    return getEnvInt("ATTACHMENT_MAX_FILES", 5)
+}
+
+// GetAttachmentMaxChunks は添付ファイル1つから埋め込むチャンクの最大数。超えた部分は検索対象にしない
+func GetAttachmentMaxChunks() int {
+    return getEnvInt("ATTACHMENT_MAX_CHUNKS", 200)
+}
+
+// GetAttachmentMaxRequestBytes はファイルを添付できるリクエストの本文の上限。添付できる数の分とフォームの余裕を見込む
+func GetAttachmentMaxRequestBytes() int64 {
+    return GetAttachmentMaxBytes()*int64(GetAttachmentMaxFiles()) + 1<<20
+}
+
+// GetAttachmentProcessTimeout は添付ファイル1つのテキスト抽出と埋め込みの期限
+func GetAttachmentProcessTimeout() time.Duration {
+    return getEnvDuration("ATTACHMENT_PROCESS_TIMEOUT", 60*time.Second)
+}
+
+// GetDocumentMaxBytes はナレッジベースに取り込む資料1つあたりの最大サイズ
+func GetDocumentMaxBytes() int64 {
+    return int64(getEnvInt("DOCUMENT_MAX_BYTES", 5<<20))
+}
+
+// GetDocumentMaxChunks は資料1つから埋め込むチャンクの最大数。超える資料は取り込まない
+func GetDocumentMaxChunks() int {
+    return getEnvInt("DOCUMENT_MAX_CHUNKS", 1000)
+}
+
+// GetDocumentIngestTimeout は資料1つの埋め込みと保存の期限
+func GetDocumentIngestTimeout() time.Duration {
+    return getEnvDuration("DOCUMENT_INGEST_TIMEOUT", 5*time.Minute)
+}
+
+// GetEmbeddingModel は埋め込みに使うモデル
+func GetEmbeddingModel() string {
+    if model := os.Getenv("EMBEDDING_MODEL"); model != "" {
+        return model
+    }
+    return "text-embedding-ada-002"
+}
+
+// GetEmbeddingVersion は現在の埋め込みのバージョン。モデルを変えたら上げて cmd/reindex で作り直す
+func GetEmbeddingVersion() int {
+    return getEnvInt("EMBEDDING_VERSION", 1)
+}
+
+// GetReindexBatchSize は cmd/reindex が1回に作り直す行数
+func GetReindexBatchSize() int {
+    return getEnvInt("REINDEX_BATCH_SIZE", 100)
+}
+
+// GetPromptTemplateDir は組み込みのプロンプトを上書き・追加するテンプレートのディレクトリ。空なら組み込みだけを使う
+func GetPromptTemplateDir() string {
+    return os.Getenv("PROMPT_TEMPLATE_DIR")
+}
+
+// GetPromptVersion はプロンプトの既定のバージョン (PROMPT_<NAME>_VERSION)。0 なら最新を使う
+func GetPromptVersion(name string) int {
+    return getEnvInt("PROMPT_"+strings.ToUpper(name)+"_VERSION", 0)
+}
+
+// GetDefaultLocale はユーザーの言語が設定も判定もできないときに、応答や要約に使う言語
+func GetDefaultLocale() string {
+    if locale := os.Getenv("DEFAULT_LOCALE"); locale != "" {
+        return locale
+    }
+    return "ja"
+}
+
+// GetHealthCheckTimeout は依存先1つあたりのヘルスチェックのタイムアウト
+func GetHealthCheckTimeout() time.Duration {
+    return getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second)
+}
+
+// GetProviderHealthTTL はLLMプロバイダーの疎通確認結果をキャッシュする時間
+func GetProviderHealthTTL() time.Duration {
+    return getEnvDuration("PROVIDER_HEALTH_TTL", time.Minute)
+}
+
+// GetBatchHealthMaxAge はバッチの最後の成功からこの時間を過ぎたら異常とみなす
+func GetBatchHealthMaxAge() time.Duration {
+    return getEnvDuration("BATCH_HEALTH_MAX_AGE", 30*time.Minute)
+}
+
+// GetDailyTokenQuota はユーザーごとの1日(UTC)あたりのトークン上限。0なら無制限
+func GetDailyTokenQuota() int {
+    return getEnvInt("USAGE_DAILY_TOKEN_QUOTA", 200000)
+}
+
+// GetMonthlyTokenQuota はユーザーごとの1か月(UTC)あたりのトークン上限。0なら無制限
+func GetMonthlyTokenQuota() int {
+    return getEnvInt("USAGE_MONTHLY_TOKEN_QUOTA", 3000000)
+}
+
+// GetAdminAPIToken は管理用APIのBearerトークン。未設定なら管理用APIは無効
+func GetAdminAPIToken() string {
+    return os.Getenv("ADMIN_API_TOKEN")
+}
+
+// RateLimitPolicy はルートごとのレート制限。1分あたりのリクエスト数が0なら無制限
+type RateLimitPolicy struct {
+    UserPerMinute int
+    UserBurst     int
+    IPPerMinute   int
+    IPBurst       int
+}
+
+var defaultRateLimitPolicies = map[string]RateLimitPolicy{
+    "chat":        {UserPerMinute: 20, UserBurst: 5, IPPerMinute: 60, IPBurst: 20},
+    "research":    {UserPerMinute: 5, UserBurst: 2, IPPerMinute: 20, IPBurst: 5},
+    "attachments": {UserPerMinute: 10, UserBurst: 5, IPPerMinute: 30, IPBurst: 10},
+    "documents":   {UserPerMinute: 10, UserBurst: 5, IPPerMinute: 30, IPBurst: 10},
+}
+
+// GetRateLimitPolicy はポリシー名(chat, research, attachments, documents)ごとのレート制限。
+// RATE_LIMIT_<NAME>_USER_PER_MINUTE / _USER_BURST / _IP_PER_MINUTE / _IP_BURST で上書きできる
+func GetRateLimitPolicy(name string) RateLimitPolicy {
+    def := defaultRateLimitPolicies[name]
+    prefix := "RATE_LIMIT_" + strings.ToUpper(name) + "_"
+    return RateLimitPolicy{
+        UserPerMinute: getEnvInt(prefix+"USER_PER_MINUTE", def.UserPerMinute),
+        UserBurst:     getEnvInt(prefix+"USER_BURST", def.UserBurst),
+        IPPerMinute:   getEnvInt(prefix+"IP_PER_MINUTE", def.IPPerMinute),
+        IPBurst:       getEnvInt(prefix+"IP_BURST", def.IPBurst),
+    }
+}
+
+// GetTrustedProxies はクライアントのIPとして X-Forwarded-For を信頼するプロキシ(IPかCIDR)。
+// 未設定ならプロキシを信頼せず、接続元のIPをそのまま使う
+func GetTrustedProxies() []string {
+    return getEnvList("TRUSTED_PROXIES", nil)
+}
+
+// RetentionPolicy はデータの保持期間。日数が0なら期限なし
+type RetentionPolicy struct {
+    // MessageDays は要約済みの生のメッセージを残す日数(DynamoDBのTTLで削除)
+    MessageDays int `json:"message_days"`
+    // SummaryDays は日・週にまとめた後の細かい要約を残す日数
+    SummaryDays int `json:"summary_days"`
+}
+
+// DefaultRetentionTier はユーザーに区分が設定されていないときの保持期間の区分
+const DefaultRetentionTier = "default"
+
+// GetRetentionPolicy は区分ごとの保持期間。
+// RETENTION_<TIER>_MESSAGE_DAYS / _SUMMARY_DAYS で設定する。設定がなければ default 区分の値を使う
+func GetRetentionPolicy(tier string) RetentionPolicy {
+    def := RetentionPolicy{
+        MessageDays: getEnvInt("RETENTION_DEFAULT_MESSAGE_DAYS", 0),
+        SummaryDays: getEnvInt("RETENTION_DEFAULT_SUMMARY_DAYS", 0),
+    }
+    prefix := "RETENTION_" + strings.ToUpper(tier) + "_"
+    return RetentionPolicy{
+        MessageDays: getEnvInt(prefix+"MESSAGE_DAYS", def.MessageDays),
+        SummaryDays: getEnvInt(prefix+"SUMMARY_DAYS", def.SummaryDays),
+    }
+}
+
+// GetRetentionInterval はバッチが保持期間を過ぎた要約を削除する間隔
+func GetRetentionInterval() time.Duration {
+    return getEnvDuration("RETENTION_INTERVAL", 6*time.Hour)
+}
+
+// GetRetentionBatchSize は1回の実行で1ユーザーあたりに削除する要約の最大数。残りは次回に回す
+func GetRetentionBatchSize() int {
+    return getEnvInt("RETENTION_BATCH_SIZE", 1000)
+}
+
+// GetCORSAllowedOrigins はCORSで許可するオリジン。"*" は全オリジンを許可する
+func GetCORSAllowedOrigins() []string {
+    return getEnvList("CORS_ALLOWED_ORIGINS", []string{"*"})
+}
+
+// GetCORSAllowedMethods はCORSで許可するメソッド
+func GetCORSAllowedMethods() []string {
+    return getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+}
+
+// GetCORSAllowedHeaders はCORSで許可するリクエストヘッダー
+func GetCORSAllowedHeaders() []string {
+    return getEnvList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "X-Request-ID", "X-User-ID"})
+}
+
+// GetCORSExposedHeaders はブラウザのスクリプトから読めるようにするレスポンスヘッダー
+func GetCORSExposedHeaders() []string {
+    return getEnvList("CORS_EXPOSED_HEADERS", []string{"X-Request-ID", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"})
+}
+
+// GetCORSAllowCredentials はCookieや認証ヘッダー付きのクロスオリジンリクエストを許可するか
+func GetCORSAllowCredentials() bool {
+    return os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+}
+
+// GetCORSMaxAge はプリフライトの結果をブラウザがキャッシュする時間
+func GetCORSMaxAge() time.Duration {
+    return getEnvDuration("CORS_MAX_AGE", 10*time.Minute)
+}
+
+func getEnvInt(key string, defaultValue int) int {
+    v := os.Getenv(key)
+    if v == "" {
+        return defaultValue
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return defaultValue
+    }
+    return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+    v := os.Getenv(key)
+    if v == "" {
+        return defaultValue
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        return defaultValue
+    }
+    return d
+}
+
+// getEnvList はカンマ区切りの環境変数を読む
+func getEnvList(key string, defaultValue []string) []string {
+    v := os.Getenv(key)
+    if v == "" {
+        return defaultValue
+    }
+    var values []string
+    for _, item := range strings.Split(v, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            values = append(values, item)
+        }
+    }
+    return values
+}
@@ -0,0 +1,22 @@
+package config
+
+// ModelPrice はモデルごとの100万トークンあたりの料金(USD)
+type ModelPrice struct {
+	PromptPerMillion     float64
+	CompletionPerMillion float64
+}
+
+// modelPrices はコスト見積もり用の料金表。プロバイダーの価格改定時はここを更新する
+var modelPrices = map[string]ModelPrice{
+	"gpt-4o-mini":            {PromptPerMillion: 0.15, CompletionPerMillion: 0.60},
+	"gpt-4o":                 {PromptPerMillion: 2.50, CompletionPerMillion: 10.00},
+	"gpt-4-turbo-preview":    {PromptPerMillion: 10.00, CompletionPerMillion: 30.00},
+	"text-embedding-ada-002": {PromptPerMillion: 0.10},
+	"sonar":                  {PromptPerMillion: 1.00, CompletionPerMillion: 1.00},
+}
+
+// GetModelPrice はモデルの料金を返す。料金表にないモデルは ok=false
+func GetModelPrice(model string) (ModelPrice, bool) {
+	price, ok := modelPrices[model]
+	return price, ok
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"back/models"
+	"back/services"
+)
+
+// AttachmentController は添付ファイルのアップロードと取得のハンドラー
+type AttachmentController struct {
+	attachments *services.AttachmentService
+	usage       *services.UsageService
+}
+
+// NewAttachmentController コンストラクタ
+func NewAttachmentController(attachments *services.AttachmentService, usage *services.UsageService) *AttachmentController {
+	return &AttachmentController{attachments: attachments, usage: usage}
+}
+
+// UploadAttachment は multipart の file を保存し、テキストを抽出する。
+// 返したIDはチャットの attachment_ids に指定できる
+func (ac *AttachmentController) UploadAttachment(c *gin.Context) {
+	userID := c.PostForm("user_id")
+	fh, err := c.FormFile("file")
+	if err != nil || userID == "" {
+		if isBodyTooLarge(err) {
+			respondError(c, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return
+		}
+		respondError(c, http.StatusBadRequest, "user_id and file are required")
+		return
+	}
+
+	ctx := c.Request.Context()
+	// 抽出・埋め込みにトークンを使うので、先にクォータを確認する
+	if err := ac.usage.CheckQuota(ctx, userID); err != nil {
+		respondQuotaError(c, err)
+		return
+	}
+
+	attachment, err := uploadFormFile(ctx, ac.attachments, userID, fh)
+	if err != nil {
+		respondAttachmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"attachment": attachment})
+}
+
+// GetAttachment は添付ファイルの情報と処理状態を返す
+func (ac *AttachmentController) GetAttachment(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	attachment, err := ac.attachments.Get(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		respondAttachmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attachment": attachment})
+}
+
+// GetAttachmentContent は添付ファイルの本体を返す。ブラウザで開かれないようダウンロードとして返す
+func (ac *AttachmentController) GetAttachmentContent(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	attachment, body, err := ac.attachments.Open(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		respondAttachmentError(c, err)
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Type", attachment.ContentType)
+	c.Header("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	c.Header("Content-Disposition", disposition)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		slog.WarnContext(c.Request.Context(), "Error streaming attachment", "attachment_id", attachment.ID, "error", err)
+	}
+}
+
+// uploadFormFile は multipart のファイルを開いて保存する
+func uploadFormFile(ctx context.Context, attachments *services.AttachmentService, userID string, fh *multipart.FileHeader) (models.Attachment, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("failed to open uploaded file: %v", err)
+	}
+	defer file.Close()
+
+	return attachments.Upload(ctx, userID, fh.Filename, file)
+}
+
+// respondAttachmentError は添付ファイルのエラーを404/400/500に変換して返す
+func respondAttachmentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAttachmentNotFound):
+		respondError(c, http.StatusNotFound, "Attachment not found")
+	case errors.Is(err, services.ErrInvalidAttachment):
+		respondError(c, http.StatusBadRequest, err.Error())
+	default:
+		slog.ErrorContext(c.Request.Context(), "Error handling attachment", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to process attachment")
+	}
+}
+
+// isBodyTooLarge は MaxBodySize の上限を超えたことによるエラーかを返す
+func isBodyTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
@@ -1,147 +1,380 @@
 package controllers
 
 import (
-	"database/sql"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 
+	"back/config"
+	"back/i18n"
+	"back/metrics"
+	"back/models"
 	"back/services"
+	"back/tracing"
 )
 
-// TODO: ファイル切り分ける
-func getDB() (*sql.DB, error) {
-	dsn := os.Getenv("POSTGRES_URI")
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+// ChatController はチャット関連のハンドラー。依存先は main で組み立てたものを共有する
+type ChatController struct {
+	chat          *services.ChatService
+	conversations *services.ConversationStore
+	rag           *services.RAGService
+	research      *services.ResearchService
+	usage         *services.UsageService
+	attachments   *services.AttachmentService
+	retention     *services.RetentionService
+	settings      *services.SettingsService
 }
 
-func HandleChat(c *gin.Context) {
-	var request struct {
-		Message string `json:"message" binding:"required"`
-		UserID  string `json:"user_id" binding:"required"`
+// NewChatController コンストラクタ
+func NewChatController(chat *services.ChatService, conversations *services.ConversationStore, rag *services.RAGService, research *services.ResearchService, usage *services.UsageService, attachments *services.AttachmentService, retention *services.RetentionService, settings *services.SettingsService) *ChatController {
+	return &ChatController{chat: chat, conversations: conversations, rag: rag, research: research, usage: usage, attachments: attachments, retention: retention, settings: settings}
+}
+
+// HandleChat はJSONのほか、ファイルを添付する場合は multipart/form-data を受け付ける。
+// 添付済みのファイルは attachment_ids で指定する
+func (cc *ChatController) HandleChat(c *gin.Context) {
+	var request models.ChatRequest
+
+	// JSON・フォームのバインド
+	if err := c.ShouldBind(&request); err != nil {
+		slog.WarnContext(c.Request.Context(), "Error binding chat request", "error", err)
+		if isBodyTooLarge(err) {
+			respondError(c, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return
+		}
+		respondError(c, http.StatusBadRequest, "Message and UserID are required")
+		return
 	}
 
-	// JSONバインド
-	if err := c.BindJSON(&request); err != nil {
-		log.Printf("Error binding JSON: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Message and UserID are required"})
+	// クライアントが切断したらキャンセルされるリクエストのコンテキストを起点にする
+	ctx, span := tracing.Start(c.Request.Context(), "HandleChat", attribute.String("user.id", request.UserID))
+	defer span.End()
+
+	var files []*multipart.FileHeader
+	if c.Request.MultipartForm != nil {
+		files = c.Request.MultipartForm.File["files"]
+	}
+	if len(files)+len(request.AttachmentIDs) > config.GetAttachmentMaxFiles() {
+		respondError(c, http.StatusBadRequest, "At most %d attachments are allowed per message", config.GetAttachmentMaxFiles())
 		return
 	}
 
-	if _, err := services.SaveMessage(request.UserID, "user", request.Message); err != nil {
-		log.Printf("Error saving user message: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user message"})
+	attachments, err := cc.attachments.Resolve(ctx, request.UserID, request.AttachmentIDs)
+	if err != nil {
+		respondAttachmentError(c, err)
 		return
 	}
 
-	// ---------- RAGサービスによるプロンプト拡張部分 START ----------
-	db, err := getDB() 
+	if len(files) > 0 {
+		// ファイルの処理にもトークンを使うので、先にクォータを確認する
+		if err := cc.usage.CheckQuota(ctx, request.UserID); err != nil {
+			respondQuotaError(c, err)
+			return
+		}
+		for _, fh := range files {
+			attachment, err := uploadFormFile(ctx, cc.attachments, request.UserID, fh)
+			if err != nil {
+				respondAttachmentError(c, err)
+				return
+			}
+			attachments = append(attachments, attachment)
+		}
+	}
+
+	_, reply, err := cc.runChatTurn(ctx, request.UserID, request.Message, attachments, chatTurnHooks{})
+	if ctx.Err() != nil {
+		slog.InfoContext(ctx, "Request canceled during chat", "error", ctx.Err())
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting DB: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect DB"})
+		respondChatTurnError(c, err)
 		return
 	}
-	defer db.Close()
 
-	ragService := services.NewRAGService(db, os.Getenv("OPENAI_API_KEY"))
+	// 必要な情報を含むレスポンスを返す
+	response := gin.H{
+		"reply":     reply.Content,
+		"id":        reply.ID,
+		"timestamp": reply.Timestamp.Format(time.RFC3339),
+	}
+	if len(attachments) > 0 {
+		response["attachments"] = attachments
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// チャット1往復の処理の段階
+const (
+	chatStageQuota     = "quota"
+	chatStageSaveUser  = "save_user_message"
+	chatStageComplete  = "completion"
+	chatStageSaveReply = "save_reply"
+)
+
+// chatTurnError はチャット1往復のどの段階で失敗したかを表す
+type chatTurnError struct {
+	stage string
+	err   error
+}
+
+func (e *chatTurnError) Error() string { return e.stage + ": " + e.err.Error() }
+func (e *chatTurnError) Unwrap() error { return e.err }
 
+// chatTurnHooks は途中経過を返すためのコールバック。nil の項目は呼ばない
+type chatTurnHooks struct {
+	// saved はユーザーのメッセージを保存した直後に呼ばれる
+	saved func(userMessage models.Conversation)
+	// delta は応答本文の差分ごとに呼ばれる。指定するとストリーミングで生成する
+	delta func(text string)
+}
+
+// runChatTurn はクォータ確認、返答する言語の決定、ユーザーメッセージの保存、RAGによる拡張、応答の生成と保存を行う。
+// HTTPとWebSocketのチャットで共有する。失敗時は *chatTurnError を返す
+func (cc *ChatController) runChatTurn(ctx context.Context, userID, message string, attachments []models.Attachment, hooks chatTurnHooks) (userMessage, reply models.Conversation, err error) {
+	// トークン上限に達していれば、LLMを呼ぶ前に断る
+	if err := cc.usage.CheckQuota(ctx, userID); err != nil {
+		slog.WarnContext(ctx, "Chat rejected by quota", "user_id", userID, "error", err)
+		return userMessage, reply, &chatTurnError{stage: chatStageQuota, err: err}
+	}
+
+	// モデルや記憶の利用はユーザーの設定に従う。返答する言語はメッセージと一緒に保存し、応答の生成と要約で使う
+	settings := cc.settings.SettingsOrDefault(ctx, userID)
+	locale := cc.settings.ResolveLocale(ctx, settings, message)
+
+	stageStart := time.Now()
+	refs := make([]models.AttachmentRef, 0, len(attachments))
+	attachmentIDs := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		refs = append(refs, attachment.Ref())
+		attachmentIDs = append(attachmentIDs, attachment.ID)
+	}
+	userMessage, err = cc.conversations.SaveConversation(ctx, models.Conversation{UserID: userID, Role: "user", Content: message, Attachments: refs, Locale: locale})
+	observeChatStage("save_user_message", stageStart)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving user message", "error", err)
+		return userMessage, reply, &chatTurnError{stage: chatStageSaveUser, err: err}
+	}
+	if hooks.saved != nil {
+		hooks.saved(userMessage)
+	}
+
+	// ---------- RAGサービスによるプロンプト拡張部分 START ----------
 	// RAG で拡張プロンプトを作成
-	enhancedPrompt, err := ragService.EnhancePrompt(request.UserID, request.Message)
+	stageStart = time.Now()
+	ragCtx, cancelRAG := context.WithTimeout(ctx, config.GetRAGTimeout())
+	enhancedPrompt, ragVersions, err := cc.rag.EnhancePrompt(ragCtx, userID, message, services.EnhanceOptions{
+		Locale:        locale,
+		AttachmentIDs: attachmentIDs,
+		SkipMemories:  !settings.MemoryEnabled,
+	})
+	cancelRAG()
+	observeChatStage("rag", stageStart)
+	if ctx.Err() != nil {
+		return userMessage, reply, &chatTurnError{stage: chatStageComplete, err: ctx.Err()}
+	}
 	if err != nil {
-		log.Printf("Error enhancing prompt: %v", err)
+		slog.WarnContext(ctx, "Error enhancing prompt", "error", err)
 		// エラー時はとりあえず通常の入力を使用
-		enhancedPrompt = request.Message
+		enhancedPrompt = message
+	}
+	if len(attachments) > 0 {
+		enhancedPrompt += "\n\n" + describeAttachments(attachments, locale)
 	}
 	// ---------- RAGサービスによるプロンプト拡張部分 END ----------
 
-	replyContent, err := services.CallOpenAI(request.UserID, enhancedPrompt)
+	completionCtx, cancelCompletion := context.WithTimeout(ctx, config.GetCompletionTimeout())
+	defer cancelCompletion()
+
+	stageStart = time.Now()
+	replyContent, chatVersions, err := cc.chat.StreamOpenAI(completionCtx, userMessage, enhancedPrompt, settings, hooks.delta)
+	observeChatStage("completion", stageStart)
 	if err != nil {
-		log.Printf("Error calling OpenAI: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		if ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Error calling OpenAI", "error", err)
+		}
+		return userMessage, reply, &chatTurnError{stage: chatStageComplete, err: err}
 	}
 
-	reply, err := services.SaveMessage(request.UserID, "assistant", replyContent)
+	stageStart = time.Now()
+	// 応答には生成に使ったプロンプトのバージョンを記録する
+	reply, err = cc.conversations.SaveConversation(ctx, models.Conversation{
+		UserID:         userID,
+		Role:           "assistant",
+		Content:        replyContent,
+		PromptVersions: chatVersions.Merge(ragVersions),
+		Locale:         locale,
+	})
+	observeChatStage("save_reply", stageStart)
 	if err != nil {
-		log.Printf("Error saving bot reply: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save bot reply"})
+		slog.ErrorContext(ctx, "Error saving bot reply", "error", err)
+		return userMessage, reply, &chatTurnError{stage: chatStageSaveReply, err: err}
+	}
+
+	return userMessage, reply, nil
+}
+
+// describeAttachments は添付ファイルの一覧をモデルに伝える文を作る。
+// テキストを取り出せなかったファイルもあることを伝え、内容を推測させない
+func describeAttachments(attachments []models.Attachment, locale string) string {
+	var b strings.Builder
+	for i, attachment := range attachments {
+		if i > 0 {
+			b.WriteString(i18n.T(locale, ", "))
+		}
+		b.WriteString(attachment.Filename)
+		if attachment.Status != services.AttachmentReady {
+			b.WriteString(i18n.T(locale, " [could not read the content]"))
+		}
+	}
+	return i18n.T(locale, "(Attachments on this message: %s)", b.String())
+}
+
+// respondChatTurnError は runChatTurn のエラーを段階に応じたレスポンスに変換して返す
+func respondChatTurnError(c *gin.Context, err error) {
+	var terr *chatTurnError
+	if !errors.As(err, &terr) {
+		respondError(c, http.StatusInternalServerError, "Failed to process chat")
 		return
 	}
 
-	// 必要な情報を含むレスポンスを返す
-	c.JSON(http.StatusOK, gin.H{
-		"reply":     reply.Content,
-		"id":        reply.ID,
-		"timestamp": reply.Timestamp.Format(time.RFC3339),
-	})
+	switch terr.stage {
+	case chatStageQuota:
+		respondQuotaError(c, terr.err)
+	case chatStageSaveUser:
+		respondError(c, http.StatusInternalServerError, "Failed to save user message")
+	case chatStageComplete:
+		respondProviderError(c, terr.err, "Failed to get reply from AI")
+	default:
+		respondError(c, http.StatusInternalServerError, "Failed to save bot reply")
+	}
 }
 
-func UpdateMessageFlag(c *gin.Context) {
+// observeChatStage はチャット処理の各段階にかかった時間を記録する
+func observeChatStage(stage string, start time.Time) {
+	metrics.ChatStageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+func (cc *ChatController) UpdateMessageFlag(c *gin.Context) {
 	type RequestBody struct {
 		UserID     string `json:"userId" binding:"required"`
 		Timestamp  string `json:"timestamp" binding:"required"`
 		IsLiked    *bool  `json:"isLiked"`
 		IsDisliked *bool  `json:"isDisliked"`
+		// IsPinned はピン留め。ピン留めしたメッセージは保持期間を過ぎても削除しない
+		IsPinned *bool `json:"isPinned"`
 	}
 
 	var requestBody RequestBody
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	err := services.UpdateMessageFlag(requestBody.UserID, requestBody.Timestamp, requestBody.IsLiked, requestBody.IsDisliked)
+	// ピン留めを外したメッセージには、保持期間に応じた削除期限を付け直す
+	var expiresAt *time.Time
+	if requestBody.IsPinned != nil && !*requestBody.IsPinned {
+		sentAt, err := time.Parse(time.RFC3339, requestBody.Timestamp)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "timestamp must be RFC3339")
+			return
+		}
+		policy, err := cc.retention.PolicyFor(c.Request.Context(), requestBody.UserID)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Error getting retention policy", "error", err)
+			respondError(c, http.StatusInternalServerError, "Failed to update message flag")
+			return
+		}
+		if policy.MessageDays > 0 {
+			t := sentAt.AddDate(0, 0, policy.MessageDays)
+			expiresAt = &t
+		}
+	}
+
+	err := cc.conversations.UpdateMessageFlag(c.Request.Context(), requestBody.UserID, requestBody.Timestamp, requestBody.IsLiked, requestBody.IsDisliked, requestBody.IsPinned, expiresAt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message flag"})
+		respondError(c, http.StatusInternalServerError, "Failed to update message flag")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Message updated successfully"})
 }
 
-func GetConversations(c *gin.Context) {
+func (cc *ChatController) GetConversations(c *gin.Context) {
 	userID := c.Query("userId")
 	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "userId is required"})
+		respondError(c, http.StatusBadRequest, "userId is required")
 		return
 	}
 
-	conversations, err := services.GetAllConversations(userID)
+	conversations, err := cc.conversations.GetAllConversations(c.Request.Context(), userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch conversations"})
+		respondError(c, http.StatusInternalServerError, "Failed to fetch conversations")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
 }
 
-func HandleResearchAI(c *gin.Context) {
+func (cc *ChatController) HandleResearchAI(c *gin.Context) {
 	userID := c.Query("userId")
 	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "userId is required"})
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	if err := cc.usage.CheckQuota(ctx, userID); err != nil {
+		slog.WarnContext(ctx, "Research rejected by quota", "user_id", userID, "error", err)
+		respondQuotaError(c, err)
 		return
 	}
 
-	// AIの話題をリサーチ
-	topic, err := services.ResearchAITopic(c)
+	// 話題を省略した場合はユーザーの記憶から決める
+	researchRequest := services.ResearchRequest{
+		Topics:   c.QueryArray("topic"),
+		Language: c.Query("language"),
+		Recency:  c.Query("recency"),
+		Domains:  splitQueryList(c.Query("domains")),
+	}
+	if err := researchRequest.Normalize(); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	researchCtx, cancel := context.WithTimeout(ctx, config.GetResearchTimeout())
+	defer cancel()
+
+	result, err := cc.research.Research(researchCtx, userID, researchRequest)
+	if ctx.Err() != nil {
+		slog.InfoContext(ctx, "Request canceled during research", "error", ctx.Err())
+		return
+	}
 	if err != nil {
-		log.Printf("Error researching AI topic: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to research AI topic"})
+		slog.ErrorContext(ctx, "Error researching topic", "error", err)
+		respondProviderError(c, err, "Failed to research topic")
 		return
 	}
 
 	// リサーチ結果をDynamoDBに保存
-	reply, err := services.SaveMessage(userID, "assistant", topic)
+	reply, err := cc.conversations.SaveConversation(ctx, models.Conversation{
+		UserID:         userID,
+		Role:           "assistant",
+		Content:        result.Content,
+		Citations:      result.Citations,
+		PromptVersions: result.PromptVersions,
+		Locale:         result.Locale,
+	})
 	if err != nil {
-		log.Printf("Error saving AI research topic: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save AI research topic"})
+		slog.ErrorContext(ctx, "Error saving research result", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to save research result")
 		return
 	}
 
@@ -150,5 +383,17 @@ func HandleResearchAI(c *gin.Context) {
 		"reply":     reply.Content,
 		"id":        reply.ID,
 		"timestamp": reply.Timestamp.Format(time.RFC3339),
+		"citations": reply.Citations,
 	})
 }
+
+// splitQueryList はカンマ区切りのクエリパラメーターを分割する
+func splitQueryList(v string) []string {
+	var values []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
@@ -0,0 +1,510 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"back/config"
+	"back/i18n"
+	"back/metrics"
+	"back/models"
+	"back/ratelimit"
+	"back/realtime"
+	"back/services"
+)
+
+const (
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = socketPongWait * 9 / 10
+	// socketMaxFrameBytes はクライアントから受け取るフレームの最大サイズ
+	socketMaxFrameBytes = 64 << 10
+	// socketSyncPage は新着メッセージを読むときの1回の取得件数
+	socketSyncPage = 100
+)
+
+// socketInFrame はクライアントから届くフレーム。
+// chat: {"type":"chat","client_id":"...","message":"...","attachment_ids":["..."]} / ack: {"type":"ack","id":"<message id>"} / ping
+type socketInFrame struct {
+	Type     string `json:"type"`
+	ClientID string `json:"client_id,omitempty"`
+	Message  string `json:"message,omitempty"`
+	ID       string `json:"id,omitempty"`
+
+	// AttachmentIDs は POST /attachments で登録済みのファイル
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+}
+
+// socketOutFrame はサーバーから送るフレーム。
+// ready / ack(チャットの受付) / typing / delta(応答の差分) / done(応答の完了) / message(サーバーからのメッセージ) / resync / error / pong
+type socketOutFrame struct {
+	Type       string               `json:"type"`
+	ClientID   string               `json:"client_id,omitempty"`
+	ID         string               `json:"id,omitempty"`
+	Timestamp  string               `json:"timestamp,omitempty"`
+	State      string               `json:"state,omitempty"`
+	Text       string               `json:"text,omitempty"`
+	Message    *models.Conversation `json:"message,omitempty"`
+	Resumed    int                  `json:"resumed,omitempty"`
+	Code       string               `json:"code,omitempty"`
+	Error      string               `json:"error,omitempty"`
+	RetryAfter int                  `json:"retry_after,omitempty"`
+}
+
+// ChatSocketController はWebSocketでのチャットとサーバーからのメッセージ配信を扱う
+type ChatSocketController struct {
+	chat          *ChatController
+	conversations *services.ConversationStore
+	hub           *realtime.Hub
+	limits        ratelimit.Store
+	upgrader      websocket.Upgrader
+}
+
+// NewChatSocketController コンストラクタ
+func NewChatSocketController(chat *ChatController, conversations *services.ConversationStore, hub *realtime.Hub, limits ratelimit.Store) *ChatSocketController {
+	return &ChatSocketController{
+		chat:          chat,
+		conversations: conversations,
+		hub:           hub,
+		limits:        limits,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     socketOriginAllowed,
+		},
+	}
+}
+
+// socketOriginAllowed はCORSと同じ許可リストでオリジンを確認する。Originのないネイティブアプリは許可する
+func socketOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range config.GetCORSAllowedOrigins() {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleWebSocket は GET /ws/chat?userId=...&lastMessageId=... をWebSocketに切り替える。
+// lastMessageId を指定すると、それより後のメッセージを再送してから新着の配信を始める
+func (sc *ChatSocketController) HandleWebSocket(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	// 再開位置はHTTPでエラーを返せるよう、切り替える前に決める
+	ctx := c.Request.Context()
+	cursor, resume, err := sc.resumeCursor(ctx, userID, c.Query("lastMessageId"))
+	if errors.Is(err, services.ErrMessageNotFound) {
+		respondError(c, http.StatusNotFound, "lastMessageId not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error resolving resume position", "user_id", userID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to resume conversation")
+		return
+	}
+
+	conn, err := sc.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade がエラーレスポンスを返している
+		slog.WarnContext(ctx, "WebSocket upgrade failed", "user_id", userID, "error", err)
+		return
+	}
+
+	session := &chatSession{
+		sc:       sc,
+		conn:     conn,
+		userID:   userID,
+		locale:   i18n.RequestLocale(c.Request),
+		cursor:   cursor,
+		sent:     make(map[string]time.Time),
+		out:      make(chan socketOutFrame),
+		turnDone: make(chan []models.Conversation),
+	}
+	session.run(ctx, resume)
+}
+
+// resumeCursor は配信を始める位置を返す。lastMessageId、このプロセスで記録した受信確認の順に使い、
+// どちらもなければ最新のメッセージから(再送なし)にする
+func (sc *ChatSocketController) resumeCursor(ctx context.Context, userID, lastMessageID string) (time.Time, bool, error) {
+	if lastMessageID != "" {
+		msg, err := sc.conversations.FindMessage(ctx, userID, lastMessageID)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return msg.Timestamp, true, nil
+	}
+
+	if ack, ok := sc.hub.LastAck(userID); ok {
+		return ack.Timestamp, true, nil
+	}
+
+	latest, err := sc.conversations.GetRecentConversations(ctx, userID, 1)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if len(latest) == 0 {
+		return time.Time{}, false, nil
+	}
+	return latest[0].Timestamp, false, nil
+}
+
+// chatSession は1接続分の状態。conn への書き込みと状態の更新は run のゴルーチンだけが行う
+type chatSession struct {
+	sc     *ChatSocketController
+	conn   *websocket.Conn
+	userID string
+	// locale はエラーメッセージの言語。接続時の Accept-Language で決める
+	locale string
+
+	// cursor まで読んだ。sent は送信済みのメッセージの時刻で、重複送信の防止と受信確認に使う
+	cursor time.Time
+	sent   map[string]time.Time
+
+	// busy の間は応答の生成中で、新着の確認は終わるまで待つ
+	busy        bool
+	syncPending bool
+	out         chan socketOutFrame
+	turnDone    chan []models.Conversation
+}
+
+// run は接続が切れるまでフレームを処理する。再開時は取りこぼしたメッセージを送り終えてから ready を送る
+func (s *chatSession) run(parent context.Context, resume bool) {
+	// 応答生成中のゴルーチンは cancel で止めてから待つ
+	var turns sync.WaitGroup
+	defer turns.Wait()
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	defer s.conn.Close()
+
+	metrics.WebSocketConnections.Inc()
+	defer metrics.WebSocketConnections.Dec()
+
+	notify, unsubscribe := s.sc.hub.Subscribe(s.userID)
+	defer unsubscribe()
+
+	inbound := make(chan socketInFrame)
+	go s.readLoop(ctx, cancel, inbound)
+
+	resumed := 0
+	if resume {
+		var err error
+		if resumed, err = s.resume(ctx); err != nil {
+			slog.WarnContext(ctx, "WebSocket write failed", "user_id", s.userID, "error", err)
+			return
+		}
+	}
+	if err := s.write(socketOutFrame{Type: "ready", Resumed: resumed}); err != nil {
+		return
+	}
+	slog.InfoContext(ctx, "WebSocket connected", "user_id", s.userID, "resumed", resumed)
+
+	ping := time.NewTicker(socketPingPeriod)
+	defer ping.Stop()
+	poll := time.NewTicker(config.GetWebSocketPollInterval())
+	defer poll.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "WebSocket disconnected", "user_id", s.userID)
+			return
+		case frame := <-inbound:
+			err = s.handle(ctx, frame, &turns)
+		case frame := <-s.out:
+			err = s.write(frame)
+		case saved := <-s.turnDone:
+			s.busy = false
+			for _, m := range saved {
+				if m.ID != "" {
+					s.sent[m.ID] = m.Timestamp
+				}
+			}
+			if s.syncPending {
+				s.syncPending = false
+				err = s.sync(ctx)
+			}
+		case <-notify:
+			err = s.syncOrDefer(ctx)
+		case <-poll.C:
+			// バッチが投稿したリマインダーなど、別プロセスの新着はここで拾う
+			err = s.syncOrDefer(ctx)
+		case <-ping.C:
+			err = s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait))
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "WebSocket write failed", "user_id", s.userID, "error", err)
+			return
+		}
+	}
+}
+
+// readLoop はクライアントからのフレームを読んで inbound に渡す。読み込みに失敗したら接続を終える
+func (s *chatSession) readLoop(ctx context.Context, cancel context.CancelFunc, inbound chan<- socketInFrame) {
+	defer cancel()
+
+	s.conn.SetReadLimit(socketMaxFrameBytes)
+	s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.InfoContext(ctx, "WebSocket closed unexpectedly", "user_id", s.userID, "error", err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+
+		var frame socketInFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			frame = socketInFrame{Type: "invalid"}
+		}
+		metrics.WebSocketFrames.WithLabelValues("in", frame.Type).Inc()
+
+		select {
+		case inbound <- frame:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle はクライアントからのフレーム1つを処理する
+func (s *chatSession) handle(ctx context.Context, frame socketInFrame, turns *sync.WaitGroup) error {
+	switch frame.Type {
+	case "ping":
+		return s.write(socketOutFrame{Type: "pong"})
+	case "ack":
+		s.acknowledge(frame.ID)
+		return nil
+	case "chat":
+		return s.startTurn(ctx, frame, turns)
+	default:
+		return s.write(socketOutFrame{Type: "error", Code: "invalid_frame", Error: "type must be chat, ack or ping"})
+	}
+}
+
+// acknowledge はクライアントの受信確認を記録し、それ以前の送信済みの記録を捨てる
+func (s *chatSession) acknowledge(messageID string) {
+	ts, ok := s.sent[messageID]
+	if !ok {
+		return
+	}
+	s.sc.hub.Acknowledge(s.userID, realtime.Ack{MessageID: messageID, Timestamp: ts})
+
+	for id, t := range s.sent {
+		if !t.After(ts) && !t.After(s.cursor) {
+			delete(s.sent, id)
+		}
+	}
+}
+
+// startTurn はチャット1往復を別のゴルーチンで始める。応答の生成は同時に1つまで
+func (s *chatSession) startTurn(ctx context.Context, frame socketInFrame, turns *sync.WaitGroup) error {
+	message := strings.TrimSpace(frame.Message)
+	if message == "" {
+		return s.write(socketOutFrame{Type: "error", ClientID: frame.ClientID, Code: "invalid_frame", Error: "message is required"})
+	}
+	if s.busy {
+		return s.write(socketOutFrame{Type: "error", ClientID: frame.ClientID, Code: "busy", Error: "A reply is already being generated"})
+	}
+	if len(frame.AttachmentIDs) > config.GetAttachmentMaxFiles() {
+		return s.write(socketOutFrame{Type: "error", ClientID: frame.ClientID, Code: "invalid_attachment", Error: "Too many attachments"})
+	}
+	attachments, err := s.sc.chat.attachments.Resolve(ctx, s.userID, frame.AttachmentIDs)
+	if errors.Is(err, services.ErrAttachmentNotFound) {
+		return s.write(socketOutFrame{Type: "error", ClientID: frame.ClientID, Code: "invalid_attachment", Error: "Attachment not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error resolving attachments", "error", err)
+		return s.write(socketOutFrame{Type: "error", ClientID: frame.ClientID, Code: "internal", Error: "Failed to process chat"})
+	}
+
+	// RateLimit ミドルウェアと同じキーで、HTTPのチャットとバケットを共有する
+	policy := config.GetRateLimitPolicy("chat")
+	limit := ratelimit.Limit{PerMinute: policy.UserPerMinute, Burst: policy.UserBurst}
+	if limit.Enabled() {
+		result, err := s.sc.limits.Take(ctx, "chat:user:"+s.userID, limit)
+		if err != nil {
+			slog.WarnContext(ctx, "Rate limit store unavailable", "policy", "chat", "scope", "user", "error", err)
+		} else if !result.Allowed {
+			metrics.RateLimited.WithLabelValues("chat", "user").Inc()
+			return s.write(socketOutFrame{
+				Type:       "error",
+				ClientID:   frame.ClientID,
+				Code:       "rate_limited",
+				Error:      "Too many requests, please retry later",
+				RetryAfter: int(math.Ceil(result.RetryAfter.Seconds())),
+			})
+		}
+	}
+
+	s.busy = true
+	turns.Add(1)
+	go func() {
+		defer turns.Done()
+
+		s.send(ctx, socketOutFrame{Type: "typing", State: "start"})
+		userMessage, reply, err := s.sc.chat.runChatTurn(ctx, s.userID, message, attachments, chatTurnHooks{
+			saved: func(m models.Conversation) {
+				s.send(ctx, socketOutFrame{Type: "ack", ClientID: frame.ClientID, ID: m.ID, Timestamp: m.Timestamp.Format(time.RFC3339)})
+			},
+			delta: func(text string) {
+				s.send(ctx, socketOutFrame{Type: "delta", ClientID: frame.ClientID, Text: text})
+			},
+		})
+		s.send(ctx, socketOutFrame{Type: "typing", State: "stop"})
+
+		if err != nil {
+			if ctx.Err() == nil {
+				s.send(ctx, chatTurnErrorFrame(frame.ClientID, err))
+			}
+		} else {
+			s.send(ctx, socketOutFrame{Type: "done", ClientID: frame.ClientID, ID: reply.ID, Timestamp: reply.Timestamp.Format(time.RFC3339), Message: &reply})
+		}
+
+		select {
+		case s.turnDone <- []models.Conversation{userMessage, reply}:
+		case <-ctx.Done():
+		}
+	}()
+	return nil
+}
+
+// send は応答生成中のゴルーチンからフレームを送る。接続が終わっていれば捨てる
+func (s *chatSession) send(ctx context.Context, frame socketOutFrame) {
+	select {
+	case s.out <- frame:
+	case <-ctx.Done():
+	}
+}
+
+func (s *chatSession) syncOrDefer(ctx context.Context) error {
+	if s.busy {
+		s.syncPending = true
+		return nil
+	}
+	return s.sync(ctx)
+}
+
+// sync は cursor より後のメッセージを送る。読み込みの失敗は次の確認で取り直すので接続は切らない
+func (s *chatSession) sync(ctx context.Context) error {
+	_, err := s.deliverAfterCursor(ctx, 0)
+	return err
+}
+
+// resume は再接続時に取りこぼしたメッセージを送る。上限を超える場合は resync を送って最新の位置から始める
+func (s *chatSession) resume(ctx context.Context) (int, error) {
+	limit := config.GetWebSocketResumeLimit()
+	n, err := s.deliverAfterCursor(ctx, limit)
+	if err != nil || n < limit {
+		return n, err
+	}
+
+	latest, err := s.sc.conversations.GetRecentConversations(ctx, s.userID, 1)
+	if err != nil || len(latest) == 0 || !latest[0].Timestamp.After(s.cursor) {
+		return n, nil
+	}
+	s.cursor = latest[0].Timestamp
+	return n, s.write(socketOutFrame{Type: "resync", Error: "Too many missed messages; reload the conversation history"})
+}
+
+// deliverAfterCursor は cursor より後のメッセージを古い順に送り、送った件数を返す。limit が0なら上限なし
+func (s *chatSession) deliverAfterCursor(ctx context.Context, limit int) (int, error) {
+	delivered := 0
+	for {
+		page, err := s.sc.conversations.GetConversationsAfter(ctx, s.userID, s.cursor, socketSyncPage)
+		if err != nil {
+			slog.WarnContext(ctx, "Error fetching new messages", "user_id", s.userID, "error", err)
+			return delivered, nil
+		}
+
+		for i := range page {
+			m := page[i]
+			s.cursor = m.Timestamp
+			// ツールの記録は監査用なので送らない
+			if m.Role == "tool" {
+				continue
+			}
+			if _, ok := s.sent[m.ID]; ok {
+				continue
+			}
+			if err := s.write(socketOutFrame{Type: "message", ID: m.ID, Timestamp: m.Timestamp.Format(time.RFC3339), Message: &m}); err != nil {
+				return delivered, err
+			}
+			s.sent[m.ID] = m.Timestamp
+			delivered++
+			if limit > 0 && delivered >= limit {
+				return delivered, nil
+			}
+		}
+
+		if len(page) < socketSyncPage {
+			return delivered, nil
+		}
+	}
+}
+
+func (s *chatSession) write(frame socketOutFrame) error {
+	if frame.Error != "" {
+		frame.Error = i18n.T(s.locale, frame.Error)
+	}
+	metrics.WebSocketFrames.WithLabelValues("out", frame.Type).Inc()
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return s.conn.WriteJSON(frame)
+}
+
+// chatTurnErrorFrame は runChatTurn のエラーをクライアント向けのエラーフレームに変換する
+func chatTurnErrorFrame(clientID string, err error) socketOutFrame {
+	frame := socketOutFrame{Type: "error", ClientID: clientID, Code: "internal", Error: "Failed to process chat"}
+
+	var terr *chatTurnError
+	if !errors.As(err, &terr) {
+		return frame
+	}
+
+	var qerr *services.QuotaError
+	var perr *services.ProviderError
+	switch {
+	case terr.stage == chatStageQuota && errors.As(terr.err, &qerr):
+		frame.Code, frame.Error = "quota_exceeded", "Token quota exceeded"
+		frame.RetryAfter = int(math.Ceil(time.Until(qerr.ResetAt).Seconds()))
+	case terr.stage != chatStageComplete:
+		// 保存やクォータ集計の失敗は internal のまま
+	case errors.Is(terr.err, services.ErrRateLimited):
+		frame.Code, frame.Error = "provider_rate_limited", "AI provider is rate limiting requests, please retry later"
+		if errors.As(terr.err, &perr) && perr.RetryAfter > 0 {
+			frame.RetryAfter = int(math.Ceil(perr.RetryAfter.Seconds()))
+		}
+	case isProviderTimeout(terr.err):
+		frame.Code, frame.Error = "provider_timeout", "AI provider timed out"
+	case errors.Is(terr.err, context.DeadlineExceeded):
+		// プロバイダー以外のタイムアウトは internal のまま
+	default:
+		frame.Code, frame.Error = "provider_error", "Failed to get reply from AI"
+	}
+	return frame
+}
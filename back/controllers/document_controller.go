@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"back/config"
+	"back/services"
+)
+
+// DocumentController はナレッジベースの資料の取り込みと管理のハンドラー
+type DocumentController struct {
+	documents *services.DocumentService
+	usage     *services.UsageService
+}
+
+// NewDocumentController コンストラクタ
+func NewDocumentController(documents *services.DocumentService, usage *services.UsageService) *DocumentController {
+	return &DocumentController{documents: documents, usage: usage}
+}
+
+// IngestDocument は資料を取り込む。JSON の content か、multipart の file (テキスト・Markdown) を受け付ける。
+// 同じ source の資料は置き換え、内容が変わっていなければ何もしない
+func (dc *DocumentController) IngestDocument(c *gin.Context) {
+	var request struct {
+		UserID  string `json:"user_id" form:"user_id" binding:"required"`
+		Title   string `json:"title" form:"title"`
+		Source  string `json:"source" form:"source"`
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBind(&request); err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return
+		}
+		respondError(c, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	input := services.DocumentInput{Title: request.Title, Source: request.Source, Content: request.Content}
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "file is required")
+			return
+		}
+		file, err := fh.Open()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Failed to read file")
+			return
+		}
+		content, err := io.ReadAll(io.LimitReader(file, config.GetDocumentMaxBytes()+1))
+		file.Close()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Failed to read file")
+			return
+		}
+		input.Content = string(content)
+		if input.Source == "" {
+			input.Source = fh.Filename
+		}
+	}
+
+	ctx := c.Request.Context()
+	// 埋め込みにトークンを使うので、先にクォータを確認する
+	if err := dc.usage.CheckQuota(ctx, request.UserID); err != nil {
+		respondQuotaError(c, err)
+		return
+	}
+
+	result, err := dc.documents.Ingest(ctx, request.UserID, input)
+	if err != nil {
+		respondDocumentError(c, err, "Failed to ingest document")
+		return
+	}
+
+	status := http.StatusOK
+	if result.Status == services.DocumentCreated {
+		status = http.StatusCreated
+	}
+	c.JSON(status, result)
+}
+
+// ListDocuments はユーザーの資料を返す
+func (dc *DocumentController) ListDocuments(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	documents, err := dc.documents.List(c.Request.Context(), userID)
+	if err != nil {
+		respondDocumentError(c, err, "Failed to fetch documents")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"documents": documents})
+}
+
+// GetDocument は資料の情報を返す
+func (dc *DocumentController) GetDocument(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	document, err := dc.documents.Get(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		respondDocumentError(c, err, "Failed to fetch document")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"document": document})
+}
+
+// DeleteDocument は資料を削除し、検索対象から外す
+func (dc *DocumentController) DeleteDocument(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	if err := dc.documents.Delete(c.Request.Context(), userID, c.Param("id")); err != nil {
+		respondDocumentError(c, err, "Failed to delete document")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondDocumentError は資料操作のエラーを404/400/500に変換して返す
+func respondDocumentError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrDocumentNotFound):
+		respondError(c, http.StatusNotFound, "Document not found")
+	case errors.Is(err, services.ErrInvalidDocument):
+		respondError(c, http.StatusBadRequest, err.Error())
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "error", err)
+		respondError(c, http.StatusInternalServerError, message)
+	}
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/i18n"
+	"back/services"
+)
+
+// respondError はエラーメッセージをリクエストの言語 (Accept-Language) に翻訳して返す。訳がなければ英語のまま返す
+func respondError(c *gin.Context, status int, message string, args ...any) {
+	c.JSON(status, gin.H{"error": i18n.T(i18n.RequestLocale(c.Request), message, args...)})
+}
+
+// respondProviderError は外部API呼び出しのエラーを種類に応じた429/502/504に変換して返す。
+// プロバイダー以外(保存やRAGなど)のタイムアウトは503にする
+func respondProviderError(c *gin.Context, err error, message string) {
+	status := http.StatusInternalServerError
+
+	var perr *services.ProviderError
+	switch {
+	case errors.Is(err, services.ErrRateLimited):
+		status = http.StatusTooManyRequests
+		message = "AI provider is rate limiting requests, please retry later"
+		if errors.As(err, &perr) && perr.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(perr.RetryAfter.Seconds()))))
+		}
+	case isProviderTimeout(err):
+		status = http.StatusGatewayTimeout
+		message = "AI provider timed out"
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, services.ErrCircuitOpen):
+		status = http.StatusBadGateway
+		message = "AI provider is temporarily unavailable"
+	case errors.Is(err, services.ErrUpstream):
+		status = http.StatusBadGateway
+	}
+
+	respondError(c, status, message)
+}
+
+// isProviderTimeout はプロバイダーの呼び出しがタイムアウトしたかを返す。
+// プロバイダーのエラーに包まれていない期限切れは、プロバイダーのせいとは限らないので含めない
+func isProviderTimeout(err error) bool {
+	if errors.Is(err, services.ErrTimeout) {
+		return true
+	}
+	var perr *services.ProviderError
+	return errors.As(err, &perr) && errors.Is(perr.Err, context.DeadlineExceeded)
+}
+
+// respondQuotaError はトークン上限超過を429で返す。それ以外のエラー(集計の失敗)は500にする
+func respondQuotaError(c *gin.Context, err error) {
+	var qerr *services.QuotaError
+	if !errors.As(err, &qerr) {
+		respondError(c, http.StatusInternalServerError, "Failed to check usage quota")
+		return
+	}
+
+	retryAfter := time.Until(qerr.ResetAt)
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":    i18n.T(i18n.RequestLocale(c.Request), "Token quota exceeded"),
+		"period":   qerr.Period,
+		"limit":    qerr.Limit,
+		"used":     qerr.Used,
+		"reset_at": qerr.ResetAt.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"back/services"
+)
+
+// Healthz はプロセスが応答できるかだけを返すライブネスプローブ
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": services.HealthStatusUp})
+}
+
+// Readyz は依存先(DynamoDB, PostgreSQL, LLMプロバイダー)ごとの状態を返すレディネスプローブ
+func Readyz(checker *services.HealthChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready, components := checker.Check(c.Request.Context())
+
+		status := http.StatusOK
+		overall := services.HealthStatusUp
+		if !ready {
+			status = http.StatusServiceUnavailable
+			overall = services.HealthStatusDown
+		}
+
+		c.JSON(status, gin.H{
+			"status":     overall,
+			"draining":   checker.Draining(),
+			"components": components,
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"back/services"
+)
+
+const (
+	defaultMemoryListLimit = 50
+	maxMemoryListLimit     = 500
+	defaultAuditLogLimit   = 100
+	maxAuditLogLimit       = 1000
+)
+
+// MemoryController は要約(記憶)の一覧・ピン留めと、保持期間の管理のハンドラー
+type MemoryController struct {
+	retention *services.RetentionService
+}
+
+// NewMemoryController コンストラクタ
+func NewMemoryController(retention *services.RetentionService) *MemoryController {
+	return &MemoryController{retention: retention}
+}
+
+// ListMemories はユーザーの要約を新しい順に返す。level で粒度(window, daily, weekly, topic)を絞り込める
+func (mc *MemoryController) ListMemories(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+	level := c.Query("level")
+	switch level {
+	case "", services.SummaryLevelWindow, services.SummaryLevelDaily, services.SummaryLevelWeekly, services.SummaryLevelTopic:
+	default:
+		respondError(c, http.StatusBadRequest, "level must be one of window, daily, weekly, topic")
+		return
+	}
+
+	limit, ok := queryLimit(c, defaultMemoryListLimit, maxMemoryListLimit)
+	if !ok {
+		return
+	}
+
+	memories, err := mc.retention.ListMemories(c.Request.Context(), userID, level, limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error listing memories", "user_id", userID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch memories")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"memories": memories})
+}
+
+// PinMemory は要約のピン留めを切り替える。ピン留めした要約は保持期間を過ぎても削除しない
+func (mc *MemoryController) PinMemory(c *gin.Context) {
+	var request struct {
+		UserID string `json:"user_id" binding:"required"`
+		Pinned *bool  `json:"pinned" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "user_id and pinned are required")
+		return
+	}
+
+	err := mc.retention.SetMemoryPinned(c.Request.Context(), request.UserID, c.Param("id"), *request.Pinned)
+	if errors.Is(err, services.ErrMemoryNotFound) {
+		respondError(c, http.StatusNotFound, "Memory not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error pinning memory", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to update memory")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "pinned": *request.Pinned})
+}
+
+// AdminGetRetention はユーザーの保持期間の設定と、実際に適用される日数を返す
+func (mc *MemoryController) AdminGetRetention(c *gin.Context) {
+	settings, err := mc.retention.Settings(c.Request.Context(), c.Param("userId"))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error getting retention settings", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch retention settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"retention": settings})
+}
+
+// AdminUpdateRetention はユーザーの保持期間の区分と日数を設定する。日数を null にすると区分の設定に戻す
+func (mc *MemoryController) AdminUpdateRetention(c *gin.Context) {
+	var request struct {
+		Tier        string `json:"tier"`
+		MessageDays *int   `json:"message_days"`
+		SummaryDays *int   `json:"summary_days"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	settings, err := mc.retention.UpdateSettings(c.Request.Context(), c.Param("userId"), request.Tier, request.MessageDays, request.SummaryDays)
+	if errors.Is(err, services.ErrInvalidRetention) {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error updating retention settings", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to update retention settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"retention": settings})
+}
+
+// AdminRetentionAudit は保持期間による削除の監査ログを返す。userId で絞り込める
+func (mc *MemoryController) AdminRetentionAudit(c *gin.Context) {
+	limit, ok := queryLimit(c, defaultAuditLogLimit, maxAuditLogLimit)
+	if !ok {
+		return
+	}
+
+	entries, err := mc.retention.AuditLog(c.Request.Context(), c.Query("userId"), limit)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error reading retention audit log", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch audit log")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// queryLimit は limit クエリを読む。指定がなければ def、1〜max の範囲外なら400を返して false
+func queryLimit(c *gin.Context, def, max int) (int, bool) {
+	v := c.Query("limit")
+	if v == "" {
+		return def, true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > max {
+		respondError(c, http.StatusBadRequest, "limit must be between 1 and %d", max)
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"back/services"
+)
+
+// NotificationController は通知の送信先の登録とデッドレターの管理用ハンドラー
+type NotificationController struct {
+	notifications *services.NotificationService
+}
+
+// NewNotificationController コンストラクタ
+func NewNotificationController(notifications *services.NotificationService) *NotificationController {
+	return &NotificationController{notifications: notifications}
+}
+
+// RegisterEndpoint はWebhook URLかデバイストークンを登録する。署名用の鍵はこのレスポンスでのみ返す
+func (nc *NotificationController) RegisterEndpoint(c *gin.Context) {
+	var request struct {
+		UserID   string   `json:"user_id" binding:"required"`
+		Kind     string   `json:"kind" binding:"required"`
+		URL      string   `json:"url"`
+		Token    string   `json:"token"`
+		Platform string   `json:"platform"`
+		Events   []string `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "user_id and kind are required")
+		return
+	}
+
+	target := request.URL
+	if request.Kind == services.NotificationKindPush {
+		target = request.Token
+	}
+
+	endpoint, err := nc.notifications.Register(c.Request.Context(), request.UserID, request.Kind, target, request.Platform, request.Events)
+	if err != nil {
+		respondNotificationError(c, err, "Failed to register notification endpoint")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"endpoint": endpoint})
+}
+
+// ListEndpoints はユーザーの送信先を返す
+func (nc *NotificationController) ListEndpoints(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	endpoints, err := nc.notifications.List(c.Request.Context(), userID)
+	if err != nil {
+		respondNotificationError(c, err, "Failed to fetch notification endpoints")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"endpoints": endpoints})
+}
+
+// DeleteEndpoint は送信先を削除する
+func (nc *NotificationController) DeleteEndpoint(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	if err := nc.notifications.Delete(c.Request.Context(), userID, c.Param("id")); err != nil {
+		respondNotificationError(c, err, "Failed to delete notification endpoint")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminDeadLetters は送信をあきらめた通知を返す。limit は1-500で既定は100
+func (nc *NotificationController) AdminDeadLetters(c *gin.Context) {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			respondError(c, http.StatusBadRequest, "limit must be between 1 and %d", 500)
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := nc.notifications.DeadLetters(c.Request.Context(), limit)
+	if err != nil {
+		respondNotificationError(c, err, "Failed to fetch dead letters")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dead_letters": deliveries})
+}
+
+// AdminRetryDeadLetter はデッドレターの通知を送信待ちに戻す
+func (nc *NotificationController) AdminRetryDeadLetter(c *gin.Context) {
+	if err := nc.notifications.RetryDeadLetter(c.Request.Context(), c.Param("id")); err != nil {
+		respondNotificationError(c, err, "Failed to retry dead letter")
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// respondNotificationError は通知関連のエラーを404/400/500に変換して返す
+func respondNotificationError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrNotificationEndpointNotFound):
+		respondError(c, http.StatusNotFound, "Notification endpoint not found")
+	case errors.Is(err, services.ErrNotificationDeliveryNotFound):
+		respondError(c, http.StatusNotFound, "Dead letter not found")
+	case errors.Is(err, services.ErrInvalidNotificationEndpoint):
+		respondError(c, http.StatusBadRequest, err.Error())
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "error", err)
+		respondError(c, http.StatusInternalServerError, message)
+	}
+}
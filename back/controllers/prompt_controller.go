@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"back/models"
+	"back/services"
+)
+
+// PromptController はプロンプトのバージョンと実験を管理する管理者向けのハンドラー
+type PromptController struct {
+	prompts *services.PromptService
+}
+
+// NewPromptController コンストラクタ
+func NewPromptController(prompts *services.PromptService) *PromptController {
+	return &PromptController{prompts: prompts}
+}
+
+// AdminListPrompts はテンプレートのバージョンと既定のバージョン、実験の一覧を返す
+func (pc *PromptController) AdminListPrompts(c *gin.Context) {
+	experiments, err := pc.prompts.Experiments(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error listing prompt experiments", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch prompt experiments")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"templates":   pc.prompts.Templates(),
+		"experiments": experiments,
+	})
+}
+
+// AdminGetUserPrompts はユーザーに使う各プロンプトのバージョンと、その決まり方を返す
+func (pc *PromptController) AdminGetUserPrompts(c *gin.Context) {
+	selections, err := pc.prompts.Selections(c.Request.Context(), c.Param("userId"))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error selecting prompt versions", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch prompt versions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"prompts": selections})
+}
+
+// AdminUpdateUserPrompt はユーザーに使うプロンプトのバージョンを固定する。version を null にすると固定を外す
+func (pc *PromptController) AdminUpdateUserPrompt(c *gin.Context) {
+	var request struct {
+		Prompt  string `json:"prompt" binding:"required"`
+		Version *int   `json:"version"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	userID := c.Param("userId")
+	if err := pc.prompts.SetUserVersion(c.Request.Context(), userID, request.Prompt, request.Version); err != nil {
+		respondPromptError(c, err, "Failed to update prompt version")
+		return
+	}
+
+	selection, err := pc.prompts.Select(c.Request.Context(), userID, request.Prompt)
+	if err != nil {
+		respondPromptError(c, err, "Failed to fetch prompt version")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"prompt": selection})
+}
+
+// AdminSaveExperiment は実験を作成または更新する
+func (pc *PromptController) AdminSaveExperiment(c *gin.Context) {
+	var request struct {
+		Prompt         string `json:"prompt" binding:"required"`
+		Version        int    `json:"version" binding:"required"`
+		TrafficPercent int    `json:"traffic_percent"`
+		Enabled        *bool  `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	experiment := models.PromptExperiment{
+		Name:           c.Param("name"),
+		Prompt:         request.Prompt,
+		Version:        request.Version,
+		TrafficPercent: request.TrafficPercent,
+		Enabled:        request.Enabled == nil || *request.Enabled,
+	}
+	saved, err := pc.prompts.SaveExperiment(c.Request.Context(), experiment)
+	if err != nil {
+		respondPromptError(c, err, "Failed to save prompt experiment")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"experiment": saved})
+}
+
+// AdminDeleteExperiment は実験を削除する
+func (pc *PromptController) AdminDeleteExperiment(c *gin.Context) {
+	if err := pc.prompts.DeleteExperiment(c.Request.Context(), c.Param("name")); err != nil {
+		respondPromptError(c, err, "Failed to delete prompt experiment")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondPromptError はプロンプトの管理のエラーを400/404/500に変換して返す
+func respondPromptError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidPrompt):
+		respondError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrPromptExperimentNotFound):
+		respondError(c, http.StatusNotFound, "Prompt experiment not found")
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "error", err)
+		respondError(c, http.StatusInternalServerError, message)
+	}
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/services"
+)
+
+// ReminderController はリマインダーのCRUDハンドラー
+type ReminderController struct {
+	reminders *services.ReminderService
+}
+
+// NewReminderController コンストラクタ
+func NewReminderController(reminders *services.ReminderService) *ReminderController {
+	return &ReminderController{reminders: reminders}
+}
+
+// ListReminders はユーザーのリマインダーを返す。all=true なら送信済み・取り消し済みも含める
+func (rc *ReminderController) ListReminders(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	reminders, err := rc.reminders.List(c.Request.Context(), userID, c.Query("all") == "true")
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error listing reminders", "user_id", userID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch reminders")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reminders": reminders})
+}
+
+// CreateReminder はAPIからリマインダーを登録する
+func (rc *ReminderController) CreateReminder(c *gin.Context) {
+	var request struct {
+		UserID  string    `json:"user_id" binding:"required"`
+		Message string    `json:"message" binding:"required"`
+		DueAt   time.Time `json:"due_at" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "user_id, message and due_at (RFC3339) are required")
+		return
+	}
+
+	reminder, err := rc.reminders.Create(c.Request.Context(), request.UserID, request.Message, request.DueAt, services.ReminderSourceAPI)
+	if err != nil {
+		respondReminderError(c, err, "Failed to create reminder")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"reminder": reminder})
+}
+
+// UpdateReminder は未送信のリマインダーの本文・期限を変更する
+func (rc *ReminderController) UpdateReminder(c *gin.Context) {
+	var request struct {
+		UserID  string     `json:"user_id" binding:"required"`
+		Message *string    `json:"message"`
+		DueAt   *time.Time `json:"due_at"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, "user_id is required and due_at must be RFC3339")
+		return
+	}
+
+	reminder, err := rc.reminders.Update(c.Request.Context(), request.UserID, c.Param("id"), request.Message, request.DueAt)
+	if err != nil {
+		respondReminderError(c, err, "Failed to update reminder")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reminder": reminder})
+}
+
+// DeleteReminder は未送信のリマインダーを取り消す
+func (rc *ReminderController) DeleteReminder(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	if err := rc.reminders.Cancel(c.Request.Context(), userID, c.Param("id")); err != nil {
+		respondReminderError(c, err, "Failed to cancel reminder")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondReminderError はリマインダー操作のエラーを404/400/500に変換して返す
+func respondReminderError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrReminderNotFound):
+		respondError(c, http.StatusNotFound, "Reminder not found")
+	case errors.Is(err, services.ErrInvalidReminder):
+		respondError(c, http.StatusBadRequest, err.Error())
+	default:
+		slog.ErrorContext(c.Request.Context(), message, "error", err)
+		respondError(c, http.StatusInternalServerError, message)
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"back/config"
+	"back/middlewares"
+	"back/models"
+	"back/services"
+)
+
+// SettingsController はユーザー自身の設定のハンドラー
+type SettingsController struct {
+	settings *services.SettingsService
+}
+
+// NewSettingsController コンストラクタ
+func NewSettingsController(settings *services.SettingsService) *SettingsController {
+	return &SettingsController{settings: settings}
+}
+
+// GetSettings はユーザーの設定と既定を反映した値、選べるモデルを返す
+func (sc *SettingsController) GetSettings(c *gin.Context) {
+	userID := currentUserID(c)
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	settings, err := sc.settings.Settings(c.Request.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error fetching user settings", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": settings, "models": config.GetChatModels()})
+}
+
+// UpdateSettings はユーザーの設定を変える。指定しなかった項目はそのまま残し、null の項目は既定に戻す
+func (sc *SettingsController) UpdateSettings(c *gin.Context) {
+	userID := currentUserID(c)
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	var update models.UserSettingsUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	settings, err := sc.settings.UpdateSettings(c.Request.Context(), userID, update)
+	if err != nil {
+		respondSettingsError(c, err, "Failed to update settings")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": settings})
+}
+
+// currentUserID はリクエストしたユーザー。X-User-ID ヘッダー、userId クエリの順に使う
+func currentUserID(c *gin.Context) string {
+	if userID := c.GetHeader(middlewares.UserIDHeader); userID != "" {
+		return userID
+	}
+	return c.Query("userId")
+}
+
+// respondSettingsError は設定のエラーを400/500に変換して返す
+func respondSettingsError(c *gin.Context, err error, message string) {
+	if errors.Is(err, services.ErrInvalidSettings) {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.ErrorContext(c.Request.Context(), message, "error", err)
+	respondError(c, http.StatusInternalServerError, message)
+}
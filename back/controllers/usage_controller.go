@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/services"
+)
+
+// UsageController はトークン使用量の参照用ハンドラー
+type UsageController struct {
+	usage *services.UsageService
+}
+
+// NewUsageController コンストラクタ
+func NewUsageController(usage *services.UsageService) *UsageController {
+	return &UsageController{usage: usage}
+}
+
+// GetUsage はユーザーの今月の使用量(機能別)とクォータの状況を返す
+func (uc *UsageController) GetUsage(c *gin.Context) {
+	userID := c.Query("userId")
+	if userID == "" {
+		respondError(c, http.StatusBadRequest, "userId is required")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	quotas, err := uc.usage.Quotas(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching quotas", "user_id", userID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch usage")
+		return
+	}
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	features, err := uc.usage.UserUsage(ctx, userID, monthStart)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error fetching usage", "user_id", userID, "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to fetch usage")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":  userID,
+		"since":    monthStart.Format(time.RFC3339),
+		"quotas":   quotas,
+		"features": features,
+	})
+}
+
+// AdminUsageReport は期間内の全ユーザーの使用量を返す。from/to はRFC3339で、省略時は今月
+func (uc *UsageController) AdminUsageReport(c *gin.Context) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+
+	var err error
+	if v := c.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(c, http.StatusBadRequest, "from must be RFC3339")
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(c, http.StatusBadRequest, "to must be RFC3339")
+			return
+		}
+	}
+	if !from.Before(to) {
+		respondError(c, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	ctx := c.Request.Context()
+	report, err := uc.usage.Report(ctx, from, to)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error building usage report", "error", err)
+		respondError(c, http.StatusInternalServerError, "Failed to build usage report")
+		return
+	}
+
+	var totalCost float64
+	var totalTokens int
+	for _, r := range report {
+		totalCost += r.CostUSD
+		totalTokens += r.TotalTokens
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":           from.Format(time.RFC3339),
+		"to":             to.Format(time.RFC3339),
+		"total_tokens":   totalTokens,
+		"total_cost_usd": totalCost,
+		"usage":          report,
+	})
+}
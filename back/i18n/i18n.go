@@ -0,0 +1,123 @@
+// Package i18n は対応する言語の判定と、APIのメッセージの翻訳。
+// メッセージは英語の文をキーにし、訳がない言語や文はそのまま英語で返す
+package i18n
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 対応するロケール
+const (
+	Japanese = "ja"
+	English  = "en"
+)
+
+// Supported は対応するロケールの一覧
+var Supported = []string{Japanese, English}
+
+// Normalize は "en-US" や "ja_JP" のような言語タグを対応するロケールにする。対応していなければ空文字
+func Normalize(tag string) string {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	base, _, _ = strings.Cut(base, "_")
+	for _, locale := range Supported {
+		if base == locale {
+			return locale
+		}
+	}
+	return ""
+}
+
+// FromAcceptLanguage は Accept-Language の中で優先度が最も高い対応ロケールを返す。なければ空文字
+func FromAcceptLanguage(header string) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		locale := Normalize(tag)
+		if locale == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{locale: locale, q: q})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].locale
+}
+
+// RequestLocale はAPIのメッセージに使うロケール。Accept-Language になければ英語
+func RequestLocale(r *http.Request) string {
+	if locale := FromAcceptLanguage(r.Header.Get("Accept-Language")); locale != "" {
+		return locale
+	}
+	return English
+}
+
+// Detect は文字の種類から文章の言語を推定する。仮名を含めば日本語、ほぼラテン文字なら英語。
+// 短すぎる文や判断できない文は空文字
+func Detect(text string) string {
+	var kana, han, latin int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	switch {
+	case kana > 0:
+		return Japanese
+	case han == 0 && latin >= 3:
+		return English
+	case han > 0 && latin > han*2:
+		return English
+	}
+	return ""
+}
+
+type contextKey struct{}
+
+// WithLocale は ctx にロケールを持たせる。ツールのように引数で言語を渡せない処理に使う
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, contextKey{}, locale)
+}
+
+// FromContext は WithLocale で持たせたロケールを返す。なければ空文字
+func FromContext(ctx context.Context) string {
+	locale, _ := ctx.Value(contextKey{}).(string)
+	return locale
+}
+
+// T は英語のメッセージを locale に翻訳し、args を埋め込む
+func T(locale, message string, args ...any) string {
+	if translated, ok := catalog[locale][message]; ok {
+		message = translated
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
@@ -0,0 +1,110 @@
+package i18n
+
+// catalog はロケールごとの英語のメッセージの訳
+var catalog = map[string]map[string]string{
+	Japanese: {
+		// リクエストの検証
+		"Invalid request body":                               "リクエストの本文が不正です",
+		"Request body is too large":                          "リクエストの本文が大きすぎます",
+		"userId is required":                                 "userId は必須です",
+		"user_id is required":                                "user_id は必須です",
+		"user_id and file are required":                      "user_id と file は必須です",
+		"user_id and kind are required":                      "user_id と kind は必須です",
+		"user_id and pinned are required":                    "user_id と pinned は必須です",
+		"user_id, message and due_at (RFC3339) are required": "user_id、message、due_at (RFC3339) は必須です",
+		"user_id is required and due_at must be RFC3339":     "user_id は必須で、due_at は RFC3339 で指定してください",
+		"Message and UserID are required":                    "メッセージとユーザーIDは必須です",
+		"file is required":                                   "file は必須です",
+		"from must be RFC3339":                               "from は RFC3339 で指定してください",
+		"to must be RFC3339":                                 "to は RFC3339 で指定してください",
+		"from must be before to":                             "from は to より前にしてください",
+		"timestamp must be RFC3339":                          "timestamp は RFC3339 で指定してください",
+		"limit must be between 1 and %d":                     "limit は 1〜%d で指定してください",
+		"level must be one of window, daily, weekly, topic":  "level は window、daily、weekly、topic のいずれかです",
+		"At most %d attachments are allowed per message":     "1つのメッセージに添付できるファイルは %d 個までです",
+
+		// 見つからない
+		"lastMessageId not found":         "lastMessageId が見つかりません",
+		"Attachment not found":            "添付ファイルが見つかりません",
+		"Dead letter not found":           "デッドレターが見つかりません",
+		"Document not found":              "資料が見つかりません",
+		"Memory not found":                "記憶が見つかりません",
+		"Notification endpoint not found": "通知先が見つかりません",
+		"Prompt experiment not found":     "プロンプトの実験が見つかりません",
+		"Reminder not found":              "リマインダーが見つかりません",
+
+		// 認証・制限
+		"Admin API is disabled":                 "管理APIは無効です",
+		"Invalid admin token":                   "管理トークンが不正です",
+		"Too many requests, please retry later": "リクエストが多すぎます。しばらくしてから再試行してください",
+		"Token quota exceeded":                  "トークンの上限を超えました",
+
+		// AIプロバイダー
+		"AI provider is rate limiting requests, please retry later": "AIプロバイダーのリクエスト制限中です。しばらくしてから再試行してください",
+		"AI provider timed out":                  "AIプロバイダーの応答がタイムアウトしました",
+		"AI provider is temporarily unavailable": "AIプロバイダーが一時的に利用できません",
+		"Failed to get reply from AI":            "AIからの返答を取得できませんでした",
+
+		// チャットのソケット
+		"type must be chat, ack or ping":                            "type は chat、ack、ping のいずれかです",
+		"message is required":                                       "message は必須です",
+		"A reply is already being generated":                        "返答を生成中です",
+		"Too many attachments":                                      "添付ファイルが多すぎます",
+		"Too many missed messages; reload the conversation history": "受け取れなかったメッセージが多すぎます。会話履歴を読み込み直してください",
+
+		// 処理の失敗
+		"Failed to build usage report":             "利用状況のレポートを作成できませんでした",
+		"Failed to cancel reminder":                "リマインダーを取り消せませんでした",
+		"Failed to check usage quota":              "利用上限を確認できませんでした",
+		"Failed to create reminder":                "リマインダーを登録できませんでした",
+		"Failed to delete document":                "資料を削除できませんでした",
+		"Failed to delete notification endpoint":   "通知先を削除できませんでした",
+		"Failed to delete prompt experiment":       "プロンプトの実験を削除できませんでした",
+		"Failed to fetch audit log":                "監査ログを取得できませんでした",
+		"Failed to fetch conversations":            "会話を取得できませんでした",
+		"Failed to fetch dead letters":             "デッドレターを取得できませんでした",
+		"Failed to fetch document":                 "資料を取得できませんでした",
+		"Failed to fetch documents":                "資料の一覧を取得できませんでした",
+		"Failed to fetch memories":                 "記憶を取得できませんでした",
+		"Failed to fetch notification endpoints":   "通知先を取得できませんでした",
+		"Failed to fetch prompt experiments":       "プロンプトの実験を取得できませんでした",
+		"Failed to fetch prompt version":           "プロンプトのバージョンを取得できませんでした",
+		"Failed to fetch prompt versions":          "プロンプトのバージョンを取得できませんでした",
+		"Failed to fetch reminders":                "リマインダーを取得できませんでした",
+		"Failed to fetch retention settings":       "保存期間の設定を取得できませんでした",
+		"Failed to fetch settings":                 "設定を取得できませんでした",
+		"Failed to fetch usage":                    "利用状況を取得できませんでした",
+		"Failed to ingest document":                "資料を取り込めませんでした",
+		"Failed to process attachment":             "添付ファイルを処理できませんでした",
+		"Failed to process chat":                   "チャットを処理できませんでした",
+		"Failed to read file":                      "ファイルを読み込めませんでした",
+		"Failed to register notification endpoint": "通知先を登録できませんでした",
+		"Failed to research topic":                 "話題を調べられませんでした",
+		"Failed to resume conversation":            "会話を再開できませんでした",
+		"Failed to retry dead letter":              "デッドレターを再実行できませんでした",
+		"Failed to save bot reply":                 "返答を保存できませんでした",
+		"Failed to save prompt experiment":         "プロンプトの実験を保存できませんでした",
+		"Failed to save research result":           "調べた結果を保存できませんでした",
+		"Failed to save user message":              "メッセージを保存できませんでした",
+		"Failed to update memory":                  "記憶を更新できませんでした",
+		"Failed to update message flag":            "メッセージのフラグを更新できませんでした",
+		"Failed to update prompt version":          "プロンプトのバージョンを更新できませんでした",
+		"Failed to update reminder":                "リマインダーを更新できませんでした",
+		"Failed to update retention settings":      "保存期間の設定を更新できませんでした",
+		"Failed to update settings":                "設定を更新できませんでした",
+
+		// モデルに渡す文
+		"(Attachments on this message: %s)":  "（このメッセージの添付ファイル：%s）",
+		", ":                                 "、",
+		" [could not read the content]":      "［内容を読み取れませんでした］",
+		"Sources:":                           "出典:",
+		"Topic \"%s\" summary":               "話題「%s」のまとめ",
+		"Week of %s to %s":                   "%s〜%sの週のまとめ",
+		"Conversations on %s":                "%sの会話のまとめ",
+		"Conversation at %s":                 "%sの会話",
+		"Reminder: %s":                       "リマインダー: %s",
+		"Reminder created (id: %s, due: %s)": "リマインダーを登録しました (id: %s, 日時: %s)",
+		"%s (%s)":                            "%s（%s）",
+		"No related past conversations were found.": "関連する過去の会話は見つかりませんでした。",
+	},
+}
@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey struct{}
+
+var requestIDKey = contextKey{}
+
+// ユーザーの入力やLLMの応答をログに出す方法
+const (
+	ContentRedact   = "redact"
+	ContentTruncate = "truncate"
+	ContentFull     = "full"
+)
+
+const truncateRunes = 40
+
+var contentMode = ContentRedact
+
+// 値を必ず伏せるログ属性のキー。小文字で完全一致するか "_" 付きの接尾辞 (access_token など) として一致したものを伏せる。
+// prompt_tokens のような集計値は伏せない
+var secretKeys = []string{"api_key", "apikey", "authorization", "password", "secret", "token"}
+
+// Setup は LOG_LEVEL / LOG_FORMAT / LOG_CONTENT の設定で slog のデフォルトロガーを構成する
+func Setup() {
+	SetupWithWriter(os.Stdout)
+}
+
+// SetupWithWriter は出力先を指定してデフォルトロガーを構成する
+func SetupWithWriter(w io.Writer) {
+	opts := &slog.HandlerOptions{
+		Level:       parseLevel(os.Getenv("LOG_LEVEL")),
+		ReplaceAttr: redactSecrets,
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		handler = slog.NewTextHandler(w, opts)
+	} else {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+
+	switch mode := strings.ToLower(os.Getenv("LOG_CONTENT")); mode {
+	case ContentTruncate, ContentFull:
+		contentMode = mode
+	default:
+		contentMode = ContentRedact
+	}
+
+	// 標準の log パッケージの出力も同じハンドラーに流れる
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+}
+
+// WithRequestID はリクエストIDをコンテキストに保存する
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext はコンテキストのリクエストIDを返す
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// Content はユーザーの入力やLLMの応答をログ用に伏せる・切り詰める
+func Content(key, content string) slog.Attr {
+	switch contentMode {
+	case ContentFull:
+		return slog.String(key, content)
+	case ContentTruncate:
+		if utf8.RuneCountInString(content) > truncateRunes {
+			runes := []rune(content)
+			return slog.String(key, string(runes[:truncateRunes])+"…")
+		}
+		return slog.String(key, content)
+	default:
+		return slog.String(key, fmt.Sprintf("[redacted %d chars]", utf8.RuneCountInString(content)))
+	}
+}
+
+func parseLevel(v string) slog.Level {
+	switch strings.ToLower(v) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func redactSecrets(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ReplaceAll(strings.ToLower(a.Key), "-", "_")
+	for _, secret := range secretKeys {
+		if key == secret || strings.HasSuffix(key, "_"+secret) {
+			return slog.String(a.Key, "[REDACTED]")
+		}
+	}
+	return a
+}
+
+// contextHandler はコンテキストに含まれるリクエストIDとトレースIDを全てのログ行に付与する
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -1,37 +1,92 @@
 package main
 
 import (
+	"back/app"
+	"back/config"
+	"back/logging"
 	"back/routes"
-	"log"
+	"back/tracing"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	logging.Setup()
+
 	// デバッグモードを有効化
 	gin.SetMode(gin.DebugMode)
 
-	// CORSの設定
-	router := routes.SetupRouter()
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
+	// 接続プールやサービスはプロセス全体で共有する
+	container, err := app.NewContainer(context.Background())
+	if err != nil {
+		slog.Error("Failed to initialize dependencies", "error", err)
+		os.Exit(1)
+	}
+	defer container.Close()
+
+	router, err := routes.SetupRouter(container)
+	if err != nil {
+		slog.Error("Failed to set up router", "error", err)
+		os.Exit(1)
+	}
 
-	// エラーハンドリングを追加
-	router.Use(gin.Recovery())
-	router.Use(gin.LoggerWithWriter(os.Stdout))
+	// SIGINT/SIGTERMで終了処理を開始する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "memorai-api")
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
 
 	port := ":8080"
-	log.Printf("Server starting on port %s", port)
-	if err := router.Run(port); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	server := &http.Server{
+		Addr:    port,
+		Handler: router,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "port", port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed to start", "error", err)
+			os.Exit(1)
+		}
+		return
+	case <-ctx.Done():
 	}
+	stop()
+	container.Health.MarkDraining()
+
+	// 新規接続の受付を止め、処理中のリクエストが終わるまで猶予期間だけ待つ
+	grace := config.GetShutdownGracePeriod()
+	slog.Info("Shutting down server, waiting for in-flight requests", "grace_period", grace.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// 猶予期間を過ぎたら残りの接続を強制的に閉じる(リクエストのコンテキストもキャンセルされる)
+		slog.Warn("Graceful shutdown timed out", "error", err)
+		server.Close()
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "memorai"
+
+// HTTP
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"method", "route", "status"})
+
+	// ChatStageDuration は HandleChat の各段階(保存、RAG、応答生成)にかかった時間
+	ChatStageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "chat_stage_duration_seconds",
+		Help:      "Time spent in each stage of a chat turn.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"stage"})
+)
+
+// LLM / 埋め込み
+var (
+	LLMRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "llm_request_duration_seconds",
+		Help:      "Latency of LLM and embedding calls including retries.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"provider", "model", "operation"})
+
+	LLMTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_tokens_total",
+		Help:      "Tokens consumed by LLM and embedding calls.",
+	}, []string{"provider", "model", "type"})
+
+	LLMErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_errors_total",
+		Help:      "Failed LLM and embedding calls.",
+	}, []string{"provider", "model", "operation", "kind"})
+
+	EmbeddingsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "embeddings_created_total",
+		Help:      "Embedding vectors created.",
+	}, []string{"model", "source"})
+)
+
+// ツール呼び出し
+var (
+	ToolCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tool_calls_total",
+		Help:      "Tool invocations by the chat assistant.",
+	}, []string{"tool", "result"})
+)
+
+// RAG
+var (
+	RAGSearches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rag_searches_total",
+		Help:      "Memory retrievals by outcome (hit, miss, error).",
+	}, []string{"result"})
+
+	RAGHits = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rag_hits",
+		Help:      "Number of summaries, attachment chunks and document chunks retrieved per search.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 10},
+	})
+
+	RAGSimilarity = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rag_similarity_score",
+		Help:      "Cosine similarity of retrieved summaries.",
+		Buckets:   []float64{0.5, 0.6, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95, 1},
+	})
+)
+
+// バッチ
+var (
+	BatchRunDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_run_duration_seconds",
+		Help:      "Duration of batch summarization runs.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+	})
+
+	BatchRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "batch_runs_total",
+		Help:      "Batch summarization runs by result.",
+	}, []string{"result"})
+
+	BatchUsers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "batch_users_total",
+		Help:      "Users handled by batch runs by result (processed, skipped, failed).",
+	}, []string{"result"})
+
+	BatchLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "batch_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful batch run.",
+	})
+
+	SummaryRollups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "summary_rollups_total",
+		Help:      "Summaries consolidated into daily, weekly and topic summaries by level and result.",
+	}, []string{"level", "result"})
+
+	Reindexed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reindexed_total",
+		Help:      "Rows rebuilt by cmd/reindex by target (summaries, attachments, documents) and result (reembedded, resummarized, skipped, failed).",
+	}, []string{"target", "result"})
+)
+
+// リサーチダイジェスト
+var (
+	ResearchDigests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "research_digests_total",
+		Help:      "Scheduled research digests by result.",
+	}, []string{"result"})
+)
+
+// リマインダー
+var (
+	RemindersDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reminders_delivered_total",
+		Help:      "Due reminders posted to conversations by result.",
+	}, []string{"result"})
+)
+
+// 通知
+var (
+	NotificationsEnqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_enqueued_total",
+		Help:      "Notification deliveries queued by event type.",
+	}, []string{"event"})
+
+	NotificationDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notification_deliveries_total",
+		Help:      "Notification delivery attempts by endpoint kind and result (delivered, retry, dead).",
+	}, []string{"kind", "result"})
+)
+
+// WebSocket
+var (
+	WebSocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open WebSocket chat connections.",
+	})
+
+	WebSocketFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_frames_total",
+		Help:      "WebSocket frames by direction (in, out) and type.",
+	}, []string{"direction", "type"})
+)
+
+// 添付ファイル
+var (
+	AttachmentsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_processed_total",
+		Help:      "Uploaded attachments by kind (image, pdf, text) and final status.",
+	}, []string{"kind", "status"})
+)
+
+// ナレッジベース
+var (
+	DocumentsIngested = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_ingested_total",
+		Help:      "Knowledge base documents ingested by result (created, updated, unchanged).",
+	}, []string{"status"})
+)
+
+// 保持期間
+var (
+	RetentionDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_deleted_total",
+		Help:      "Rows removed or scheduled for expiry by retention policies by kind (summary, message).",
+	}, []string{"kind"})
+)
+
+// プロンプト
+var (
+	PromptRenders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "prompt_renders_total",
+		Help:      "Prompts rendered by prompt, version and how the version was selected (user, experiment, default).",
+	}, []string{"prompt", "version", "source"})
+)
+
+// レート制限
+var (
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by the rate limiter.",
+	}, []string{"policy", "scope"})
+)
+
+// ObserveLLMCall はLLM・埋め込み呼び出し1回分のレイテンシとトークン数を記録する
+func ObserveLLMCall(provider, model, operation string, start time.Time, promptTokens, completionTokens int) {
+	LLMRequestDuration.WithLabelValues(provider, model, operation).Observe(time.Since(start).Seconds())
+	if promptTokens > 0 {
+		LLMTokens.WithLabelValues(provider, model, "prompt").Add(float64(promptTokens))
+	}
+	if completionTokens > 0 {
+		LLMTokens.WithLabelValues(provider, model, "completion").Add(float64(completionTokens))
+	}
+}
+
+// ObserveLLMError はLLM・埋め込み呼び出しの失敗を記録する
+func ObserveLLMError(provider, model, operation, kind string, start time.Time) {
+	LLMRequestDuration.WithLabelValues(provider, model, operation).Observe(time.Since(start).Seconds())
+	LLMErrors.WithLabelValues(provider, model, operation, kind).Inc()
+}
@@ -0,0 +1,30 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"back/config"
+	"back/i18n"
+)
+
+// AdminAuth は ADMIN_API_TOKEN と一致するBearerトークンを要求する。トークン未設定時は管理用APIを無効にする
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expected := config.GetAdminAPIToken()
+		if expected == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": i18n.T(i18n.RequestLocale(c.Request), "Admin API is disabled")})
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": i18n.T(i18n.RequestLocale(c.Request), "Invalid admin token")})
+			return
+		}
+		c.Next()
+	}
+}
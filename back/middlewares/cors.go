@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"back/config"
+)
+
+// CORS は設定の許可リストに従ってCORSヘッダーを付与し、プリフライトに応答する。
+// ルート登録より前に Use すること(後から Use しても登録済みのルートには効かない)
+func CORS() gin.HandlerFunc {
+	allowedOrigins := make(map[string]bool)
+	allowAll := false
+	for _, origin := range config.GetCORSAllowedOrigins() {
+		if origin == "*" {
+			allowAll = true
+		}
+		allowedOrigins[strings.TrimRight(origin, "/")] = true
+	}
+
+	allowCredentials := config.GetCORSAllowCredentials()
+	if allowCredentials && allowAll {
+		// 全オリジンに認証情報付きのアクセスを許すとCSRFと同等になるため無効にする
+		slog.Warn("CORS_ALLOW_CREDENTIALS is ignored when all origins are allowed")
+		allowCredentials = false
+	}
+
+	allowMethods := strings.Join(config.GetCORSAllowedMethods(), ", ")
+	allowHeaders := strings.Join(config.GetCORSAllowedHeaders(), ", ")
+	exposeHeaders := strings.Join(config.GetCORSExposedHeaders(), ", ")
+	maxAge := strconv.Itoa(int(config.GetCORSMaxAge().Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		// オリジンによって応答が変わるのでキャッシュにも伝える
+		c.Writer.Header().Add("Vary", "Origin")
+		if !allowAll && !allowedOrigins[origin] {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if allowAll {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+		}
+		if allowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+			c.Header("Access-Control-Allow-Methods", allowMethods)
+			c.Header("Access-Control-Allow-Headers", allowHeaders)
+			c.Header("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		if exposeHeaders != "" {
+			c.Header("Access-Control-Expose-Headers", exposeHeaders)
+		}
+		c.Next()
+	}
+}
@@ -1,12 +1,32 @@
 package middlewares
 
 import (
+    "log/slog"
+    "time"
+
     "github.com/gin-gonic/gin"
 )
 
 func Logger() gin.HandlerFunc {
     return func(c *gin.Context) {
-        // リクエストのログを記録
+        start := time.Now()
         c.Next()
+
+        // リクエストのログを記録(クエリ文字列は userId 等を含むためパスのみ)
+        level := slog.LevelInfo
+        if c.Writer.Status() >= 500 {
+            level = slog.LevelError
+        } else if c.Writer.Status() >= 400 {
+            level = slog.LevelWarn
+        }
+        slog.Log(c.Request.Context(), level, "http request",
+            "method", c.Request.Method,
+            "path", c.Request.URL.Path,
+            "route", c.FullPath(),
+            "status", c.Writer.Status(),
+            "latency_ms", time.Since(start).Milliseconds(),
+            "client_ip", c.ClientIP(),
+            "bytes", c.Writer.Size(),
+        )
     }
 }
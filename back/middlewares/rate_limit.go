@@ -0,0 +1,145 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"back/config"
+	"back/i18n"
+	"back/metrics"
+	"back/ratelimit"
+)
+
+const (
+	UserIDHeader = "X-User-ID"
+
+	// ユーザーIDを探すためにJSON本文を読む上限
+	maxPeekBodyBytes = 1 << 20
+)
+
+// RateLimit はポリシー名に対応する制限を、ユーザー単位とIP単位のトークンバケットで適用する。
+// ストアが使えない場合は制限せずに通す
+func RateLimit(store ratelimit.Store, policy string) gin.HandlerFunc {
+	p := config.GetRateLimitPolicy(policy)
+	userLimit := ratelimit.Limit{PerMinute: p.UserPerMinute, Burst: p.UserBurst}
+	ipLimit := ratelimit.Limit{PerMinute: p.IPPerMinute, Burst: p.IPBurst}
+
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		type check struct {
+			scope string
+			key   string
+			limit ratelimit.Limit
+		}
+		checks := []check{{scope: "ip", key: "ip:" + c.ClientIP(), limit: ipLimit}}
+		if userID := requestUserID(c); userID != "" {
+			checks = append(checks, check{scope: "user", key: "user:" + userID, limit: userLimit})
+		}
+
+		// 拒否されたリクエストで他のバケットを減らさないように、先に全ての制限を確かめてから消費する
+		enabled := checks[:0]
+		for _, ch := range checks {
+			if !ch.limit.Enabled() {
+				continue
+			}
+			result, err := store.Peek(ctx, policy+":"+ch.key, ch.limit)
+			if err != nil {
+				slog.WarnContext(ctx, "Rate limit store unavailable", "policy", policy, "scope", ch.scope, "error", err)
+				continue
+			}
+			if !result.Allowed {
+				rejectRateLimited(c, policy, ch.scope, result)
+				return
+			}
+			enabled = append(enabled, ch)
+		}
+
+		// ヘッダーには最も残りの少ない制限を返す
+		var tightest *ratelimit.Result
+		for _, ch := range enabled {
+			result, err := store.Take(ctx, policy+":"+ch.key, ch.limit)
+			if err != nil {
+				slog.WarnContext(ctx, "Rate limit store unavailable", "policy", policy, "scope", ch.scope, "error", err)
+				continue
+			}
+
+			if tightest == nil || result.Remaining < tightest.Remaining {
+				tightest = &result
+			}
+			// 確かめてから消費するまでに他のリクエストが使い切った場合
+			if !result.Allowed {
+				rejectRateLimited(c, policy, ch.scope, result)
+				return
+			}
+		}
+
+		if tightest != nil {
+			setRateLimitHeaders(c, *tightest)
+		}
+		c.Next()
+	}
+}
+
+func rejectRateLimited(c *gin.Context, policy, scope string, result ratelimit.Result) {
+	setRateLimitHeaders(c, result)
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	metrics.RateLimited.WithLabelValues(policy, scope).Inc()
+	slog.InfoContext(c.Request.Context(), "Rate limit exceeded", "policy", policy, "scope", scope)
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": i18n.T(i18n.RequestLocale(c.Request), "Too many requests, please retry later")})
+}
+
+func setRateLimitHeaders(c *gin.Context, result ratelimit.Result) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// requestUserID はヘッダー、クエリ、本文の順にユーザーIDを探す。
+// 本文を読んだ場合はハンドラーが再度読めるように戻しておく
+func requestUserID(c *gin.Context) string {
+	if userID := c.GetHeader(UserIDHeader); userID != "" {
+		return userID
+	}
+	if userID := c.Query("userId"); userID != "" {
+		return userID
+	}
+	// multipart はパースした結果を Request に残すので、ハンドラーからもそのまま読める
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		return c.PostForm("user_id")
+	}
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return ""
+	}
+
+	peeked, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPeekBodyBytes))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(peeked), c.Request.Body))
+	if err != nil {
+		return ""
+	}
+
+	var body struct {
+		UserID      string `json:"user_id"`
+		UserIDCamel string `json:"userId"`
+	}
+	if err := json.Unmarshal(peeked, &body); err != nil {
+		return ""
+	}
+	if body.UserID != "" {
+		return body.UserID
+	}
+	return body.UserIDCamel
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+)
+
+// Attachment はチャットに添付されたファイル。本体はblobストアに、抽出したテキストはチャンクに分けて保存する
+type Attachment struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	TextChars   int       `json:"text_chars"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Ref は会話に残す添付ファイルの参照を返す
+func (a Attachment) Ref() AttachmentRef {
+	return AttachmentRef{ID: a.ID, Filename: a.Filename, ContentType: a.ContentType, Size: a.Size}
+}
+
+// AttachmentChunk は検索でヒットした添付ファイルのテキストの一部
+type AttachmentChunk struct {
+	AttachmentID string  `json:"attachment_id"`
+	Filename     string  `json:"filename"`
+	ChunkIndex   int     `json:"chunk_index"`
+	Content      string  `json:"content"`
+	Similarity   float64 `json:"similarity"`
+}
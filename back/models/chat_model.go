@@ -1,7 +1,10 @@
 package models
 
+// ChatRequest はJSONとmultipartのどちらでも受け付ける。multipartのファイルは "files" フィールドで送る
 type ChatRequest struct {
-    Message string `json:"message"`
+    Message       string   `json:"message" form:"message" binding:"required"`
+    UserID        string   `json:"user_id" form:"user_id" binding:"required"`
+    AttachmentIDs []string `json:"attachment_ids" form:"attachment_ids"`
 }
 
 type ChatResponse struct {
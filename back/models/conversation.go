@@ -5,9 +5,44 @@ import (
 )
 
 type Conversation struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Role      string    `json:"role"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
-} 
\ No newline at end of file
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	Citations []Citation `json:"citations,omitempty"`
+	// ToolCall は role が tool のメッセージで、どのツールをどの引数で呼んだか
+	ToolCall *ToolCall `json:"tool_call,omitempty"`
+	// Attachments はユーザーがメッセージに添付したファイル
+	Attachments []AttachmentRef `json:"attachments,omitempty"`
+	// Pinned はピン留めされ、保持期間を過ぎても削除しないメッセージ
+	Pinned bool `json:"pinned,omitempty"`
+	// ExpiresAt は保持期間によって削除される日時。期限がなければ nil
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PromptVersions はアシスタントのメッセージの生成に使ったプロンプトのバージョン
+	PromptVersions PromptVersions `json:"prompt_versions,omitempty"`
+	// Locale はメッセージの言語。要約をその言語で作るのに使う
+	Locale string `json:"locale,omitempty"`
+}
+
+// Citation はリサーチ結果の出典
+type Citation struct {
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url"`
+}
+
+// AttachmentRef はメッセージに添付したファイルの参照。内容は attachments テーブルにある
+type AttachmentRef struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// ToolCall はアシスタントによるツール呼び出しの記録。結果は Content に入る
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Error     string `json:"error,omitempty"`
+}
@@ -14,4 +14,16 @@ type ConversationSummary struct {
     StartTime time.Time      `json:"start_time"`
     EndTime   time.Time      `json:"end_time"`
     CreatedAt time.Time      `json:"created_at"`
+    // Level は要約の粒度 (window, daily, weekly, topic)
+    Level     string         `json:"level"`
+    // Topic は話題の要約のみ設定される話題の名前
+    Topic     string         `json:"topic,omitempty"`
+    // Pinned はピン留めされ、保持期間を過ぎても削除しない要約
+    Pinned    bool           `json:"pinned"`
+    // EmbeddingVersion は Vector を作った埋め込みのバージョン
+    EmbeddingVersion int     `json:"-"`
+    // SummaryVersion は Summary を作った要約の指示のバージョン
+    SummaryVersion int       `json:"-"`
+    // Similarity は類似検索時のみ設定されるコサイン類似度
+    Similarity float64       `json:"similarity,omitempty"`
 }
\ No newline at end of file
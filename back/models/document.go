@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// Document はナレッジベースに取り込んだ資料。本文はチャンクに分けて保存する
+type Document struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	Title       string    `json:"title"`
+	Source      string    `json:"source"`
+	ContentHash string    `json:"content_hash"`
+	Chars       int       `json:"chars"`
+	ChunkCount  int       `json:"chunk_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DocumentChunk は検索でヒットした資料の一部
+type DocumentChunk struct {
+	DocumentID string  `json:"document_id"`
+	Title      string  `json:"title"`
+	Source     string  `json:"source"`
+	ChunkIndex int     `json:"chunk_index"`
+	Content    string  `json:"content"`
+	Similarity float64 `json:"similarity"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// NotificationEndpoint は通知の送信先。Kind が webhook なら Target はURL、push ならデバイストークン
+type NotificationEndpoint struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Platform string `json:"platform,omitempty"`
+	// Secret は署名用の鍵。登録時のレスポンスでのみ返す
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationDelivery は送信先1つへのイベント1件の配信
+type NotificationDelivery struct {
+	ID            string          `json:"id"`
+	EndpointID    string          `json:"endpoint_id"`
+	UserID        string          `json:"user_id"`
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
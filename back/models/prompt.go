@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// PromptVersions はメッセージの生成に使ったプロンプトの名前とバージョン
+type PromptVersions map[string]int
+
+// PromptTemplateInfo はプロンプトのテンプレートと、既定で使うバージョン
+type PromptTemplateInfo struct {
+	Name           string `json:"name"`
+	Versions       []int  `json:"versions"`
+	DefaultVersion int    `json:"default_version"`
+	// Locales は既定のバージョンにある言語向けの版のロケール
+	Locales []string `json:"locales"`
+}
+
+// PromptSelection はユーザーに使うプロンプトのバージョンと、その決まり方
+type PromptSelection struct {
+	Prompt  string `json:"prompt"`
+	Version int    `json:"version"`
+	// Source は user (ユーザーごとの固定)、experiment (実験)、default (既定) のいずれか
+	Source string `json:"source"`
+	// Experiment は Source が experiment のときの実験の名前
+	Experiment string `json:"experiment,omitempty"`
+}
+
+// PromptExperiment はプロンプトの実験。ユーザーIDから決まる TrafficPercent の割合のユーザーに Version を使う
+type PromptExperiment struct {
+	Name           string    `json:"name"`
+	Prompt         string    `json:"prompt"`
+	Version        int       `json:"version"`
+	TrafficPercent int       `json:"traffic_percent"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Merge は other のバージョンを加えた PromptVersions を返す
+func (v PromptVersions) Merge(other PromptVersions) PromptVersions {
+	merged := make(PromptVersions, len(v)+len(other))
+	for name, version := range v {
+		merged[name] = version
+	}
+	for name, version := range other {
+		merged[name] = version
+	}
+	return merged
+}
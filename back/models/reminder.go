@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+type Reminder struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Message   string     `json:"message"`
+	DueAt     time.Time  `json:"due_at"`
+	Status    string     `json:"status"`
+	Source    string     `json:"source"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RetentionSettings はユーザーの保持期間の設定。日数が nil なら区分の設定を使う
+type RetentionSettings struct {
+	UserID      string `json:"user_id"`
+	Tier        string `json:"tier"`
+	MessageDays *int   `json:"message_days"`
+	SummaryDays *int   `json:"summary_days"`
+	// EffectiveMessageDays / EffectiveSummaryDays は区分の設定を反映した実際の日数。0なら期限なし
+	EffectiveMessageDays int       `json:"effective_message_days"`
+	EffectiveSummaryDays int       `json:"effective_summary_days"`
+	UpdatedAt            time.Time `json:"updated_at,omitempty"`
+}
+
+// RetentionAuditEntry は保持期間による削除の記録
+type RetentionAuditEntry struct {
+	ID        string          `json:"id"`
+	UserID    string          `json:"user_id"`
+	Action    string          `json:"action"`
+	TargetID  string          `json:"target_id,omitempty"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt time.Time       `json:"created_at"`
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// UserSettings はユーザーごとの設定。nil の項目は既定の値を使う
+type UserSettings struct {
+	UserID string `json:"user_id"`
+	// Locale はユーザーが選んだ言語。auto ならメッセージから判定した言語を使う
+	Locale string `json:"locale"`
+	// DetectedLocale は最後にメッセージから判定した言語
+	DetectedLocale string `json:"detected_locale,omitempty"`
+	// Persona はシステムプロンプトに加えるアシスタントの人格・指示。空なら加えない
+	Persona string `json:"persona"`
+	// Model はチャットに使うモデル。許可されたモデルから選ぶ
+	Model *string `json:"model"`
+	// Temperature は応答のランダムさ (0〜2)。nil ならモデルの既定
+	Temperature *float64 `json:"temperature"`
+	// HistoryWindow は応答の生成に送る直近のメッセージ数
+	HistoryWindow *int `json:"history_window"`
+	// MemoryEnabled が false なら過去の会話の要約や過去の添付ファイルを応答に使わない
+	MemoryEnabled bool `json:"memory_enabled"`
+	// SummarizationEnabled が false ならバッチで会話を要約しない
+	SummarizationEnabled bool `json:"summarization_enabled"`
+	// EffectiveLocale / EffectiveModel / EffectiveHistoryWindow は既定の値を反映した実際の値
+	EffectiveLocale        string    `json:"effective_locale"`
+	EffectiveModel         string    `json:"effective_model"`
+	EffectiveHistoryWindow int       `json:"effective_history_window"`
+	UpdatedAt              time.Time `json:"updated_at,omitempty"`
+}
+
+// UserSettingsUpdate はユーザーの設定の変更。省略した項目は変えず、Nullable の項目は null で既定に戻す
+type UserSettingsUpdate struct {
+	Locale               *string           `json:"locale"`
+	Persona              *string           `json:"persona"`
+	Model                Nullable[string]  `json:"model"`
+	Temperature          Nullable[float64] `json:"temperature"`
+	HistoryWindow        Nullable[int]     `json:"history_window"`
+	MemoryEnabled        *bool             `json:"memory_enabled"`
+	SummarizationEnabled *bool             `json:"summarization_enabled"`
+}
+
+// Nullable はJSONで項目の省略と null を区別する値。Set が false なら省略、Value が nil なら null
+type Nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+// UnmarshalJSON は項目があるときだけ呼ばれるので、Set を立てる
+func (n *Nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	n.Value = &v
+	return nil
+}
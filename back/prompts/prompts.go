@@ -0,0 +1,201 @@
+// Package prompts はモデルに送るプロンプトのテンプレート。
+// テンプレートは templates/<名前>/v<バージョン>.tmpl の text/template で、バイナリに埋め込んだものを
+// ディレクトリのファイルで上書き・追加できる。指示を変えるときは既存のファイルを書き換えず、新しいバージョンを足す。
+// v<バージョン>.<ロケール>.tmpl はその言語向けの版で、ない言語には v<バージョン>.tmpl を使う
+package prompts
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// プロンプトの名前
+const (
+	// ChatSystem はチャットのシステムプロンプト
+	ChatSystem = "chat_system"
+	// RAGContext は過去の会話の要約・添付ファイル・資料を添えたユーザーメッセージ
+	RAGContext = "rag_context"
+	// SummaryWindow は3時間ごとの会話の要約の指示
+	SummaryWindow = "summary_window"
+	// SummaryDaily, SummaryWeekly, SummaryTopic は要約をまとめる指示
+	SummaryDaily  = "summary_daily"
+	SummaryWeekly = "summary_weekly"
+	SummaryTopic  = "summary_topic"
+	// ResearchSystem はリサーチのシステムプロンプト
+	ResearchSystem = "research_system"
+	// ResearchQuery は話題ごとに最新の動向を尋ねるプロンプト
+	ResearchQuery = "research_query"
+	// ResearchTopics は要約から関心のある話題を抽出する指示
+	ResearchTopics = "research_topics"
+	// AttachmentImage は添付された画像を検索用のテキストに書き出させる指示
+	AttachmentImage = "attachment_image"
+)
+
+// ErrNotFound は指定した名前・バージョンのテンプレートがないことを表す
+var ErrNotFound = errors.New("prompt template not found")
+
+//go:embed templates
+var embedded embed.FS
+
+// Template はバージョン付きのプロンプトのテンプレート
+type Template struct {
+	Name    string
+	Version int
+	// Locale は言語向けの版のロケール。既定の版は空
+	Locale string
+	Source string
+	tmpl   *template.Template
+}
+
+// Render はテンプレートに data を埋め込む。前後の空白は取り除く
+func (t *Template) Render(data any) (string, error) {
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt %s v%d: %v", t.Name, t.Version, err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Registry は名前とバージョンからテンプレートを引く
+type Registry struct {
+	templates map[string]map[int]*Template
+	localized map[string]map[int]map[string]*Template
+}
+
+// Load は埋め込みのテンプレートを読み、dir が空でなければそのディレクトリのテンプレートで上書き・追加する
+func Load(dir string) (*Registry, error) {
+	r := &Registry{
+		templates: make(map[string]map[int]*Template),
+		localized: make(map[string]map[int]map[string]*Template),
+	}
+
+	sub, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if err := r.loadFS(sub); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := r.loadFS(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("failed to load prompt templates from %s: %v", dir, err)
+		}
+	}
+	for name, versions := range r.localized {
+		for version := range versions {
+			if _, ok := r.templates[name][version]; !ok {
+				return nil, fmt.Errorf("prompt %s v%d has localized templates but no v%d.tmpl", name, version, version)
+			}
+		}
+	}
+	return r, nil
+}
+
+// loadFS は <名前>/v<バージョン>[.<ロケール>].tmpl のファイルを読む。それ以外のファイルは無視する
+func (r *Registry) loadFS(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*/v*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := path.Dir(file)
+		base, locale, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(path.Base(file), "v"), ".tmpl"), ".")
+		version, err := strconv.Atoi(base)
+		if err != nil || version < 1 || strings.Contains(locale, ".") {
+			continue
+		}
+
+		source, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(file).Option("missingkey=error").Parse(string(source))
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+
+		t := &Template{Name: name, Version: version, Locale: locale, Source: string(source), tmpl: tmpl}
+		if locale != "" {
+			if r.localized[name] == nil {
+				r.localized[name] = make(map[int]map[string]*Template)
+			}
+			if r.localized[name][version] == nil {
+				r.localized[name][version] = make(map[string]*Template)
+			}
+			r.localized[name][version][locale] = t
+			continue
+		}
+		if r.templates[name] == nil {
+			r.templates[name] = make(map[int]*Template)
+		}
+		r.templates[name][version] = t
+	}
+	return nil
+}
+
+// Get は名前とバージョンのテンプレートを返す
+func (r *Registry) Get(name string, version int) (*Template, error) {
+	t, ok := r.templates[name][version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s v%d", ErrNotFound, name, version)
+	}
+	return t, nil
+}
+
+// GetLocalized は名前とバージョンのテンプレートのうち、locale 向けの版を返す。なければ既定の版を返す
+func (r *Registry) GetLocalized(name string, version int, locale string) (*Template, error) {
+	if t, ok := r.localized[name][version][locale]; ok {
+		return t, nil
+	}
+	return r.Get(name, version)
+}
+
+// Locales は名前とバージョンのテンプレートにある言語向けの版のロケールを辞書順に返す
+func (r *Registry) Locales(name string, version int) []string {
+	locales := make([]string, 0, len(r.localized[name][version]))
+	for locale := range r.localized[name][version] {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Latest は名前のテンプレートの最新のバージョンを返す。テンプレートがなければ 0
+func (r *Registry) Latest(name string) int {
+	latest := 0
+	for version := range r.templates[name] {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// Versions は名前のテンプレートのバージョンを古い順に返す
+func (r *Registry) Versions(name string) []int {
+	versions := make([]int, 0, len(r.templates[name]))
+	for version := range r.templates[name] {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Names はテンプレートの名前を辞書順に返す
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.templates))
+	for name := range r.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
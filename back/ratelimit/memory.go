@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// 何回の Take ごとに満杯のまま放置されたバケットを掃除するか
+const sweepInterval = 1024
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// refill は空から満杯に戻るまでの時間
+	refill time.Duration
+}
+
+// MemoryStore はプロセス内のトークンバケット。単一インスタンスでの運用向け
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+	now     func() time.Time
+}
+
+// NewMemoryStore コンストラクタ
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Take はキーのバケットからトークンを1つ消費する
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	return s.use(key, limit, true), nil
+}
+
+// Peek はトークンを消費せずに、Take したら許可されるかを返す
+func (s *MemoryStore) Peek(_ context.Context, key string, limit Limit) (Result, error) {
+	return s.use(key, limit, false), nil
+}
+
+func (s *MemoryStore) use(key string, limit Limit, consume bool) Result {
+	burst := float64(limit.burst())
+	perSecond := float64(limit.PerMinute) / 60
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.takes++
+	if s.takes%sweepInterval == 0 {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now, refill: secondsToDuration(burst / perSecond)}
+		s.buckets[key] = b
+	}
+
+	// 前回からの経過時間分だけ補充する
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	tokens := b.tokens
+	result := Result{Limit: int(burst)}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - tokens) / perSecond)
+	}
+	if consume {
+		b.tokens = tokens
+	}
+	result.Remaining = int(tokens)
+	result.ResetAfter = secondsToDuration((burst - tokens) / perSecond)
+
+	return result
+}
+
+// sweep は満杯に戻っているはずのバケットを削除してメモリを解放する
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) > b.refill {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeClock は MemoryStore の now を差し替えて時間を進める
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore()
+	s.now = clock.Now
+	return s, clock
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	// 1秒に1トークン補充、最大3トークン
+	limit := Limit{PerMinute: 60, Burst: 3}
+
+	type step struct {
+		advance    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		resetAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{
+			name:  "burst exhaustion",
+			limit: limit,
+			steps: []step{
+				{allowed: true, remaining: 2, resetAfter: time.Second},
+				{allowed: true, remaining: 1, resetAfter: 2 * time.Second},
+				{allowed: true, remaining: 0, resetAfter: 3 * time.Second},
+				{allowed: false, remaining: 0, retryAfter: time.Second, resetAfter: 3 * time.Second},
+			},
+		},
+		{
+			name:  "refill over time",
+			limit: limit,
+			steps: []step{
+				{allowed: true, remaining: 2, resetAfter: time.Second},
+				{allowed: true, remaining: 1, resetAfter: 2 * time.Second},
+				{allowed: true, remaining: 0, resetAfter: 3 * time.Second},
+				{advance: 500 * time.Millisecond, allowed: false, remaining: 0, retryAfter: 500 * time.Millisecond, resetAfter: 2500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, allowed: true, remaining: 0, resetAfter: 3 * time.Second},
+				{advance: 2 * time.Second, allowed: true, remaining: 1, resetAfter: 2 * time.Second},
+			},
+		},
+		{
+			name:  "refill is capped at burst",
+			limit: limit,
+			steps: []step{
+				{allowed: true, remaining: 2, resetAfter: time.Second},
+				{advance: time.Hour, allowed: true, remaining: 2, resetAfter: time.Second},
+			},
+		},
+		{
+			name:  "burst defaults to per minute",
+			limit: Limit{PerMinute: 2},
+			steps: []step{
+				{allowed: true, remaining: 1, resetAfter: 30 * time.Second},
+				{allowed: true, remaining: 0, resetAfter: time.Minute},
+				{allowed: false, remaining: 0, retryAfter: 30 * time.Second, resetAfter: time.Minute},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, clock := newTestStore()
+			for i, st := range tt.steps {
+				clock.Advance(st.advance)
+				got, err := s.Take(context.Background(), "key", tt.limit)
+				if err != nil {
+					t.Fatalf("step %d: Take returned error: %v", i, err)
+				}
+				want := Result{
+					Allowed:    st.allowed,
+					Limit:      tt.limit.burst(),
+					Remaining:  st.remaining,
+					RetryAfter: st.retryAfter,
+					ResetAfter: st.resetAfter,
+				}
+				if got != want {
+					t.Errorf("step %d: got %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreKeysAreIndependent(t *testing.T) {
+	s, _ := newTestStore()
+	limit := Limit{PerMinute: 60, Burst: 1}
+
+	if r, _ := s.Take(context.Background(), "a", limit); !r.Allowed {
+		t.Fatal("first take for a was rejected")
+	}
+	if r, _ := s.Take(context.Background(), "a", limit); r.Allowed {
+		t.Fatal("second take for a was allowed")
+	}
+	if r, _ := s.Take(context.Background(), "b", limit); !r.Allowed {
+		t.Fatal("take for b was rejected after a was exhausted")
+	}
+}
+
+func TestMemoryStorePeekDoesNotConsume(t *testing.T) {
+	s, _ := newTestStore()
+	limit := Limit{PerMinute: 60, Burst: 1}
+
+	for i := 0; i < 3; i++ {
+		r, err := s.Peek(context.Background(), "key", limit)
+		if err != nil {
+			t.Fatalf("Peek returned error: %v", err)
+		}
+		if !r.Allowed || r.Remaining != 0 {
+			t.Fatalf("peek %d: got %+v, want allowed with 0 remaining", i, r)
+		}
+	}
+	if r, _ := s.Take(context.Background(), "key", limit); !r.Allowed {
+		t.Fatal("take after peeks was rejected")
+	}
+	if r, _ := s.Peek(context.Background(), "key", limit); r.Allowed || r.RetryAfter != time.Second {
+		t.Fatalf("peek after take: got %+v, want rejected with 1s retry", r)
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s, clock := newTestStore()
+	// 満杯に戻るまで3秒
+	limit := Limit{PerMinute: 60, Burst: 3}
+
+	s.Take(context.Background(), "stale", limit)
+	clock.Advance(2 * time.Second)
+	s.Take(context.Background(), "fresh", limit)
+	clock.Advance(2 * time.Second)
+
+	s.sweep(clock.Now())
+	if _, ok := s.buckets["stale"]; ok {
+		t.Error("bucket idle longer than its refill time was not evicted")
+	}
+	if _, ok := s.buckets["fresh"]; !ok {
+		t.Error("bucket still refilling was evicted")
+	}
+}
+
+func TestMemoryStoreSweepsEveryInterval(t *testing.T) {
+	s, clock := newTestStore()
+	limit := Limit{PerMinute: 60, Burst: 1}
+
+	s.Take(context.Background(), "stale", limit)
+	clock.Advance(time.Minute)
+	for i := 1; i < sweepInterval-1; i++ {
+		s.Take(context.Background(), "other", limit)
+	}
+	if _, ok := s.buckets["stale"]; !ok {
+		t.Fatal("bucket was evicted before the sweep interval")
+	}
+
+	s.Take(context.Background(), "other", limit)
+	if _, ok := s.buckets["stale"]; ok {
+		t.Error("stale bucket was not evicted on the sweep interval")
+	}
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit はトークンバケットの設定。PerMinute が0以下なら無制限
+type Limit struct {
+	PerMinute int
+	Burst     int
+}
+
+// Enabled は制限が有効かを返す
+func (l Limit) Enabled() bool {
+	return l.PerMinute > 0
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.PerMinute
+}
+
+// Result は1回の消費の結果
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter は拒否時に次のトークンが貯まるまでの時間
+	RetryAfter time.Duration
+	// ResetAfter はバケットが満杯に戻るまでの時間
+	ResetAfter time.Duration
+}
+
+// Store はトークンバケットの状態を保持する。
+// 複数インスタンスで制限を共有する場合は、Redis等でこのインターフェースを実装して差し替える
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+	// Peek はトークンを消費せずに、Take したら許可されるかを返す
+	Peek(ctx context.Context, key string, limit Limit) (Result, error)
+}
@@ -0,0 +1,96 @@
+// Package realtime はWebSocket接続へ新着メッセージを知らせるためのプロセス内のハブ
+package realtime
+
+import (
+	"sync"
+	"time"
+)
+
+// Ack はクライアントが受信を確認した最後のメッセージ
+type Ack struct {
+	MessageID string
+	Timestamp time.Time
+}
+
+// Hub はユーザーごとの接続の購読と、受信確認の位置を管理する。
+// 通知は「新着がある」ことだけを伝え、内容は各接続が会話ストアから読み直す
+type Hub struct {
+	mu    sync.Mutex
+	subs  map[string]map[chan struct{}]struct{}
+	acked map[string]Ack
+	acks  int
+}
+
+// ackRetention を過ぎた受信確認は捨てる。それより長く切断していたクライアントは lastMessageId で再開する
+const ackRetention = 24 * time.Hour
+
+// NewHub コンストラクタ
+func NewHub() *Hub {
+	return &Hub{
+		subs:  make(map[string]map[chan struct{}]struct{}),
+		acked: make(map[string]Ack),
+	}
+}
+
+// Subscribe はユーザーの新着通知を受け取るチャネルと、購読をやめる関数を返す。
+// 通知は合流するので、受け取ったら新着をまとめて読めばよい
+func (h *Hub) Subscribe(userID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan struct{}]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+	}
+}
+
+// Notify はユーザーの全接続に新着を知らせる
+func (h *Hub) Notify(userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Acknowledge は受信確認の位置を進める。古い確認では戻さない
+func (h *Hub) Acknowledge(userID string, ack Ack) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if current, ok := h.acked[userID]; ok && !ack.Timestamp.After(current.Timestamp) {
+		return
+	}
+	h.acked[userID] = ack
+
+	// 接続しなくなったユーザーの分が溜まらないよう、ときどき掃除する
+	if h.acks++; h.acks%1024 == 0 {
+		cutoff := time.Now().Add(-ackRetention)
+		for id, a := range h.acked {
+			if a.Timestamp.Before(cutoff) {
+				delete(h.acked, id)
+			}
+		}
+	}
+}
+
+// LastAck は再接続時に lastMessageId が指定されなかった場合の再開位置を返す。
+// プロセス内にしか保持しないので、再起動や別インスタンスへの接続では見つからない
+func (h *Hub) LastAck(userID string) (Ack, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ack, ok := h.acked[userID]
+	return ack, ok
+}
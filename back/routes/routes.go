@@ -1,24 +1,114 @@
 package routes
 
 import (
+    "back/app"
+    "back/config"
     "back/controllers"
+    "back/middlewares"
+    "fmt"
 
     "github.com/gin-gonic/gin"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func SetupRouter() *gin.Engine {
-    r := gin.Default()
+func SetupRouter(container *app.Container) (*gin.Engine, error) {
+    r := gin.New()
 
-    // チャットメッセージ送信
-    r.POST("/chat", controllers.HandleChat)
+    // レート制限のIP単位の制限を X-Forwarded-For で回避されないように、信頼するプロキシを限定する
+    if err := r.SetTrustedProxies(config.GetTrustedProxies()); err != nil {
+        return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+    }
+
+    // ルート登録より前にミドルウェアを設定する
+    r.Use(gin.Recovery())
+    // プリフライトはレート制限やログより前に応答する
+    r.Use(middlewares.CORS())
+    r.Use(middlewares.RequestID())
+    r.Use(middlewares.Tracing())
+    r.Use(middlewares.Logger())
+    r.Use(middlewares.Metrics())
+
+    chat := controllers.NewChatController(container.Chat, container.Conversations, container.RAG, container.Research, container.Usage, container.Attachments, container.Retention, container.Settings)
+    attachments := controllers.NewAttachmentController(container.Attachments, container.Usage)
+    documents := controllers.NewDocumentController(container.Documents, container.Usage)
+    memories := controllers.NewMemoryController(container.Retention)
+    prompts := controllers.NewPromptController(container.Prompts)
+    settings := controllers.NewSettingsController(container.Settings)
+    usage := controllers.NewUsageController(container.Usage)
+    reminders := controllers.NewReminderController(container.Reminders)
+    notifications := controllers.NewNotificationController(container.Notifications)
+    socket := controllers.NewChatSocketController(chat, container.Conversations, container.Realtime, container.RateLimits)
+
+    // 本文の上限はレート制限が multipart を読むより前に掛ける
+    bodyLimit := middlewares.MaxBodySize(config.GetAttachmentMaxRequestBytes())
+
+    // チャットメッセージ送信(JSON、またはファイルを添付する場合は multipart)
+    r.POST("/chat", bodyLimit, middlewares.RateLimit(container.RateLimits, "chat"), chat.HandleChat)
 
     // メッセージのフラグ更新
-    r.POST("/chat/update-flag", controllers.UpdateMessageFlag)
+    r.POST("/chat/update-flag", chat.UpdateMessageFlag)
 
     // 過去の会話を取得
-    r.GET("/chat/conversations", controllers.GetConversations)
+    r.GET("/chat/conversations", chat.GetConversations)
+
+    // WebSocketでのチャットとサーバーからのメッセージ配信
+    r.GET("/ws/chat", socket.HandleWebSocket)
+
+    r.GET("/chat/research-ai", middlewares.RateLimit(container.RateLimits, "research"), chat.HandleResearchAI)
+
+    // 添付ファイル
+    r.POST("/attachments", bodyLimit, middlewares.RateLimit(container.RateLimits, "attachments"), attachments.UploadAttachment)
+    r.GET("/attachments/:id", attachments.GetAttachment)
+    r.GET("/attachments/:id/content", attachments.GetAttachmentContent)
+
+    // 要約(記憶)の一覧とピン留め
+    r.GET("/memories", memories.ListMemories)
+    r.PUT("/memories/:id/pin", memories.PinMemory)
+
+    // ナレッジベースの資料
+    r.GET("/documents", documents.ListDocuments)
+    r.POST("/documents", middlewares.MaxBodySize(config.GetDocumentMaxBytes()+1<<20), middlewares.RateLimit(container.RateLimits, "documents"), documents.IngestDocument)
+    r.GET("/documents/:id", documents.GetDocument)
+    r.DELETE("/documents/:id", documents.DeleteDocument)
+
+    // リマインダー
+    r.GET("/reminders", reminders.ListReminders)
+    r.POST("/reminders", reminders.CreateReminder)
+    r.PATCH("/reminders/:id", reminders.UpdateReminder)
+    r.DELETE("/reminders/:id", reminders.DeleteReminder)
+
+    // 通知の送信先(Webhook / プッシュ通知)
+    r.GET("/notifications/endpoints", notifications.ListEndpoints)
+    r.POST("/notifications/endpoints", notifications.RegisterEndpoint)
+    r.DELETE("/notifications/endpoints/:id", notifications.DeleteEndpoint)
+
+    // ユーザーの設定(言語・人格・モデル・記憶の利用など)
+    r.GET("/users/me/settings", settings.GetSettings)
+    r.PUT("/users/me/settings", settings.UpdateSettings)
+
+    // トークン使用量
+    r.GET("/usage", usage.GetUsage)
+
+    // 管理者向け
+    admin := r.Group("/admin", middlewares.AdminAuth())
+    admin.GET("/usage", usage.AdminUsageReport)
+    admin.GET("/notifications/dead-letters", notifications.AdminDeadLetters)
+    admin.POST("/notifications/dead-letters/:id/retry", notifications.AdminRetryDeadLetter)
+    admin.GET("/retention/users/:userId", memories.AdminGetRetention)
+    admin.PUT("/retention/users/:userId", memories.AdminUpdateRetention)
+    admin.GET("/retention/audit", memories.AdminRetentionAudit)
+    admin.GET("/prompts", prompts.AdminListPrompts)
+    admin.GET("/prompts/users/:userId", prompts.AdminGetUserPrompts)
+    admin.PUT("/prompts/users/:userId", prompts.AdminUpdateUserPrompt)
+    admin.PUT("/prompts/experiments/:name", prompts.AdminSaveExperiment)
+    admin.DELETE("/prompts/experiments/:name", prompts.AdminDeleteExperiment)
+
+    // ヘルスチェック
+    r.GET("/healthz", controllers.Healthz)
+    r.GET("/readyz", controllers.Readyz(container.Health))
 
-    r.GET("/chat/research-ai", controllers.HandleResearchAI)
+    // Prometheus メトリクス
+    r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-    return r
+    return r, nil
 }
@@ -0,0 +1,422 @@
+package services
+
+import (
+	"back/blob"
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/ledongthuc/pdf"
+	"github.com/lib/pq"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 添付ファイルの処理状態
+const (
+	AttachmentProcessing = "processing"
+	AttachmentReady      = "ready"
+	AttachmentFailed     = "failed"
+)
+
+const (
+	// maxAttachmentFilenameRunes はファイル名の最大文字数
+	maxAttachmentFilenameRunes = 255
+	// maxAttachmentErrorRunes は保存する処理エラーの最大文字数
+	maxAttachmentErrorRunes = 500
+)
+
+// attachmentTypes は受け付けるファイルの拡張子と Content-Type
+var attachmentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".csv":  "text/csv",
+	".json": "application/json",
+}
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrInvalidAttachment はサイズや種類が受け付けられないファイルであることを表す
+	ErrInvalidAttachment = errors.New("invalid attachment")
+)
+
+const attachmentColumns = `id, user_id, filename, content_type, size, status, COALESCE(error, ''), text_chars, created_at`
+
+// AttachmentService は添付ファイルの保存と、テキストの抽出・チャンク分割・埋め込みを行う。
+// 画像はモデルに説明させたテキストを、PDFとテキストファイルは本文を検索対象にする
+type AttachmentService struct {
+	db       *sql.DB
+	blobs    blob.Store
+	usage    *UsageService
+	prompts  *PromptService
+	settings *SettingsService
+}
+
+// NewAttachmentService コンストラクタ
+func NewAttachmentService(db *sql.DB, blobs blob.Store, usage *UsageService, prompts *PromptService, settings *SettingsService) *AttachmentService {
+	return &AttachmentService{db: db, blobs: blobs, usage: usage, prompts: prompts, settings: settings}
+}
+
+// Upload はファイルを保存し、テキストを抽出して検索できるようにする。
+// 抽出や埋め込みに失敗してもファイル自体は保存し、status を failed にして返す
+func (as *AttachmentService) Upload(ctx context.Context, userID, filename string, r io.Reader) (_ models.Attachment, err error) {
+	ctx, span := tracing.Start(ctx, "AttachmentService.Upload", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	maxBytes := config.GetAttachmentMaxBytes()
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("failed to read attachment: %v", err)
+	}
+	if len(data) == 0 {
+		return models.Attachment{}, fmt.Errorf("%w: file is empty", ErrInvalidAttachment)
+	}
+	if int64(len(data)) > maxBytes {
+		return models.Attachment{}, fmt.Errorf("%w: file must be at most %d bytes", ErrInvalidAttachment, maxBytes)
+	}
+
+	filename = sanitizeFilename(filename)
+	contentType, err := detectAttachmentType(filename, data)
+	if err != nil {
+		return models.Attachment{}, err
+	}
+	span.SetAttributes(attribute.String("attachment.content_type", contentType), attribute.Int("attachment.size", len(data)))
+
+	attachment := models.Attachment{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Status:      AttachmentProcessing,
+		CreatedAt:   time.Now().UTC(),
+	}
+	key := attachmentBlobKey(attachment.ID)
+
+	if err := as.blobs.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		return models.Attachment{}, fmt.Errorf("failed to store attachment: %v", err)
+	}
+
+	storeCtx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	_, err = as.db.ExecContext(storeCtx, `
+        INSERT INTO attachments (id, user_id, filename, content_type, size, blob_key, status, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `, attachment.ID, userID, attachment.Filename, contentType, attachment.Size, key, AttachmentProcessing, attachment.CreatedAt)
+	cancel()
+	if err != nil {
+		if delErr := as.blobs.Delete(context.WithoutCancel(ctx), key); delErr != nil {
+			slog.WarnContext(ctx, "Failed to delete orphaned attachment blob", "key", key, "error", delErr)
+		}
+		return models.Attachment{}, fmt.Errorf("failed to save attachment: %v", err)
+	}
+
+	processCtx, cancel := context.WithTimeout(ctx, config.GetAttachmentProcessTimeout())
+	chars, indexErr := as.index(processCtx, attachment, data)
+	cancel()
+
+	attachment.Status, attachment.TextChars = AttachmentReady, chars
+	if indexErr != nil {
+		attachment.Status, attachment.Error = AttachmentFailed, truncateRunes(indexErr.Error(), maxAttachmentErrorRunes)
+		slog.WarnContext(ctx, "Failed to index attachment", "attachment_id", attachment.ID, "content_type", contentType, "error", indexErr)
+	}
+	metrics.AttachmentsProcessed.WithLabelValues(attachmentKind(contentType), attachment.Status).Inc()
+
+	// 呼び出し元がキャンセルされても、処理結果は残す
+	storeCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), config.GetStorageTimeout())
+	defer cancel()
+	_, err = as.db.ExecContext(storeCtx, `
+        UPDATE attachments SET status = $2, error = NULLIF($3, ''), text_chars = $4 WHERE id = $1
+    `, attachment.ID, attachment.Status, attachment.Error, attachment.TextChars)
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("failed to update attachment: %v", err)
+	}
+
+	return attachment, nil
+}
+
+// index はテキストを抽出し、チャンクに分けて埋め込みを保存する。抽出した文字数を返す
+func (as *AttachmentService) index(ctx context.Context, attachment models.Attachment, data []byte) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "AttachmentService.index", attribute.String("attachment.id", attachment.ID))
+	defer func() { tracing.End(span, err) }()
+
+	text, err := as.extractText(ctx, attachment, data)
+	if err != nil {
+		return 0, err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, fmt.Errorf("no text could be extracted")
+	}
+
+	chunks := chunkText(text, chunkRunes, chunkOverlapRunes)
+	if max := config.GetAttachmentMaxChunks(); len(chunks) > max {
+		slog.InfoContext(ctx, "Attachment truncated for indexing", "attachment_id", attachment.ID, "chunks", len(chunks), "max_chunks", max)
+		chunks = chunks[:max]
+	}
+
+	vectors, err := embedTexts(ctx, as.usage, attachment.UserID, FeatureAttachment, chunks)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO attachment_chunks (attachment_id, user_id, chunk_index, content, vector, embedding_model, embedding_version)
+        VALUES ($1, $2, $3, $4, $5::float8[], $6, $7)
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare chunk insert: %v", err)
+	}
+	defer stmt.Close()
+
+	model, version := embeddingModel(), embeddingVersion()
+	for i, chunk := range chunks {
+		if _, err := stmt.ExecContext(ctx, attachment.ID, attachment.UserID, i, chunk, pq.Float64Array(vectors[i]), model, version); err != nil {
+			return 0, fmt.Errorf("failed to save chunk: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit chunks: %v", err)
+	}
+
+	return utf8.RuneCountInString(text), nil
+}
+
+// extractText は種類に応じてテキストを取り出す
+func (as *AttachmentService) extractText(ctx context.Context, attachment models.Attachment, data []byte) (string, error) {
+	switch {
+	case strings.HasPrefix(attachment.ContentType, "image/"):
+		return as.describeImage(ctx, attachment, data)
+	case attachment.ContentType == "application/pdf":
+		return extractPDFText(data)
+	default:
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("text file is not valid UTF-8")
+		}
+		return string(data), nil
+	}
+}
+
+// describeImage は画像の内容と画像中の文字を、ユーザーの言語でモデルにテキストで書き出させる
+func (as *AttachmentService) describeImage(ctx context.Context, attachment models.Attachment, data []byte) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "AttachmentService.describeImage", attribute.String("llm.model", chatModel))
+	defer func() { tracing.End(span, err) }()
+
+	locale := as.settings.Locale(ctx, attachment.UserID)
+	instruction, _, err := as.prompts.Render(ctx, attachment.UserID, prompts.AttachmentImage, locale, nil)
+	if err != nil {
+		return "", err
+	}
+
+	dataURL := "data:" + attachment.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+
+	start := time.Now()
+	resp, err := newOpenAIClient().CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: chatModel,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role: openai.ChatMessageRoleUser,
+				MultiContent: []openai.ChatMessagePart{
+					{
+						Type: openai.ChatMessagePartTypeText,
+						Text: instruction,
+					},
+					{
+						Type:     openai.ChatMessagePartTypeImageURL,
+						ImageURL: &openai.ChatMessageImageURL{URL: dataURL, Detail: openai.ImageURLDetailAuto},
+					},
+				},
+			},
+		},
+	})
+	observeProviderCall(ProviderOpenAI, chatModel, "image_description", start, err, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if err != nil {
+		return "", fmt.Errorf("image description failed: %w", err)
+	}
+	as.usage.Record(ctx, UsageRecord{
+		UserID:           attachment.UserID,
+		Feature:          FeatureAttachment,
+		Provider:         ProviderOpenAI,
+		Model:            chatModel,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("OpenAI API returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// extractPDFText はPDFのテキストレイヤーを取り出す。スキャン画像だけのPDFからは取り出せない
+func extractPDFText(data []byte) (_ string, err error) {
+	// 壊れたPDFでライブラリが panic することがあるので、エラーとして扱う
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to parse PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse PDF: %v", err)
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract PDF text: %v", err)
+	}
+
+	var text bytes.Buffer
+	if _, err := text.ReadFrom(plain); err != nil {
+		return "", fmt.Errorf("failed to extract PDF text: %v", err)
+	}
+	return strings.ToValidUTF8(text.String(), ""), nil
+}
+
+// Get はユーザーの添付ファイルの情報を返す
+func (as *AttachmentService) Get(ctx context.Context, userID, id string) (_ models.Attachment, err error) {
+	ctx, span := tracing.Start(ctx, "AttachmentService.Get", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return models.Attachment{}, ErrAttachmentNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	row := as.db.QueryRowContext(ctx, `
+        SELECT `+attachmentColumns+` FROM attachments WHERE id = $1 AND user_id = $2
+    `, id, userID)
+	attachment, err := scanAttachment(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Attachment{}, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return models.Attachment{}, fmt.Errorf("failed to get attachment: %v", err)
+	}
+	return attachment, nil
+}
+
+// Resolve は指定したIDの添付ファイルを順に返す。1つでもなければ ErrAttachmentNotFound
+func (as *AttachmentService) Resolve(ctx context.Context, userID string, ids []string) ([]models.Attachment, error) {
+	attachments := make([]models.Attachment, 0, len(ids))
+	for _, id := range ids {
+		attachment, err := as.Get(ctx, userID, id)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// Open は添付ファイルの本体を開く。呼び出し元が Close すること
+func (as *AttachmentService) Open(ctx context.Context, userID, id string) (models.Attachment, io.ReadCloser, error) {
+	attachment, err := as.Get(ctx, userID, id)
+	if err != nil {
+		return models.Attachment{}, nil, err
+	}
+
+	body, err := as.blobs.Get(ctx, attachmentBlobKey(attachment.ID))
+	if errors.Is(err, blob.ErrNotFound) {
+		return models.Attachment{}, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return models.Attachment{}, nil, err
+	}
+	return attachment, body, nil
+}
+
+func attachmentBlobKey(id string) string {
+	return "attachments/" + id
+}
+
+// sanitizeFilename はパスを除いたファイル名を返す
+func sanitizeFilename(filename string) string {
+	filename = strings.TrimSpace(filepath.Base(strings.ReplaceAll(filename, "\\", "/")))
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+	if filename == "" || filename == "." || filename == "/" {
+		return "attachment"
+	}
+	if runes := []rune(filename); len(runes) > maxAttachmentFilenameRunes {
+		filename = string(runes[:maxAttachmentFilenameRunes])
+	}
+	return filename
+}
+
+// detectAttachmentType は内容から種類を判定する。クライアントの申告は信用せず、
+// テキストと判定された場合だけ拡張子で markdown/csv/json を区別する
+func detectAttachmentType(filename string, data []byte) (string, error) {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	byExt := attachmentTypes[strings.ToLower(filepath.Ext(filename))]
+
+	switch {
+	case strings.HasPrefix(sniffed, "image/") || sniffed == "application/pdf":
+		for _, allowed := range attachmentTypes {
+			if allowed == sniffed {
+				return sniffed, nil
+			}
+		}
+	case sniffed == "text/plain":
+		if strings.HasPrefix(byExt, "text/") || byExt == "application/json" {
+			return byExt, nil
+		}
+		return "text/plain", nil
+	}
+
+	return "", fmt.Errorf("%w: only images (png, jpeg, gif, webp), PDF and text files are supported", ErrInvalidAttachment)
+}
+
+// attachmentKind はメトリクス用の大まかな種類
+func attachmentKind(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case contentType == "application/pdf":
+		return "pdf"
+	default:
+		return "text"
+	}
+}
+
+func scanAttachment(row rowScanner) (models.Attachment, error) {
+	var a models.Attachment
+	if err := row.Scan(&a.ID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.Status, &a.Error, &a.TextChars, &a.CreatedAt); err != nil {
+		return models.Attachment{}, err
+	}
+	return a, nil
+}
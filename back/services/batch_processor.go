@@ -1,139 +1,223 @@
 package services
 
 import (
+	"back/config"
+	"back/i18n"
+	"back/metrics"
 	"back/models"
+	"back/prompts"
+	"back/tracing"
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
-	"strings"
+	"log/slog"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/lib/pq"
-	_ "github.com/lib/pq"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type BatchProcessor struct {
-	postgresDB *sql.DB
-	dynamoDB   *dynamodb.Client
+	postgresDB    *sql.DB
+	conversations *ConversationStore
+	usage         *UsageService
+	events        *EventBus
+	retention     *RetentionService
+	prompts       *PromptService
+	settings      *SettingsService
+	shutdownGrace time.Duration
+
+	statusMu sync.Mutex
+	status   BatchStatus
 }
 
-func NewBatchProcessor(postgresURI string, dynamoClient *dynamodb.Client) (*BatchProcessor, error) {
-	connStr := postgresURI
-	if !strings.Contains(postgresURI, "sslmode=") {
-		if strings.Contains(postgresURI, "?") {
-			connStr += "&sslmode=disable"
-		} else {
-			connStr += "?sslmode=disable"
-		}
-	}
+// BatchStatus はバッチの直近の実行状況
+type BatchStatus struct {
+	Running       bool      `json:"running"`
+	StartedAt     time.Time `json:"started_at,omitempty"`
+	LastRunAt     time.Time `json:"last_run_at"`
+	LastSuccessAt time.Time `json:"last_success_at"`
+	LastError     string    `json:"last_error,omitempty"`
+}
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+func NewBatchProcessor(db *sql.DB, conversations *ConversationStore, usage *UsageService, events *EventBus, retention *RetentionService, prompts *PromptService, settings *SettingsService) *BatchProcessor {
+	return &BatchProcessor{
+		postgresDB:    db,
+		conversations: conversations,
+		usage:         usage,
+		events:        events,
+		retention:     retention,
+		prompts:       prompts,
+		settings:      settings,
+		shutdownGrace: config.GetShutdownGracePeriod(),
 	}
+}
 
-	// 接続テスト
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Status は直近の実行状況を返す
+func (bp *BatchProcessor) Status() BatchStatus {
+	bp.statusMu.Lock()
+	defer bp.statusMu.Unlock()
+	return bp.status
+}
 
-	if err := db.PingContext(ctx); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to ping postgres: %v", err)
-	}
+func (bp *BatchProcessor) recordRun(start time.Time, err error) {
+	bp.statusMu.Lock()
+	defer bp.statusMu.Unlock()
 
-	return &BatchProcessor{
-		postgresDB: db,
-		dynamoDB:   dynamoClient,
-	}, nil
+	bp.status.Running = false
+	bp.status.LastRunAt = start
+	if err != nil {
+		bp.status.LastError = err.Error()
+		return
+	}
+	bp.status.LastSuccessAt = start
+	bp.status.LastError = ""
 }
 
-// ProcessConversations は会話データの処理メインロジック
-func (bp *BatchProcessor) ProcessConversations() error {
+// ProcessConversations は会話データの処理メインロジック。
+// ctx がキャンセルされると新しいユーザーの処理は始めず、処理中のユーザーは猶予期間内で完了させる
+func (bp *BatchProcessor) ProcessConversations(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.ProcessConversations")
+	defer func() { tracing.End(span, err) }()
+
 	now := time.Now()
 	threeHoursAgo := now.Add(-3 * time.Hour)
 
+	bp.statusMu.Lock()
+	bp.status.Running = true
+	bp.status.StartedAt = now
+	bp.statusMu.Unlock()
+
+	defer func() {
+		bp.recordRun(now, err)
+		metrics.BatchRunDuration.Observe(time.Since(now).Seconds())
+		if err != nil {
+			metrics.BatchRuns.WithLabelValues("failure").Inc()
+			return
+		}
+		metrics.BatchRuns.WithLabelValues("success").Inc()
+		metrics.BatchLastSuccess.SetToCurrentTime()
+	}()
+
 	// アクティブユーザーを取得
-	users, err := bp.getActiveUsers(threeHoursAgo)
+	users, err := bp.conversations.GetActiveUsers(ctx, threeHoursAgo)
 	if err != nil {
 		return fmt.Errorf("failed to get active users: %v", err)
 	}
 
 	for _, userID := range users {
-		// 各ユーザーの会話を期間で取得
-		conversations, err := bp.getConversationsInPeriod(userID, threeHoursAgo, now)
-		if err != nil {
-			log.Printf("Error getting conversations for user %s: %v", userID, err)
-			continue
+		// キャンセルされたら残りのユーザーは次回に回す
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		if len(conversations) == 0 {
-			log.Printf("No conversations found for user %s", userID)
-			continue
+		processed, err := bp.processUser(ctx, userID, threeHoursAgo, now)
+		switch {
+		case err != nil:
+			metrics.BatchUsers.WithLabelValues("failed").Inc()
+			slog.ErrorContext(ctx, "Error processing conversations", "user_id", userID, "error", err)
+		case processed:
+			metrics.BatchUsers.WithLabelValues("processed").Inc()
+		default:
+			metrics.BatchUsers.WithLabelValues("skipped").Inc()
 		}
+	}
 
-		// 要約処理以下は変更なし
-		summary, err := bp.summarizeConversations(conversations)
-		if err != nil {
-			log.Printf("Error summarizing conversations for user %s: %v", userID, err)
-			continue
-		}
+	return nil
+}
 
-		vector, err := bp.vectorizeText(summary)
-		if err != nil {
-			log.Printf("Error vectorizing text for user %s: %v", userID, err)
-			continue
-		}
+// processUser は1ユーザー分の会話を要約・ベクトル化して保存する。会話がないか、ユーザーが要約を止めていれば false を返す
+func (bp *BatchProcessor) processUser(ctx context.Context, userID string, start, end time.Time) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.processUser", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
 
-		err = bp.saveToPostgres(userID, summary, vector, threeHoursAgo, now)
-		if err != nil {
-			log.Printf("Error saving to postgres for user %s: %v", userID, err)
-			continue
-		}
+	ctx, cancel := bp.drainContext(ctx, config.GetBatchUserTimeout())
+	defer cancel()
 
-		log.Printf("Successfully processed conversations for user %s", userID)
+	// 各ユーザーの会話を期間で取得
+	conversations, err := bp.conversations.GetConversationsInPeriod(ctx, userID, start, end)
+	if err != nil {
+		return false, fmt.Errorf("failed to get conversations: %w", err)
 	}
 
-	return nil
-}
+	if len(conversations) == 0 {
+		slog.InfoContext(ctx, "No conversations found", "user_id", userID)
+		return false, nil
+	}
+
+	settings, err := bp.settings.Settings(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if !settings.SummarizationEnabled {
+		// 要約しなくても、メッセージは保持期間に従って削除する
+		if err := bp.scheduleMessageExpiry(ctx, userID, conversations, start, end); err != nil {
+			slog.WarnContext(ctx, "Failed to schedule message expiry", "user_id", userID, "error", err)
+		}
+		slog.InfoContext(ctx, "Summarization disabled by user", "user_id", userID)
+		return false, nil
+	}
 
-func (bp *BatchProcessor) getActiveUsers(since time.Time) ([]string, error) {
-	sinceStr := since.Format(time.RFC3339)
+	summary, summaryVersion, err := bp.summarizeConversations(ctx, userID, conversations)
+	if err != nil {
+		return false, fmt.Errorf("failed to summarize conversations: %w", err)
+	}
 
-	// Scanを使用してアクティブユーザーを取得
-	result, err := bp.dynamoDB.Scan(context.TODO(), &dynamodb.ScanInput{
-		TableName:        aws.String("Conversations"),
-		FilterExpression: aws.String("#ts >= :ts"),
-		ExpressionAttributeNames: map[string]string{
-			"#ts": "Timestamp",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":ts": &types.AttributeValueMemberS{Value: sinceStr},
-		},
-	})
+	vector, err := bp.vectorizeText(ctx, userID, summary)
 	if err != nil {
-		return nil, fmt.Errorf("failed to scan DynamoDB: %v", err)
+		return false, fmt.Errorf("failed to vectorize text: %w", err)
 	}
 
-	// ユニークなユーザーIDを収集
-	userMap := make(map[string]bool)
-	for _, item := range result.Items {
-		if userID, ok := item["UserID"].(*types.AttributeValueMemberS); ok {
-			userMap[userID.Value] = true
-		}
+	if err := bp.saveToPostgres(ctx, userID, summary, vector, start, end, summaryVersion); err != nil {
+		return false, err
+	}
+	bp.events.Publish(ctx, Event{
+		Type:   EventSummaryCreated,
+		UserID: userID,
+		Data:   SummaryCreated{Summary: summary, StartTime: start, EndTime: end},
+	})
+
+	// 要約したメッセージには保持期間に応じた削除期限を付ける。失敗しても次回の要約で付け直す
+	if err := bp.scheduleMessageExpiry(ctx, userID, conversations, start, end); err != nil {
+		slog.WarnContext(ctx, "Failed to schedule message expiry", "user_id", userID, "error", err)
+	}
+
+	slog.InfoContext(ctx, "Successfully processed conversations", "user_id", userID)
+	return true, nil
+}
+
+// scheduleMessageExpiry は要約済みのメッセージに、ユーザーの保持期間に応じたTTLを設定して監査ログに残す
+func (bp *BatchProcessor) scheduleMessageExpiry(ctx context.Context, userID string, conversations []models.Conversation, start, end time.Time) error {
+	policy, err := bp.retention.PolicyFor(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if policy.MessageDays <= 0 {
+		return nil
 	}
 
-	var users []string
-	for userID := range userMap {
-		users = append(users, userID)
+	after := time.Duration(policy.MessageDays) * 24 * time.Hour
+	scheduled, err := bp.conversations.ScheduleExpiry(ctx, userID, conversations, after)
+	if scheduled > 0 {
+		metrics.RetentionDeleted.WithLabelValues("message").Add(float64(scheduled))
+		bp.retention.RecordMessageExpiry(ctx, userID, scheduled, start, end, end.Add(after), policy.MessageDays)
 	}
+	return err
+}
 
-	return users, nil
+// drainContext は親のキャンセル後も猶予期間だけ生き続ける、処理中の作業用コンテキストを返す
+func (bp *BatchProcessor) drainContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), timeout)
+	stop := context.AfterFunc(parent, func() {
+		timer := time.AfterFunc(bp.shutdownGrace, cancel)
+		context.AfterFunc(ctx, func() { timer.Stop() })
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
 }
 
 // PostgreSQLから最後の要約時刻を取得
@@ -163,23 +247,36 @@ func (bp *BatchProcessor) getActiveUsers(since time.Time) ([]string, error) {
 // 	return exists, err
 // }
 
-// 会話を要約
-func (bp *BatchProcessor) summarizeConversations(conversations []models.Conversation) (string, error) {
+// 会話をその言語で要約する。使ったプロンプトのバージョンも返す
+func (bp *BatchProcessor) summarizeConversations(ctx context.Context, userID string, conversations []models.Conversation) (_ string, _ int, err error) {
+	locale := conversationLocale(conversations)
+	ctx, span := tracing.Start(ctx, "BatchProcessor.summarizeConversations", attribute.Int("conversation.count", len(conversations)), attribute.String("summary.locale", locale))
+	defer func() { tracing.End(span, err) }()
+
+	instruction, version, err := bp.prompts.Render(ctx, userID, prompts.SummaryWindow, locale, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
 	messages := []map[string]string{
 		{
 			"role":    "system",
-			"content": "以下の会話を具体的な内容がわかるように要約してください。",
+			"content": instruction,
 		},
 	}
 
 	for _, conv := range conversations {
+		// ツール呼び出しの記録は要約に含めない(結果はアシスタントの回答に反映されている)
+		if conv.Role == "tool" {
+			continue
+		}
 		messages = append(messages, map[string]string{
 			"role":    conv.Role,
-			"content": conv.Content,
+			"content": contentWithCitations(conv, locale),
 		})
 	}
 
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	client := newOpenAIClient()
 
 	var openAIMessages []openai.ChatCompletionMessage
 	for _, msg := range messages {
@@ -189,56 +286,128 @@ func (bp *BatchProcessor) summarizeConversations(conversations []models.Conversa
 		})
 	}
 
+	start := time.Now()
 	resp, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			Model:    openai.GPT4TurboPreview,
 			Messages: openAIMessages,
 		},
 	)
+	observeProviderCall(ProviderOpenAI, openai.GPT4TurboPreview, "summary", start, err, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
 	if err != nil {
-		return "", fmt.Errorf("OpenAI API error: %v", err)
+		return "", 0, fmt.Errorf("OpenAI API error: %w", err)
+	}
+	bp.usage.Record(ctx, UsageRecord{
+		UserID:           userID,
+		Feature:          FeatureSummary,
+		Provider:         ProviderOpenAI,
+		Model:            openai.GPT4TurboPreview,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+
+	if len(resp.Choices) == 0 {
+		return "", 0, fmt.Errorf("OpenAI API returned no choices")
+	}
+
+	return resp.Choices[0].Message.Content, version, nil
+}
+
+// conversationLocale は会話の言語。メッセージに記録した言語、なければユーザーのメッセージから判定した言語のうち
+// 最も多いものを使い、どちらもなければ既定の言語にする
+func conversationLocale(conversations []models.Conversation) string {
+	locales := make([]string, 0, len(conversations))
+	for _, conv := range conversations {
+		switch {
+		case conv.Locale != "":
+			locales = append(locales, conv.Locale)
+		case conv.Role == "user":
+			locales = append(locales, i18n.Detect(conv.Content))
+		}
+	}
+	return dominantLocale(locales)
+}
+
+// summariesLocale は要約の本文から判定した言語のうち最も多いもの。判定できなければ既定の言語
+func summariesLocale(summaries []models.ConversationSummary) string {
+	locales := make([]string, 0, len(summaries))
+	for _, s := range summaries {
+		locales = append(locales, i18n.Detect(s.Summary))
 	}
+	return dominantLocale(locales)
+}
 
-	return resp.Choices[0].Message.Content, nil
+// dominantLocale は最も多い言語を返す。同数なら i18n.Supported の順で先のものにする
+func dominantLocale(locales []string) string {
+	counts := make(map[string]int, len(i18n.Supported))
+	for _, locale := range locales {
+		counts[locale]++
+	}
+	dominant, max := "", 0
+	for _, locale := range i18n.Supported {
+		if counts[locale] > max {
+			dominant, max = locale, counts[locale]
+		}
+	}
+	if dominant == "" {
+		return defaultLocale()
+	}
+	return dominant
 }
 
-func (bp *BatchProcessor) saveToPostgres(userID string, summary string, vector []float64, startTime time.Time, endTime time.Time) error {
+// saveToPostgres は3時間ごとの要約を保存する。summaryVersion は要約に使ったプロンプトのバージョン
+func (bp *BatchProcessor) saveToPostgres(ctx context.Context, userID string, summary string, vector []float64, startTime time.Time, endTime time.Time, summaryVersion int) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.saveToPostgres", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
 	query := `
         INSERT INTO conversation_summaries 
-        (user_id, summary, vector, start_time, end_time)
-        VALUES ($1, $2, $3::float8[], $4, $5)
-        ON CONFLICT (user_id, start_time, end_time)
+        (user_id, summary, vector, start_time, end_time, level, embedding_model, embedding_version, summary_version)
+        VALUES ($1, $2, $3::float8[], $4, $5, '` + SummaryLevelWindow + `', $6, $7, $8)
+        ON CONFLICT (user_id, level, start_time, end_time) WHERE level <> 'topic'
         DO UPDATE SET
             summary = EXCLUDED.summary,
-            vector = EXCLUDED.vector
+            vector = EXCLUDED.vector,
+            embedding_model = EXCLUDED.embedding_model,
+            embedding_version = EXCLUDED.embedding_version,
+            summary_version = EXCLUDED.summary_version
     `
 
 	// float64スライスをpq.Float64Arrayに変換
 	vectorArray := pq.Float64Array(vector)
 
-	_, err := bp.postgresDB.Exec(query, userID, summary, vectorArray, startTime, endTime)
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	_, err = bp.postgresDB.ExecContext(ctx, query, userID, summary, vectorArray, startTime, endTime, embeddingModel(), embeddingVersion(), summaryVersion)
 	if err != nil {
 		return fmt.Errorf("failed to save to postgres: %v", err)
 	}
 
-	log.Printf("Successfully saved summary for user %s with vector length %d", userID, len(vector))
+	slog.InfoContext(ctx, "Successfully saved summary", "user_id", userID, "vector_length", len(vector))
 	return nil
 }
 
-func (bp *BatchProcessor) vectorizeText(text string) ([]float64, error) {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+func (bp *BatchProcessor) vectorizeText(ctx context.Context, userID string, text string) (_ []float64, err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.vectorizeText", attribute.String("llm.model", embeddingModel()))
+	defer func() { tracing.End(span, err) }()
 
-	resp, err := client.CreateEmbeddings(
-		context.Background(),
-		openai.EmbeddingRequest{
-			Input: []string{text},
-			Model: openai.AdaEmbeddingV2,
-		},
-	)
+	client := newOpenAIClient()
+
+	start := time.Now()
+	resp, err := client.CreateEmbeddings(ctx, newEmbeddingRequest([]string{text}))
+	observeProviderCall(ProviderOpenAI, embeddingModel(), "embedding", start, err, resp.Usage.PromptTokens, 0)
 	if err != nil {
-		return nil, fmt.Errorf("embedding creation failed: %v", err)
+		return nil, fmt.Errorf("embedding creation failed: %w", err)
 	}
+	bp.usage.Record(ctx, UsageRecord{
+		UserID:       userID,
+		Feature:      FeatureSummary,
+		Provider:     ProviderOpenAI,
+		Model:        embeddingModel(),
+		PromptTokens: resp.Usage.PromptTokens,
+	})
 
 	if len(resp.Data) == 0 {
 		return nil, fmt.Errorf("no embeddings received")
@@ -248,47 +417,7 @@ func (bp *BatchProcessor) vectorizeText(text string) ([]float64, error) {
 	for i, v := range resp.Data[0].Embedding {
 		embeddings[i] = float64(v)
 	}
-	log.Printf("Created embedding vector with length %d", len(embeddings))
+	metrics.EmbeddingsCreated.WithLabelValues(embeddingModel(), "batch").Inc()
+	slog.DebugContext(ctx, "Created embedding vector", "length", len(embeddings))
 	return embeddings, nil
 }
-
-func NewBatchProcessorWithDynamo(postgresURI string) (*BatchProcessor, error) {
-	db := GetDynamoDBClient()
-	return NewBatchProcessor(postgresURI, db)
-}
-
-func (bp *BatchProcessor) getConversationsInPeriod(userID string, start, end time.Time) ([]models.Conversation, error) {
-	startStr := start.Format(time.RFC3339)
-	endStr := end.Format(time.RFC3339)
-
-	result, err := bp.dynamoDB.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String("Conversations"),
-		KeyConditionExpression: aws.String("UserID = :uid AND #ts BETWEEN :start AND :end"),
-		ExpressionAttributeNames: map[string]string{
-			"#ts": "Timestamp",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":uid":   &types.AttributeValueMemberS{Value: userID},
-			":start": &types.AttributeValueMemberS{Value: startStr},
-			":end":   &types.AttributeValueMemberS{Value: endStr},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to query conversations: %v", err)
-	}
-
-	conversations := make([]models.Conversation, 0)
-	for _, item := range result.Items {
-		timestamp, _ := time.Parse(time.RFC3339, item["Timestamp"].(*types.AttributeValueMemberS).Value)
-		conv := models.Conversation{
-			ID:        item["ID"].(*types.AttributeValueMemberS).Value,
-			UserID:    item["UserID"].(*types.AttributeValueMemberS).Value,
-			Role:      item["Role"].(*types.AttributeValueMemberS).Value,
-			Content:   item["Content"].(*types.AttributeValueMemberS).Value,
-			Timestamp: timestamp,
-		}
-		conversations = append(conversations, conv)
-	}
-
-	return conversations, nil
-}
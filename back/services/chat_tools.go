@@ -0,0 +1,182 @@
+package services
+
+import (
+	"back/i18n"
+	"back/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// currentTimeTool は現在時刻を返す
+type currentTimeTool struct{}
+
+// NewCurrentTimeTool は現在時刻を返すツールを作成する
+func NewCurrentTimeTool() Tool {
+	return currentTimeTool{}
+}
+
+func (currentTimeTool) Name() string { return "get_current_time" }
+
+func (currentTimeTool) Description() string {
+	return "現在の日時をISO8601形式で返します。今日の日付や曜日、経過時間を答えるときに使います。"
+}
+
+func (currentTimeTool) Parameters() *JSONSchema {
+	return &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}, AdditionalProperties: boolPtr(false)}
+}
+
+func (currentTimeTool) Call(context.Context, string, json.RawMessage) (string, error) {
+	return GetCurrentTimestamp(), nil
+}
+
+// memorySearchToolName は記憶を検索するツールの名前。記憶の利用を止めたユーザーには渡さない
+const memorySearchToolName = "search_memory"
+
+// memorySearchTool は過去の会話の要約を検索する
+type memorySearchTool struct {
+	rag *RAGService
+}
+
+// NewMemorySearchTool はユーザーの記憶(会話の要約)を検索するツールを作成する
+func NewMemorySearchTool(rag *RAGService) Tool {
+	return memorySearchTool{rag: rag}
+}
+
+func (memorySearchTool) Name() string { return memorySearchToolName }
+
+func (memorySearchTool) Description() string {
+	return "ユーザーとの過去の会話の要約を意味検索します。以前話した内容や、ユーザーの好み・予定を思い出すときに使います。"
+}
+
+func (memorySearchTool) Parameters() *JSONSchema {
+	return &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"query": {Type: "string", Description: "探したい内容", MinLength: intPtr(1), MaxLength: intPtr(500)},
+		},
+		Required:             []string{"query"},
+		AdditionalProperties: boolPtr(false),
+	}
+}
+
+func (t memorySearchTool) Call(ctx context.Context, userID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+
+	locale := i18n.FromContext(ctx)
+	summaries, err := t.rag.SearchMemories(ctx, userID, params.Query)
+	if err != nil {
+		return "", err
+	}
+	if len(summaries) == 0 {
+		return i18n.T(locale, "No related past conversations were found."), nil
+	}
+
+	var b strings.Builder
+	for _, s := range summaries {
+		fmt.Fprintf(&b, "- [%s] %s\n", summaryLabel(s, locale), s.Summary)
+	}
+	return b.String(), nil
+}
+
+// researchTool はPerplexityでWeb上の最新情報を調べる
+type researchTool struct {
+	research *ResearchService
+}
+
+// NewResearchTool は最新情報を調べるツールを作成する
+func NewResearchTool(research *ResearchService) Tool {
+	return researchTool{research: research}
+}
+
+func (researchTool) Name() string { return "research_web" }
+
+func (researchTool) Description() string {
+	return "Webで最新の情報を調べ、出典付きで返します。ニュースや最近の出来事など、学習データにない情報が必要なときに使います。"
+}
+
+func (researchTool) Parameters() *JSONSchema {
+	recencies := []string{"hour", "day", "week", "month", "year"}
+	return &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"topic":   {Type: "string", Description: "調べる話題", MinLength: intPtr(1), MaxLength: intPtr(100)},
+			"recency": {Type: "string", Description: "対象とする期間", Enum: recencies},
+		},
+		Required:             []string{"topic"},
+		AdditionalProperties: boolPtr(false),
+	}
+}
+
+func (t researchTool) Call(ctx context.Context, userID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Topic   string `json:"topic"`
+		Recency string `json:"recency"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+
+	locale := i18n.FromContext(ctx)
+	result, err := t.research.Research(ctx, userID, ResearchRequest{Topics: []string{params.Topic}, Recency: params.Recency, Language: locale})
+	if err != nil {
+		return "", err
+	}
+	return contentWithCitations(models.Conversation{Content: result.Content, Citations: result.Citations}, locale), nil
+}
+
+// createReminderTool は会話からリマインダーを登録する
+type createReminderTool struct {
+	reminders *ReminderService
+}
+
+// NewCreateReminderTool はリマインダーを登録するツールを作成する
+func NewCreateReminderTool(reminders *ReminderService) Tool {
+	return createReminderTool{reminders: reminders}
+}
+
+func (createReminderTool) Name() string { return "create_reminder" }
+
+func (createReminderTool) Description() string {
+	return "指定した日時にユーザーへ知らせるリマインダーを登録します。「明日の朝に歯医者のことを思い出させて」のような依頼に使います。相対的な日時は get_current_time で現在時刻を確認してから計算してください。"
+}
+
+func (createReminderTool) Parameters() *JSONSchema {
+	return &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"message": {Type: "string", Description: "知らせる内容", MinLength: intPtr(1), MaxLength: intPtr(maxReminderMessageRunes)},
+			"due_at":  {Type: "string", Description: "知らせる日時(タイムゾーン付きのRFC3339形式)", MinLength: intPtr(1)},
+		},
+		Required:             []string{"message", "due_at"},
+		AdditionalProperties: boolPtr(false),
+	}
+}
+
+func (t createReminderTool) Call(ctx context.Context, userID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Message string `json:"message"`
+		DueAt   string `json:"due_at"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+
+	dueAt, err := time.Parse(time.RFC3339, params.DueAt)
+	if err != nil {
+		return "", fmt.Errorf("%w: due_at must be RFC3339", ErrInvalidToolArguments)
+	}
+
+	reminder, err := t.reminders.Create(ctx, userID, params.Message, dueAt, ReminderSourceChat)
+	if err != nil {
+		return "", err
+	}
+	return i18n.T(i18n.FromContext(ctx), "Reminder created (id: %s, due: %s)", reminder.ID, dueAt.Format(time.RFC3339)), nil
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// chunkRunes は埋め込み1件あたりのテキストの目安の文字数
+	chunkRunes = 1000
+	// chunkOverlapRunes は前のチャンクと重ねる文字数。境界をまたぐ内容も検索できるようにする
+	chunkOverlapRunes = 150
+)
+
+// chunkText はテキストを size 文字程度のチャンクに分ける。
+// なるべく段落・改行・句点の位置で区切り、隣り合うチャンクは overlap 文字重ねる
+func chunkText(text string, size, overlap int) []string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) == 0 {
+		return nil
+	}
+	// 0文字ずつでは進まないので分けない
+	if size < 1 {
+		return []string{string(runes)}
+	}
+	if overlap >= size {
+		overlap = size / 4
+	}
+
+	var chunks []string
+	for start := 0; start < len(runes); {
+		end := start + size
+		if end >= len(runes) {
+			end = len(runes)
+		} else {
+			end = chunkBoundary(runes, start+size/2, end)
+		}
+
+		if chunk := strings.TrimSpace(string(runes[start:end])); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		if end == len(runes) {
+			break
+		}
+
+		next := end - overlap
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+// chunkBoundary は [min, end) の中で区切りやすい位置を返す。段落、改行、文末、空白の順に優先し、見つからなければ end
+func chunkBoundary(runes []rune, min, end int) int {
+	newline, sentence, space := -1, -1, -1
+	for i := end - 1; i >= min; i-- {
+		switch {
+		case runes[i] == '\n' && i > 0 && runes[i-1] == '\n':
+			return i + 1
+		case runes[i] == '\n':
+			if newline < 0 {
+				newline = i + 1
+			}
+		case strings.ContainsRune("。．！？.!?", runes[i]):
+			if sentence < 0 {
+				sentence = i + 1
+			}
+		case unicode.IsSpace(runes[i]):
+			if space < 0 {
+				space = i + 1
+			}
+		}
+	}
+	for _, pos := range []int{newline, sentence, space} {
+		if pos >= 0 {
+			return pos
+		}
+	}
+	return end
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{name: "empty", text: "", size: 10, overlap: 2, want: nil},
+		{name: "only whitespace", text: " \n\t ", size: 10, overlap: 2, want: nil},
+		{name: "shorter than one chunk", text: "  hello  ", size: 10, overlap: 2, want: []string{"hello"}},
+		{name: "exactly one chunk", text: "0123456789", size: 10, overlap: 2, want: []string{"0123456789"}},
+		{name: "multibyte counts runes", text: "あいうえおかきくけこ", size: 10, overlap: 2, want: []string{"あいうえおかきくけこ"}},
+		{
+			name: "no boundaries overlaps by overlap",
+			text: "abcdefghijklmnopqrst", size: 10, overlap: 3,
+			want: []string{"abcdefghij", "hijklmnopq", "opqrst"},
+		},
+		{
+			name: "overlap >= size falls back to a quarter of size",
+			text: "abcdefghijklmnopqrst", size: 8, overlap: 8,
+			want: []string{"abcdefgh", "ghijklmn", "mnopqrst"},
+		},
+		{
+			name: "splits after a paragraph",
+			text: "first para.\n\nsecond paragraph here", size: 20, overlap: 0,
+			want: []string{"first para.", "second paragraph", "here"},
+		},
+		{
+			name: "zero size keeps the text whole",
+			text: "abcdef", size: 0, overlap: 0,
+			want: []string{"abcdef"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkText(tt.text, tt.size, tt.overlap)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("chunkText(%q, %d, %d) = %q, want %q", tt.text, tt.size, tt.overlap, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkBoundary(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		min  int
+		want string
+	}{
+		{name: "paragraph beats later newline", text: "aa\n\nbb\ncc. dd ee", min: 0, want: "aa\n\n"},
+		{name: "newline beats later sentence", text: "aa bb\ncc. dd ee", min: 0, want: "aa bb\n"},
+		{name: "sentence beats later space", text: "aa bb. cc dd", min: 0, want: "aa bb."},
+		{name: "japanese sentence end", text: "あいう。えおか きく", min: 0, want: "あいう。"},
+		{name: "last space when nothing better", text: "aa bb cc", min: 0, want: "aa bb "},
+		{name: "no boundary uses end", text: "aabbccdd", min: 0, want: "aabbccdd"},
+		{name: "ignores boundaries before min", text: "aa\n\nbbccdd", min: 5, want: "aa\n\nbbccdd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runes := []rune(tt.text)
+			got := chunkBoundary(runes, tt.min, len(runes))
+			if string(runes[:got]) != tt.want {
+				t.Fatalf("chunkBoundary(%q, %d) cut at %q, want %q", tt.text, tt.min, string(runes[:got]), tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkTextProgress(t *testing.T) {
+	texts := []string{
+		strings.Repeat("a", 500),
+		strings.Repeat("word ", 100),
+		strings.Repeat("文。", 250),
+		strings.Repeat("line\n", 100),
+		strings.Repeat("\n\n", 100) + "x",
+	}
+	for _, text := range texts {
+		for _, size := range []int{1, 2, 3, 7, 50} {
+			for _, overlap := range []int{0, 1, size - 1, size, size * 2} {
+				chunks := chunkText(text, size, overlap)
+				// 1文字ずつでも進めばチャンク数は文字数を超えない
+				if n := utf8.RuneCountInString(text); len(chunks) > n {
+					t.Fatalf("size %d overlap %d: %d chunks for %d runes", size, overlap, len(chunks), n)
+				}
+				for _, chunk := range chunks {
+					if n := utf8.RuneCountInString(chunk); n == 0 || n > size {
+						t.Fatalf("size %d overlap %d: chunk %q has %d runes", size, overlap, chunk, n)
+					}
+				}
+				trimmed := strings.TrimSpace(text)
+				if len(chunks) == 0 || !strings.HasPrefix(trimmed, chunks[0]) || !strings.HasSuffix(trimmed, chunks[len(chunks)-1]) {
+					t.Fatalf("size %d overlap %d: chunks do not cover the text", size, overlap)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker はプロバイダー単位で連続失敗を検知し、一定時間呼び出しを遮断する
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	threshold int
+	cooldown  time.Duration
+}
+
+// NewCircuitBreaker コンストラクタ
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow は呼び出しを許可するかを返す。クールダウン経過後は1件だけ試行(half-open)を通す
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.openedAt = time.Now()
+		return true
+	case breakerHalfOpen:
+		// 試行中の呼び出しの結果が出るまでは遮断する(結果が返らないままクールダウンを過ぎたら再試行)
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.openedAt = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// Success は成功を記録してブレーカーを閉じる
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = breakerClosed
+	cb.failures = 0
+}
+
+// Failure は失敗を記録し、閾値を超えたらブレーカーを開く
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// IsOpen はブレーカーが開いている(呼び出しを遮断中)かを返す
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state == breakerOpen && time.Since(cb.openedAt) < cb.cooldown
+}
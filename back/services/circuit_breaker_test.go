@@ -0,0 +1,63 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		cb.Failure()
+		if !cb.Allow() || cb.IsOpen() {
+			t.Fatalf("breaker opened after %d failures, threshold is 3", i+1)
+		}
+	}
+	cb.Failure()
+	if cb.Allow() || !cb.IsOpen() {
+		t.Fatal("breaker did not open at the threshold")
+	}
+
+	// クールダウン後は1件だけ通し、結果が出るまで次は遮断する
+	time.Sleep(60 * time.Millisecond)
+	if cb.IsOpen() {
+		t.Fatal("IsOpen reports open after the cooldown")
+	}
+	if !cb.Allow() {
+		t.Fatal("half-open breaker rejected the trial call")
+	}
+	if cb.Allow() {
+		t.Fatal("half-open breaker allowed a second call")
+	}
+
+	// half-open での失敗はすぐに開き直す
+	cb.Failure()
+	if cb.Allow() || !cb.IsOpen() {
+		t.Fatal("breaker did not reopen after the trial call failed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("breaker rejected the trial call after the second cooldown")
+	}
+	cb.Success()
+	if !cb.Allow() || !cb.Allow() || cb.IsOpen() {
+		t.Fatal("breaker did not close after the trial call succeeded")
+	}
+
+	// 成功で失敗数もリセットされる
+	cb.Failure()
+	cb.Failure()
+	if cb.IsOpen() {
+		t.Fatal("failures before the success were still counted")
+	}
+}
+
+func TestNewCircuitBreakerMinimumThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(0, time.Minute)
+	cb.Failure()
+	if !cb.IsOpen() {
+		t.Fatal("breaker with threshold 0 did not open on the first failure")
+	}
+}
@@ -0,0 +1,574 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 要約の粒度。3時間ごとの要約を日、日を週にまとめ、日の要約を話題ごとに束ねる
+const (
+	SummaryLevelWindow = "window"
+	SummaryLevelDaily  = "daily"
+	SummaryLevelWeekly = "weekly"
+	SummaryLevelTopic  = "topic"
+)
+
+const (
+	// maxRollupsPerRun は1回の実行で1ユーザー・1レベルあたりにまとめる期間の数。残りは次回に回す
+	maxRollupsPerRun = 14
+	// topicSimilarity 以上の日の要約を同じ話題とみなす
+	topicSimilarity = 0.85
+	// minTopicMembers 未満の日しか集まらない話題は作らない
+	minTopicMembers = 2
+	// maxTopicInputs は話題の要約に使う日の要約の数(新しい順)
+	maxTopicInputs = 20
+	// topicLookback より古い日の要約は新たに話題に振り分けない
+	topicLookback = 90 * 24 * time.Hour
+	// maxTopicNameRunes は話題の名前の最大文字数
+	maxTopicNameRunes = 100
+)
+
+// rollupPrompts はレベルごとの要約のプロンプト
+var rollupPrompts = map[string]string{
+	SummaryLevelDaily:  prompts.SummaryDaily,
+	SummaryLevelWeekly: prompts.SummaryWeekly,
+	SummaryLevelTopic:  prompts.SummaryTopic,
+}
+
+// Consolidate は日が変わった3時間ごとの要約を日の要約に、週が変わった日の要約を週の要約にまとめ、
+// 日の要約を話題ごとに束ねる。まとめた要約には consolidated_at を付け、検索では上位から辿る
+func (bp *BatchProcessor) Consolidate(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.Consolidate")
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now().UTC()
+	today := now.Truncate(24 * time.Hour)
+	thisWeek := startOfWeek(today)
+	topicSince := now.Add(-topicLookback)
+
+	users, err := bp.consolidationCandidates(ctx, today, thisWeek, topicSince)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := bp.consolidateUser(ctx, userID, today, thisWeek, topicSince); err != nil {
+			slog.ErrorContext(ctx, "Error consolidating summaries", "user_id", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// consolidationCandidates はまとめる要約か、話題に振り分けていない日の要約があるユーザーを返す
+func (bp *BatchProcessor) consolidationCandidates(ctx context.Context, today, thisWeek, topicSince time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := bp.postgresDB.QueryContext(ctx, `
+        SELECT DISTINCT s.user_id
+        FROM conversation_summaries s
+        WHERE (s.level = 'window' AND s.consolidated_at IS NULL AND s.start_time < $1)
+           OR (s.level = 'daily' AND s.consolidated_at IS NULL AND s.start_time < $2)
+           OR (s.level = 'daily' AND s.start_time >= $3 AND NOT EXISTS (
+                   SELECT 1 FROM conversation_summary_links l
+                   JOIN conversation_summaries p ON p.id = l.parent_id
+                   WHERE l.child_id = s.id AND p.level = 'topic'))
+    `, today, thisWeek, topicSince)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users to consolidate: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+// consolidateUser は1ユーザー分の要約を日→週の順にまとめ、話題に振り分ける
+func (bp *BatchProcessor) consolidateUser(ctx context.Context, userID string, today, thisWeek, topicSince time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.consolidateUser", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := bp.drainContext(ctx, config.GetConsolidationUserTimeout())
+	defer cancel()
+
+	// 要約を止めたユーザーは、それまでの要約もまとめない
+	settings, err := bp.settings.Settings(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !settings.SummarizationEnabled {
+		return nil
+	}
+
+	// 3時間ごとの要約 → 日
+	days, err := bp.pendingPeriods(ctx, userID, SummaryLevelWindow, "day", today)
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		children, err := bp.summariesInPeriod(ctx, userID, SummaryLevelWindow, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		err = bp.rollup(ctx, userID, SummaryLevelDaily, day, day.AddDate(0, 0, 1), children, coveringWindows(children))
+		recordRollup(SummaryLevelDaily, err)
+		if err != nil {
+			return fmt.Errorf("failed to roll up %s: %w", day.Format(time.DateOnly), err)
+		}
+	}
+
+	// 日 → 週
+	weeks, err := bp.pendingPeriods(ctx, userID, SummaryLevelDaily, "week", thisWeek)
+	if err != nil {
+		return err
+	}
+	for _, week := range weeks {
+		children, err := bp.summariesInPeriod(ctx, userID, SummaryLevelDaily, week, week.AddDate(0, 0, 7))
+		if err != nil {
+			return err
+		}
+		err = bp.rollup(ctx, userID, SummaryLevelWeekly, week, week.AddDate(0, 0, 7), children, children)
+		recordRollup(SummaryLevelWeekly, err)
+		if err != nil {
+			return fmt.Errorf("failed to roll up week of %s: %w", week.Format(time.DateOnly), err)
+		}
+	}
+
+	// 日 → 話題
+	return bp.clusterTopics(ctx, userID, topicSince)
+}
+
+// pendingPeriods はまだまとめていない要約がある期間(unit は day か week)の開始を、before より前について古い順に返す
+func (bp *BatchProcessor) pendingPeriods(ctx context.Context, userID, level, unit string, before time.Time) ([]time.Time, error) {
+	rows, err := bp.postgresDB.QueryContext(ctx, `
+        SELECT DISTINCT date_trunc($3, start_time) AS period
+        FROM conversation_summaries
+        WHERE user_id = $1 AND level = $2 AND consolidated_at IS NULL AND start_time < $4
+        ORDER BY period
+        LIMIT $5
+    `, userID, level, unit, before, maxRollupsPerRun)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find periods to consolidate: %v", err)
+	}
+	defer rows.Close()
+
+	var periods []time.Time
+	for rows.Next() {
+		var period time.Time
+		if err := rows.Scan(&period); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		periods = append(periods, period.UTC())
+	}
+	return periods, rows.Err()
+}
+
+// summariesInPeriod は期間内に始まる指定レベルの要約を、まとめ済みかどうかに関わらず古い順に返す
+func (bp *BatchProcessor) summariesInPeriod(ctx context.Context, userID, level string, start, end time.Time) ([]models.ConversationSummary, error) {
+	return bp.querySummaries(ctx, `
+        SELECT id, user_id, summary, vector::real[], start_time, end_time, created_at, level, COALESCE(topic, ''), embedding_version, summary_version
+        FROM conversation_summaries
+        WHERE user_id = $1 AND level = $2 AND start_time >= $3 AND start_time < $4
+        ORDER BY start_time, end_time
+    `, userID, level, start, end)
+}
+
+func (bp *BatchProcessor) querySummaries(ctx context.Context, query string, args ...any) ([]models.ConversationSummary, error) {
+	rows, err := bp.postgresDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query summaries: %v", err)
+	}
+	defer rows.Close()
+
+	var summaries []models.ConversationSummary
+	for rows.Next() {
+		var s models.ConversationSummary
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Summary, &s.Vector, &s.StartTime, &s.EndTime, &s.CreatedAt, &s.Level, &s.Topic, &s.EmbeddingVersion, &s.SummaryVersion); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		summaries = append(summaries, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration failed: %v", err)
+	}
+	return summaries, nil
+}
+
+// rollup は inputs を要約して上位の要約を作り(既にあれば作り直し)、children をその下にまとめる。
+// 元が1つだけならモデルを呼ばずにそのまま使う (プロンプトを使わないため summary_version は 0 にする)
+func (bp *BatchProcessor) rollup(ctx context.Context, userID, level string, start, end time.Time, children, inputs []models.ConversationSummary) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.rollup", attribute.String("summary.level", level), attribute.Int("summary.children", len(children)))
+	defer func() { tracing.End(span, err) }()
+
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	summary, vector, summaryVersion := inputs[0].Summary, []float64(inputs[0].Vector), 0
+	if len(inputs) > 1 {
+		instruction, version, err := bp.prompts.Render(ctx, userID, rollupPrompts[level], summariesLocale(inputs), nil)
+		if err != nil {
+			return err
+		}
+		summary, err = bp.summarizeSummaries(ctx, userID, instruction, inputs)
+		if err != nil {
+			return err
+		}
+		summaryVersion = version
+	}
+	// 元のベクトルが古い埋め込みのものなら作り直す
+	if len(inputs) > 1 || inputs[0].EmbeddingVersion != embeddingVersion() {
+		vector, err = bp.vectorizeText(ctx, userID, summary)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := bp.postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var parentID string
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO conversation_summaries
+        (user_id, summary, vector, start_time, end_time, level, embedding_model, embedding_version, summary_version)
+        VALUES ($1, $2, $3::float8[], $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (user_id, level, start_time, end_time) WHERE level <> 'topic'
+        DO UPDATE SET
+            summary = EXCLUDED.summary,
+            vector = EXCLUDED.vector,
+            embedding_model = EXCLUDED.embedding_model,
+            embedding_version = EXCLUDED.embedding_version,
+            summary_version = EXCLUDED.summary_version
+        RETURNING id
+    `, userID, summary, pq.Float64Array(vector), start, end, level, embeddingModel(), embeddingVersion(), summaryVersion).Scan(&parentID)
+	if err != nil {
+		return fmt.Errorf("failed to save %s summary: %v", level, err)
+	}
+
+	if err := linkSummaries(ctx, tx, parentID, summaryIDs(children)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE conversation_summaries SET consolidated_at = $2
+        WHERE id = ANY($1::uuid[]) AND consolidated_at IS NULL
+    `, pq.StringArray(summaryIDs(children)), time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to mark summaries consolidated: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// clusterTopics は話題に振り分けていない日の要約を、近い既存の話題に加えるか、
+// 互いに近いもの同士で新しい話題にする。どこにも入らない日の要約は次回以降に持ち越す
+func (bp *BatchProcessor) clusterTopics(ctx context.Context, userID string, since time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.clusterTopics", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	candidates, err := bp.querySummaries(ctx, `
+        SELECT s.id, s.user_id, s.summary, s.vector::real[], s.start_time, s.end_time, s.created_at, s.level, '', s.embedding_version, s.summary_version
+        FROM conversation_summaries s
+        WHERE s.user_id = $1 AND s.level = 'daily' AND s.start_time >= $2 AND s.embedding_version = $3
+          AND NOT EXISTS (
+              SELECT 1 FROM conversation_summary_links l
+              JOIN conversation_summaries p ON p.id = l.parent_id
+              WHERE l.child_id = s.id AND p.level = 'topic')
+        ORDER BY s.start_time
+    `, userID, since, embeddingVersion())
+	if err != nil || len(candidates) == 0 {
+		return err
+	}
+
+	topics, err := bp.querySummaries(ctx, `
+        SELECT id, user_id, summary, vector::real[], start_time, end_time, created_at, level, COALESCE(topic, ''), embedding_version, summary_version
+        FROM conversation_summaries
+        WHERE user_id = $1 AND level = 'topic' AND embedding_version = $2
+    `, userID, embeddingVersion())
+	if err != nil {
+		return err
+	}
+
+	// 既存の話題に近いものはその話題に加える
+	joined := make(map[string][]models.ConversationSummary)
+	var unassigned []models.ConversationSummary
+	for _, c := range candidates {
+		best, bestSimilarity := -1, 0.0
+		for i, t := range topics {
+			if sim := cosineSimilarity(c.Vector, t.Vector); sim > bestSimilarity {
+				best, bestSimilarity = i, sim
+			}
+		}
+		if best >= 0 && bestSimilarity >= topicSimilarity {
+			joined[topics[best].ID] = append(joined[topics[best].ID], c)
+			continue
+		}
+		unassigned = append(unassigned, c)
+	}
+
+	for topicID, members := range joined {
+		err := bp.saveTopic(ctx, userID, topicID, members)
+		recordRollup(SummaryLevelTopic, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 残りは互いに近いもの同士で新しい話題にする
+	for _, group := range groupSimilar(unassigned, topicSimilarity) {
+		if len(group) < minTopicMembers {
+			continue
+		}
+		err := bp.saveTopic(ctx, userID, "", group)
+		recordRollup(SummaryLevelTopic, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveTopic は話題に日の要約を加えて、話題の名前と要約を作り直す。topicID が空なら新しい話題を作る
+func (bp *BatchProcessor) saveTopic(ctx context.Context, userID, topicID string, added []models.ConversationSummary) (err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.saveTopic", attribute.String("user.id", userID), attribute.Int("summary.children", len(added)))
+	defer func() { tracing.End(span, err) }()
+
+	members := append([]models.ConversationSummary(nil), added...)
+	if topicID != "" {
+		existing, err := bp.querySummaries(ctx, `
+            SELECT s.id, s.user_id, s.summary, s.vector::real[], s.start_time, s.end_time, s.created_at, s.level, '', s.embedding_version, s.summary_version
+            FROM conversation_summary_links l
+            JOIN conversation_summaries s ON s.id = l.child_id
+            WHERE l.parent_id = $1
+        `, topicID)
+		if err != nil {
+			return err
+		}
+		members = append(members, existing...)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].StartTime.Before(members[j].StartTime) })
+
+	inputs := members
+	if len(inputs) > maxTopicInputs {
+		inputs = inputs[len(inputs)-maxTopicInputs:]
+	}
+	instruction, summaryVersion, err := bp.prompts.Render(ctx, userID, rollupPrompts[SummaryLevelTopic], summariesLocale(inputs), nil)
+	if err != nil {
+		return err
+	}
+	text, err := bp.summarizeSummaries(ctx, userID, instruction, inputs)
+	if err != nil {
+		return err
+	}
+	name, summary := parseTopicSummary(text)
+	vector, err := bp.vectorizeText(ctx, userID, summary)
+	if err != nil {
+		return err
+	}
+
+	start, end := members[0].StartTime, members[0].EndTime
+	for _, m := range members {
+		if m.EndTime.After(end) {
+			end = m.EndTime
+		}
+	}
+
+	tx, err := bp.postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if topicID == "" {
+		err = tx.QueryRowContext(ctx, `
+            INSERT INTO conversation_summaries
+            (user_id, summary, vector, start_time, end_time, level, topic, embedding_model, embedding_version, summary_version)
+            VALUES ($1, $2, $3::float8[], $4, $5, 'topic', $6, $7, $8, $9)
+            RETURNING id
+        `, userID, summary, pq.Float64Array(vector), start, end, name, embeddingModel(), embeddingVersion(), summaryVersion).Scan(&topicID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE conversation_summaries
+            SET summary = $2, vector = $3::float8[], start_time = $4, end_time = $5, topic = $6,
+                embedding_model = $7, embedding_version = $8, summary_version = $9
+            WHERE id = $1
+        `, topicID, summary, pq.Float64Array(vector), start, end, name, embeddingModel(), embeddingVersion(), summaryVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save topic summary: %v", err)
+	}
+
+	if err := linkSummaries(ctx, tx, topicID, summaryIDs(added)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// summarizeSummaries は複数の要約を指示に従って1つにまとめる
+func (bp *BatchProcessor) summarizeSummaries(ctx context.Context, userID, instruction string, summaries []models.ConversationSummary) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.summarizeSummaries", attribute.Int("summary.count", len(summaries)))
+	defer func() { tracing.End(span, err) }()
+
+	var b strings.Builder
+	for _, s := range summaries {
+		fmt.Fprintf(&b, "[%s 〜 %s]\n%s\n\n", s.StartTime.Format("2006-01-02 15:04"), s.EndTime.Format("2006-01-02 15:04"), s.Summary)
+	}
+
+	start := time.Now()
+	resp, err := newOpenAIClient().CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: openai.GPT4TurboPreview,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: instruction},
+			{Role: openai.ChatMessageRoleUser, Content: b.String()},
+		},
+	})
+	observeProviderCall(ProviderOpenAI, openai.GPT4TurboPreview, "summary_rollup", start, err, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	if err != nil {
+		return "", fmt.Errorf("OpenAI API error: %w", err)
+	}
+	bp.usage.Record(ctx, UsageRecord{
+		UserID:           userID,
+		Feature:          FeatureSummary,
+		Provider:         ProviderOpenAI,
+		Model:            openai.GPT4TurboPreview,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("OpenAI API returned no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// linkSummaries は上位の要約と元になった要約を対応付ける
+func linkSummaries(ctx context.Context, tx *sql.Tx, parentID string, childIDs []string) error {
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO conversation_summary_links (parent_id, child_id)
+        SELECT $1, unnest($2::uuid[])
+        ON CONFLICT DO NOTHING
+    `, parentID, pq.StringArray(childIDs))
+	if err != nil {
+		return fmt.Errorf("failed to link summaries: %v", err)
+	}
+	return nil
+}
+
+// coveringWindows は重なり合う3時間ごとの要約から、重ならずに期間を覆うものを選ぶ。
+// バッチは10分ごとに直近3時間を要約するため、そのまま全部まとめると同じ内容を何度も読むことになる
+func coveringWindows(windows []models.ConversationSummary) []models.ConversationSummary {
+	var selected []models.ConversationSummary
+	for _, w := range windows {
+		if len(selected) == 0 || !w.StartTime.Before(selected[len(selected)-1].EndTime) {
+			selected = append(selected, w)
+		}
+	}
+	// 最後の時間帯は、期間の終わりまで含むものを使う
+	if n := len(windows); n > 0 && windows[n-1].ID != selected[len(selected)-1].ID {
+		selected = append(selected, windows[n-1])
+	}
+	return selected
+}
+
+// groupSimilar は最初の要素に threshold 以上近いもの同士でグループにする
+func groupSimilar(summaries []models.ConversationSummary, threshold float64) [][]models.ConversationSummary {
+	used := make([]bool, len(summaries))
+	var groups [][]models.ConversationSummary
+	for i := range summaries {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		group := []models.ConversationSummary{summaries[i]}
+		for j := i + 1; j < len(summaries); j++ {
+			if !used[j] && cosineSimilarity(summaries[i].Vector, summaries[j].Vector) >= threshold {
+				used[j] = true
+				group = append(group, summaries[j])
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// parseTopicSummary は1行目を話題の名前、残りを要約として取り出す
+func parseTopicSummary(text string) (name, summary string) {
+	text = strings.TrimSpace(text)
+	first, rest, _ := strings.Cut(text, "\n")
+	name = strings.TrimSpace(strings.Trim(first, "#*「」 "))
+	for _, prefix := range []string{"話題:", "話題："} {
+		name = strings.TrimSpace(strings.TrimPrefix(name, prefix))
+	}
+	summary = strings.TrimSpace(rest)
+	if summary == "" {
+		summary = text
+	}
+	if name == "" {
+		name = "その他"
+	}
+	return truncateRunes(name, maxTopicNameRunes), summary
+}
+
+// startOfWeek は day を含む週の月曜日(UTC)を返す
+func startOfWeek(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func summaryIDs(summaries []models.ConversationSummary) []string {
+	ids := make([]string, len(summaries))
+	for i, s := range summaries {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+func recordRollup(level string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.SummaryRollups.WithLabelValues(level, result).Inc()
+}
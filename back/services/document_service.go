@@ -0,0 +1,282 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/tracing"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 資料の取り込み結果
+const (
+	DocumentCreated   = "created"
+	DocumentUpdated   = "updated"
+	DocumentUnchanged = "unchanged"
+)
+
+// maxDocumentTitleRunes は資料のタイトルの最大文字数
+const maxDocumentTitleRunes = 255
+
+var (
+	ErrDocumentNotFound = errors.New("document not found")
+	// ErrInvalidDocument は空・大きすぎる・UTF-8でない資料であることを表す
+	ErrInvalidDocument = errors.New("invalid document")
+)
+
+const documentColumns = `id, user_id, title, source, content_hash, chars, chunk_count, created_at, updated_at`
+
+// DocumentInput は取り込む資料。Source が同じ資料は上書きする
+type DocumentInput struct {
+	Title   string
+	Source  string
+	Content string
+}
+
+// IngestResult は資料の取り込み結果
+type IngestResult struct {
+	Document models.Document `json:"document"`
+	Status   string          `json:"status"`
+}
+
+// DocumentService はナレッジベースの資料をチャンクに分けて埋め込み、検索できるようにする
+type DocumentService struct {
+	db    *sql.DB
+	usage *UsageService
+}
+
+// NewDocumentService コンストラクタ
+func NewDocumentService(db *sql.DB, usage *UsageService) *DocumentService {
+	return &DocumentService{db: db, usage: usage}
+}
+
+// Ingest は資料を取り込む。同じ取り込み元の資料は内容が変わっていれば置き換え、
+// 変わっていなければ埋め込みをやり直さずにそのまま返す
+func (ds *DocumentService) Ingest(ctx context.Context, userID string, input DocumentInput) (_ IngestResult, err error) {
+	ctx, span := tracing.Start(ctx, "DocumentService.Ingest", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	input, err = normalizeDocumentInput(input)
+	if err != nil {
+		return IngestResult{}, err
+	}
+	hash := sha256.Sum256([]byte(input.Content))
+	contentHash := hex.EncodeToString(hash[:])
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetDocumentIngestTimeout())
+	defer cancel()
+
+	existing, err := ds.findBySource(ctx, userID, input.Source)
+	switch {
+	case err == nil && existing.ContentHash == contentHash && existing.Title == input.Title:
+		metrics.DocumentsIngested.WithLabelValues(DocumentUnchanged).Inc()
+		return IngestResult{Document: existing, Status: DocumentUnchanged}, nil
+	case err != nil && !errors.Is(err, ErrDocumentNotFound):
+		return IngestResult{}, err
+	}
+
+	chunks := chunkText(input.Content, chunkRunes, chunkOverlapRunes)
+	if max := config.GetDocumentMaxChunks(); len(chunks) > max {
+		return IngestResult{}, fmt.Errorf("%w: document has %d chunks, at most %d are allowed", ErrInvalidDocument, len(chunks), max)
+	}
+	span.SetAttributes(attribute.Int("document.chunks", len(chunks)))
+
+	// 埋め込みはトランザクションの外で行い、ロックを長く持たない
+	vectors, err := embedTexts(ctx, ds.usage, userID, FeatureDocument, chunks)
+	if err != nil {
+		return IngestResult{}, err
+	}
+
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		return IngestResult{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var inserted bool
+	row := tx.QueryRowContext(ctx, `
+        INSERT INTO documents (id, user_id, title, source, content_hash, chars, chunk_count, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+        ON CONFLICT (user_id, source) DO UPDATE
+        SET title = EXCLUDED.title,
+            content_hash = EXCLUDED.content_hash,
+            chars = EXCLUDED.chars,
+            chunk_count = EXCLUDED.chunk_count,
+            updated_at = EXCLUDED.updated_at
+        RETURNING `+documentColumns+`, (xmax = 0)
+    `, uuid.New().String(), userID, input.Title, input.Source, contentHash, utf8.RuneCountInString(input.Content), len(chunks), now)
+	var doc models.Document
+	if err := row.Scan(&doc.ID, &doc.UserID, &doc.Title, &doc.Source, &doc.ContentHash, &doc.Chars, &doc.ChunkCount, &doc.CreatedAt, &doc.UpdatedAt, &inserted); err != nil {
+		return IngestResult{}, fmt.Errorf("failed to save document: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM document_chunks WHERE document_id = $1`, doc.ID); err != nil {
+		return IngestResult{}, fmt.Errorf("failed to delete old chunks: %v", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT INTO document_chunks (document_id, user_id, chunk_index, content, vector, embedding_model, embedding_version)
+        VALUES ($1, $2, $3, $4, $5::float8[], $6, $7)
+    `)
+	if err != nil {
+		return IngestResult{}, fmt.Errorf("failed to prepare chunk insert: %v", err)
+	}
+	defer stmt.Close()
+
+	model, version := embeddingModel(), embeddingVersion()
+	for i, chunk := range chunks {
+		if _, err := stmt.ExecContext(ctx, doc.ID, userID, i, chunk, pq.Float64Array(vectors[i]), model, version); err != nil {
+			return IngestResult{}, fmt.Errorf("failed to save chunk: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return IngestResult{}, fmt.Errorf("failed to commit document: %v", err)
+	}
+
+	status := DocumentUpdated
+	if inserted {
+		status = DocumentCreated
+	}
+	metrics.DocumentsIngested.WithLabelValues(status).Inc()
+	return IngestResult{Document: doc, Status: status}, nil
+}
+
+// List はユーザーの資料を更新の新しい順に返す
+func (ds *DocumentService) List(ctx context.Context, userID string) (_ []models.Document, err error) {
+	ctx, span := tracing.Start(ctx, "DocumentService.List", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := ds.db.QueryContext(ctx, `
+        SELECT `+documentColumns+` FROM documents WHERE user_id = $1 ORDER BY updated_at DESC
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list documents: %v", err)
+	}
+	defer rows.Close()
+
+	documents := make([]models.Document, 0)
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		documents = append(documents, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration failed: %v", err)
+	}
+	return documents, nil
+}
+
+// Get はユーザーの資料を返す
+func (ds *DocumentService) Get(ctx context.Context, userID, id string) (_ models.Document, err error) {
+	ctx, span := tracing.Start(ctx, "DocumentService.Get", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return models.Document{}, ErrDocumentNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	doc, err := scanDocument(ds.db.QueryRowContext(ctx, `
+        SELECT `+documentColumns+` FROM documents WHERE id = $1 AND user_id = $2
+    `, id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Document{}, ErrDocumentNotFound
+	}
+	if err != nil {
+		return models.Document{}, fmt.Errorf("failed to get document: %v", err)
+	}
+	return doc, nil
+}
+
+// Delete は資料とそのチャンクを削除する
+func (ds *DocumentService) Delete(ctx context.Context, userID, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "DocumentService.Delete", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrDocumentNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := ds.db.ExecContext(ctx, `DELETE FROM documents WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete document: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDocumentNotFound
+	}
+	return nil
+}
+
+func (ds *DocumentService) findBySource(ctx context.Context, userID, source string) (models.Document, error) {
+	doc, err := scanDocument(ds.db.QueryRowContext(ctx, `
+        SELECT `+documentColumns+` FROM documents WHERE user_id = $1 AND source = $2
+    `, userID, source))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Document{}, ErrDocumentNotFound
+	}
+	if err != nil {
+		return models.Document{}, fmt.Errorf("failed to find document: %v", err)
+	}
+	return doc, nil
+}
+
+// normalizeDocumentInput は本文を検証し、タイトル・取り込み元の省略を補う
+func normalizeDocumentInput(input DocumentInput) (DocumentInput, error) {
+	if int64(len(input.Content)) > config.GetDocumentMaxBytes() {
+		return input, fmt.Errorf("%w: document must be at most %d bytes", ErrInvalidDocument, config.GetDocumentMaxBytes())
+	}
+	if !utf8.ValidString(input.Content) {
+		return input, fmt.Errorf("%w: document is not valid UTF-8", ErrInvalidDocument)
+	}
+	input.Content = strings.TrimSpace(input.Content)
+	if input.Content == "" {
+		return input, fmt.Errorf("%w: document is empty", ErrInvalidDocument)
+	}
+
+	input.Title = strings.TrimSpace(input.Title)
+	input.Source = strings.TrimSpace(input.Source)
+	if input.Title == "" && input.Source == "" {
+		return input, fmt.Errorf("%w: title or source is required", ErrInvalidDocument)
+	}
+	if input.Title == "" {
+		input.Title = path.Base(input.Source)
+	}
+	if input.Source == "" {
+		input.Source = input.Title
+	}
+	input.Title = truncateRunes(input.Title, maxDocumentTitleRunes-1) // 省略記号の分を空ける
+
+	return input, nil
+}
+
+func scanDocument(row rowScanner) (models.Document, error) {
+	var d models.Document
+	if err := row.Scan(&d.ID, &d.UserID, &d.Title, &d.Source, &d.ContentHash, &d.Chars, &d.ChunkCount, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return models.Document{}, err
+	}
+	return d, nil
+}
@@ -1,9 +1,16 @@
 package services
 
 import (
+	appconfig "back/config"
+	"back/logging"
 	"back/models"
+	"back/tracing"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -12,37 +19,44 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var db *dynamodb.Client
+// ErrMessageNotFound は指定したIDのメッセージがないことを表す
+var ErrMessageNotFound = errors.New("message not found")
 
-func init() {
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL: "http://localhost:8000",
-		}, nil
-	})
+const (
+	conversationsTable = "Conversations"
+	// expiresAtAttribute はTTLで削除する日時(Unix秒)を持つ属性
+	expiresAtAttribute = "ExpiresAt"
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion("us-east-1"),
-		config.WithEndpointResolverWithOptions(customResolver),
-		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
-			Value: aws.Credentials{
-				AccessKeyID: "dummy", SecretAccessKey: "dummy", SessionToken: "dummy",
-			},
-		}),
-	)
-	if err != nil {
-		panic(err)
-	}
+	// maxTimestampCollisions は同じ秒に保存が重なったときにずらす最大回数
+	maxTimestampCollisions = 10
+)
+
+// ConversationStore はDynamoDBの会話テーブルへのアクセスをまとめたもの
+type ConversationStore struct {
+	client *dynamodb.Client
+	events *EventBus
+}
+
+// NewConversationStore コンストラクタ。events にはアシスタントのメッセージを保存するたびに EventMessageCreated を流す
+func NewConversationStore(client *dynamodb.Client, events *EventBus) *ConversationStore {
+	return &ConversationStore{client: client, events: events}
+}
 
-	db = dynamodb.NewFromConfig(cfg)
-	ensureTableExists()
+// Client はDynamoDBクライアントを返す
+func (s *ConversationStore) Client() *dynamodb.Client {
+	return s.client
 }
 
-func ensureTableExists() {
-	_, err := db.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
-		TableName: aws.String("Conversations"),
+// EnsureTable は会話テーブルがなければ作成する
+func (s *ConversationStore) EnsureTable(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	_, err := s.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(conversationsTable),
 		AttributeDefinitions: []types.AttributeDefinition{
 			{
 				AttributeName: aws.String("UserID"),
@@ -66,145 +80,438 @@ func ensureTableExists() {
 		BillingMode: types.BillingModePayPerRequest,
 	})
 	if err != nil {
-		fmt.Printf("Table might already exist: %v\n", err)
+		slog.InfoContext(ctx, "Table might already exist", "table", conversationsTable, "error", err)
 	}
-}
 
-func SaveMessage(userID string, role string, content string) (models.Conversation, error) {
-	conversation := models.Conversation{
-		ID:        uuid.New().String(),
-		UserID:    userID,
-		Role:      role,
-		Content:   content,
-		Timestamp: time.Now(),
-	}
-
-	// デバッグログ
-	fmt.Printf("Saving conversation: %+v\n", conversation)
-
-	_, err := db.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("Conversations"),
-		Item: map[string]types.AttributeValue{
-			"ID":        &types.AttributeValueMemberS{Value: conversation.ID},
-			"UserID":    &types.AttributeValueMemberS{Value: conversation.UserID},
-			"Role":      &types.AttributeValueMemberS{Value: conversation.Role},
-			"Content":   &types.AttributeValueMemberS{Value: conversation.Content},
-			"Timestamp": &types.AttributeValueMemberS{Value: conversation.Timestamp.Format(time.RFC3339)},
+	// 保持期間を過ぎたメッセージは ExpiresAt でDynamoDBに削除させる
+	_, err = s.client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(conversationsTable),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(expiresAtAttribute),
+			Enabled:       aws.Bool(true),
 		},
 	})
+	if err != nil {
+		slog.InfoContext(ctx, "TTL might already be enabled", "table", conversationsTable, "error", err)
+	}
+}
+
+func (s *ConversationStore) SaveMessage(ctx context.Context, userID string, role string, content string) (models.Conversation, error) {
+	return s.SaveConversation(ctx, models.Conversation{UserID: userID, Role: role, Content: content})
+}
+
+// SaveMessageWithCitations は出典付きのメッセージを保存する。出典は Citations 属性にリストで持つ
+func (s *ConversationStore) SaveMessageWithCitations(ctx context.Context, userID string, role string, content string, citations []models.Citation) (models.Conversation, error) {
+	return s.SaveConversation(ctx, models.Conversation{UserID: userID, Role: role, Content: content, Citations: citations})
+}
+
+// SaveConversation はIDとタイムスタンプを採番してメッセージを保存する。
+// ソートキーが秒単位のため、同じ秒に既にメッセージがあれば1秒ずつずらして上書きを防ぐ
+func (s *ConversationStore) SaveConversation(ctx context.Context, conversation models.Conversation) (_ models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.SaveMessage", attribute.String("user.id", conversation.UserID), attribute.String("message.role", conversation.Role))
+	defer func() { tracing.End(span, err) }()
+
+	conversation.ID = uuid.New().String()
+	conversation.Timestamp = time.Now().Truncate(time.Second)
+
+	slog.DebugContext(ctx, "Saving conversation", "user_id", conversation.UserID, "role", conversation.Role, "message_id", conversation.ID, logging.Content("content", conversation.Content))
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	for attempt := 0; attempt < maxTimestampCollisions; attempt++ {
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(conversationsTable),
+			Item:                conversationItem(conversation),
+			ConditionExpression: aws.String("attribute_not_exists(#ts)"),
+			ExpressionAttributeNames: map[string]string{
+				"#ts": "Timestamp",
+			},
+		})
+
+		var conflict *types.ConditionalCheckFailedException
+		if !errors.As(err, &conflict) {
+			break
+		}
+		conversation.Timestamp = conversation.Timestamp.Add(time.Second)
+	}
 
 	// エラーが発生した場合は空の会話とエラーを返す
 	if err != nil {
 		return models.Conversation{}, err
 	}
 
+	if conversation.Role == "assistant" {
+		s.events.Publish(ctx, Event{Type: EventMessageCreated, UserID: conversation.UserID, Data: conversation})
+	}
+
 	// 保存した内容を返す
 	return conversation, nil
 }
 
-func GetRecentConversations(userID string, limit int) ([]models.Conversation, error) {
-	result, err := db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String("Conversations"),
+// conversationItem は会話をDynamoDBのアイテムに変換する
+func conversationItem(conversation models.Conversation) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"ID":        &types.AttributeValueMemberS{Value: conversation.ID},
+		"UserID":    &types.AttributeValueMemberS{Value: conversation.UserID},
+		"Role":      &types.AttributeValueMemberS{Value: conversation.Role},
+		"Content":   &types.AttributeValueMemberS{Value: conversation.Content},
+		"Timestamp": &types.AttributeValueMemberS{Value: conversation.Timestamp.Format(time.RFC3339)},
+	}
+	if len(conversation.Citations) > 0 {
+		item["Citations"] = citationsToAttribute(conversation.Citations)
+	}
+	if conversation.ToolCall != nil {
+		item["ToolCall"] = toolCallToAttribute(conversation.ToolCall)
+	}
+	if len(conversation.Attachments) > 0 {
+		item["Attachments"] = attachmentsToAttribute(conversation.Attachments)
+	}
+	if len(conversation.PromptVersions) > 0 {
+		item["PromptVersions"] = promptVersionsToAttribute(conversation.PromptVersions)
+	}
+	if conversation.Locale != "" {
+		item["Locale"] = &types.AttributeValueMemberS{Value: conversation.Locale}
+	}
+	return item
+}
+
+// GetRecentConversations は新しい順に最大 limit 件のメッセージを返す。
+// ツールの記録は監査用なので数えず、フィルターで減った分は次のページから補う
+func (s *ConversationStore) GetRecentConversations(ctx context.Context, userID string, limit int) (_ []models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.GetRecentConversations", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	input := excludeToolRecords(&dynamodb.QueryInput{
+		TableName:              aws.String(conversationsTable),
 		KeyConditionExpression: aws.String("UserID = :uid"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":uid": &types.AttributeValueMemberS{Value: userID},
 		},
-		ScanIndexForward: aws.Bool(false),         // 新しい順にソート
-		Limit:            aws.Int32(int32(limit)), // 最大5件を取得
+		ScanIndexForward: aws.Bool(false), // 新しい順にソート
+		Limit:            aws.Int32(int32(limit)),
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	conversations := make([]models.Conversation, 0)
-	for _, item := range result.Items {
-		timestamp, _ := time.Parse(time.RFC3339, item["Timestamp"].(*types.AttributeValueMemberS).Value)
-		conv := models.Conversation{
-			ID:        item["ID"].(*types.AttributeValueMemberS).Value,
-			UserID:    item["UserID"].(*types.AttributeValueMemberS).Value,
-			Role:      item["Role"].(*types.AttributeValueMemberS).Value,
-			Content:   item["Content"].(*types.AttributeValueMemberS).Value,
-			Timestamp: timestamp,
+	var conversations []models.Conversation
+	for len(conversations) < limit {
+		result, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
 		}
-		conversations = append(conversations, conv)
+		conversations = append(conversations, conversationsFromItems(ctx, result.Items)...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
 	}
-
-	// デバッグログで取得結果を確認
-	fmt.Println("Conversations from DynamoDB:")
-	for i, conv := range conversations {
-		fmt.Printf("%d: %+v\n", i+1, conv)
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
 	}
 
+	slog.DebugContext(ctx, "Fetched recent conversations", "user_id", userID, "count", len(conversations))
+
 	return conversations, nil
 }
 
-func UpdateMessageFlag(userID, timestamp string, isLiked, isDisliked *bool) error {
-	fmt.Printf("Updating message - UserID: %s, Timestamp: %s, IsLiked: %v, IsDisliked: %v\n", userID, timestamp, isLiked, isDisliked)
+// UpdateMessageFlag はメッセージの評価とピン留めを更新する。
+// ピン留めすると削除期限を外し、外すときは expiresAt があればその期限を付け直す
+func (s *ConversationStore) UpdateMessageFlag(ctx context.Context, userID, timestamp string, isLiked, isDisliked, isPinned *bool, expiresAt *time.Time) error {
+	slog.DebugContext(ctx, "Updating message flag", "user_id", userID, "timestamp", timestamp, "is_liked", isLiked, "is_disliked", isDisliked, "is_pinned", isPinned)
 
 	// 更新フィールドを構築
-	updateExpression := "SET"
+	var sets, removes []string
 	expressionAttributeValues := map[string]types.AttributeValue{}
 	expressionAttributeNames := map[string]string{}
 
 	if isLiked != nil {
-		updateExpression += " #isLiked = :isLiked,"
+		sets = append(sets, "#isLiked = :isLiked")
 		expressionAttributeValues[":isLiked"] = &types.AttributeValueMemberBOOL{Value: *isLiked}
 		expressionAttributeNames["#isLiked"] = "isLiked"
 	}
 	if isDisliked != nil {
-		updateExpression += " #isDisliked = :isDisliked,"
+		sets = append(sets, "#isDisliked = :isDisliked")
 		expressionAttributeValues[":isDisliked"] = &types.AttributeValueMemberBOOL{Value: *isDisliked}
 		expressionAttributeNames["#isDisliked"] = "isDisliked"
 	}
+	if isPinned != nil {
+		sets = append(sets, "#pinned = :pinned")
+		expressionAttributeValues[":pinned"] = &types.AttributeValueMemberBOOL{Value: *isPinned}
+		expressionAttributeNames["#pinned"] = "Pinned"
+		expressionAttributeNames["#expiresAt"] = expiresAtAttribute
+		switch {
+		case *isPinned:
+			removes = append(removes, "#expiresAt")
+		case expiresAt != nil:
+			sets = append(sets, "#expiresAt = :expiresAt")
+			expressionAttributeValues[":expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)}
+		default:
+			delete(expressionAttributeNames, "#expiresAt")
+		}
+	}
 
-	// 末尾のカンマを削除
-	if len(expressionAttributeValues) > 0 {
-		updateExpression = updateExpression[:len(updateExpression)-1]
+	var updateExpression string
+	if len(sets) > 0 {
+		updateExpression = "SET " + strings.Join(sets, ", ")
+	}
+	if len(removes) > 0 {
+		updateExpression += " REMOVE " + strings.Join(removes, ", ")
 	}
 
-	// デバッグログ: UpdateItemInput を確認
-	fmt.Printf("UpdateItemInput: UpdateExpression: %s, ExpressionAttributeValues: %+v, ExpressionAttributeNames: %+v\n", updateExpression, expressionAttributeValues, expressionAttributeNames)
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
 
-	_, err := db.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String("Conversations"),
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(conversationsTable),
 		Key: map[string]types.AttributeValue{
 			"UserID":    &types.AttributeValueMemberS{Value: userID},
 			"Timestamp": &types.AttributeValueMemberS{Value: timestamp},
 		},
-		UpdateExpression:          aws.String(updateExpression),
+		UpdateExpression:          aws.String(strings.TrimSpace(updateExpression)),
 		ExpressionAttributeValues: expressionAttributeValues,
 		ExpressionAttributeNames:  expressionAttributeNames,
 		ReturnValues:              types.ReturnValueUpdatedNew,
 	})
 
 	if err != nil {
-		fmt.Printf("DynamoDB Update Error: %v\n", err)
+		slog.ErrorContext(ctx, "DynamoDB update failed", "user_id", userID, "error", err)
 		return err
 	}
 
-	fmt.Println("Update successful")
 	return nil
 }
 
-func GetAllConversations(userID string) ([]models.Conversation, error) {
-	result, err := db.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String("Conversations"),
+// ScheduleExpiry は要約済みのメッセージに、送信から after 経過した日時の削除期限を設定する。
+// ピン留めしたメッセージと、既に期限のあるメッセージは変更しない。設定した件数を返す
+func (s *ConversationStore) ScheduleExpiry(ctx context.Context, userID string, messages []models.Conversation, after time.Duration) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.ScheduleExpiry", attribute.String("user.id", userID), attribute.Int("message.count", len(messages)))
+	defer func() { tracing.End(span, err) }()
+
+	scheduled := 0
+	for _, m := range messages {
+		if m.Pinned || m.ExpiresAt != nil {
+			continue
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+		_, err := s.client.UpdateItem(callCtx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(conversationsTable),
+			Key: map[string]types.AttributeValue{
+				"UserID":    &types.AttributeValueMemberS{Value: userID},
+				"Timestamp": &types.AttributeValueMemberS{Value: m.Timestamp.Format(time.RFC3339)},
+			},
+			UpdateExpression:    aws.String("SET #expiresAt = :expiresAt"),
+			ConditionExpression: aws.String("attribute_exists(#ts) AND attribute_not_exists(#expiresAt) AND (attribute_not_exists(#pinned) OR #pinned = :false)"),
+			ExpressionAttributeNames: map[string]string{
+				"#ts":        "Timestamp",
+				"#expiresAt": expiresAtAttribute,
+				"#pinned":    "Pinned",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(m.Timestamp.Add(after).Unix(), 10)},
+				":false":     &types.AttributeValueMemberBOOL{Value: false},
+			},
+		})
+		cancel()
+
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			continue
+		}
+		if err != nil {
+			return scheduled, fmt.Errorf("failed to set message expiry: %v", err)
+		}
+		scheduled++
+	}
+	return scheduled, nil
+}
+
+// GetAllConversations はユーザーの会話を古い順に全て返す。ツールの記録は監査用なので含めない
+func (s *ConversationStore) GetAllConversations(ctx context.Context, userID string) ([]models.Conversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	input := excludeToolRecords(&dynamodb.QueryInput{
+		TableName:              aws.String(conversationsTable),
 		KeyConditionExpression: aws.String("UserID = :uid"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":uid": &types.AttributeValueMemberS{Value: userID},
 		},
 		ScanIndexForward: aws.Bool(true), // 古い順に並び替え
 	})
+	conversations := make([]models.Conversation, 0)
+	for {
+		result, err := s.client.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversationsFromItems(ctx, result.Items)...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return conversations, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// excludeToolRecords はクエリにツールの記録(Role が tool)を除くフィルターを加える
+func excludeToolRecords(input *dynamodb.QueryInput) *dynamodb.QueryInput {
+	filter := "#role <> :tool"
+	if input.FilterExpression != nil {
+		filter = "(" + *input.FilterExpression + ") AND " + filter
+	}
+	input.FilterExpression = aws.String(filter)
+
+	// ROLE は予約語なので名前を置き換える
+	if input.ExpressionAttributeNames == nil {
+		input.ExpressionAttributeNames = map[string]string{}
+	}
+	input.ExpressionAttributeNames["#role"] = "Role"
+	if input.ExpressionAttributeValues == nil {
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{}
+	}
+	input.ExpressionAttributeValues[":tool"] = &types.AttributeValueMemberS{Value: "tool"}
+	return input
+}
+
+// GetConversationsInPeriod は期間内の会話を古い順に取得する
+func (s *ConversationStore) GetConversationsInPeriod(ctx context.Context, userID string, start, end time.Time) (_ []models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.GetConversationsInPeriod", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	result, err := s.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(conversationsTable),
+		KeyConditionExpression: aws.String("UserID = :uid AND #ts BETWEEN :start AND :end"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "Timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid":   &types.AttributeValueMemberS{Value: userID},
+			":start": &types.AttributeValueMemberS{Value: start.Format(time.RFC3339)},
+			":end":   &types.AttributeValueMemberS{Value: end.Format(time.RFC3339)},
+		},
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to query conversations: %v", err)
 	}
 
-	conversations := make([]models.Conversation, 0)
+	return conversationsFromItems(ctx, result.Items), nil
+}
+
+// GetConversationsAfter は after より後のメッセージを古い順に最大 limit 件取得する
+func (s *ConversationStore) GetConversationsAfter(ctx context.Context, userID string, after time.Time, limit int) (_ []models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.GetConversationsAfter", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	result, err := s.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(conversationsTable),
+		KeyConditionExpression: aws.String("UserID = :uid AND #ts > :after"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "Timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid":   &types.AttributeValueMemberS{Value: userID},
+			":after": &types.AttributeValueMemberS{Value: after.Format(time.RFC3339)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversations: %v", err)
+	}
+
+	return conversationsFromItems(ctx, result.Items), nil
+}
+
+// FindMessage はIDでメッセージを探す。IDはキーではないので、新しい順にたどって見つかった時点で止める
+func (s *ConversationStore) FindMessage(ctx context.Context, userID, messageID string) (_ models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.FindMessage", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(conversationsTable),
+		KeyConditionExpression: aws.String("UserID = :uid"),
+		FilterExpression:       aws.String("ID = :id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+			":id":  &types.AttributeValueMemberS{Value: messageID},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	for {
+		result, err := s.client.Query(ctx, input)
+		if err != nil {
+			return models.Conversation{}, fmt.Errorf("failed to query conversations: %v", err)
+		}
+		if found := conversationsFromItems(ctx, result.Items); len(found) > 0 {
+			return found[0], nil
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return models.Conversation{}, ErrMessageNotFound
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// GetActiveUsers は since 以降に発言のあったユーザーを返す
+func (s *ConversationStore) GetActiveUsers(ctx context.Context, since time.Time) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "ConversationStore.GetActiveUsers")
+	defer func() { tracing.End(span, err) }()
+
+	sinceStr := since.Format(time.RFC3339)
+
+	ctx, cancel := context.WithTimeout(ctx, appconfig.GetStorageTimeout())
+	defer cancel()
+
+	// Scanを使用してアクティブユーザーを取得
+	result, err := s.client.Scan(ctx, &dynamodb.ScanInput{
+		TableName:        aws.String(conversationsTable),
+		FilterExpression: aws.String("#ts >= :ts"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "Timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ts": &types.AttributeValueMemberS{Value: sinceStr},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan DynamoDB: %v", err)
+	}
+
+	// ユニークなユーザーIDを収集
+	userMap := make(map[string]bool)
 	for _, item := range result.Items {
+		if userID, ok := item["UserID"].(*types.AttributeValueMemberS); ok {
+			userMap[userID.Value] = true
+		}
+	}
+
+	var users []string
+	for userID := range userMap {
+		users = append(users, userID)
+	}
+
+	return users, nil
+}
+
+// conversationsFromItems はDynamoDBのアイテムを会話に変換する。不正なアイテムは読み飛ばす
+func conversationsFromItems(ctx context.Context, items []map[string]types.AttributeValue) []models.Conversation {
+	now := time.Now()
+	conversations := make([]models.Conversation, 0)
+	for _, item := range items {
 		// IDの型アサーションを安全に実施
 		idAttr, ok := item["ID"].(*types.AttributeValueMemberS)
 		if !ok || idAttr == nil {
-			fmt.Println("Missing or invalid ID")
+			slog.WarnContext(ctx, "Missing or invalid ID")
 			continue
 		}
 		id := idAttr.Value
@@ -212,7 +519,7 @@ func GetAllConversations(userID string) ([]models.Conversation, error) {
 		// UserIDの型アサーションを安全に実施
 		userIDAttr, ok := item["UserID"].(*types.AttributeValueMemberS)
 		if !ok || userIDAttr == nil {
-			fmt.Println("Missing or invalid UserID")
+			slog.WarnContext(ctx, "Missing or invalid UserID")
 			continue
 		}
 		userID := userIDAttr.Value
@@ -220,7 +527,7 @@ func GetAllConversations(userID string) ([]models.Conversation, error) {
 		// Roleの型アサーションを安全に実施
 		roleAttr, ok := item["Role"].(*types.AttributeValueMemberS)
 		if !ok || roleAttr == nil {
-			fmt.Println("Missing or invalid Role")
+			slog.WarnContext(ctx, "Missing or invalid Role")
 			continue
 		}
 		role := roleAttr.Value
@@ -228,7 +535,7 @@ func GetAllConversations(userID string) ([]models.Conversation, error) {
 		// Contentの型アサーションを安全に実施
 		contentAttr, ok := item["Content"].(*types.AttributeValueMemberS)
 		if !ok || contentAttr == nil {
-			fmt.Println("Missing or invalid Content")
+			slog.WarnContext(ctx, "Missing or invalid Content")
 			continue
 		}
 		content := contentAttr.Value
@@ -236,12 +543,12 @@ func GetAllConversations(userID string) ([]models.Conversation, error) {
 		// Timestampの型アサーションを安全に実施
 		timestampAttr, ok := item["Timestamp"].(*types.AttributeValueMemberS)
 		if !ok || timestampAttr == nil {
-			fmt.Println("Missing or invalid Timestamp")
+			slog.WarnContext(ctx, "Missing or invalid Timestamp")
 			continue
 		}
 		timestamp, err := time.Parse(time.RFC3339, timestampAttr.Value)
 		if err != nil {
-			fmt.Printf("Invalid Timestamp format: %v\n", err)
+			slog.WarnContext(ctx, "Invalid Timestamp format", "error", err)
 			continue
 		}
 
@@ -251,18 +558,188 @@ func GetAllConversations(userID string) ([]models.Conversation, error) {
 			Role:      role,
 			Content:   content,
 			Timestamp: timestamp,
+			Citations: citationsFromAttribute(item["Citations"]),
+			ToolCall:  toolCallFromAttribute(item["ToolCall"]),
+		}
+		conv.Attachments = attachmentsFromAttribute(item["Attachments"])
+		conv.PromptVersions = promptVersionsFromAttribute(item["PromptVersions"])
+		if locale, ok := item["Locale"].(*types.AttributeValueMemberS); ok && locale != nil {
+			conv.Locale = locale.Value
+		}
+		if pinned, ok := item["Pinned"].(*types.AttributeValueMemberBOOL); ok && pinned != nil {
+			conv.Pinned = pinned.Value
+		}
+
+		// TTLによる削除は遅れることがあるので、期限を過ぎたメッセージは返さない
+		if expiresAt, ok := item[expiresAtAttribute].(*types.AttributeValueMemberN); ok && expiresAt != nil {
+			if sec, err := strconv.ParseInt(expiresAt.Value, 10, 64); err == nil {
+				t := time.Unix(sec, 0).UTC()
+				if !t.After(now) {
+					continue
+				}
+				conv.ExpiresAt = &t
+			}
 		}
 		conversations = append(conversations, conv)
 	}
 
-	return conversations, nil
+	return conversations
 }
 
+// citationsToAttribute は出典を {Title, URL} のマップのリストに変換する
+func citationsToAttribute(citations []models.Citation) types.AttributeValue {
+	list := make([]types.AttributeValue, 0, len(citations))
+	for _, c := range citations {
+		m := map[string]types.AttributeValue{
+			"URL": &types.AttributeValueMemberS{Value: c.URL},
+		}
+		if c.Title != "" {
+			m["Title"] = &types.AttributeValueMemberS{Value: c.Title}
+		}
+		list = append(list, &types.AttributeValueMemberM{Value: m})
+	}
+	return &types.AttributeValueMemberL{Value: list}
+}
+
+// citationsFromAttribute は Citations 属性を読み取る。属性がない・形式が不正な要素は無視する
+func citationsFromAttribute(attr types.AttributeValue) []models.Citation {
+	list, ok := attr.(*types.AttributeValueMemberL)
+	if !ok || list == nil {
+		return nil
+	}
+
+	var citations []models.Citation
+	for _, v := range list.Value {
+		m, ok := v.(*types.AttributeValueMemberM)
+		if !ok || m == nil {
+			continue
+		}
+		url, ok := m.Value["URL"].(*types.AttributeValueMemberS)
+		if !ok || url == nil || url.Value == "" {
+			continue
+		}
+		c := models.Citation{URL: url.Value}
+		if title, ok := m.Value["Title"].(*types.AttributeValueMemberS); ok && title != nil {
+			c.Title = title.Value
+		}
+		citations = append(citations, c)
+	}
+	return citations
+}
+
+// attachmentsToAttribute は添付ファイルの参照を {ID, Filename, ContentType, Size} のマップのリストに変換する
+func attachmentsToAttribute(attachments []models.AttachmentRef) types.AttributeValue {
+	list := make([]types.AttributeValue, 0, len(attachments))
+	for _, a := range attachments {
+		list = append(list, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"ID":          &types.AttributeValueMemberS{Value: a.ID},
+			"Filename":    &types.AttributeValueMemberS{Value: a.Filename},
+			"ContentType": &types.AttributeValueMemberS{Value: a.ContentType},
+			"Size":        &types.AttributeValueMemberN{Value: strconv.FormatInt(a.Size, 10)},
+		}})
+	}
+	return &types.AttributeValueMemberL{Value: list}
+}
+
+// attachmentsFromAttribute は Attachments 属性を読み取る。IDのない要素は無視する
+func attachmentsFromAttribute(attr types.AttributeValue) []models.AttachmentRef {
+	list, ok := attr.(*types.AttributeValueMemberL)
+	if !ok || list == nil {
+		return nil
+	}
+
+	var attachments []models.AttachmentRef
+	for _, v := range list.Value {
+		m, ok := v.(*types.AttributeValueMemberM)
+		if !ok || m == nil {
+			continue
+		}
+		id, ok := m.Value["ID"].(*types.AttributeValueMemberS)
+		if !ok || id == nil || id.Value == "" {
+			continue
+		}
+		a := models.AttachmentRef{ID: id.Value}
+		if filename, ok := m.Value["Filename"].(*types.AttributeValueMemberS); ok && filename != nil {
+			a.Filename = filename.Value
+		}
+		if contentType, ok := m.Value["ContentType"].(*types.AttributeValueMemberS); ok && contentType != nil {
+			a.ContentType = contentType.Value
+		}
+		if size, ok := m.Value["Size"].(*types.AttributeValueMemberN); ok && size != nil {
+			a.Size, _ = strconv.ParseInt(size.Value, 10, 64)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
+
+// promptVersionsToAttribute はプロンプトのバージョンを名前→バージョンのマップに変換する
+func promptVersionsToAttribute(versions models.PromptVersions) types.AttributeValue {
+	m := make(map[string]types.AttributeValue, len(versions))
+	for name, version := range versions {
+		m[name] = &types.AttributeValueMemberN{Value: strconv.Itoa(version)}
+	}
+	return &types.AttributeValueMemberM{Value: m}
+}
+
+// promptVersionsFromAttribute は PromptVersions 属性を読み取る。数値でない要素は無視する
+func promptVersionsFromAttribute(attr types.AttributeValue) models.PromptVersions {
+	m, ok := attr.(*types.AttributeValueMemberM)
+	if !ok || m == nil {
+		return nil
+	}
+
+	versions := make(models.PromptVersions, len(m.Value))
+	for name, v := range m.Value {
+		n, ok := v.(*types.AttributeValueMemberN)
+		if !ok || n == nil {
+			continue
+		}
+		if version, err := strconv.Atoi(n.Value); err == nil {
+			versions[name] = version
+		}
+	}
+	return versions
+}
+
+// toolCallToAttribute はツール呼び出しの記録をマップに変換する
+func toolCallToAttribute(call *models.ToolCall) types.AttributeValue {
+	m := map[string]types.AttributeValue{
+		"ID":        &types.AttributeValueMemberS{Value: call.ID},
+		"Name":      &types.AttributeValueMemberS{Value: call.Name},
+		"Arguments": &types.AttributeValueMemberS{Value: call.Arguments},
+	}
+	if call.Error != "" {
+		m["Error"] = &types.AttributeValueMemberS{Value: call.Error}
+	}
+	return &types.AttributeValueMemberM{Value: m}
+}
+
+// toolCallFromAttribute は ToolCall 属性を読み取る。属性がなければ nil
+func toolCallFromAttribute(attr types.AttributeValue) *models.ToolCall {
+	m, ok := attr.(*types.AttributeValueMemberM)
+	if !ok || m == nil {
+		return nil
+	}
+
+	str := func(key string) string {
+		if v, ok := m.Value[key].(*types.AttributeValueMemberS); ok && v != nil {
+			return v.Value
+		}
+		return ""
+	}
+	return &models.ToolCall{
+		ID:        str("ID"),
+		Name:      str("Name"),
+		Arguments: str("Arguments"),
+		Error:     str("Error"),
+	}
+}
 
 func GetDynamoDBClient() *dynamodb.Client {
     customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
         return aws.Endpoint{
-            URL: "http://localhost:8000",
+            URL: appconfig.GetDynamoDBEndpoint(),
         }, nil
     })
 
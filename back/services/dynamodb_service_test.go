@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// fakeConversationTable は DynamoDB の Query だけに答えるテスト用のサーバー。
+// 1ページに pageSize 件ずつ読み、フィルターは excludeToolRecords が作る式だけを解釈する
+type fakeConversationTable struct {
+	t        *testing.T
+	items    []map[string]map[string]string
+	pageSize int
+	queries  int
+}
+
+type fakeQueryRequest struct {
+	FilterExpression          string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]map[string]string
+	ExclusiveStartKey         map[string]map[string]string
+	Limit                     int
+	ScanIndexForward          *bool
+}
+
+func (f *fakeConversationTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); target != "DynamoDB_20120810.Query" {
+		f.t.Errorf("unexpected operation %q", target)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.queries++
+
+	var req fakeQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("failed to decode query: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	excludeRole := ""
+	switch req.FilterExpression {
+	case "":
+	case "#role <> :tool":
+		if req.ExpressionAttributeNames["#role"] != "Role" {
+			f.t.Errorf("#role refers to %q", req.ExpressionAttributeNames["#role"])
+		}
+		excludeRole = req.ExpressionAttributeValues[":tool"]["S"]
+	default:
+		f.t.Errorf("unexpected filter %q", req.FilterExpression)
+	}
+
+	ordered := f.items
+	if req.ScanIndexForward != nil && !*req.ScanIndexForward {
+		ordered = make([]map[string]map[string]string, len(f.items))
+		for i, item := range f.items {
+			ordered[len(f.items)-1-i] = item
+		}
+	}
+
+	start := 0
+	if key, ok := req.ExclusiveStartKey["Offset"]; ok {
+		start, _ = strconv.Atoi(key["N"])
+	}
+	size := f.pageSize
+	if req.Limit > 0 && req.Limit < size {
+		size = req.Limit
+	}
+	end := min(start+size, len(ordered))
+
+	// Limit と 1MB の上限はフィルターの前に適用されるので、ページが空になることもある
+	items := make([]map[string]map[string]string, 0)
+	for _, item := range ordered[start:end] {
+		if excludeRole != "" && item["Role"]["S"] == excludeRole {
+			continue
+		}
+		items = append(items, item)
+	}
+	resp := map[string]interface{}{"Items": items, "Count": len(items), "ScannedCount": end - start}
+	if end < len(ordered) {
+		resp["LastEvaluatedKey"] = map[string]map[string]string{"Offset": {"N": strconv.Itoa(end)}}
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newFakeConversationStore(t *testing.T, roles []string, pageSize int) (*ConversationStore, *fakeConversationTable) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := &fakeConversationTable{t: t, pageSize: pageSize}
+	for i, role := range roles {
+		table.items = append(table.items, map[string]map[string]string{
+			"ID":        {"S": fmt.Sprintf("m%d", i)},
+			"UserID":    {"S": "user"},
+			"Role":      {"S": role},
+			"Content":   {"S": fmt.Sprintf("%s %d", role, i)},
+			"Timestamp": {"S": base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339)},
+		})
+	}
+	server := httptest.NewServer(table)
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL),
+		Retryer:          aws.NopRetryer{},
+	})
+	return NewConversationStore(client, nil), table
+}
+
+func TestGetAllConversationsExcludesToolRecords(t *testing.T) {
+	roles := []string{"user", "tool", "tool", "assistant", "user", "tool", "assistant"}
+	store, table := newFakeConversationStore(t, roles, 2)
+
+	conversations, err := store.GetAllConversations(context.Background(), "user")
+	if err != nil {
+		t.Fatalf("GetAllConversations returned error: %v", err)
+	}
+
+	var ids []string
+	for _, c := range conversations {
+		if c.Role == "tool" {
+			t.Errorf("tool record %s was returned", c.ID)
+		}
+		ids = append(ids, c.ID)
+	}
+	if want := []string{"m0", "m3", "m4", "m6"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("GetAllConversations returned %v, want %v", ids, want)
+	}
+	if table.queries != 4 {
+		t.Fatalf("made %d queries, want 4 pages", table.queries)
+	}
+}
+
+func TestGetRecentConversationsFillsLimitWithoutToolRecords(t *testing.T) {
+	// 新しい方から tool が3件続いても、会話のメッセージを limit 件まで集める
+	roles := []string{"user", "assistant", "user", "assistant", "tool", "tool", "tool", "user"}
+	store, _ := newFakeConversationStore(t, roles, 10)
+
+	conversations, err := store.GetRecentConversations(context.Background(), "user", 3)
+	if err != nil {
+		t.Fatalf("GetRecentConversations returned error: %v", err)
+	}
+
+	var ids []string
+	for _, c := range conversations {
+		ids = append(ids, c.ID)
+	}
+	if want := []string{"m7", "m3", "m2"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("GetRecentConversations returned %v, want %v", ids, want)
+	}
+}
+
+func TestExcludeToolRecordsKeepsExistingFilter(t *testing.T) {
+	input := excludeToolRecords(&dynamodb.QueryInput{
+		FilterExpression:         aws.String("#ts >= :ts"),
+		ExpressionAttributeNames: map[string]string{"#ts": "Timestamp"},
+	})
+	if got := aws.ToString(input.FilterExpression); got != "(#ts >= :ts) AND #role <> :tool" {
+		t.Fatalf("FilterExpression = %q", got)
+	}
+	if input.ExpressionAttributeNames["#ts"] != "Timestamp" || input.ExpressionAttributeNames["#role"] != "Role" {
+		t.Fatalf("ExpressionAttributeNames = %v", input.ExpressionAttributeNames)
+	}
+	if _, ok := input.ExpressionAttributeValues[":tool"]; !ok {
+		t.Fatal(":tool value was not added")
+	}
+}
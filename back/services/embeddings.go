@@ -0,0 +1,91 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/tracing"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// embeddingBatchSize は1回の埋め込みAPI呼び出しにまとめるテキスト数
+const embeddingBatchSize = 100
+
+// embeddingDimensions は vector 列の次元数
+const embeddingDimensions = 1536
+
+// embeddingModel は現在の埋め込みモデル
+func embeddingModel() string {
+	return config.GetEmbeddingModel()
+}
+
+// embeddingVersion は現在の埋め込みのバージョン。保存する行に付け、検索はこのバージョンの行だけを対象にする
+func embeddingVersion() int {
+	return config.GetEmbeddingVersion()
+}
+
+// newEmbeddingRequest は現在のモデルで埋め込みを作るリクエストを組み立てる
+func newEmbeddingRequest(texts []string) openai.EmbeddingRequest {
+	req := openai.EmbeddingRequest{
+		Input: texts,
+		Model: openai.EmbeddingModel(embeddingModel()),
+	}
+	// ada-002 は次元数を指定できない。それ以外のモデルは列の次元数に合わせて出力させる
+	if req.Model != openai.AdaEmbeddingV2 {
+		req.Dimensions = embeddingDimensions
+	}
+	return req
+}
+
+// embedTexts は複数のテキストをまとめてベクトル化し、入力と同じ順で返す。使用量は feature として記録する
+func embedTexts(ctx context.Context, usage *UsageService, userID, feature string, texts []string) (_ [][]float64, err error) {
+	ctx, span := tracing.Start(ctx, "embedTexts", attribute.String("llm.model", embeddingModel()), attribute.Int("embedding.count", len(texts)))
+	defer func() { tracing.End(span, err) }()
+
+	client := newOpenAIClient()
+
+	vectors := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		callStart := time.Now()
+		resp, err := client.CreateEmbeddings(ctx, newEmbeddingRequest(texts[start:end]))
+		observeProviderCall(ProviderOpenAI, embeddingModel(), "embedding", callStart, err, resp.Usage.PromptTokens, 0)
+		if err != nil {
+			return nil, fmt.Errorf("embedding creation failed: %w", err)
+		}
+		usage.Record(ctx, UsageRecord{
+			UserID:       userID,
+			Feature:      feature,
+			Provider:     ProviderOpenAI,
+			Model:        embeddingModel(),
+			PromptTokens: resp.Usage.PromptTokens,
+		})
+
+		if len(resp.Data) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(resp.Data))
+		}
+		batch := make([][]float64, end-start)
+		for _, d := range resp.Data {
+			if d.Index < 0 || d.Index >= len(batch) {
+				return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+			}
+			vector := make([]float64, len(d.Embedding))
+			for i, v := range d.Embedding {
+				vector[i] = float64(v)
+			}
+			batch[d.Index] = vector
+		}
+		vectors = append(vectors, batch...)
+	}
+
+	metrics.EmbeddingsCreated.WithLabelValues(embeddingModel(), feature).Add(float64(len(vectors)))
+	return vectors, nil
+}
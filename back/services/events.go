@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 通知などに流すイベントの種類
+const (
+	// EventMessageCreated はアシスタントのメッセージが会話に保存されたこと。Data は models.Conversation
+	EventMessageCreated = "message.created"
+	// EventSummaryCreated はバッチが会話の要約を保存したこと。Data は SummaryCreated
+	EventSummaryCreated = "summary.created"
+)
+
+// EventTypes は購読できるイベントの一覧
+var EventTypes = []string{EventMessageCreated, EventSummaryCreated}
+
+// Event はプロセス内で配信されるイベント
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	UserID    string      `json:"user_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// SummaryCreated は EventSummaryCreated の Data
+type SummaryCreated struct {
+	Summary   string    `json:"summary"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// EventHandler はイベントの購読者。Publish の呼び出し元で同期的に呼ばれるので、重い処理はしないこと
+type EventHandler func(ctx context.Context, event Event)
+
+// EventBus はイベントを購読者に配るプロセス内のバス
+type EventBus struct {
+	mu       sync.RWMutex
+	handlers []EventHandler
+}
+
+// NewEventBus コンストラクタ
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe は購読者を追加する
+func (b *EventBus) Subscribe(handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Publish はIDと時刻を採番してイベントを全購読者に渡す。b が nil なら何もしない
+func (b *EventBus) Publish(ctx context.Context, event Event) {
+	if b == nil {
+		return
+	}
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(ctx, event)
+	}
+}
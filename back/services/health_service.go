@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	HealthStatusUp   = "up"
+	HealthStatusDown = "down"
+)
+
+// HealthCheckFunc は依存先1つの疎通確認
+type HealthCheckFunc func(ctx context.Context) error
+
+// ComponentStatus は依存先ごとの確認結果
+type ComponentStatus struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Critical  bool   `json:"critical"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthCheck struct {
+	name     string
+	critical bool
+	check    HealthCheckFunc
+}
+
+// HealthChecker は登録された依存先をタイムアウト付きで並行に確認する
+type HealthChecker struct {
+	timeout  time.Duration
+	checks   []healthCheck
+	draining atomic.Bool
+}
+
+// NewHealthChecker コンストラクタ
+func NewHealthChecker(timeout time.Duration) *HealthChecker {
+	return &HealthChecker{timeout: timeout}
+}
+
+// Register は依存先を登録する。critical な依存先が落ちているとレディネスは失敗する
+func (h *HealthChecker) Register(name string, critical bool, check HealthCheckFunc) {
+	h.checks = append(h.checks, healthCheck{name: name, critical: critical, check: check})
+}
+
+// MarkDraining は終了処理中としてレディネスを失敗させ、新しいトラフィックが来ないようにする
+func (h *HealthChecker) MarkDraining() {
+	h.draining.Store(true)
+}
+
+// Draining は終了処理中かを返す
+func (h *HealthChecker) Draining() bool {
+	return h.draining.Load()
+}
+
+// Check は全ての依存先を確認し、critical なものが全て正常かどうかと各結果を返す
+func (h *HealthChecker) Check(ctx context.Context) (bool, []ComponentStatus) {
+	results := make([]ComponentStatus, len(h.checks))
+
+	var wg sync.WaitGroup
+	for i, hc := range h.checks {
+		wg.Add(1)
+		go func(i int, hc healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := hc.check(checkCtx)
+			results[i] = ComponentStatus{
+				Name:      hc.name,
+				Status:    HealthStatusUp,
+				Critical:  hc.critical,
+				LatencyMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				results[i].Status = HealthStatusDown
+				results[i].Error = err.Error()
+			}
+		}(i, hc)
+	}
+	wg.Wait()
+
+	ready := !h.Draining()
+	for _, r := range results {
+		if r.Critical && r.Status != HealthStatusUp {
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+// PostgresHealthCheck は接続プールにPingする
+func PostgresHealthCheck(db *sql.DB) HealthCheckFunc {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// DynamoDBHealthCheck は会話テーブルを参照できるかを確認する
+func DynamoDBHealthCheck(client *dynamodb.Client) HealthCheckFunc {
+	return func(ctx context.Context) error {
+		_, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(conversationsTable),
+		})
+		return err
+	}
+}
+
+// ProviderHealthCheck はLLMプロバイダーの到達性を確認する。
+// プローブのたびに外部APIを叩かないよう、結果を ttl の間キャッシュする
+func ProviderHealthCheck(provider, url, apiKey string, ttl time.Duration) HealthCheckFunc {
+	var (
+		mu        sync.Mutex
+		checkedAt time.Time
+		lastErr   error
+	)
+	client := &http.Client{}
+
+	return func(ctx context.Context) error {
+		if ProviderCircuitOpen(provider) {
+			return &ProviderError{Provider: provider, Kind: ErrCircuitOpen}
+		}
+		if apiKey == "" {
+			return fmt.Errorf("%s API key is not set", provider)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return lastErr
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			// 到達できれば十分なので、認証エラー以外の4xxは正常とみなす
+			if resp.StatusCode >= 500 || resp.StatusCode == http.StatusUnauthorized {
+				err = fmt.Errorf("%s returned status %d", provider, resp.StatusCode)
+			}
+		}
+		checkedAt, lastErr = time.Now(), err
+		return err
+	}
+}
@@ -0,0 +1,568 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/tracing"
+	"back/webhook"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 通知の送信先の種類
+const (
+	NotificationKindWebhook = "webhook"
+	NotificationKindPush    = "push"
+)
+
+// 通知の配信状態
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	// maxNotificationEndpoints はユーザーごとに登録できる送信先の数
+	maxNotificationEndpoints = 20
+	// maxDeliveryRetryDelay は再送間隔の上限
+	maxDeliveryRetryDelay = 6 * time.Hour
+	// maxDeliveryErrorRunes は last_error に残すエラーの最大文字数
+	maxDeliveryErrorRunes = 500
+)
+
+// pushPlatforms はプッシュ通知ゲートウェイが扱うプラットフォーム
+var pushPlatforms = []string{"ios", "android"}
+
+var (
+	ErrNotificationEndpointNotFound = errors.New("notification endpoint not found")
+	ErrNotificationDeliveryNotFound = errors.New("notification delivery not found")
+	// ErrInvalidNotificationEndpoint は送信先の登録内容が不正なことを表す
+	ErrInvalidNotificationEndpoint = errors.New("invalid notification endpoint")
+
+	errBlockedAddress = errors.New("webhook address is not allowed")
+)
+
+const notificationEndpointColumns = `id, user_id, kind, target, COALESCE(platform, ''), secret, events, created_at`
+
+// NotificationService は通知の送信先の管理と、イベントの配信キューへの登録・送信を行う。
+// 送信はバッチデーモンの DeliverPending が行い、失敗したものは間隔を空けて再送する
+type NotificationService struct {
+	db      *sql.DB
+	webhook *http.Client
+	push    *http.Client
+}
+
+// NewNotificationService コンストラクタ
+func NewNotificationService(db *sql.DB) *NotificationService {
+	timeout := config.GetNotificationTimeout()
+	return &NotificationService{
+		db:      db,
+		webhook: newWebhookHTTPClient(timeout, config.GetWebhookAllowInsecure()),
+		// ゲートウェイは運用側が設定する送信先なので、プライベートアドレスでも許可する
+		push: &http.Client{Timeout: timeout},
+	}
+}
+
+// newWebhookHTTPClient はユーザーが登録したURLに送るためのクライアント。
+// allowInsecure でなければ、名前解決後のアドレスがプライベート・ループバックなら接続しない
+func newWebhookHTTPClient(timeout time.Duration, allowInsecure bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowInsecure {
+		dialer := &net.Dialer{
+			Timeout: timeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+					return errBlockedAddress
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// リダイレクト先は検証していないので追わない
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()
+}
+
+// validateWebhookURL はWebhookのURLを検証する。本番ではhttpsのみ許可する
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute URL", ErrInvalidNotificationEndpoint)
+	}
+	if config.GetWebhookAllowInsecure() {
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("%w: url must be http or https", ErrInvalidNotificationEndpoint)
+		}
+		return nil
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("%w: url must be https", ErrInvalidNotificationEndpoint)
+	}
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("%w: url must not point to an internal address", ErrInvalidNotificationEndpoint)
+	}
+	if ip := net.ParseIP(host); ip != nil && isInternalIP(ip) {
+		return fmt.Errorf("%w: url must not point to an internal address", ErrInvalidNotificationEndpoint)
+	}
+	return nil
+}
+
+// Register は送信先を登録する。同じ送信先を登録し直した場合は購読イベントを更新し、署名用の鍵を作り直す
+func (ns *NotificationService) Register(ctx context.Context, userID, kind, target, platform string, events []string) (_ models.NotificationEndpoint, err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.Register", attribute.String("user.id", userID), attribute.String("notification.kind", kind))
+	defer func() { tracing.End(span, err) }()
+
+	target = strings.TrimSpace(target)
+	switch kind {
+	case NotificationKindWebhook:
+		if err := validateWebhookURL(target); err != nil {
+			return models.NotificationEndpoint{}, err
+		}
+		platform = ""
+	case NotificationKindPush:
+		if config.GetPushGatewayURL() == "" {
+			return models.NotificationEndpoint{}, fmt.Errorf("%w: push notifications are not configured", ErrInvalidNotificationEndpoint)
+		}
+		if target == "" || len(target) > 4096 {
+			return models.NotificationEndpoint{}, fmt.Errorf("%w: token must be 1-4096 characters", ErrInvalidNotificationEndpoint)
+		}
+		if !containsString(pushPlatforms, platform) {
+			return models.NotificationEndpoint{}, fmt.Errorf("%w: platform must be one of %v", ErrInvalidNotificationEndpoint, pushPlatforms)
+		}
+	default:
+		return models.NotificationEndpoint{}, fmt.Errorf("%w: kind must be %s or %s", ErrInvalidNotificationEndpoint, NotificationKindWebhook, NotificationKindPush)
+	}
+
+	if len(events) == 0 {
+		events = EventTypes
+	}
+	for _, event := range events {
+		if !containsString(EventTypes, event) {
+			return models.NotificationEndpoint{}, fmt.Errorf("%w: events must be in %v", ErrInvalidNotificationEndpoint, EventTypes)
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return models.NotificationEndpoint{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	var count int
+	err = ns.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM notification_endpoints WHERE user_id = $1 AND NOT (kind = $2 AND target = $3)
+    `, userID, kind, target).Scan(&count)
+	if err != nil {
+		return models.NotificationEndpoint{}, fmt.Errorf("failed to count notification endpoints: %v", err)
+	}
+	if count >= maxNotificationEndpoints {
+		return models.NotificationEndpoint{}, fmt.Errorf("%w: at most %d endpoints are allowed", ErrInvalidNotificationEndpoint, maxNotificationEndpoints)
+	}
+
+	row := ns.db.QueryRowContext(ctx, `
+        INSERT INTO notification_endpoints (user_id, kind, target, platform, secret, events, created_at)
+        VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)
+        ON CONFLICT (user_id, kind, target) DO UPDATE SET
+            platform = EXCLUDED.platform,
+            secret = EXCLUDED.secret,
+            events = EXCLUDED.events
+        RETURNING `+notificationEndpointColumns,
+		userID, kind, target, platform, secret, pq.Array(events), time.Now().UTC())
+
+	endpoint, err := scanNotificationEndpoint(row)
+	if err != nil {
+		return models.NotificationEndpoint{}, fmt.Errorf("failed to register notification endpoint: %v", err)
+	}
+	return endpoint, nil
+}
+
+// List はユーザーの送信先を返す。署名用の鍵は含めない
+func (ns *NotificationService) List(ctx context.Context, userID string) (_ []models.NotificationEndpoint, err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.List", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := ns.db.QueryContext(ctx, `
+        SELECT `+notificationEndpointColumns+`
+        FROM notification_endpoints
+        WHERE user_id = $1
+        ORDER BY created_at
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification endpoints: %v", err)
+	}
+	defer rows.Close()
+
+	endpoints := make([]models.NotificationEndpoint, 0)
+	for rows.Next() {
+		endpoint, err := scanNotificationEndpoint(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan notification endpoint: %v", err)
+		}
+		endpoint.Secret = ""
+		endpoints = append(endpoints, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read notification endpoints: %v", err)
+	}
+	return endpoints, nil
+}
+
+// Delete は送信先を削除する。送信待ちの通知も一緒に削除される
+func (ns *NotificationService) Delete(ctx context.Context, userID, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.Delete", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrNotificationEndpointNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := ns.db.ExecContext(ctx, `
+        DELETE FROM notification_endpoints WHERE id = $1 AND user_id = $2
+    `, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete notification endpoint: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotificationEndpointNotFound
+	}
+	return nil
+}
+
+// Publish はイベントを購読している送信先ごとに配信キューへ登録する。EventBus の購読者として使う。
+// 通知の失敗で元の処理を失敗させないよう、エラーはログに残すだけにする
+func (ns *NotificationService) Publish(ctx context.Context, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode notification event", "event", event.Type, "error", err)
+		return
+	}
+
+	// 呼び出し元がキャンセルされても、発生したイベントは登録する
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := ns.db.ExecContext(ctx, `
+        INSERT INTO notification_deliveries (endpoint_id, event_id, event_type, payload, next_attempt_at, created_at)
+        SELECT id, $2, $3, $4, $5, $5
+        FROM notification_endpoints
+        WHERE user_id = $1 AND $3 = ANY(events)
+    `, event.UserID, event.ID, event.Type, payload, time.Now().UTC())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to enqueue notifications", "user_id", event.UserID, "event", event.Type, "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		metrics.NotificationsEnqueued.WithLabelValues(event.Type).Add(float64(n))
+	}
+}
+
+// claimedDelivery は送信のために確保した配信1件と送信先
+type claimedDelivery struct {
+	id        string
+	eventType string
+	payload   []byte
+	attempts  int
+	kind      string
+	target    string
+	platform  string
+	secret    string
+}
+
+// DeliverPending は送信時刻の来た通知を最大 limit 件送信し、成功した件数を返す。
+// 送信中の行は next_attempt_at を先に延ばして確保するので、複数のバッチが動いても二重に送らず、
+// 途中でプロセスが落ちても確保期間が過ぎれば再送される
+func (ns *NotificationService) DeliverPending(ctx context.Context, limit int) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.DeliverPending")
+	defer func() { tracing.End(span, err) }()
+
+	claimed, err := ns.claim(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, d := range claimed {
+		sendErr := ns.send(ctx, d)
+		if err := ns.recordAttempt(ctx, d, sendErr); err != nil {
+			slog.ErrorContext(ctx, "Failed to record notification attempt", "delivery_id", d.id, "error", err)
+		}
+		if sendErr == nil {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+func (ns *NotificationService) claim(ctx context.Context, limit int) ([]claimedDelivery, error) {
+	now := time.Now().UTC()
+	// 全件を順に送り終えるまで他のバッチに取られないようにする
+	lease := config.GetNotificationTimeout()*time.Duration(limit) + time.Minute
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := ns.db.QueryContext(ctx, `
+        UPDATE notification_deliveries d
+        SET attempts = d.attempts + 1, next_attempt_at = $2
+        FROM notification_endpoints e
+        WHERE e.id = d.endpoint_id AND d.id IN (
+            SELECT id FROM notification_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= $1
+            ORDER BY next_attempt_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING d.id, d.event_type, d.payload, d.attempts, e.kind, e.target, COALESCE(e.platform, ''), e.secret
+    `, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim notifications: %v", err)
+	}
+	defer rows.Close()
+
+	var claimed []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		if err := rows.Scan(&d.id, &d.eventType, &d.payload, &d.attempts, &d.kind, &d.target, &d.platform, &d.secret); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %v", err)
+		}
+		claimed = append(claimed, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read notifications: %v", err)
+	}
+	return claimed, nil
+}
+
+// errGone は送信先がもう存在しない(410)ことを表す。再送せずにデッドレターにする
+var errGone = errors.New("endpoint is gone")
+
+// send は通知を1件送信する。Webhookはイベントをそのまま、プッシュはゲートウェイにトークンと一緒に送る
+func (ns *NotificationService) send(ctx context.Context, d claimedDelivery) (err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.send", attribute.String("notification.kind", d.kind), attribute.String("event.type", d.eventType))
+	defer func() { tracing.End(span, err) }()
+
+	client, target, secret, body := ns.webhook, d.target, d.secret, d.payload
+	if d.kind == NotificationKindPush {
+		target = config.GetPushGatewayURL()
+		if target == "" {
+			return fmt.Errorf("push notifications are not configured")
+		}
+		body, err = json.Marshal(map[string]interface{}{
+			"token":    d.target,
+			"platform": d.platform,
+			"event":    json.RawMessage(d.payload),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode push notification: %v", err)
+		}
+		client, secret = ns.push, config.GetPushGatewaySecret()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "memorai-notifications/1")
+	req.Header.Set(webhook.EventHeader, d.eventType)
+	req.Header.Set(webhook.DeliveryHeader, d.id)
+	req.Header.Set(webhook.TimestampHeader, fmt.Sprint(now.Unix()))
+	if secret != "" {
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign(secret, now, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusGone:
+		return errGone
+	default:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// recordAttempt は送信結果を保存する。失敗なら再送時刻を決めるか、上限に達していればデッドレターにする
+func (ns *NotificationService) recordAttempt(ctx context.Context, d claimedDelivery, sendErr error) error {
+	// 送信済みの結果は、シャットダウン中でも記録しておく
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.GetStorageTimeout())
+	defer cancel()
+
+	now := time.Now().UTC()
+	if sendErr == nil {
+		metrics.NotificationDeliveries.WithLabelValues(d.kind, DeliveryDelivered).Inc()
+		_, err := ns.db.ExecContext(ctx, `
+            UPDATE notification_deliveries SET status = $2, delivered_at = $3, last_error = NULL WHERE id = $1
+        `, d.id, DeliveryDelivered, now)
+		return err
+	}
+
+	status, next := DeliveryPending, now.Add(retryDelay(d.attempts))
+	if errors.Is(sendErr, errGone) || d.attempts >= config.GetNotificationMaxAttempts() {
+		status, next = DeliveryDead, now
+		slog.WarnContext(ctx, "Notification moved to dead letters", "delivery_id", d.id, "kind", d.kind, "attempts", d.attempts, "error", sendErr)
+		metrics.NotificationDeliveries.WithLabelValues(d.kind, DeliveryDead).Inc()
+	} else {
+		slog.InfoContext(ctx, "Notification delivery failed, will retry", "delivery_id", d.id, "kind", d.kind, "attempts", d.attempts, "retry_at", next, "error", sendErr)
+		metrics.NotificationDeliveries.WithLabelValues(d.kind, "retry").Inc()
+	}
+
+	_, err := ns.db.ExecContext(ctx, `
+        UPDATE notification_deliveries SET status = $2, next_attempt_at = $3, last_error = $4 WHERE id = $1
+    `, d.id, status, next, truncateRunes(sendErr.Error(), maxDeliveryErrorRunes))
+	return err
+}
+
+// retryDelay は attempts 回目の失敗の後に待つ時間
+func retryDelay(attempts int) time.Duration {
+	delay := config.GetNotificationRetryBaseDelay()
+	for i := 1; i < attempts && delay < maxDeliveryRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDeliveryRetryDelay {
+		delay = maxDeliveryRetryDelay
+	}
+	return delay
+}
+
+// DeadLetters は送信をあきらめた通知を新しい順に返す
+func (ns *NotificationService) DeadLetters(ctx context.Context, limit int) (_ []models.NotificationDelivery, err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.DeadLetters")
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := ns.db.QueryContext(ctx, `
+        SELECT d.id, d.endpoint_id, e.user_id, d.event_id, d.event_type, d.payload, d.status,
+               d.attempts, d.next_attempt_at, COALESCE(d.last_error, ''), d.created_at, d.delivered_at
+        FROM notification_deliveries d
+        JOIN notification_endpoints e ON e.id = d.endpoint_id
+        WHERE d.status = 'dead'
+        ORDER BY d.created_at DESC
+        LIMIT $1
+    `, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %v", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]models.NotificationDelivery, 0)
+	for rows.Next() {
+		var d models.NotificationDelivery
+		var payload []byte
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.UserID, &d.EventID, &d.EventType, &payload, &d.Status,
+			&d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %v", err)
+		}
+		d.Payload = payload
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %v", err)
+	}
+	return deliveries, nil
+}
+
+// RetryDeadLetter はデッドレターの通知を送信待ちに戻す。送信回数は数え直す
+func (ns *NotificationService) RetryDeadLetter(ctx context.Context, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "NotificationService.RetryDeadLetter")
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrNotificationDeliveryNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := ns.db.ExecContext(ctx, `
+        UPDATE notification_deliveries
+        SET status = $2, attempts = 0, next_attempt_at = $3
+        WHERE id = $1 AND status = 'dead'
+    `, id, DeliveryPending, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to retry dead letter: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotificationDeliveryNotFound
+	}
+	return nil
+}
+
+// newWebhookSecret は署名用のランダムな鍵を作る
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %v", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func scanNotificationEndpoint(row rowScanner) (models.NotificationEndpoint, error) {
+	var e models.NotificationEndpoint
+	var events pq.StringArray
+	if err := row.Scan(&e.ID, &e.UserID, &e.Kind, &e.Target, &e.Platform, &e.Secret, &events, &e.CreatedAt); err != nil {
+		return models.NotificationEndpoint{}, err
+	}
+	e.Events = events
+	return e, nil
+}
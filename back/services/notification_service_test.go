@@ -0,0 +1,290 @@
+package services
+
+import (
+	"back/webhook"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "https", url: "https://example.com/hook"},
+		{name: "public IP", url: "https://93.184.216.34/hook"},
+		{name: "http", url: "http://example.com/hook", wantErr: true},
+		{name: "relative", url: "/hook", wantErr: true},
+		{name: "not a URL", url: "://", wantErr: true},
+		{name: "other scheme", url: "ftp://example.com/hook", wantErr: true},
+		{name: "localhost", url: "https://LOCALHOST/hook", wantErr: true},
+		{name: "loopback", url: "https://127.0.0.1/hook", wantErr: true},
+		{name: "private", url: "https://10.0.0.1/hook", wantErr: true},
+		{name: "link local metadata", url: "https://169.254.169.254/latest", wantErr: true},
+		{name: "IPv6 loopback", url: "https://[::1]/hook", wantErr: true},
+		{name: "insecure allows http", url: "http://localhost:8080/hook", insecure: true},
+		{name: "insecure allows private", url: "https://10.0.0.1/hook", insecure: true},
+		{name: "insecure still rejects other schemes", url: "ftp://example.com/hook", insecure: true, wantErr: true},
+		{name: "insecure still requires a host", url: "/hook", insecure: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.insecure {
+				t.Setenv("WEBHOOK_ALLOW_INSECURE", "true")
+			} else {
+				t.Setenv("WEBHOOK_ALLOW_INSECURE", "")
+			}
+			err := validateWebhookURL(tt.url)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidNotificationEndpoint) {
+					t.Fatalf("validateWebhookURL(%q) = %v, want ErrInvalidNotificationEndpoint", tt.url, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateWebhookURL(%q) = %v", tt.url, err)
+			}
+		})
+	}
+}
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "127.0.0.1", want: true},
+		{ip: "::1", want: true},
+		{ip: "10.1.2.3", want: true},
+		{ip: "172.16.0.1", want: true},
+		{ip: "192.168.1.1", want: true},
+		{ip: "fd00::1", want: true},
+		{ip: "0.0.0.0", want: true},
+		{ip: "::", want: true},
+		{ip: "169.254.169.254", want: true},
+		{ip: "fe80::1", want: true},
+		{ip: "224.0.0.1", want: true},
+		{ip: "93.184.216.34", want: false},
+		{ip: "172.32.0.1", want: false},
+		{ip: "2606:4700::1111", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isInternalIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isInternalIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	t.Setenv("NOTIFICATION_RETRY_BASE_DELAY", "30s")
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: 30 * time.Second},
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 10, want: 256 * time.Minute},
+		{attempts: 11, want: maxDeliveryRetryDelay},
+		{attempts: 1000, want: maxDeliveryRetryDelay},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelayBaseAboveCap(t *testing.T) {
+	t.Setenv("NOTIFICATION_RETRY_BASE_DELAY", "24h")
+	if got := retryDelay(1); got != maxDeliveryRetryDelay {
+		t.Fatalf("retryDelay(1) = %v, want %v", got, maxDeliveryRetryDelay)
+	}
+}
+
+func TestDeliverPending(t *testing.T) {
+	t.Setenv("NOTIFICATION_MAX_ATTEMPTS", "3")
+	t.Setenv("NOTIFICATION_RETRY_BASE_DELAY", "30s")
+
+	stub := webhook.NewStubReceiver("secret")
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer gone.Close()
+
+	tests := []struct {
+		name          string
+		target        string
+		attempts      int
+		failNext      int
+		wantDelivered int
+		wantStatus    string
+		wantRetry     bool
+	}{
+		{name: "success", target: server.URL, attempts: 1, wantDelivered: 1, wantStatus: DeliveryDelivered},
+		{name: "gone is dead-lettered", target: gone.URL, attempts: 1, wantStatus: DeliveryDead},
+		{name: "server error is retried", target: server.URL, attempts: 1, failNext: 1, wantStatus: DeliveryPending, wantRetry: true},
+		{name: "last attempt is dead-lettered", target: server.URL, attempts: 3, failNext: 1, wantStatus: DeliveryDead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub.FailNext(tt.failNext)
+			before := len(stub.Received())
+
+			db := &fakeDeliveryDB{claimed: []claimedDelivery{{
+				id:        "delivery-1",
+				eventType: "reminder.sent",
+				payload:   []byte(`{"id":"1"}`),
+				attempts:  tt.attempts,
+				kind:      NotificationKindWebhook,
+				target:    tt.target,
+				secret:    "secret",
+			}}}
+			ns := &NotificationService{
+				db:      sql.OpenDB(db),
+				webhook: newWebhookHTTPClient(time.Second, true),
+				push:    &http.Client{Timeout: time.Second},
+			}
+			defer ns.db.Close()
+
+			start := time.Now()
+			delivered, err := ns.DeliverPending(context.Background(), 10)
+			if err != nil {
+				t.Fatalf("DeliverPending returned error: %v", err)
+			}
+			if delivered != tt.wantDelivered {
+				t.Fatalf("delivered = %d, want %d", delivered, tt.wantDelivered)
+			}
+
+			if tt.wantStatus == DeliveryDelivered {
+				received := stub.Received()
+				if len(received) != before+1 {
+					t.Fatalf("stub received %d notifications, want %d", len(received), before+1)
+				}
+				if r := received[len(received)-1]; r.Event != "reminder.sent" || r.DeliveryID != "delivery-1" || string(r.Body) != `{"id":"1"}` {
+					t.Fatalf("stub received %+v", r)
+				}
+			}
+
+			execs := db.recorded()
+			if len(execs) != 1 {
+				t.Fatalf("recorded %d updates, want 1", len(execs))
+			}
+			args := execs[0]
+			if args[0] != "delivery-1" || args[1] != tt.wantStatus {
+				t.Fatalf("update args = %v, want delivery-1 with status %s", args, tt.wantStatus)
+			}
+			if tt.wantRetry {
+				next, _ := args[2].(time.Time)
+				if next.Before(start.Add(30*time.Second)) || next.After(time.Now().Add(30*time.Second)) {
+					t.Fatalf("next attempt at %v, want about 30s after %v", next, start)
+				}
+				if lastError, _ := args[3].(string); !strings.Contains(lastError, "unexpected status 500") {
+					t.Fatalf("last error = %q", lastError)
+				}
+			}
+		})
+	}
+}
+
+// fakeDeliveryDB は DeliverPending が使うクエリだけに答える database/sql のドライバー。
+// 最初の claim で claimed を返し、送信結果の UPDATE の引数を記録する
+type fakeDeliveryDB struct {
+	mu      sync.Mutex
+	claimed []claimedDelivery
+	execs   [][]driver.Value
+}
+
+func (db *fakeDeliveryDB) recorded() [][]driver.Value {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.execs
+}
+
+func (db *fakeDeliveryDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeDeliveryConn{db: db}, nil
+}
+func (db *fakeDeliveryDB) Driver() driver.Driver { return fakeDeliveryDriver{} }
+
+type fakeDeliveryDriver struct{}
+
+func (fakeDeliveryDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("use sql.OpenDB")
+}
+
+type fakeDeliveryConn struct {
+	db *fakeDeliveryDB
+}
+
+func (c *fakeDeliveryConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c *fakeDeliveryConn) Close() error { return nil }
+func (c *fakeDeliveryConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c *fakeDeliveryConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "UPDATE notification_deliveries d") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	rows := &fakeDeliveryRows{deliveries: c.db.claimed}
+	c.db.claimed = nil
+	return rows, nil
+}
+
+func (c *fakeDeliveryConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "UPDATE notification_deliveries SET status") {
+		return nil, errors.New("unexpected statement: " + query)
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs = append(c.db.execs, values)
+	return driver.RowsAffected(1), nil
+}
+
+type fakeDeliveryRows struct {
+	deliveries []claimedDelivery
+}
+
+func (r *fakeDeliveryRows) Columns() []string {
+	return []string{"id", "event_type", "payload", "attempts", "kind", "target", "platform", "secret"}
+}
+
+func (r *fakeDeliveryRows) Close() error { return nil }
+
+func (r *fakeDeliveryRows) Next(dest []driver.Value) error {
+	if len(r.deliveries) == 0 {
+		return io.EOF
+	}
+	d := r.deliveries[0]
+	r.deliveries = r.deliveries[1:]
+	copy(dest, []driver.Value{d.id, d.eventType, d.payload, int64(d.attempts), d.kind, d.target, d.platform, d.secret})
+	return nil
+}
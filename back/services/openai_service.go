@@ -1,120 +1,438 @@
 package services
 
 import (
+	"back/config"
+	"back/i18n"
+	"back/logging"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/go-resty/resty/v2"
-	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func CallOpenAI(userID string, message string) (string, error) {
-	fmt.Printf("CallOpenAI: %+v", message)
-	client := resty.New()
+// openAIChatResponse はChat Completions APIのレスポンス(エラー時は error のみ)
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage openAIUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// openAIMessage はChat Completions APIのメッセージ。ツール呼び出しの要求と結果も表す
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+const (
+	openAIChatURL = "https://api.openai.com/v1/chat/completions"
+	chatModel     = "gpt-4o-mini"
+
+	// maxToolResultRunes はモデルに返すツール結果の最大文字数
+	maxToolResultRunes = 8000
+)
+
+// ChatService はユーザーとの会話に対する応答を生成する
+type ChatService struct {
+	conversations *ConversationStore
+	usage         *UsageService
+	tools         *ToolRegistry
+	prompts       *PromptService
+}
+
+// NewChatService コンストラクタ。tools が nil ならツールを使わずに応答する
+func NewChatService(conversations *ConversationStore, usage *UsageService, tools *ToolRegistry, prompts *PromptService) *ChatService {
+	return &ChatService{conversations: conversations, usage: usage, tools: tools, prompts: prompts}
+}
+
+// CallOpenAI は保存済みのユーザーメッセージに対する応答を生成する。
+// prompt はRAGで拡張したユーザーメッセージで、履歴中の元のメッセージの代わりに送る。
+// モデルがツールを要求した場合は実行して結果を返し、最大ステップ数まで繰り返す。使ったプロンプトのバージョンも返す。
+// システムプロンプトや履歴の出典はユーザーメッセージの言語 (Locale) で作り、モデル・temperature・履歴の件数・
+// 人格はユーザーの設定に従う
+func (cs *ChatService) CallOpenAI(ctx context.Context, userMessage models.Conversation, prompt string, settings models.UserSettings) (string, models.PromptVersions, error) {
+	return cs.StreamOpenAI(ctx, userMessage, prompt, settings, nil)
+}
+
+// StreamOpenAI は CallOpenAI と同じ応答を、生成された本文の差分を onDelta に渡しながら返す。
+// onDelta が nil ならストリーミングしない
+func (cs *ChatService) StreamOpenAI(ctx context.Context, userMessage models.Conversation, prompt string, settings models.UserSettings, onDelta func(text string)) (_ string, _ models.PromptVersions, err error) {
+	userID := userMessage.UserID
+	model := settings.EffectiveModel
+	if model == "" {
+		model = defaultChatModel()
+	}
+	ctx, span := tracing.Start(ctx, "ChatService.CallOpenAI", attribute.String("user.id", userID), attribute.String("llm.model", model), attribute.Bool("llm.stream", onDelta != nil))
+	defer func() { tracing.End(span, err) }()
+
+	slog.DebugContext(ctx, "CallOpenAI", "user_id", userID, logging.Content("message", prompt))
 	apiKey := os.Getenv("OPENAI_API_KEY")
-	openAIURL := "https://api.openai.com/v1/chat/completions"
 	if apiKey == "" {
-		return "", fmt.Errorf("OPENAI_API_KEY is not set")
+		return "", nil, fmt.Errorf("OPENAI_API_KEY is not set")
+	}
+
+	historyWindow := settings.EffectiveHistoryWindow
+	if historyWindow <= 0 {
+		historyWindow = config.GetChatHistoryWindow()
+	}
+	recentConversations, err := cs.conversations.GetRecentConversations(ctx, userID, historyWindow)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// デバッグログを追加
-	// fmt.Printf("Making request with userID: %s, message: %s\n", userID, message)
+	locale := userMessage.Locale
+	if locale == "" {
+		locale = defaultLocale()
+	}
+	// ツールの結果も同じ言語で返させる
+	ctx = i18n.WithLocale(ctx, locale)
 
-	recentConversations, err := GetRecentConversations(userID, 10)
+	systemPrompt, systemVersion, err := cs.prompts.Render(ctx, userID, prompts.ChatSystem, locale, nil)
 	if err != nil {
-		// fmt.Printf("Error getting recent conversations: %v\n", err)
-		return "", err
+		return "", nil, err
 	}
+	versions := models.PromptVersions{prompts.ChatSystem: systemVersion}
 
 	// 会話履歴の初期化
-	messages := []map[string]string{
+	messages := []openAIMessage{
 		{
-			"role":    "system",
-			"content": "過去の会話を参考に、ユーザーの質問に答えてください。",
+			Role:    "system",
+			Content: systemPrompt,
 		},
 	}
+	// ユーザーが設定した人格・指示は、テンプレートのシステムプロンプトの後に別のメッセージで送る
+	if settings.Persona != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: settings.Persona})
+	}
 
-	// 会話履歴を追加
+	// 記憶の利用を止めたユーザーには記憶を検索するツールを渡さない
+	tools := cs.tools
+	if !settings.MemoryEnabled {
+		tools = tools.Without(memorySearchToolName)
+	}
+
+	// 会話履歴を追加(今回のメッセージは拡張したものを最後に送る。ツールの記録は GetRecentConversations が除いている)
 	for i := len(recentConversations) - 1; i >= 0; i-- {
-		messages = append(messages, map[string]string{
-			"role":    recentConversations[i].Role,
-			"content": recentConversations[i].Content,
+		conv := recentConversations[i]
+		if conv.ID == userMessage.ID {
+			continue
+		}
+		messages = append(messages, openAIMessage{
+			Role:    conv.Role,
+			Content: contentWithCitations(conv, locale),
 		})
 	}
 
 	// 新しいメッセージを追加
-	// メッセージを追加
-	// messages = append(messages, map[string]string{
-	// "role":    "user",
-	// "content": message,
-	// })
+	messages = append(messages, openAIMessage{Role: "user", Content: prompt})
+
+	maxSteps := config.GetChatMaxToolSteps()
+	for step := 0; ; step++ {
+		requestBody := map[string]interface{}{
+			"model":    model,
+			"messages": messages,
+		}
+		if settings.Temperature != nil {
+			requestBody["temperature"] = *settings.Temperature
+		}
+		useTools := tools.Len() > 0 && step < maxSteps
+		if tools.Len() > 0 {
+			requestBody["tools"] = tools.Definitions()
+			if !useTools {
+				// ステップ数の上限に達したら、ツールなしで回答させる
+				requestBody["tool_choice"] = "none"
+			}
+		}
+
+		slog.DebugContext(ctx, "Sending chat completion request", "user_id", userID, "message_count", len(messages), "step", step)
+
+		start := time.Now()
+		var reply openAIMessage
+		var usage openAIUsage
+		if onDelta != nil {
+			reply, usage, err = streamChatCompletion(ctx, apiKey, requestBody, onDelta)
+		} else {
+			reply, usage, err = postChatCompletion(ctx, apiKey, requestBody)
+		}
+		observeProviderCall(ProviderOpenAI, model, "chat", start, err, usage.PromptTokens, usage.CompletionTokens)
+		if err != nil {
+			return "", nil, err
+		}
+		cs.usage.Record(ctx, UsageRecord{
+			UserID:           userID,
+			Feature:          FeatureChat,
+			Provider:         ProviderOpenAI,
+			Model:            model,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+		})
+
+		if !useTools || len(reply.ToolCalls) == 0 {
+			if reply.Content == "" {
+				return "", nil, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: http.StatusOK, Err: fmt.Errorf("empty reply")}
+			}
+			span.SetAttributes(attribute.Int("chat.tool_steps", step))
+			return reply.Content, versions, nil
+		}
+
+		messages = append(messages, reply)
+		for _, call := range reply.ToolCalls {
+			messages = append(messages, openAIMessage{
+				Role:       "tool",
+				ToolCallID: call.ID,
+				Content:    cs.runTool(ctx, tools, userID, call),
+			})
+		}
+	}
+}
+
+// runTool はツールを実行して結果を履歴に記録し、モデルに返す内容を返す。
+// 失敗してもモデルが回答を続けられるよう、エラーは結果の文字列として返す
+func (cs *ChatService) runTool(ctx context.Context, tools *ToolRegistry, userID string, call openAIToolCall) string {
+	ctx, span := tracing.Start(ctx, "ChatService.runTool", attribute.String("tool.name", call.Function.Name))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	toolCtx, cancel := context.WithTimeout(ctx, config.GetToolCallTimeout())
+	defer cancel()
 
-	// `content`だけを改行で羅列して出力
-	fmt.Println("Messages content:")
-	for i, msg := range messages {
-		fmt.Printf("%d: %s\n", i+1, msg["content"])
+	record := &models.ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+	result, err := tools.Call(toolCtx, userID, call.Function.Name, call.Function.Arguments)
+	switch {
+	case err != nil:
+		record.Error = err.Error()
+		result = "error: " + err.Error()
+		metrics.ToolCalls.WithLabelValues(call.Function.Name, "error").Inc()
+		slog.WarnContext(ctx, "Tool call failed", "user_id", userID, "tool", call.Function.Name, "error", err)
+	default:
+		metrics.ToolCalls.WithLabelValues(call.Function.Name, "success").Inc()
+		slog.DebugContext(ctx, "Tool call succeeded", "user_id", userID, "tool", call.Function.Name, logging.Content("result", result))
 	}
+	result = truncateRunes(result, maxToolResultRunes)
 
-	requestBody := map[string]interface{}{
-		"model":    "gpt-4o-mini",
-		"messages": messages,
+	if _, saveErr := cs.conversations.SaveConversation(ctx, models.Conversation{UserID: userID, Role: "tool", Content: result, ToolCall: record}); saveErr != nil {
+		slog.ErrorContext(ctx, "Failed to save tool call", "user_id", userID, "tool", call.Function.Name, "error", saveErr)
 	}
+	return result
+}
+
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max]) + "…"
+}
+
+// postChatCompletion はChat Completions APIを呼び出し、応答メッセージとトークン使用量を返す
+func postChatCompletion(ctx context.Context, apiKey string, requestBody map[string]interface{}) (openAIMessage, openAIUsage, error) {
+	client := newRestyClient(ProviderOpenAI)
 
 	resp, err := client.R().
+		SetContext(ctx).
 		SetHeader("Authorization", "Bearer "+apiKey).
 		SetHeader("Content-Type", "application/json").
 		SetBody(requestBody).
-		Post(openAIURL)
+		Post(openAIChatURL)
+
+	if err != nil {
+		return openAIMessage{}, openAIUsage{}, err
+	}
+
+	slog.DebugContext(ctx, "OpenAI response received", "status", resp.StatusCode(), "bytes", len(resp.Body()))
+
+	var result openAIChatResponse
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return openAIMessage{}, openAIUsage{}, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode(), Err: err}
+	}
+
+	if resp.StatusCode() != http.StatusOK || result.Error != nil {
+		perr := &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode()}
+		if result.Error != nil {
+			perr.Err = fmt.Errorf("%s: %s", result.Error.Type, result.Error.Message)
+		}
+		return openAIMessage{}, result.Usage, perr
+	}
+
+	if len(result.Choices) == 0 {
+		return openAIMessage{}, result.Usage, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode(), Err: fmt.Errorf("no choices in response")}
+	}
+
+	return result.Choices[0].Message, result.Usage, nil
+}
+
+// openAIStreamChunk はストリーミング時に1行ずつ届く差分
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// streamChatCompletion は stream: true でChat Completions APIを呼び出し、本文の差分を onDelta に渡す。
+// 差分を組み立てた応答メッセージ(ツール呼び出しを含む)とトークン使用量を返す
+func streamChatCompletion(ctx context.Context, apiKey string, requestBody map[string]interface{}, onDelta func(string)) (openAIMessage, openAIUsage, error) {
+	body := make(map[string]interface{}, len(requestBody)+2)
+	for k, v := range requestBody {
+		body[k] = v
+	}
+	body["stream"] = true
+	body["stream_options"] = map[string]interface{}{"include_usage": true}
 
+	payload, err := json.Marshal(body)
 	if err != nil {
-		return "", err
+		return openAIMessage{}, openAIUsage{}, fmt.Errorf("failed to encode request: %v", err)
 	}
 
-	// レスポンスをデバッグ出力
-	fmt.Println("OpenAI Response:", resp.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, openAIChatURL, bytes.NewReader(payload))
+	if err != nil {
+		return openAIMessage{}, openAIUsage{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
 
-	var result map[string]interface{}
-	err = json.Unmarshal(resp.Body(), &result)
+	resp, err := ProviderHTTPClient(ProviderOpenAI).Do(req)
 	if err != nil {
-		return "", err
+		return openAIMessage{}, openAIUsage{}, err
 	}
+	defer resp.Body.Close()
 
-	choices, ok := result["choices"].([]interface{})
-	if ok && len(choices) > 0 {
-		messageContent := choices[0].(map[string]interface{})["message"].(map[string]interface{})["content"].(string)
+	if resp.StatusCode != http.StatusOK {
+		var result openAIChatResponse
+		perr := &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err == nil && result.Error != nil {
+			perr.Err = fmt.Errorf("%s: %s", result.Error.Type, result.Error.Message)
+		}
+		return openAIMessage{}, openAIUsage{}, perr
+	}
 
-		// 応答を保存
-		if messageContent != "" {
-			assistantMessage, err := SaveMessage(userID, "assistant", messageContent)
-			if err != nil {
-				fmt.Printf("Failed to save assistant message: %v\n", err)
-			} else {
-				fmt.Printf("Assistant message saved: %+v\n", assistantMessage)
-			}
+	reply := openAIMessage{Role: "assistant"}
+	var content strings.Builder
+	var usage openAIUsage
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return openAIMessage{}, usage, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode, Err: err}
+		}
+		if chunk.Error != nil {
+			return openAIMessage{}, usage, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode, Err: fmt.Errorf("%s: %s", chunk.Error.Type, chunk.Error.Message)}
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
 		}
 
-		return messageContent, nil
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				onDelta(choice.Delta.Content)
+			}
+			// ツール呼び出しは index ごとに名前と引数が分割されて届く
+			for _, tc := range choice.Delta.ToolCalls {
+				for len(reply.ToolCalls) <= tc.Index {
+					reply.ToolCalls = append(reply.ToolCalls, openAIToolCall{Type: "function"})
+				}
+				call := &reply.ToolCalls[tc.Index]
+				if tc.ID != "" {
+					call.ID = tc.ID
+				}
+				if tc.Function.Name != "" {
+					call.Function.Name = tc.Function.Name
+				}
+				call.Function.Arguments += tc.Function.Arguments
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return openAIMessage{}, usage, ctx.Err()
+		}
+		return openAIMessage{}, usage, &ProviderError{Provider: ProviderOpenAI, Kind: ErrUpstream, StatusCode: resp.StatusCode, Err: err}
 	}
 
-	return "", nil
+	reply.Content = content.String()
+	return reply, usage, nil
 }
 
 // テキストをベクトル化する関数
-func (rs *RAGService) vectorizeText(text string) ([]float64, error) {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-
-	resp, err := client.CreateEmbeddings(
-		context.Background(),
-		openai.EmbeddingRequest{
-			Input: []string{text},
-			Model: openai.AdaEmbeddingV2,
-		},
-	)
+func (rs *RAGService) vectorizeText(ctx context.Context, userID string, text string) (_ []float64, err error) {
+	ctx, span := tracing.Start(ctx, "RAGService.vectorizeText", attribute.String("llm.model", embeddingModel()))
+	defer func() { tracing.End(span, err) }()
+
+	client := newOpenAIClient()
+
+	start := time.Now()
+	resp, err := client.CreateEmbeddings(ctx, newEmbeddingRequest([]string{text}))
+	observeProviderCall(ProviderOpenAI, embeddingModel(), "embedding", start, err, resp.Usage.PromptTokens, 0)
 	if err != nil {
-		return nil, fmt.Errorf("embedding creation failed: %v", err)
+		return nil, fmt.Errorf("embedding creation failed: %w", err)
 	}
+	rs.usage.Record(ctx, UsageRecord{
+		UserID:       userID,
+		Feature:      FeatureChat,
+		Provider:     ProviderOpenAI,
+		Model:        embeddingModel(),
+		PromptTokens: resp.Usage.PromptTokens,
+	})
 
 	if len(resp.Data) == 0 {
 		return nil, fmt.Errorf("no embeddings received")
@@ -124,6 +442,7 @@ func (rs *RAGService) vectorizeText(text string) ([]float64, error) {
 	for i, v := range resp.Data[0].Embedding {
 		embeddings[i] = float64(v)
 	}
+	metrics.EmbeddingsCreated.WithLabelValues(embeddingModel(), "chat").Inc()
 	return embeddings, nil
 }
 
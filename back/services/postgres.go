@@ -0,0 +1,51 @@
+package services
+
+import (
+	"back/config"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// OpenPostgres は設定に従ってプールを構成したPostgreSQL接続を開き、疎通を確認する。
+// 返した *sql.DB はプロセス全体で共有し、終了時に呼び出し側で Close する
+func OpenPostgres(ctx context.Context, uri string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", withSSLModeDefault(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %v", err)
+	}
+
+	db.SetMaxOpenConns(config.GetPostgresMaxOpenConns())
+	db.SetMaxIdleConns(config.GetPostgresMaxIdleConns())
+	db.SetConnMaxLifetime(config.GetPostgresConnMaxLifetime())
+	db.SetConnMaxIdleTime(config.GetPostgresConnMaxIdleTime())
+
+	// 接続テスト
+	pingCtx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping postgres: %v", err)
+	}
+
+	return db, nil
+}
+
+// withSSLModeDefault は sslmode の指定がなければ disable を付け足す
+func withSSLModeDefault(uri string) string {
+	if strings.Contains(uri, "sslmode=") {
+		return uri
+	}
+	if !strings.Contains(uri, "://") {
+		// key=value 形式のDSN
+		return uri + " sslmode=disable"
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&sslmode=disable"
+	}
+	return uri + "?sslmode=disable"
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"regexp"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// プロンプトのバージョンの決まり方
+const (
+	PromptSourceUser       = "user"
+	PromptSourceExperiment = "experiment"
+	PromptSourceDefault    = "default"
+)
+
+var (
+	// ErrInvalidPrompt はプロンプトの名前・バージョンや実験の指定が不正であることを表す
+	ErrInvalidPrompt            = errors.New("invalid prompt selection")
+	ErrPromptExperimentNotFound = errors.New("prompt experiment not found")
+
+	validExperimentName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// PromptService はユーザーに使うプロンプトのバージョンを決めて描画する。
+// ユーザーごとの固定 > 有効な実験 > 既定 (PROMPT_<NAME>_VERSION、なければ最新) の順に決める
+type PromptService struct {
+	db       *sql.DB
+	registry *prompts.Registry
+	defaults map[string]int
+}
+
+// NewPromptService コンストラクタ。既定のバージョンにないものが指定されていれば最新を使う
+func NewPromptService(db *sql.DB, registry *prompts.Registry) *PromptService {
+	defaults := make(map[string]int)
+	for _, name := range registry.Names() {
+		version := config.GetPromptVersion(name)
+		if _, err := registry.Get(name, version); err != nil {
+			if version != 0 {
+				slog.Warn("Default prompt version not found, using latest", "prompt", name, "version", version)
+			}
+			version = registry.Latest(name)
+		}
+		defaults[name] = version
+	}
+	return &PromptService{db: db, registry: registry, defaults: defaults}
+}
+
+// Render はユーザーに使うバージョンのプロンプトを locale 向けの版で描画し、本文と使ったバージョンを返す。
+// バージョンの選択に失敗したら既定のバージョンを使う
+func (ps *PromptService) Render(ctx context.Context, userID, name, locale string, data any) (_ string, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "PromptService.Render", attribute.String("prompt.name", name), attribute.String("prompt.locale", locale))
+	defer func() { tracing.End(span, err) }()
+
+	selection, err := ps.Select(ctx, userID, name)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to select prompt version, using default", "prompt", name, "user_id", userID, "error", err)
+		selection = ps.defaultSelection(name)
+	}
+
+	t, err := ps.registry.GetLocalized(name, selection.Version, locale)
+	if err != nil {
+		return "", 0, err
+	}
+	text, err := t.Render(data)
+	if err != nil {
+		return "", 0, err
+	}
+
+	span.SetAttributes(attribute.Int("prompt.version", t.Version), attribute.String("prompt.source", selection.Source))
+	metrics.PromptRenders.WithLabelValues(name, strconv.Itoa(t.Version), selection.Source).Inc()
+	return text, t.Version, nil
+}
+
+// Select はユーザーに使うプロンプトのバージョンを決める
+func (ps *PromptService) Select(ctx context.Context, userID, name string) (models.PromptSelection, error) {
+	if _, ok := ps.defaults[name]; !ok {
+		return models.PromptSelection{}, fmt.Errorf("%w: unknown prompt %s", ErrInvalidPrompt, name)
+	}
+	if userID == "" {
+		return ps.defaultSelection(name), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	var version int
+	err := ps.db.QueryRowContext(ctx, `
+        SELECT version FROM user_prompt_versions WHERE user_id = $1 AND prompt = $2
+    `, userID, name).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.PromptSelection{}, fmt.Errorf("failed to get user prompt version: %v", err)
+	}
+	if err == nil && ps.exists(name, version) {
+		return models.PromptSelection{Prompt: name, Version: version, Source: PromptSourceUser}, nil
+	}
+
+	experiments, err := ps.queryExperiments(ctx, `
+        SELECT name, prompt, version, traffic_percent, enabled, created_at, updated_at
+        FROM prompt_experiments
+        WHERE prompt = $1 AND enabled
+        ORDER BY created_at, name
+    `, name)
+	if err != nil {
+		return models.PromptSelection{}, err
+	}
+	for _, e := range experiments {
+		if experimentBucket(e.Name, userID) < e.TrafficPercent && ps.exists(name, e.Version) {
+			return models.PromptSelection{Prompt: name, Version: e.Version, Source: PromptSourceExperiment, Experiment: e.Name}, nil
+		}
+	}
+
+	return ps.defaultSelection(name), nil
+}
+
+// Selections はユーザーに使う全プロンプトのバージョンを返す
+func (ps *PromptService) Selections(ctx context.Context, userID string) ([]models.PromptSelection, error) {
+	selections := make([]models.PromptSelection, 0, len(ps.defaults))
+	for _, name := range ps.registry.Names() {
+		selection, err := ps.Select(ctx, userID, name)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	return selections, nil
+}
+
+// Templates はテンプレートの一覧と既定のバージョンを返す
+func (ps *PromptService) Templates() []models.PromptTemplateInfo {
+	templates := make([]models.PromptTemplateInfo, 0, len(ps.defaults))
+	for _, name := range ps.registry.Names() {
+		templates = append(templates, models.PromptTemplateInfo{
+			Name:           name,
+			Versions:       ps.registry.Versions(name),
+			DefaultVersion: ps.defaults[name],
+			Locales:        ps.registry.Locales(name, ps.defaults[name]),
+		})
+	}
+	return templates
+}
+
+// SetUserVersion はユーザーに使うプロンプトのバージョンを固定する。version が nil なら固定を外す
+func (ps *PromptService) SetUserVersion(ctx context.Context, userID, name string, version *int) (err error) {
+	ctx, span := tracing.Start(ctx, "PromptService.SetUserVersion", attribute.String("user.id", userID), attribute.String("prompt.name", name))
+	defer func() { tracing.End(span, err) }()
+
+	if _, ok := ps.defaults[name]; !ok {
+		return fmt.Errorf("%w: unknown prompt %s", ErrInvalidPrompt, name)
+	}
+	if version != nil && !ps.exists(name, *version) {
+		return fmt.Errorf("%w: %s has no version %d", ErrInvalidPrompt, name, *version)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	if version == nil {
+		_, err = ps.db.ExecContext(ctx, `
+            DELETE FROM user_prompt_versions WHERE user_id = $1 AND prompt = $2
+        `, userID, name)
+	} else {
+		_, err = ps.db.ExecContext(ctx, `
+            INSERT INTO user_prompt_versions (user_id, prompt, version)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (user_id, prompt)
+            DO UPDATE SET version = EXCLUDED.version, updated_at = CURRENT_TIMESTAMP
+        `, userID, name, *version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update user prompt version: %v", err)
+	}
+	return nil
+}
+
+// Experiments は実験の一覧を作成順に返す
+func (ps *PromptService) Experiments(ctx context.Context) ([]models.PromptExperiment, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	return ps.queryExperiments(ctx, `
+        SELECT name, prompt, version, traffic_percent, enabled, created_at, updated_at
+        FROM prompt_experiments
+        ORDER BY created_at, name
+    `)
+}
+
+// SaveExperiment は実験を作成または更新する
+func (ps *PromptService) SaveExperiment(ctx context.Context, experiment models.PromptExperiment) (_ models.PromptExperiment, err error) {
+	ctx, span := tracing.Start(ctx, "PromptService.SaveExperiment", attribute.String("prompt.experiment", experiment.Name))
+	defer func() { tracing.End(span, err) }()
+
+	if !validExperimentName.MatchString(experiment.Name) {
+		return models.PromptExperiment{}, fmt.Errorf("%w: experiment name must be 1-64 letters, digits, - or _", ErrInvalidPrompt)
+	}
+	if !ps.exists(experiment.Prompt, experiment.Version) {
+		return models.PromptExperiment{}, fmt.Errorf("%w: %s has no version %d", ErrInvalidPrompt, experiment.Prompt, experiment.Version)
+	}
+	if experiment.TrafficPercent < 0 || experiment.TrafficPercent > 100 {
+		return models.PromptExperiment{}, fmt.Errorf("%w: traffic_percent must be between 0 and 100", ErrInvalidPrompt)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	experiments, err := ps.queryExperiments(ctx, `
+        INSERT INTO prompt_experiments (name, prompt, version, traffic_percent, enabled)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (name)
+        DO UPDATE SET
+            prompt = EXCLUDED.prompt,
+            version = EXCLUDED.version,
+            traffic_percent = EXCLUDED.traffic_percent,
+            enabled = EXCLUDED.enabled,
+            updated_at = CURRENT_TIMESTAMP
+        RETURNING name, prompt, version, traffic_percent, enabled, created_at, updated_at
+    `, experiment.Name, experiment.Prompt, experiment.Version, experiment.TrafficPercent, experiment.Enabled)
+	if err != nil {
+		return models.PromptExperiment{}, err
+	}
+	return experiments[0], nil
+}
+
+// DeleteExperiment は実験を削除する。実験に入っていたユーザーは既定のバージョンに戻る
+func (ps *PromptService) DeleteExperiment(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := ps.db.ExecContext(ctx, `DELETE FROM prompt_experiments WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete prompt experiment: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrPromptExperimentNotFound
+	}
+	return nil
+}
+
+func (ps *PromptService) queryExperiments(ctx context.Context, query string, args ...any) ([]models.PromptExperiment, error) {
+	rows, err := ps.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt experiments: %v", err)
+	}
+	defer rows.Close()
+
+	experiments := make([]models.PromptExperiment, 0)
+	for rows.Next() {
+		var e models.PromptExperiment
+		if err := rows.Scan(&e.Name, &e.Prompt, &e.Version, &e.TrafficPercent, &e.Enabled, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		experiments = append(experiments, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration failed: %v", err)
+	}
+	return experiments, nil
+}
+
+func (ps *PromptService) defaultSelection(name string) models.PromptSelection {
+	return models.PromptSelection{Prompt: name, Version: ps.defaults[name], Source: PromptSourceDefault}
+}
+
+func (ps *PromptService) exists(name string, version int) bool {
+	_, err := ps.registry.Get(name, version)
+	return err == nil
+}
+
+// experimentBucket はユーザーを実験ごとに 0〜99 に振り分ける。同じユーザーは同じ実験で常に同じ値になる
+func experimentBucket(experiment, userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(experiment + "/" + userID))
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"back/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 外部API呼び出し失敗の分類。controllers はこれを errors.Is で判定してHTTPステータスに変換する
+var (
+	ErrRateLimited = errors.New("rate limited by provider")
+	ErrUpstream    = errors.New("upstream provider error")
+	ErrTimeout     = errors.New("provider timeout")
+	ErrCircuitOpen = errors.New("circuit breaker open")
+)
+
+// ProviderError は外部プロバイダー(OpenAI, Perplexity)の呼び出しエラー
+type ProviderError struct {
+	Provider   string
+	Kind       error
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Provider, e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+func (e *ProviderError) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// errorKind はメトリクスのラベル用にエラーを分類する
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrUpstream):
+		return "upstream"
+	default:
+		return "other"
+	}
+}
+
+// observeProviderCall は外部プロバイダー呼び出しの結果をメトリクスに記録する
+func observeProviderCall(provider, model, operation string, start time.Time, err error, promptTokens, completionTokens int) {
+	if err != nil {
+		metrics.ObserveLLMError(provider, model, operation, errorKind(err), start)
+		return
+	}
+	metrics.ObserveLLMCall(provider, model, operation, start, promptTokens, completionTokens)
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestProviderError(t *testing.T) {
+	cause := errors.New("bad gateway")
+	err := fmt.Errorf("chat failed: %w", &ProviderError{Provider: "openai", Kind: ErrUpstream, StatusCode: 502, Err: cause})
+
+	if !errors.Is(err, ErrUpstream) || errors.Is(err, ErrRateLimited) {
+		t.Fatalf("errors.Is matched the wrong kind for %v", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Fatal("ProviderError does not unwrap to its cause")
+	}
+	if want := "chat failed: openai: upstream provider error (status 502): bad gateway"; err.Error() != want {
+		t.Fatalf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	// ストリームの読み込みエラーに包まれた idle タイムアウトもタイムアウトとして判定する
+	nested := &ProviderError{Provider: "openai", Kind: ErrUpstream, Err: &ProviderError{Provider: "openai", Kind: ErrTimeout, Err: errIdleTimeout}}
+	if !errors.Is(nested, ErrTimeout) {
+		t.Fatal("nested timeout was not detected")
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &ProviderError{Kind: ErrRateLimited, StatusCode: 429}, want: "rate_limited"},
+		{err: &ProviderError{Kind: ErrTimeout}, want: "timeout"},
+		{err: fmt.Errorf("wrapped: %w", context.DeadlineExceeded), want: "timeout"},
+		{err: &ProviderError{Kind: ErrCircuitOpen}, want: "circuit_open"},
+		{err: context.Canceled, want: "canceled"},
+		{err: &ProviderError{Kind: ErrUpstream, StatusCode: 500}, want: "upstream"},
+		{err: errors.New("boom"), want: "other"},
+	}
+
+	for _, tt := range tests {
+		if got := errorKind(tt.err); got != tt.want {
+			t.Errorf("errorKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,38 +1,106 @@
 package services
 
 import (
+    "back/i18n"
+    "back/metrics"
     "back/models"
+    "back/prompts"
+    "back/tracing"
+    "context"
     "database/sql"
     "fmt"
-    "strings"
+    "log/slog"
+
+    "github.com/lib/pq"
+    "go.opentelemetry.io/otel/attribute"
 )
 
 // RAGService 構造体の定義
 type RAGService struct {
     db *sql.DB
     openAIKey string
+    usage *UsageService
+    prompts *PromptService
 }
 
 // NewRAGService コンストラクタ
-func NewRAGService(db *sql.DB, openAIKey string) *RAGService {
+func NewRAGService(db *sql.DB, openAIKey string, usage *UsageService, prompts *PromptService) *RAGService {
     return &RAGService{
         db: db,
         openAIKey: openAIKey,
+        usage: usage,
+        prompts: prompts,
     }
 }
 
-// 類似度の高い会話を検索する関数
-func (rs *RAGService) findSimilarConversations(userID string, queryVector []float64) ([]models.ConversationSummary, error) {
+// 要約の階層検索の件数
+const (
+    // coarseSummaries は週・話題の要約から辿る起点にする件数
+    coarseSummaries = 3
+    // promptCoarseSummaries はプロンプトに含める週・話題の要約の件数
+    promptCoarseSummaries = 1
+    // fineSummaries は辿った先とまだまとめていない要約から取り出す件数
+    fineSummaries = 3
+)
+
+const summarySearchColumns = `s.id, s.user_id, s.summary, s.vector::real[], s.start_time, s.end_time, s.created_at,
+               s.level, COALESCE(s.topic, ''), 1 - (s.vector <=> $2::float8[]::vector) AS similarity`
+
+// 類似度の高い会話を検索する関数。
+// 先に週・話題の要約から近いものを探し、その下の日・3時間ごとの要約と、まだまとめていない要約から詳しいものを探す
+// 埋め込みのバージョンが違う要約はベクトルを比べられないため対象にしない (cmd/reindex で作り直す)
+func (rs *RAGService) findSimilarConversations(ctx context.Context, userID string, queryVector []float64) (_ []models.ConversationSummary, err error) {
+    ctx, span := tracing.Start(ctx, "RAGService.findSimilarConversations", attribute.String("user.id", userID))
+    defer func() { tracing.End(span, err) }()
+
     // PostgreSQLでコサイン類似度を計算して類似の会話を検索
-    query := `
-        SELECT id, user_id, summary, vector, start_time, end_time, created_at
-        FROM conversation_summaries
-        WHERE user_id = $1
-        ORDER BY vector <=> $2
-        LIMIT 3
-    `
+    coarse, err := rs.querySummaries(ctx, `
+        SELECT `+summarySearchColumns+`
+        FROM conversation_summaries s
+        WHERE s.user_id = $1 AND s.level IN ('weekly', 'topic') AND s.embedding_version = $4
+        ORDER BY s.vector <=> $2::float8[]::vector
+        LIMIT $3
+    `, userID, pq.Float64Array(queryVector), coarseSummaries, embeddingVersion())
+    if err != nil {
+        return nil, err
+    }
+
+    coarseIDs := make([]string, len(coarse))
+    for i, c := range coarse {
+        coarseIDs[i] = c.ID
+    }
+
+    fine, err := rs.querySummaries(ctx, `
+        WITH RECURSIVE descendants AS (
+            SELECT l.child_id AS id FROM conversation_summary_links l WHERE l.parent_id = ANY($3::uuid[])
+            UNION
+            SELECT l.child_id FROM conversation_summary_links l JOIN descendants d ON l.parent_id = d.id
+        )
+        SELECT `+summarySearchColumns+`
+        FROM conversation_summaries s
+        WHERE s.user_id = $1 AND s.embedding_version = $5
+          AND (s.id IN (SELECT id FROM descendants)
+               OR (s.consolidated_at IS NULL AND s.level IN ('window', 'daily')))
+        ORDER BY s.vector <=> $2::float8[]::vector
+        LIMIT $4
+    `, userID, pq.Float64Array(queryVector), pq.StringArray(coarseIDs), fineSummaries, embeddingVersion())
+    if err != nil {
+        return nil, err
+    }
 
-    rows, err := rs.db.Query(query, userID, queryVector)
+    if len(coarse) > promptCoarseSummaries {
+        coarse = coarse[:promptCoarseSummaries]
+    }
+    conversations := append(coarse, fine...)
+    for _, conv := range conversations {
+        metrics.RAGSimilarity.Observe(conv.Similarity)
+    }
+
+    return conversations, nil
+}
+
+func (rs *RAGService) querySummaries(ctx context.Context, query string, args ...any) ([]models.ConversationSummary, error) {
+    rows, err := rs.db.QueryContext(ctx, query, args...)
     if err != nil {
         return nil, fmt.Errorf("similarity search failed: %v", err)
     }
@@ -49,56 +117,277 @@ func (rs *RAGService) findSimilarConversations(userID string, queryVector []floa
             &conv.StartTime,
             &conv.EndTime,
             &conv.CreatedAt,
+            &conv.Level,
+            &conv.Topic,
+            &conv.Similarity,
         )
         if err != nil {
             return nil, fmt.Errorf("row scan failed: %v", err)
         }
         conversations = append(conversations, conv)
     }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("row iteration failed: %v", err)
+    }
 
     return conversations, nil
 }
 
-// プロンプトを生成する関数
-func (rs *RAGService) buildPromptWithContext(query string, conversations []models.ConversationSummary) string {
-    var contextBuilder strings.Builder
+// summaryLabel は要約の粒度と期間を示す locale のラベル
+func summaryLabel(conv models.ConversationSummary, locale string) string {
+    switch conv.Level {
+    case SummaryLevelTopic:
+        return i18n.T(locale, "Topic \"%s\" summary", conv.Topic)
+    case SummaryLevelWeekly:
+        return i18n.T(locale, "Week of %s to %s", conv.StartTime.Format("2006-01-02"), conv.EndTime.AddDate(0, 0, -1).Format("01-02"))
+    case SummaryLevelDaily:
+        return i18n.T(locale, "Conversations on %s", conv.StartTime.Format("2006-01-02"))
+    default:
+        return i18n.T(locale, "Conversation at %s", conv.StartTime.Format("2006-01-02 15:04"))
+    }
+}
+
+// 添付ファイルのチャンク検索の件数
+const (
+    // currentAttachmentChunks は今回のメッセージに添付されたファイルから取り出す件数
+    currentAttachmentChunks = 4
+    // pastAttachmentChunks は過去に添付されたファイルから取り出す件数
+    pastAttachmentChunks = 2
+    // minPastAttachmentSimilarity 未満の過去の添付ファイルは無関係とみなして使わない
+    minPastAttachmentSimilarity = 0.8
+)
+
+// ナレッジベースの資料の検索件数
+const (
+    documentChunks = 3
+    // minDocumentSimilarity 未満の資料は無関係とみなして使わない
+    minDocumentSimilarity = 0.78
+)
+
+// 類似度の高い資料のチャンクを検索する関数
+func (rs *RAGService) findSimilarDocumentChunks(ctx context.Context, userID string, queryVector []float64, limit int, minSimilarity float64) (_ []models.DocumentChunk, err error) {
+    ctx, span := tracing.Start(ctx, "RAGService.findSimilarDocumentChunks", attribute.String("user.id", userID))
+    defer func() { tracing.End(span, err) }()
+
+    query := `
+        SELECT c.document_id, d.title, d.source, c.chunk_index, c.content,
+               1 - (c.vector <=> $2::float8[]::vector) AS similarity
+        FROM document_chunks c
+        JOIN documents d ON d.id = c.document_id
+        WHERE c.user_id = $1 AND c.embedding_version = $5
+          AND 1 - (c.vector <=> $2::float8[]::vector) >= $4
+        ORDER BY c.vector <=> $2::float8[]::vector
+        LIMIT $3
+    `
+
+    rows, err := rs.db.QueryContext(ctx, query, userID, pq.Float64Array(queryVector), limit, minSimilarity, embeddingVersion())
+    if err != nil {
+        return nil, fmt.Errorf("document search failed: %v", err)
+    }
+    defer rows.Close()
+
+    var chunks []models.DocumentChunk
+    for rows.Next() {
+        var chunk models.DocumentChunk
+        if err := rows.Scan(&chunk.DocumentID, &chunk.Title, &chunk.Source, &chunk.ChunkIndex, &chunk.Content, &chunk.Similarity); err != nil {
+            return nil, fmt.Errorf("row scan failed: %v", err)
+        }
+        chunks = append(chunks, chunk)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("row iteration failed: %v", err)
+    }
+
+    return chunks, nil
+}
+
+// 類似度の高い添付ファイルのチャンクを検索する関数。attachmentIDs を指定するとそのファイルに限る
+func (rs *RAGService) findSimilarChunks(ctx context.Context, userID string, queryVector []float64, attachmentIDs []string, limit int, minSimilarity float64) (_ []models.AttachmentChunk, err error) {
+    ctx, span := tracing.Start(ctx, "RAGService.findSimilarChunks", attribute.String("user.id", userID))
+    defer func() { tracing.End(span, err) }()
 
-    // システムプロンプトの作成
-    contextBuilder.WriteString("以下は関連する過去の会話の要約です：\n\n")
+    query := `
+        SELECT c.attachment_id, a.filename, c.chunk_index, c.content,
+               1 - (c.vector <=> $2::float8[]::vector) AS similarity
+        FROM attachment_chunks c
+        JOIN attachments a ON a.id = c.attachment_id
+        WHERE c.user_id = $1 AND c.embedding_version = $6
+          AND (cardinality($3::uuid[]) = 0 OR c.attachment_id = ANY($3::uuid[]))
+          AND 1 - (c.vector <=> $2::float8[]::vector) >= $5
+        ORDER BY c.vector <=> $2::float8[]::vector
+        LIMIT $4
+    `
+
+    rows, err := rs.db.QueryContext(ctx, query, userID, pq.Float64Array(queryVector), pq.StringArray(attachmentIDs), limit, minSimilarity, embeddingVersion())
+    if err != nil {
+        return nil, fmt.Errorf("attachment search failed: %v", err)
+    }
+    defer rows.Close()
 
-    // 過去の会話コンテキストを追加
+    var chunks []models.AttachmentChunk
+    for rows.Next() {
+        var chunk models.AttachmentChunk
+        if err := rows.Scan(&chunk.AttachmentID, &chunk.Filename, &chunk.ChunkIndex, &chunk.Content, &chunk.Similarity); err != nil {
+            return nil, fmt.Errorf("row scan failed: %v", err)
+        }
+        chunks = append(chunks, chunk)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("row iteration failed: %v", err)
+    }
+
+    return chunks, nil
+}
+
+// findAttachmentContext は今回の添付ファイルを優先し、includePast なら過去の添付ファイルからも関連の高いものだけを加える
+func (rs *RAGService) findAttachmentContext(ctx context.Context, userID string, queryVector []float64, attachmentIDs []string, includePast bool) ([]models.AttachmentChunk, error) {
+    var chunks []models.AttachmentChunk
+    if len(attachmentIDs) > 0 {
+        current, err := rs.findSimilarChunks(ctx, userID, queryVector, attachmentIDs, currentAttachmentChunks, -1)
+        if err != nil {
+            return nil, err
+        }
+        chunks = append(chunks, current...)
+    }
+    if !includePast {
+        return chunks, nil
+    }
+
+    past, err := rs.findSimilarChunks(ctx, userID, queryVector, nil, pastAttachmentChunks+len(chunks), minPastAttachmentSimilarity)
+    if err != nil {
+        return nil, err
+    }
+
+    seen := make(map[string]bool, len(chunks))
+    for _, chunk := range chunks {
+        seen[fmt.Sprintf("%s/%d", chunk.AttachmentID, chunk.ChunkIndex)] = true
+    }
+    added := 0
+    for _, chunk := range past {
+        key := fmt.Sprintf("%s/%d", chunk.AttachmentID, chunk.ChunkIndex)
+        if seen[key] || added == pastAttachmentChunks {
+            continue
+        }
+        seen[key] = true
+        chunks = append(chunks, chunk)
+        added++
+    }
+
+    return chunks, nil
+}
+
+// ragPromptData は rag_context のテンプレートに渡す値
+type ragPromptData struct {
+    Query       string
+    Summaries   []ragPromptSummary
+    Attachments []models.AttachmentChunk
+    Documents   []ragPromptDocument
+}
+
+// ragPromptSummary は過去の会話の要約とその見出し
+type ragPromptSummary struct {
+    Label   string
+    Summary string
+}
+
+// ragPromptDocument は資料の抜粋と、タイトル・取り込み元の見出し
+type ragPromptDocument struct {
+    Label   string
+    Content string
+}
+
+// プロンプトを locale で生成する関数。使ったテンプレートのバージョンも返す
+func (rs *RAGService) buildPromptWithContext(ctx context.Context, userID, locale, query string, conversations []models.ConversationSummary, chunks []models.AttachmentChunk, documents []models.DocumentChunk) (string, int, error) {
+    data := ragPromptData{Query: query, Attachments: chunks}
+
+    // 要約には期間や話題の見出しを付ける
     for _, conv := range conversations {
-        contextBuilder.WriteString(fmt.Sprintf("- %s\n", conv.Summary))
+        data.Summaries = append(data.Summaries, ragPromptSummary{Label: summaryLabel(conv, locale), Summary: conv.Summary})
     }
 
-    // 最終的なプロンプトの構築
-    contextBuilder.WriteString("\n上記の過去の会話を踏まえて、以下の質問に答えてください：\n")
-    contextBuilder.WriteString(query)
+    // ナレッジベースの資料は、タイトルと取り込み元を付けて渡す
+    for _, doc := range documents {
+        label := doc.Title
+        if doc.Source != doc.Title {
+            label = i18n.T(locale, "%s (%s)", doc.Title, doc.Source)
+        }
+        data.Documents = append(data.Documents, ragPromptDocument{Label: label, Content: doc.Content})
+    }
+
+    return rs.prompts.Render(ctx, userID, prompts.RAGContext, locale, data)
+}
+
+// SearchMemories はクエリに近い過去の会話の要約を類似度の高い順に返す
+func (rs *RAGService) SearchMemories(ctx context.Context, userID string, query string) (_ []models.ConversationSummary, err error) {
+    ctx, span := tracing.Start(ctx, "RAGService.SearchMemories", attribute.String("user.id", userID))
+    defer func() { tracing.End(span, err) }()
+
+    queryVector, err := rs.vectorizeText(ctx, userID, query)
+    if err != nil {
+        return nil, fmt.Errorf("vectorization failed: %v", err)
+    }
+
+    return rs.findSimilarConversations(ctx, userID, queryVector)
+}
 
-    return contextBuilder.String()
+// EnhanceOptions は EnhancePrompt の条件
+type EnhanceOptions struct {
+    // Locale は返答する言語
+    Locale string
+    // AttachmentIDs は今回のメッセージに添付されたファイル
+    AttachmentIDs []string
+    // SkipMemories なら過去の会話の要約と過去に添付されたファイルを使わない (ユーザーが記憶の利用を止めたとき)
+    SkipMemories bool
 }
 
-// EnhancePromptのエラーハンドリングを改善した版
-func (rs *RAGService) EnhancePrompt(userID string, query string) (string, error) {
+// EnhancePromptのエラーハンドリングを改善した版。拡張に使ったプロンプトのバージョンも返す
+func (rs *RAGService) EnhancePrompt(ctx context.Context, userID, query string, opts EnhanceOptions) (_ string, _ models.PromptVersions, err error) {
+    ctx, span := tracing.Start(ctx, "RAGService.EnhancePrompt", attribute.String("user.id", userID), attribute.Int("rag.attachments", len(opts.AttachmentIDs)), attribute.Bool("rag.skip_memories", opts.SkipMemories))
+    defer func() { tracing.End(span, err) }()
+
     // クエリをベクトル化
-    queryVector, err := rs.vectorizeText(query)
+    queryVector, err := rs.vectorizeText(ctx, userID, query)
     if err != nil {
-        return query, fmt.Errorf("vectorization failed: %v", err) // 元のクエリを返す
+        return query, nil, fmt.Errorf("vectorization failed: %v", err) // 元のクエリを返す
     }
 
     // 類似度の高い過去の会話を検索
-    similarConversations, err := rs.findSimilarConversations(userID, queryVector)
+    var similarConversations []models.ConversationSummary
+    if !opts.SkipMemories {
+        similarConversations, err = rs.findSimilarConversations(ctx, userID, queryVector)
+        if err != nil {
+            metrics.RAGSearches.WithLabelValues("error").Inc()
+            return query, nil, fmt.Errorf("similar conversation search failed: %v", err) // 元のクエリを返す
+        }
+    }
+
+    // 添付ファイルの検索に失敗しても、会話の要約だけで続ける
+    chunks, err := rs.findAttachmentContext(ctx, userID, queryVector, opts.AttachmentIDs, !opts.SkipMemories)
+    if err != nil {
+        slog.WarnContext(ctx, "Attachment search failed", "error", err)
+        chunks = nil
+    }
+
+    // 資料の検索に失敗しても同様に続ける
+    documents, err := rs.findSimilarDocumentChunks(ctx, userID, queryVector, documentChunks, minDocumentSimilarity)
     if err != nil {
-        return query, fmt.Errorf("similar conversation search failed: %v", err) // 元のクエリを返す
+        slog.WarnContext(ctx, "Document search failed", "error", err)
+        documents = nil
     }
+    metrics.RAGHits.Observe(float64(len(similarConversations) + len(chunks) + len(documents)))
 
-    // 類似の会話が見つからない場合は元のクエリを返す
-    if len(similarConversations) == 0 {
-        return query, nil
+    // 類似の会話も添付ファイルも資料も見つからない場合は元のクエリを返す
+    if len(similarConversations) == 0 && len(chunks) == 0 && len(documents) == 0 {
+        metrics.RAGSearches.WithLabelValues("miss").Inc()
+        return query, nil, nil
     }
+    metrics.RAGSearches.WithLabelValues("hit").Inc()
 
     // プロンプトを生成
-    enhancedPrompt := rs.buildPromptWithContext(query, similarConversations)
-    
-    return enhancedPrompt, nil
-}
\ No newline at end of file
+    enhancedPrompt, version, err := rs.buildPromptWithContext(ctx, userID, opts.Locale, query, similarConversations, chunks, documents)
+    if err != nil {
+        return query, nil, err
+    }
+
+    return enhancedPrompt, models.PromptVersions{prompts.RAGContext: version}, nil
+}
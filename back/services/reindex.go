@@ -0,0 +1,372 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 作り直しの対象
+const (
+	ReindexSummaries   = "summaries"
+	ReindexAttachments = "attachments"
+	ReindexDocuments   = "documents"
+)
+
+// ReindexTargets は作り直せる対象の一覧
+var ReindexTargets = []string{ReindexSummaries, ReindexAttachments, ReindexDocuments}
+
+// reindexStartID は id の順に読み進めるときの最初のカーソル
+const reindexStartID = "00000000-0000-0000-0000-000000000000"
+
+// ReindexOptions は作り直しの条件
+type ReindexOptions struct {
+	// UserID が空なら全ユーザーを対象にする
+	UserID string
+	// BatchSize は1回に読み込んで作り直す行数
+	BatchSize int
+	// Resummarize はユーザーに今使うプロンプトと違うバージョンで作った要約を、元のメッセージや下位の要約から作り直す
+	Resummarize bool
+}
+
+// ReindexStats は作り直した行数
+type ReindexStats struct {
+	Reembedded   int
+	Resummarized int
+	// Skipped は作り直す必要がなかった行と、元が保持期間で消えていて要約を作り直せず、埋め込みは最新だった行
+	Skipped int
+	Failed  int
+}
+
+// reindexRow は埋め込みを作り直す1行
+type reindexRow struct {
+	ID     string
+	UserID string
+	Text   string
+}
+
+// Reindexer は埋め込みのバージョンが古い行を作り直す。作り直した行は現在のバージョンになるため、
+// 中断しても再実行すれば残りから続けられる
+type Reindexer struct {
+	db    *sql.DB
+	batch *BatchProcessor
+	usage *UsageService
+}
+
+// NewReindexer コンストラクタ
+func NewReindexer(db *sql.DB, batch *BatchProcessor, usage *UsageService) *Reindexer {
+	return &Reindexer{
+		db:    db,
+		batch: batch,
+		usage: usage,
+	}
+}
+
+// Reindex は target の行のうち、埋め込みのバージョンが古いもの(Resummarize ならプロンプトのバージョンが違う要約も)を作り直す
+func (r *Reindexer) Reindex(ctx context.Context, target string, opts ReindexOptions) (stats ReindexStats, err error) {
+	ctx, span := tracing.Start(ctx, "Reindexer.Reindex", attribute.String("reindex.target", target))
+	defer func() { tracing.End(span, err) }()
+
+	defer func() {
+		metrics.Reindexed.WithLabelValues(target, "reembedded").Add(float64(stats.Reembedded))
+		metrics.Reindexed.WithLabelValues(target, "resummarized").Add(float64(stats.Resummarized))
+		metrics.Reindexed.WithLabelValues(target, "skipped").Add(float64(stats.Skipped))
+		metrics.Reindexed.WithLabelValues(target, "failed").Add(float64(stats.Failed))
+	}()
+
+	if opts.BatchSize <= 0 {
+		return stats, fmt.Errorf("batch size must be positive: %d", opts.BatchSize)
+	}
+
+	switch target {
+	case ReindexSummaries:
+		return r.reindexSummaries(ctx, opts)
+	case ReindexAttachments:
+		return r.reindexChunks(ctx, "attachment_chunks", FeatureAttachment, opts)
+	case ReindexDocuments:
+		return r.reindexChunks(ctx, "document_chunks", FeatureDocument, opts)
+	}
+	return stats, fmt.Errorf("unknown reindex target: %s", target)
+}
+
+// reindexSummaries は要約を作り直す。要約を作り直すときは下位のレベルから順に作り直し、
+// 上位は作り直した下位の要約からまとめ直す
+func (r *Reindexer) reindexSummaries(ctx context.Context, opts ReindexOptions) (ReindexStats, error) {
+	var stats ReindexStats
+	version := embeddingVersion()
+
+	for _, level := range []string{SummaryLevelWindow, SummaryLevelDaily, SummaryLevelWeekly, SummaryLevelTopic} {
+		cursor := reindexStartID
+		for {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+
+			summaries, err := r.batch.querySummaries(ctx, `
+        SELECT id, user_id, summary, vector::real[], start_time, end_time, created_at,
+               level, COALESCE(topic, ''), embedding_version, summary_version
+        FROM conversation_summaries
+        WHERE level = $1 AND ($2 = '' OR user_id = $2) AND id > $3::uuid
+          AND (embedding_version <> $4 OR $5::boolean)
+        ORDER BY id
+        LIMIT $6
+    `, level, opts.UserID, cursor, version, opts.Resummarize, opts.BatchSize)
+			if err != nil {
+				return stats, err
+			}
+			if len(summaries) == 0 {
+				break
+			}
+			cursor = summaries[len(summaries)-1].ID
+
+			var stale []reindexRow
+			for _, s := range summaries {
+				outdated := false
+				if opts.Resummarize {
+					if outdated, err = r.batch.summaryOutdated(ctx, s); err != nil {
+						return stats, err
+					}
+				}
+				if outdated {
+					done, err := r.batch.resummarize(ctx, s)
+					if err != nil {
+						if ctx.Err() != nil {
+							return stats, ctx.Err()
+						}
+						slog.ErrorContext(ctx, "Failed to resummarize", "summary_id", s.ID, "level", s.Level, "user_id", s.UserID, "error", err)
+						stats.Failed++
+						continue
+					}
+					if done {
+						stats.Resummarized++
+						continue
+					}
+				}
+				if s.EmbeddingVersion != version {
+					stale = append(stale, reindexRow{ID: s.ID, UserID: s.UserID, Text: s.Summary})
+					continue
+				}
+				stats.Skipped++
+			}
+
+			n, err := r.reembed(ctx, "conversation_summaries", FeatureSummary, stale)
+			stats.Reembedded += n
+			if err != nil {
+				return stats, err
+			}
+			slog.InfoContext(ctx, "Reindexed summaries", "level", level, "cursor", cursor, "reembedded", stats.Reembedded, "resummarized", stats.Resummarized)
+		}
+	}
+	return stats, nil
+}
+
+// reindexChunks は添付ファイル・資料のチャンクの埋め込みを作り直す
+func (r *Reindexer) reindexChunks(ctx context.Context, table, feature string, opts ReindexOptions) (ReindexStats, error) {
+	var stats ReindexStats
+	cursor := reindexStartID
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		rows, err := r.db.QueryContext(ctx, `
+        SELECT id, user_id, content
+        FROM `+table+`
+        WHERE ($1 = '' OR user_id = $1) AND id > $2::uuid AND embedding_version <> $3
+        ORDER BY id
+        LIMIT $4
+    `, opts.UserID, cursor, embeddingVersion(), opts.BatchSize)
+		if err != nil {
+			return stats, fmt.Errorf("failed to query %s: %v", table, err)
+		}
+		var chunks []reindexRow
+		for rows.Next() {
+			var c reindexRow
+			if err := rows.Scan(&c.ID, &c.UserID, &c.Text); err != nil {
+				rows.Close()
+				return stats, fmt.Errorf("row scan failed: %v", err)
+			}
+			chunks = append(chunks, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return stats, fmt.Errorf("row iteration failed: %v", err)
+		}
+		if len(chunks) == 0 {
+			return stats, nil
+		}
+		cursor = chunks[len(chunks)-1].ID
+
+		n, err := r.reembed(ctx, table, feature, chunks)
+		stats.Reembedded += n
+		if err != nil {
+			return stats, err
+		}
+		slog.InfoContext(ctx, "Reindexed chunks", "table", table, "cursor", cursor, "reembedded", stats.Reembedded)
+	}
+}
+
+// reembed は行のテキストを現在のモデルでベクトル化し直して保存する。使用量はユーザーごとに記録する
+func (r *Reindexer) reembed(ctx context.Context, table, feature string, rows []reindexRow) (int, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	var users []string
+	byUser := make(map[string][]reindexRow)
+	for _, row := range rows {
+		if _, ok := byUser[row.UserID]; !ok {
+			users = append(users, row.UserID)
+		}
+		byUser[row.UserID] = append(byUser[row.UserID], row)
+	}
+
+	model, version := embeddingModel(), embeddingVersion()
+	updated := 0
+	for _, userID := range users {
+		userRows := byUser[userID]
+		texts := make([]string, len(userRows))
+		for i, row := range userRows {
+			texts[i] = row.Text
+		}
+		vectors, err := embedTexts(ctx, r.usage, userID, feature, texts)
+		if err != nil {
+			return updated, err
+		}
+
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return updated, fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		for i, row := range userRows {
+			if _, err := tx.ExecContext(ctx, `
+        UPDATE `+table+`
+        SET vector = $2::float8[], embedding_model = $3, embedding_version = $4
+        WHERE id = $1
+    `, row.ID, pq.Float64Array(vectors[i]), model, version); err != nil {
+				tx.Rollback()
+				return updated, fmt.Errorf("failed to update %s: %v", table, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return updated, fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		updated += len(userRows)
+	}
+	return updated, nil
+}
+
+// summaryOutdated は要約が、ユーザーに今使うプロンプトと違うバージョンで作られたかを返す。
+// 元の要約をそのまま使った日・週の要約 (バージョン 0) は、元が作り直されていることがあるため常に作り直す
+func (bp *BatchProcessor) summaryOutdated(ctx context.Context, s models.ConversationSummary) (bool, error) {
+	name := prompts.SummaryWindow
+	if s.Level != SummaryLevelWindow {
+		name = rollupPrompts[s.Level]
+	}
+	selection, err := bp.prompts.Select(ctx, s.UserID, name)
+	if err != nil {
+		return false, err
+	}
+	return s.SummaryVersion != selection.Version, nil
+}
+
+// resummarize は要約を今のプロンプトで作り直す。3時間ごとの要約は元のメッセージから、日・週・話題の要約は下位の要約から作る。
+// 元が保持期間で消えている(一部でも)なら作り直さず false を返す
+func (bp *BatchProcessor) resummarize(ctx context.Context, s models.ConversationSummary) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "BatchProcessor.resummarize", attribute.String("summary.level", s.Level), attribute.String("user.id", s.UserID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetBatchUserTimeout())
+	defer cancel()
+
+	pruned, err := bp.sourcesPruned(ctx, s)
+	if err != nil || pruned {
+		return false, err
+	}
+
+	switch s.Level {
+	case SummaryLevelWindow:
+		conversations, err := bp.conversations.GetConversationsInPeriod(ctx, s.UserID, s.StartTime, s.EndTime)
+		if err != nil {
+			return false, fmt.Errorf("failed to get conversations: %w", err)
+		}
+		if len(conversations) == 0 {
+			return false, nil
+		}
+		summary, summaryVersion, err := bp.summarizeConversations(ctx, s.UserID, conversations)
+		if err != nil {
+			return false, fmt.Errorf("failed to summarize conversations: %w", err)
+		}
+		vector, err := bp.vectorizeText(ctx, s.UserID, summary)
+		if err != nil {
+			return false, fmt.Errorf("failed to vectorize text: %w", err)
+		}
+		return true, bp.saveToPostgres(ctx, s.UserID, summary, vector, s.StartTime, s.EndTime, summaryVersion)
+
+	case SummaryLevelDaily, SummaryLevelWeekly:
+		childLevel := SummaryLevelWindow
+		if s.Level == SummaryLevelWeekly {
+			childLevel = SummaryLevelDaily
+		}
+		children, err := bp.summariesInPeriod(ctx, s.UserID, childLevel, s.StartTime, s.EndTime)
+		if err != nil || len(children) == 0 {
+			return false, err
+		}
+		inputs := children
+		if s.Level == SummaryLevelDaily {
+			inputs = coveringWindows(children)
+		}
+		return true, bp.rollup(ctx, s.UserID, s.Level, s.StartTime, s.EndTime, children, inputs)
+
+	case SummaryLevelTopic:
+		var members int
+		if err := bp.postgresDB.QueryRowContext(ctx, `
+            SELECT count(*) FROM conversation_summary_links WHERE parent_id = $1
+        `, s.ID).Scan(&members); err != nil {
+			return false, fmt.Errorf("failed to count topic members: %v", err)
+		}
+		if members == 0 {
+			return false, nil
+		}
+		return true, bp.saveTopic(ctx, s.UserID, s.ID, nil)
+	}
+	return false, fmt.Errorf("unknown summary level: %s", s.Level)
+}
+
+// sourcesPruned は要約の元になったメッセージ・下位の要約が保持期間で削除されたかを監査ログから調べる
+func (bp *BatchProcessor) sourcesPruned(ctx context.Context, s models.ConversationSummary) (bool, error) {
+	var pruned bool
+	var err error
+	if s.Level == SummaryLevelWindow {
+		err = bp.postgresDB.QueryRowContext(ctx, `
+            SELECT EXISTS (
+                SELECT 1 FROM retention_audit_log
+                WHERE user_id = $1 AND action = $2
+                  AND (details->>'start_time')::timestamp < $4
+                  AND (details->>'end_time')::timestamp > $3
+                  AND (details->>'expires_by')::timestamp <= $5)
+        `, s.UserID, RetentionMessageExpiryScheduled, s.StartTime, s.EndTime, time.Now().UTC()).Scan(&pruned)
+	} else {
+		err = bp.postgresDB.QueryRowContext(ctx, `
+            SELECT EXISTS (
+                SELECT 1 FROM retention_audit_log
+                WHERE user_id = $1 AND action = $2
+                  AND (details->>'start_time')::timestamp < $4
+                  AND (details->>'end_time')::timestamp > $3)
+        `, s.UserID, RetentionSummaryDeleted, s.StartTime, s.EndTime).Scan(&pruned)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check retention audit log: %v", err)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,349 @@
+package services
+
+import (
+	"back/config"
+	"back/i18n"
+	"back/metrics"
+	"back/models"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// リマインダーの状態
+const (
+	ReminderPending  = "pending"
+	ReminderSending  = "sending"
+	ReminderSent     = "sent"
+	ReminderCanceled = "canceled"
+)
+
+// リマインダーの登録元
+const (
+	ReminderSourceChat = "chat"
+	ReminderSourceAPI  = "api"
+)
+
+const (
+	// maxPendingReminders はユーザーごとに登録できる未送信のリマインダー数
+	maxPendingReminders = 100
+	// maxReminderMessageRunes はリマインダー本文の最大文字数
+	maxReminderMessageRunes = 1000
+)
+
+var (
+	ErrReminderNotFound = errors.New("reminder not found")
+	// ErrInvalidReminder はリマインダーの内容や期限が不正なことを表す
+	ErrInvalidReminder = errors.New("invalid reminder")
+)
+
+const reminderColumns = `id, user_id, message, due_at, status, source, created_at, updated_at, sent_at`
+
+// ReminderService はリマインダーの登録・管理と、期限が来たものの配信を行う
+type ReminderService struct {
+	db            *sql.DB
+	conversations *ConversationStore
+	settings      *SettingsService
+}
+
+// NewReminderService コンストラクタ
+func NewReminderService(db *sql.DB, conversations *ConversationStore, settings *SettingsService) *ReminderService {
+	return &ReminderService{db: db, conversations: conversations, settings: settings}
+}
+
+// validateReminder は本文と期限を検証する
+func validateReminder(message string, dueAt time.Time, now time.Time) error {
+	if strings.TrimSpace(message) == "" || utf8.RuneCountInString(message) > maxReminderMessageRunes {
+		return fmt.Errorf("%w: message must be 1-%d characters", ErrInvalidReminder, maxReminderMessageRunes)
+	}
+	if !dueAt.After(now) {
+		return fmt.Errorf("%w: due_at must be in the future", ErrInvalidReminder)
+	}
+	return nil
+}
+
+// Create はリマインダーを登録する
+func (rs *ReminderService) Create(ctx context.Context, userID, message string, dueAt time.Time, source string) (_ models.Reminder, err error) {
+	ctx, span := tracing.Start(ctx, "ReminderService.Create", attribute.String("user.id", userID), attribute.String("reminder.source", source))
+	defer func() { tracing.End(span, err) }()
+
+	message = strings.TrimSpace(message)
+	if err := validateReminder(message, dueAt, time.Now()); err != nil {
+		return models.Reminder{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	var pending int
+	err = rs.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM reminders WHERE user_id = $1 AND status = $2
+    `, userID, ReminderPending).Scan(&pending)
+	if err != nil {
+		return models.Reminder{}, fmt.Errorf("failed to count reminders: %v", err)
+	}
+	if pending >= maxPendingReminders {
+		return models.Reminder{}, fmt.Errorf("%w: at most %d pending reminders are allowed", ErrInvalidReminder, maxPendingReminders)
+	}
+
+	now := time.Now().UTC()
+	row := rs.db.QueryRowContext(ctx, `
+        INSERT INTO reminders (user_id, message, due_at, status, source, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $6)
+        RETURNING `+reminderColumns,
+		userID, message, dueAt.UTC(), ReminderPending, source, now)
+
+	reminder, err := scanReminder(row)
+	if err != nil {
+		return models.Reminder{}, fmt.Errorf("failed to create reminder: %v", err)
+	}
+	return reminder, nil
+}
+
+// List はユーザーのリマインダーを期限の早い順に返す。includeDone が false なら未送信(配信中を含む)のもののみ
+func (rs *ReminderService) List(ctx context.Context, userID string, includeDone bool) (_ []models.Reminder, err error) {
+	ctx, span := tracing.Start(ctx, "ReminderService.List", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        SELECT `+reminderColumns+`
+        FROM reminders
+        WHERE user_id = $1 AND ($2 OR status IN ($3, $4))
+        ORDER BY due_at
+        LIMIT 500
+    `, userID, includeDone, ReminderPending, ReminderSending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reminders: %v", err)
+	}
+	defer rows.Close()
+
+	reminders := make([]models.Reminder, 0)
+	for rows.Next() {
+		reminder, err := scanReminder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan reminder: %v", err)
+		}
+		reminders = append(reminders, reminder)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reminders: %v", err)
+	}
+	return reminders, nil
+}
+
+// Update は未送信のリマインダーの本文・期限を変更する。nil の項目は変更しない
+func (rs *ReminderService) Update(ctx context.Context, userID, id string, message *string, dueAt *time.Time) (_ models.Reminder, err error) {
+	ctx, span := tracing.Start(ctx, "ReminderService.Update", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	current, err := rs.get(ctx, userID, id)
+	if err != nil {
+		return models.Reminder{}, err
+	}
+	if current.Status != ReminderPending {
+		return models.Reminder{}, fmt.Errorf("%w: only pending reminders can be updated", ErrInvalidReminder)
+	}
+
+	if message != nil {
+		current.Message = strings.TrimSpace(*message)
+	}
+	if dueAt != nil {
+		current.DueAt = *dueAt
+	}
+	if err := validateReminder(current.Message, current.DueAt, time.Now()); err != nil {
+		return models.Reminder{}, err
+	}
+
+	// 配信と競合した場合に送信済みのものを書き換えないよう、状態も条件に含める
+	row := rs.db.QueryRowContext(ctx, `
+        UPDATE reminders
+        SET message = $3, due_at = $4, updated_at = $5
+        WHERE id = $1 AND user_id = $2 AND status = 'pending'
+        RETURNING `+reminderColumns,
+		id, userID, current.Message, current.DueAt.UTC(), time.Now().UTC())
+
+	reminder, err := scanReminder(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Reminder{}, ErrReminderNotFound
+	}
+	if err != nil {
+		return models.Reminder{}, fmt.Errorf("failed to update reminder: %v", err)
+	}
+	return reminder, nil
+}
+
+// Cancel は未送信のリマインダーを取り消す
+func (rs *ReminderService) Cancel(ctx context.Context, userID, id string) (err error) {
+	ctx, span := tracing.Start(ctx, "ReminderService.Cancel", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrReminderNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := rs.db.ExecContext(ctx, `
+        UPDATE reminders
+        SET status = $3, updated_at = $4
+        WHERE id = $1 AND user_id = $2 AND status = 'pending'
+    `, id, userID, ReminderCanceled, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to cancel reminder: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrReminderNotFound
+	}
+	return nil
+}
+
+// DeliverDue は期限の来たリマインダーを会話にアシスタントのメッセージとして投稿し、送信済みにする。
+// 複数のバッチが同時に動いても二重に送らないよう、先に配信中にして取得してから1件ずつ投稿する
+func (rs *ReminderService) DeliverDue(ctx context.Context, limit int) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "ReminderService.DeliverDue")
+	defer func() { tracing.End(span, err) }()
+
+	due, err := rs.claim(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, reminder := range due {
+		locale := rs.settings.Locale(ctx, reminder.UserID)
+		message := models.Conversation{UserID: reminder.UserID, Role: "assistant", Content: reminderText(reminder, locale), Locale: locale}
+		if _, err := rs.conversations.SaveConversation(ctx, message); err != nil {
+			metrics.RemindersDelivered.WithLabelValues("failed").Inc()
+			slog.ErrorContext(ctx, "Failed to post reminder", "user_id", reminder.UserID, "reminder_id", reminder.ID, "error", err)
+			// 次回の実行で再送する
+			if err := rs.setDeliveryStatus(ctx, reminder.ID, ReminderPending); err != nil {
+				slog.ErrorContext(ctx, "Failed to release reminder", "reminder_id", reminder.ID, "error", err)
+			}
+			continue
+		}
+
+		// 投稿した後は、他のリマインダーの失敗に巻き込まれて再送されないように1件ずつ送信済みにする
+		if err := rs.setDeliveryStatus(ctx, reminder.ID, ReminderSent); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark reminder as sent", "reminder_id", reminder.ID, "error", err)
+		}
+		delivered++
+		metrics.RemindersDelivered.WithLabelValues("sent").Inc()
+	}
+	return delivered, nil
+}
+
+// claim は期限の来たリマインダーを配信中にして返す。
+// 配信中のまま lease を過ぎたもの(途中で止まったバッチのもの)も取り直す
+func (rs *ReminderService) claim(ctx context.Context, limit int) ([]models.Reminder, error) {
+	now := time.Now().UTC()
+	// 全件を順に投稿し終えるまで他のバッチに取られないようにする
+	lease := config.GetStorageTimeout()*time.Duration(limit) + time.Minute
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        UPDATE reminders
+        SET status = $4, updated_at = $1
+        WHERE id IN (
+            SELECT id FROM reminders
+            WHERE (status = 'pending' AND due_at <= $1) OR (status = 'sending' AND updated_at <= $2)
+            ORDER BY due_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+reminderColumns,
+		now, now.Add(-lease), limit, ReminderSending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim due reminders: %v", err)
+	}
+	defer rows.Close()
+
+	var due []models.Reminder
+	for rows.Next() {
+		reminder, err := scanReminder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan reminder: %v", err)
+		}
+		due = append(due, reminder)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read due reminders: %v", err)
+	}
+	return due, nil
+}
+
+// setDeliveryStatus は配信中のリマインダーを送信済みか未送信に戻す
+func (rs *ReminderService) setDeliveryStatus(ctx context.Context, id, status string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	now := time.Now().UTC()
+	var sentAt *time.Time
+	if status == ReminderSent {
+		sentAt = &now
+	}
+	_, err := rs.db.ExecContext(ctx, `
+        UPDATE reminders SET status = $2, sent_at = $3, updated_at = $4 WHERE id = $1 AND status = 'sending'
+    `, id, status, sentAt, now)
+	if err != nil {
+		return fmt.Errorf("failed to update reminder status: %v", err)
+	}
+	return nil
+}
+
+func (rs *ReminderService) get(ctx context.Context, userID, id string) (models.Reminder, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return models.Reminder{}, ErrReminderNotFound
+	}
+
+	row := rs.db.QueryRowContext(ctx, `
+        SELECT `+reminderColumns+` FROM reminders WHERE id = $1 AND user_id = $2
+    `, id, userID)
+
+	reminder, err := scanReminder(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Reminder{}, ErrReminderNotFound
+	}
+	if err != nil {
+		return models.Reminder{}, fmt.Errorf("failed to get reminder: %v", err)
+	}
+	return reminder, nil
+}
+
+// reminderText は会話に投稿するリマインダーの文面
+func reminderText(reminder models.Reminder, locale string) string {
+	return i18n.T(locale, "Reminder: %s", reminder.Message)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReminder(row rowScanner) (models.Reminder, error) {
+	var r models.Reminder
+	var sentAt sql.NullTime
+	if err := row.Scan(&r.ID, &r.UserID, &r.Message, &r.DueAt, &r.Status, &r.Source, &r.CreatedAt, &r.UpdatedAt, &sentAt); err != nil {
+		return models.Reminder{}, err
+	}
+	if sentAt.Valid {
+		r.SentAt = &sentAt.Time
+	}
+	return r, nil
+}
@@ -1,13 +1,24 @@
 package services
 
 import (
+	"back/config"
+	"back/i18n"
+	"back/metrics"
+	"back/models"
+	"back/prompts"
+	"back/tracing"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
+	"regexp"
+	"strings"
+	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PerplexityResponse struct {
@@ -16,65 +27,471 @@ type PerplexityResponse struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	// Citations は本文中の [1], [2]... に対応する出典URL
+	Citations     []string `json:"citations"`
+	SearchResults []struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+	} `json:"search_results"`
 }
 
-func ResearchAITopic(c *gin.Context) (string, error) {
-	client := resty.New()
-	perplexityURL := "https://api.perplexity.ai/chat/completions"
+// citations は出典を本文の番号順に返す。タイトルは search_results から補う
+func (r PerplexityResponse) citations() []models.Citation {
+	titles := make(map[string]string, len(r.SearchResults))
+	for _, sr := range r.SearchResults {
+		titles[sr.URL] = sr.Title
+	}
+
+	urls := r.Citations
+	if len(urls) == 0 {
+		for _, sr := range r.SearchResults {
+			urls = append(urls, sr.URL)
+		}
+	}
+
+	citations := make([]models.Citation, 0, len(urls))
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		citations = append(citations, models.Citation{Title: titles[url], URL: url})
+	}
+	return citations
+}
+
+// ResearchResult はリサーチの回答と出典
+type ResearchResult struct {
+	Content   string
+	Citations []models.Citation
+	// PromptVersions はリサーチに使ったプロンプトのバージョン
+	PromptVersions models.PromptVersions
+	// Locale は回答の言語。対応していない言語なら空
+	Locale string
+}
+
+const (
+	perplexityURL = "https://api.perplexity.ai/chat/completions"
+	researchModel = "sonar"
+
+	// defaultResearchTopic はユーザーの記憶から話題を作れないときの話題
+	defaultResearchTopic = "AI"
+	// maxResearchDomains は search_domain_filter に渡せるドメイン数の上限
+	maxResearchDomains = 10
+	// topicSummaryLimit は話題の抽出に使う直近の要約の件数
+	topicSummaryLimit = 5
+)
+
+// ErrInvalidResearchRequest はリサーチ条件の指定が不正なことを表す
+var ErrInvalidResearchRequest = errors.New("invalid research request")
+
+var (
+	validLanguage = regexp.MustCompile(`^[a-z]{2}(-[A-Z]{2})?$`)
+	validDomain   = regexp.MustCompile(`^-?[A-Za-z0-9.-]{1,253}$`)
+
+	// Perplexity の search_recency_filter が受け付ける値
+	researchRecencies = map[string]bool{"hour": true, "day": true, "week": true, "month": true, "year": true}
+
+	// プロンプトで回答言語を指示するときの言語名
+	languageNames = map[string]string{"ja": "日本語", "en": "English"}
+)
+
+// ResearchRequest はリサーチの条件。Topics が空ならユーザーの記憶から話題を決める
+type ResearchRequest struct {
+	Topics   []string
+	Language string
+	Recency  string
+	Domains  []string
+}
+
+// Normalize は既定値を補い、不正な指定があれば ErrInvalidResearchRequest を返す。
+// Language が空なら Research がユーザーの言語を使う
+func (r *ResearchRequest) Normalize() error {
+	if r.Language != "" && !validLanguage.MatchString(r.Language) {
+		return fmt.Errorf("%w: language must be a language code like ja or en-US", ErrInvalidResearchRequest)
+	}
+
+	if r.Recency == "" {
+		r.Recency = "month"
+	}
+	if !researchRecencies[r.Recency] {
+		return fmt.Errorf("%w: recency must be one of hour, day, week, month, year", ErrInvalidResearchRequest)
+	}
+
+	if len(r.Domains) > maxResearchDomains {
+		return fmt.Errorf("%w: at most %d domains are allowed", ErrInvalidResearchRequest, maxResearchDomains)
+	}
+	for _, d := range r.Domains {
+		if !validDomain.MatchString(d) {
+			return fmt.Errorf("%w: invalid domain %q", ErrInvalidResearchRequest, d)
+		}
+	}
+
+	for i, t := range r.Topics {
+		r.Topics[i] = strings.TrimSpace(t)
+		if r.Topics[i] == "" || len([]rune(r.Topics[i])) > 100 {
+			return fmt.Errorf("%w: topics must be 1-100 characters", ErrInvalidResearchRequest)
+		}
+	}
+	return nil
+}
+
+// ResearchService はPerplexityでユーザーの関心に沿った最新の話題を調べる
+type ResearchService struct {
+	db            *sql.DB
+	conversations *ConversationStore
+	usage         *UsageService
+	prompts       *PromptService
+	settings      *SettingsService
+}
+
+// NewResearchService コンストラクタ
+func NewResearchService(db *sql.DB, conversations *ConversationStore, usage *UsageService, prompts *PromptService, settings *SettingsService) *ResearchService {
+	return &ResearchService{db: db, conversations: conversations, usage: usage, prompts: prompts, settings: settings}
+}
+
+// Research は条件に従って最新の話題を調べる。話題の指定がなければユーザーの記憶から決める
+func (rs *ResearchService) Research(ctx context.Context, userID string, req ResearchRequest) (_ ResearchResult, err error) {
+	ctx, span := tracing.Start(ctx, "ResearchService.Research", attribute.String("user.id", userID), attribute.String("llm.model", researchModel))
+	defer func() { tracing.End(span, err) }()
 
-	apiKey := os.Getenv("PERPLEXITY_API_KEY")
+	if err := req.Normalize(); err != nil {
+		return ResearchResult{}, err
+	}
+	if req.Language == "" {
+		req.Language = rs.settings.Locale(ctx, userID)
+	}
+	// 対応していない言語なら既定のテンプレートを使い、回答の言語だけを指示する
+	locale := i18n.Normalize(req.Language)
+
+	if len(req.Topics) == 0 {
+		topics, err := rs.UserTopics(ctx, userID, locale)
+		if err != nil {
+			// 話題の抽出に失敗してもリサーチ自体は続ける
+			slog.WarnContext(ctx, "Failed to derive research topics", "user_id", userID, "error", err)
+		}
+		req.Topics = topics
+	}
+	if len(req.Topics) == 0 {
+		req.Topics = []string{defaultResearchTopic}
+	}
+	span.SetAttributes(attribute.StringSlice("research.topics", req.Topics))
+
+	apiKey := config.GetPerplexityKey()
 	if apiKey == "" {
-		return "", fmt.Errorf("API key is not set")
+		return ResearchResult{}, fmt.Errorf("API key is not set")
+	}
+
+	systemPrompt, systemVersion, err := rs.prompts.Render(ctx, userID, prompts.ResearchSystem, locale, struct{ Language string }{languageName(req.Language)})
+	if err != nil {
+		return ResearchResult{}, err
+	}
+	queryPrompt, queryVersion, err := rs.prompts.Render(ctx, userID, prompts.ResearchQuery, locale, struct{ Topics []string }{req.Topics})
+	if err != nil {
+		return ResearchResult{}, err
 	}
 
 	requestBody := map[string]interface{}{
-		"model": "sonar",
+		"model": researchModel,
 		"messages": []map[string]string{
 			{
 				"role":    "system",
-				"content": "Be precise and concise.",
+				"content": systemPrompt,
 			},
 			{
 				"role":    "user",
-				"content": "最新のAIに関する話題を5つ以上教えてください。",
+				"content": queryPrompt,
 			},
 		},
-		"max_tokens":               8000,  // 必要に応じて調整
+		"max_tokens":               8000, // 必要に応じて調整
 		"temperature":              0.2,
 		"top_p":                    0.9,
-		"search_domain_filter":     []string{"perplexity.ai"},
 		"return_images":            false,
 		"return_related_questions": false,
-		"search_recency_filter":    "month",
+		"search_recency_filter":    req.Recency,
 		"top_k":                    0,
 		"stream":                   false,
 		"presence_penalty":         0,
 		"frequency_penalty":        1,
 		"response_format":          nil,
 	}
+	if len(req.Domains) > 0 {
+		requestBody["search_domain_filter"] = req.Domains
+	}
+
+	start := time.Now()
+	result, err := postResearch(ctx, apiKey, requestBody)
+	observeProviderCall(ProviderPerplexity, researchModel, "research", start, err, result.Usage.PromptTokens, result.Usage.CompletionTokens)
+	if err != nil {
+		return ResearchResult{}, err
+	}
+	rs.usage.Record(ctx, UsageRecord{
+		UserID:           userID,
+		Feature:          FeatureResearch,
+		Provider:         ProviderPerplexity,
+		Model:            researchModel,
+		PromptTokens:     result.Usage.PromptTokens,
+		CompletionTokens: result.Usage.CompletionTokens,
+	})
 
-	resp, err := client.R().
+	if len(result.Choices) > 0 && result.Choices[0].Message.Content != "" {
+		citations := result.citations()
+		span.SetAttributes(attribute.Int("research.citations", len(citations)))
+		return ResearchResult{
+			Content:        result.Choices[0].Message.Content,
+			Citations:      citations,
+			PromptVersions: models.PromptVersions{prompts.ResearchSystem: systemVersion, prompts.ResearchQuery: queryVersion},
+			Locale:         locale,
+		}, nil
+	}
+
+	return ResearchResult{}, &ProviderError{Provider: ProviderPerplexity, Kind: ErrUpstream, StatusCode: http.StatusOK, Err: fmt.Errorf("no content in response")}
+}
+
+// UserTopics はユーザーの直近の要約から関心のある話題を locale の語句で最大3つ抽出する。
+// 要約がないか、ユーザーが記憶の利用を止めていれば空を返す
+func (rs *ResearchService) UserTopics(ctx context.Context, userID, locale string) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "ResearchService.UserTopics", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	settings, err := rs.settings.Settings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.MemoryEnabled {
+		return nil, nil
+	}
+
+	summaries, err := rs.recentSummaries(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(summaries) == 0 {
+		return nil, nil
+	}
+
+	apiKey := config.GetOpenAIKey()
+	if apiKey == "" {
+		return nil, fmt.Errorf("OPENAI_API_KEY is not set")
+	}
+
+	instruction, _, err := rs.prompts.Render(ctx, userID, prompts.ResearchTopics, locale, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var contextBuilder strings.Builder
+	for _, s := range summaries {
+		contextBuilder.WriteString("- ")
+		contextBuilder.WriteString(s.Summary)
+		contextBuilder.WriteString("\n")
+	}
+
+	requestBody := map[string]interface{}{
+		"model": chatModel,
+		"messages": []map[string]string{
+			{
+				"role":    "system",
+				"content": instruction,
+			},
+			{
+				"role":    "user",
+				"content": contextBuilder.String(),
+			},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+	}
+
+	start := time.Now()
+	reply, usage, err := postChatCompletion(ctx, apiKey, requestBody)
+	observeProviderCall(ProviderOpenAI, chatModel, "research_topics", start, err, usage.PromptTokens, usage.CompletionTokens)
+	if err != nil {
+		return nil, err
+	}
+	rs.usage.Record(ctx, UsageRecord{
+		UserID:           userID,
+		Feature:          FeatureResearch,
+		Provider:         ProviderOpenAI,
+		Model:            chatModel,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	})
+
+	var parsed struct {
+		Topics []string `json:"topics"`
+	}
+	if err := json.Unmarshal([]byte(reply.Content), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse topics: %v", err)
+	}
+
+	topics := make([]string, 0, 3)
+	for _, t := range parsed.Topics {
+		if t = strings.TrimSpace(t); t != "" && len([]rune(t)) <= 100 {
+			topics = append(topics, t)
+		}
+		if len(topics) == 3 {
+			break
+		}
+	}
+	return topics, nil
+}
+
+// Digest はユーザーの関心に沿った直近1日の話題を調べ、会話に保存する。
+// 話題を抽出できるだけの記憶がないユーザーは false を返して何もしない
+func (rs *ResearchService) Digest(ctx context.Context, userID string) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "ResearchService.Digest", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	locale := rs.settings.Locale(ctx, userID)
+	topics, err := rs.UserTopics(ctx, userID, locale)
+	if err != nil {
+		return false, fmt.Errorf("failed to derive topics: %w", err)
+	}
+	if len(topics) == 0 {
+		return false, nil
+	}
+
+	result, err := rs.Research(ctx, userID, ResearchRequest{Topics: topics, Language: locale, Recency: "day"})
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := rs.conversations.SaveConversation(ctx, models.Conversation{
+		UserID:         userID,
+		Role:           "assistant",
+		Content:        result.Content,
+		Citations:      result.Citations,
+		PromptVersions: result.PromptVersions,
+		Locale:         result.Locale,
+	}); err != nil {
+		return false, fmt.Errorf("failed to save digest: %w", err)
+	}
+	return true, nil
+}
+
+// RunDigests は直近にアクティブだったユーザー全員のダイジェストを作成する。
+// ctx がキャンセルされたら残りのユーザーは処理しない
+func (rs *ResearchService) RunDigests(ctx context.Context, activeSince time.Time) (err error) {
+	ctx, span := tracing.Start(ctx, "ResearchService.RunDigests")
+	defer func() { tracing.End(span, err) }()
+
+	users, err := rs.conversations.GetActiveUsers(ctx, activeSince)
+	if err != nil {
+		return fmt.Errorf("failed to get active users: %v", err)
+	}
+
+	for _, userID := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// トークン上限に達しているユーザーには送らない
+		if err := rs.usage.CheckQuota(ctx, userID); err != nil {
+			metrics.ResearchDigests.WithLabelValues("skipped").Inc()
+			slog.InfoContext(ctx, "Skipping research digest", "user_id", userID, "error", err)
+			continue
+		}
+
+		userCtx, cancel := context.WithTimeout(ctx, config.GetResearchTimeout())
+		created, err := rs.Digest(userCtx, userID)
+		cancel()
+		switch {
+		case err != nil:
+			metrics.ResearchDigests.WithLabelValues("failed").Inc()
+			slog.ErrorContext(ctx, "Error creating research digest", "user_id", userID, "error", err)
+		case created:
+			metrics.ResearchDigests.WithLabelValues("created").Inc()
+			slog.InfoContext(ctx, "Created research digest", "user_id", userID)
+		default:
+			metrics.ResearchDigests.WithLabelValues("skipped").Inc()
+		}
+	}
+	return nil
+}
+
+// recentSummaries はユーザーの直近の要約を新しい順に取得する
+func (rs *ResearchService) recentSummaries(ctx context.Context, userID string) ([]models.ConversationSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        SELECT summary, start_time, end_time
+        FROM conversation_summaries
+        WHERE user_id = $1 AND level = 'window'
+        ORDER BY end_time DESC
+        LIMIT $2
+    `, userID, topicSummaryLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query summaries: %v", err)
+	}
+	defer rows.Close()
+
+	var summaries []models.ConversationSummary
+	for rows.Next() {
+		s := models.ConversationSummary{UserID: userID}
+		if err := rows.Scan(&s.Summary, &s.StartTime, &s.EndTime); err != nil {
+			return nil, fmt.Errorf("failed to scan summary: %v", err)
+		}
+		summaries = append(summaries, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read summaries: %v", err)
+	}
+	return summaries, nil
+}
+
+// contentWithCitations はメッセージ本文の末尾に出典の一覧を付ける。
+// 要約や会話履歴に出典を残し、後の回答で参照できるようにする
+func contentWithCitations(conv models.Conversation, locale string) string {
+	if len(conv.Citations) == 0 {
+		return conv.Content
+	}
+
+	var b strings.Builder
+	b.WriteString(conv.Content)
+	b.WriteString("\n\n" + i18n.T(locale, "Sources:") + "\n")
+	for i, c := range conv.Citations {
+		if c.Title != "" {
+			fmt.Fprintf(&b, "[%d] %s (%s)\n", i+1, c.Title, c.URL)
+		} else {
+			fmt.Fprintf(&b, "[%d] %s\n", i+1, c.URL)
+		}
+	}
+	return b.String()
+}
+
+func languageName(code string) string {
+	if name, ok := languageNames[code]; ok {
+		return name
+	}
+	return code
+}
+
+// postResearch はPerplexityのChat Completions APIを呼び出してレスポンスをデコードする
+func postResearch(ctx context.Context, apiKey string, requestBody map[string]interface{}) (PerplexityResponse, error) {
+	var result PerplexityResponse
+
+	resp, err := newRestyClient(ProviderPerplexity).R().
+		SetContext(ctx).
 		SetHeader("Authorization", "Bearer "+apiKey).
 		SetHeader("Content-Type", "application/json").
 		SetBody(requestBody).
 		Post(perplexityURL)
 
 	if err != nil {
-		return "", err
+		return result, err
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		return "", fmt.Errorf("failed to fetch AI topic, status: %d", resp.StatusCode())
+		return result, &ProviderError{Provider: ProviderPerplexity, Kind: ErrUpstream, StatusCode: resp.StatusCode(), Err: fmt.Errorf("failed to fetch research result")}
 	}
 
-	var result PerplexityResponse
 	if err := json.Unmarshal(resp.Body(), &result); err != nil {
-		return "", fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	if len(result.Choices) > 0 && result.Choices[0].Message.Content != "" {
-		return result.Choices[0].Message.Content, nil
+		return result, &ProviderError{Provider: ProviderPerplexity, Kind: ErrUpstream, StatusCode: resp.StatusCode(), Err: fmt.Errorf("failed to parse response: %v", err)}
 	}
 
-	return "", fmt.Errorf("no content in response")
+	return result, nil
 }
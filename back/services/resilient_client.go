@@ -0,0 +1,294 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"back/config"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	ProviderOpenAI     = "openai"
+	ProviderPerplexity = "perplexity"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 20 * time.Second
+)
+
+var (
+	// errHeaderTimeout は試行のタイムアウトまでにレスポンスヘッダーが届かなかったことを表す
+	errHeaderTimeout = errors.New("timed out waiting for response headers")
+	// errIdleTimeout はレスポンスボディのデータが一定時間届かなかったことを表す
+	errIdleTimeout = errors.New("timed out waiting for response body")
+)
+
+var (
+	providerClientsMu sync.Mutex
+	providerClients   = map[string]*http.Client{}
+	breakers          = map[string]*CircuitBreaker{}
+)
+
+// ProviderHTTPClient はプロバイダーごとに共有される、リトライとサーキットブレーカー付きのHTTPクライアントを返す
+func ProviderHTTPClient(provider string) *http.Client {
+	providerClientsMu.Lock()
+	defer providerClientsMu.Unlock()
+
+	if client, ok := providerClients[provider]; ok {
+		return client
+	}
+
+	breaker := NewCircuitBreaker(config.GetCircuitBreakerThreshold(), config.GetCircuitBreakerCooldown())
+	breakers[provider] = breaker
+
+	client := &http.Client{
+		Transport: &resilientTransport{
+			provider:    provider,
+			base:        http.DefaultTransport,
+			breaker:     breaker,
+			timeout:     config.GetExternalCallTimeout(),
+			idleTimeout: config.GetExternalCallIdleTimeout(),
+			maxRetries:  config.GetExternalCallMaxRetries(),
+		},
+	}
+	providerClients[provider] = client
+	return client
+}
+
+// ProviderCircuitOpen はプロバイダーのサーキットブレーカーが開いているかを返す
+func ProviderCircuitOpen(provider string) bool {
+	providerClientsMu.Lock()
+	breaker, ok := breakers[provider]
+	providerClientsMu.Unlock()
+
+	return ok && breaker.IsOpen()
+}
+
+// newRestyClient はプロバイダー用の resty クライアントを作成する
+func newRestyClient(provider string) *resty.Client {
+	return resty.NewWithClient(ProviderHTTPClient(provider))
+}
+
+// newOpenAIClient は共有HTTPクライアントを使う go-openai クライアントを作成する
+func newOpenAIClient() *openai.Client {
+	cfg := openai.DefaultConfig(config.GetOpenAIKey())
+	cfg.HTTPClient = ProviderHTTPClient(ProviderOpenAI)
+	return openai.NewClientWithConfig(cfg)
+}
+
+// resilientTransport は試行ごとのタイムアウト、429/5xx時の指数バックオフ(Retry-After優先)、
+// サーキットブレーカーを適用する http.RoundTripper。
+// timeout はレスポンスヘッダーまで、idleTimeout はボディのデータが届く間隔に適用し、ボディ全体の期限は呼び出し元の ctx に任せる
+type resilientTransport struct {
+	provider    string
+	base        http.RoundTripper
+	breaker     *CircuitBreaker
+	timeout     time.Duration
+	idleTimeout time.Duration
+	maxRetries  int
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.Allow() {
+		return nil, &ProviderError{Provider: t.provider, Kind: ErrCircuitOpen}
+	}
+
+	getBody, err := bodyGetter(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(req, getBody)
+
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				// 呼び出し元のキャンセルはプロバイダーの障害として扱わない
+				return nil, err
+			}
+			t.breaker.Failure()
+			lastErr = err
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			if resp.StatusCode >= 500 {
+				t.breaker.Failure()
+			}
+			wait = parseRetryAfter(resp.Header.Get("Retry-After"))
+			lastErr = statusError(t.provider, resp, wait)
+		default:
+			t.breaker.Success()
+			return resp, nil
+		}
+
+		if attempt >= t.maxRetries || !t.breaker.Allow() {
+			return nil, lastErr
+		}
+
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt は1回分の呼び出しを行う。タイムアウトはレスポンスヘッダーが届くまでで、
+// ストリーミングのように長く続くボディは読み込みの間隔だけを制限する
+func (t *resilientTransport) attempt(req *http.Request, getBody func() (io.ReadCloser, error)) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	headerTimer := time.AfterFunc(t.timeout, func() { cancel(errHeaderTimeout) })
+
+	attemptReq := req.Clone(ctx)
+	if getBody != nil {
+		body, err := getBody()
+		if err != nil {
+			headerTimer.Stop()
+			cancel(nil)
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	resp, err := t.base.RoundTrip(attemptReq)
+	headerFired := !headerTimer.Stop()
+	if err != nil || headerFired {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		timedOut := errors.Is(context.Cause(ctx), errHeaderTimeout)
+		cancel(nil)
+		if err == nil {
+			err = errHeaderTimeout
+		}
+		if timedOut && req.Context().Err() == nil {
+			return nil, &ProviderError{Provider: t.provider, Kind: ErrTimeout, Err: err}
+		}
+		return nil, &ProviderError{Provider: t.provider, Kind: ErrUpstream, Err: err}
+	}
+
+	resp.Body = newIdleTimeoutBody(t.provider, resp.Body, ctx, cancel, t.idleTimeout)
+	return resp, nil
+}
+
+// statusError はリトライ対象のレスポンスを型付きエラーに変換し、ボディを破棄する
+func statusError(provider string, resp *http.Response, retryAfter time.Duration) error {
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	perr := &ProviderError{
+		Provider:   provider,
+		Kind:       ErrUpstream,
+		StatusCode: resp.StatusCode,
+		RetryAfter: retryAfter,
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		perr.Kind = ErrRateLimited
+	}
+	if snippet = bytes.TrimSpace(snippet); len(snippet) > 0 {
+		perr.Err = errors.New(string(snippet))
+	}
+	return perr
+}
+
+// bodyGetter はリトライ時にリクエストボディを再生成する関数を返す
+func bodyGetter(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to buffer request body: %v", err)
+	}
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, nil
+}
+
+// backoff はジッター付きの指数バックオフ時間を返す
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << attempt
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter は秒数またはHTTP日付形式の Retry-After を解釈する
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		d = time.Until(at)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return d
+}
+
+// idleTimeoutBody はデータが idleTimeout の間届かなければ試行をキャンセルするレスポンスボディ。閉じると試行の ctx も解放する
+type idleTimeoutBody struct {
+	io.ReadCloser
+	provider string
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	timeout  time.Duration
+	timer    *time.Timer
+}
+
+func newIdleTimeoutBody(provider string, body io.ReadCloser, ctx context.Context, cancel context.CancelCauseFunc, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, provider: provider, ctx: ctx, cancel: cancel, timeout: timeout}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() { cancel(errIdleTimeout) })
+	}
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && errors.Is(context.Cause(b.ctx), errIdleTimeout) {
+		return n, &ProviderError{Provider: b.provider, Kind: ErrTimeout, Err: errIdleTimeout}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestTransport(threshold int, cooldown time.Duration, maxRetries int) *resilientTransport {
+	return &resilientTransport{
+		provider:    "test",
+		base:        http.DefaultTransport,
+		breaker:     NewCircuitBreaker(threshold, cooldown),
+		timeout:     time.Second,
+		idleTimeout: time.Second,
+		maxRetries:  maxRetries,
+	}
+}
+
+// scriptedServer は呼ばれた順に statuses のステータスを返し、使い切ったら 200 を返す
+func scriptedServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); r.Method == http.MethodPost && string(body) != "payload" {
+			t.Errorf("attempt %d sent body %q", calls.Load()+1, body)
+		}
+		n := int(calls.Add(1))
+		if n <= len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[n-1])
+			io.WriteString(w, "try again")
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func doPost(t *testing.T, tr *resilientTransport, url string) (string, error) {
+	t.Helper()
+	client := &http.Client{Transport: tr}
+	resp, err := client.Post(url, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestResilientTransportRateLimited(t *testing.T) {
+	server, calls := scriptedServer(t, "7", http.StatusTooManyRequests)
+	tr := newTestTransport(1, time.Minute, 0)
+
+	_, err := doPost(t, tr, server.URL)
+	var perr *ProviderError
+	if !errors.As(err, &perr) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("error = %v, want ErrRateLimited", err)
+	}
+	if perr.StatusCode != http.StatusTooManyRequests || perr.RetryAfter != 7*time.Second {
+		t.Fatalf("status %d, Retry-After %v", perr.StatusCode, perr.RetryAfter)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("server was called %d times, want 1", calls.Load())
+	}
+	// 429 はブレーカーの失敗として数えない
+	if tr.breaker.IsOpen() {
+		t.Fatal("breaker opened on 429")
+	}
+}
+
+func TestResilientTransportWaitsForRetryAfter(t *testing.T) {
+	server, calls := scriptedServer(t, "1", http.StatusTooManyRequests)
+	tr := newTestTransport(1, time.Minute, 1)
+
+	start := time.Now()
+	body, err := doPost(t, tr, server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if body != "ok" || calls.Load() != 2 {
+		t.Fatalf("body %q after %d calls", body, calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("retried after %v, want at least the 1s Retry-After", elapsed)
+	}
+}
+
+func TestResilientTransportRetriesServerErrors(t *testing.T) {
+	server, calls := scriptedServer(t, "", http.StatusBadGateway)
+	tr := newTestTransport(5, time.Minute, 2)
+
+	body, err := doPost(t, tr, server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if body != "ok" || calls.Load() != 2 {
+		t.Fatalf("body %q after %d calls", body, calls.Load())
+	}
+	if tr.breaker.IsOpen() {
+		t.Fatal("breaker is open after a success")
+	}
+}
+
+func TestResilientTransportOpensBreaker(t *testing.T) {
+	server, calls := scriptedServer(t, "", http.StatusInternalServerError, http.StatusInternalServerError)
+	tr := newTestTransport(2, 50*time.Millisecond, 0)
+
+	for i := 0; i < 2; i++ {
+		if _, err := doPost(t, tr, server.URL); !errors.Is(err, ErrUpstream) {
+			t.Fatalf("call %d: error = %v, want ErrUpstream", i+1, err)
+		}
+	}
+	if _, err := doPost(t, tr, server.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("error = %v, want ErrCircuitOpen", err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("server was called %d times while the breaker was open", calls.Load())
+	}
+
+	// クールダウン後は half-open で1件通し、成功すれば閉じる
+	time.Sleep(60 * time.Millisecond)
+	if body, err := doPost(t, tr, server.URL); err != nil || body != "ok" {
+		t.Fatalf("half-open call = %q, %v", body, err)
+	}
+	if tr.breaker.IsOpen() {
+		t.Fatal("breaker is still open after the half-open call succeeded")
+	}
+}
+
+func TestResilientTransportRateLimitDoesNotOpenBreaker(t *testing.T) {
+	server, calls := scriptedServer(t, "", http.StatusTooManyRequests, http.StatusTooManyRequests)
+	tr := newTestTransport(1, time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		if _, err := doPost(t, tr, server.URL); !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("call %d: error = %v, want ErrRateLimited", i+1, err)
+		}
+	}
+	if body, err := doPost(t, tr, server.URL); err != nil || body != "ok" {
+		t.Fatalf("call after 429s = %q, %v", body, err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("server was called %d times, want 3", calls.Load())
+	}
+}
+
+func TestResilientTransportHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	tr := newTestTransport(5, time.Minute, 0)
+	tr.timeout = 50 * time.Millisecond
+
+	_, err := doPost(t, tr, server.URL)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error = %v, want ErrTimeout", err)
+	}
+	if errorKind(err) != "timeout" {
+		t.Fatalf("errorKind = %q, want timeout", errorKind(err))
+	}
+}
+
+func TestResilientTransportCallerCancelIsNotAFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	tr := newTestTransport(1, time.Minute, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err := (&http.Client{Transport: tr}).Do(req)
+	if err == nil || errors.Is(err, ErrTimeout) {
+		t.Fatalf("error = %v, want the caller's cancellation", err)
+	}
+	if tr.breaker.IsOpen() {
+		t.Fatal("breaker opened on the caller's cancellation")
+	}
+}
+
+// streamingServer は interval ごとに chunks 回書き込むストリーミングのレスポンスを返す
+func streamingServer(t *testing.T, chunks int, interval time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for i := 0; i < chunks; i++ {
+			io.WriteString(w, "data\n")
+			flusher.Flush()
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResilientTransportStreamOutlivesAttemptTimeout(t *testing.T) {
+	server := streamingServer(t, 5, 30*time.Millisecond)
+	tr := newTestTransport(5, time.Minute, 0)
+	tr.timeout = 50 * time.Millisecond
+	tr.idleTimeout = 200 * time.Millisecond
+
+	body, err := doPost(t, tr, server.URL)
+	if err != nil {
+		t.Fatalf("stream failed: %v", err)
+	}
+	if body != strings.Repeat("data\n", 5) {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestResilientTransportStreamIdleTimeout(t *testing.T) {
+	server := streamingServer(t, 2, time.Second)
+	tr := newTestTransport(5, time.Minute, 0)
+	tr.idleTimeout = 50 * time.Millisecond
+
+	body, err := doPost(t, tr, server.URL)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("error = %v, want ErrTimeout", err)
+	}
+	if body != "data\n" {
+		t.Fatalf("body before the timeout = %q", body)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "empty", value: "", min: 0, max: 0},
+		{name: "seconds", value: "3", min: 3 * time.Second, max: 3 * time.Second},
+		{name: "negative", value: "-5", min: 0, max: 0},
+		{name: "capped", value: "3600", min: retryMaxDelay, max: retryMaxDelay},
+		{name: "http date", value: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), min: 8 * time.Second, max: 10 * time.Second},
+		{name: "past date", value: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "garbage", value: "soon", min: 0, max: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Fatalf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
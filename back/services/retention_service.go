@@ -0,0 +1,355 @@
+package services
+
+import (
+	"back/config"
+	"back/metrics"
+	"back/models"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// 監査ログの操作
+const (
+	RetentionSummaryDeleted         = "summary_deleted"
+	RetentionMessageExpiryScheduled = "message_expiry_scheduled"
+)
+
+// maxRetentionTierLength は保持期間の区分名の最大長
+const maxRetentionTierLength = 32
+
+var (
+	ErrMemoryNotFound = errors.New("memory not found")
+	// ErrInvalidRetention は保持期間の設定が不正であることを表す
+	ErrInvalidRetention = errors.New("invalid retention settings")
+)
+
+// RetentionService はユーザーごとの保持期間を管理し、期間を過ぎた要約を削除して監査ログに残す。
+// 生のメッセージはバッチが要約したときに DynamoDB の TTL を設定して削除させる
+type RetentionService struct {
+	db *sql.DB
+}
+
+// NewRetentionService コンストラクタ
+func NewRetentionService(db *sql.DB) *RetentionService {
+	return &RetentionService{db: db}
+}
+
+// PolicyFor はユーザーに適用する保持期間を返す。ユーザーの設定がなければ区分の設定を使う
+func (rs *RetentionService) PolicyFor(ctx context.Context, userID string) (config.RetentionPolicy, error) {
+	settings, err := rs.Settings(ctx, userID)
+	if err != nil {
+		return config.RetentionPolicy{}, err
+	}
+	return config.RetentionPolicy{MessageDays: settings.EffectiveMessageDays, SummaryDays: settings.EffectiveSummaryDays}, nil
+}
+
+// Settings はユーザーの保持期間の設定を返す。設定がなければ既定の区分の値を返す
+func (rs *RetentionService) Settings(ctx context.Context, userID string) (_ models.RetentionSettings, err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.Settings", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	settings := models.RetentionSettings{UserID: userID, Tier: config.DefaultRetentionTier}
+	var messageDays, summaryDays sql.NullInt64
+	var updatedAt sql.NullTime
+	err = rs.db.QueryRowContext(ctx, `
+        SELECT tier, message_days, summary_days, updated_at FROM user_retention WHERE user_id = $1
+    `, userID).Scan(&settings.Tier, &messageDays, &summaryDays, &updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.RetentionSettings{}, fmt.Errorf("failed to get retention settings: %v", err)
+	}
+	settings.MessageDays = nullIntPtr(messageDays)
+	settings.SummaryDays = nullIntPtr(summaryDays)
+	settings.UpdatedAt = updatedAt.Time
+
+	applyRetentionPolicy(&settings)
+	return settings, nil
+}
+
+// UpdateSettings はユーザーの区分と保持期間を設定する。日数を nil にすると区分の設定に戻す
+func (rs *RetentionService) UpdateSettings(ctx context.Context, userID, tier string, messageDays, summaryDays *int) (_ models.RetentionSettings, err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.UpdateSettings", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	tier = strings.ToLower(strings.TrimSpace(tier))
+	if tier == "" {
+		tier = config.DefaultRetentionTier
+	}
+	if len(tier) > maxRetentionTierLength {
+		return models.RetentionSettings{}, fmt.Errorf("%w: tier must be at most %d characters", ErrInvalidRetention, maxRetentionTierLength)
+	}
+	for _, days := range []*int{messageDays, summaryDays} {
+		if days != nil && *days < 0 {
+			return models.RetentionSettings{}, fmt.Errorf("%w: days must not be negative", ErrInvalidRetention)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	settings := models.RetentionSettings{UserID: userID, Tier: tier, MessageDays: messageDays, SummaryDays: summaryDays}
+	err = rs.db.QueryRowContext(ctx, `
+        INSERT INTO user_retention (user_id, tier, message_days, summary_days, updated_at)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id) DO UPDATE
+        SET tier = EXCLUDED.tier,
+            message_days = EXCLUDED.message_days,
+            summary_days = EXCLUDED.summary_days,
+            updated_at = EXCLUDED.updated_at
+        RETURNING updated_at
+    `, userID, tier, messageDays, summaryDays, time.Now().UTC()).Scan(&settings.UpdatedAt)
+	if err != nil {
+		return models.RetentionSettings{}, fmt.Errorf("failed to save retention settings: %v", err)
+	}
+
+	applyRetentionPolicy(&settings)
+	return settings, nil
+}
+
+// Enforce は保持期間を過ぎた要約を削除し、削除したものを監査ログに残す。
+// 削除するのは日・週にまとめ済みの3時間ごと・日の要約だけで、週・話題の要約とピン留めした要約は残す
+func (rs *RetentionService) Enforce(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.Enforce")
+	defer func() { tracing.End(span, err) }()
+
+	users, err := rs.usersWithExpirableSummaries(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, userID := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		policy, err := rs.PolicyFor(ctx, userID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting retention policy", "user_id", userID, "error", err)
+			continue
+		}
+		if policy.SummaryDays <= 0 {
+			continue
+		}
+
+		deleted, err := rs.deleteExpiredSummaries(ctx, userID, now.AddDate(0, 0, -policy.SummaryDays), policy)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error deleting expired summaries", "user_id", userID, "error", err)
+			continue
+		}
+		if deleted > 0 {
+			metrics.RetentionDeleted.WithLabelValues("summary").Add(float64(deleted))
+			slog.InfoContext(ctx, "Deleted expired summaries", "user_id", userID, "count", deleted, "summary_days", policy.SummaryDays)
+		}
+	}
+	return nil
+}
+
+func (rs *RetentionService) usersWithExpirableSummaries(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        SELECT DISTINCT user_id FROM conversation_summaries
+        WHERE level IN ('window', 'daily') AND consolidated_at IS NOT NULL AND NOT pinned
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users with expirable summaries: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+// deleteExpiredSummaries は before より前に終わった要約を削除し、同じ文で監査ログに記録する
+func (rs *RetentionService) deleteExpiredSummaries(ctx context.Context, userID string, before time.Time, policy config.RetentionPolicy) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	var deleted int
+	err := rs.db.QueryRowContext(ctx, `
+        WITH expired AS (
+            SELECT id FROM conversation_summaries
+            WHERE user_id = $1 AND level IN ('window', 'daily')
+              AND consolidated_at IS NOT NULL AND NOT pinned AND end_time < $2
+            ORDER BY end_time
+            LIMIT $3
+        ), deleted AS (
+            DELETE FROM conversation_summaries s
+            USING expired e
+            WHERE s.id = e.id
+            RETURNING s.id, s.level, s.start_time, s.end_time, s.consolidated_at
+        ), logged AS (
+            INSERT INTO retention_audit_log (user_id, action, target_id, details)
+            SELECT $1, $4, d.id::text, json_build_object(
+                'level', d.level,
+                'start_time', d.start_time,
+                'end_time', d.end_time,
+                'consolidated_at', d.consolidated_at,
+                'summary_days', $5::int)
+            FROM deleted d
+            RETURNING 1
+        )
+        SELECT count(*) FROM logged
+    `, userID, before, config.GetRetentionBatchSize(), RetentionSummaryDeleted, policy.SummaryDays).Scan(&deleted)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired summaries: %v", err)
+	}
+	return deleted, nil
+}
+
+// RecordMessageExpiry はメッセージに削除期限を設定したことを監査ログに残す。expiresBy は最も遅い削除期限
+func (rs *RetentionService) RecordMessageExpiry(ctx context.Context, userID string, count int, start, end, expiresBy time.Time, messageDays int) {
+	details, _ := json.Marshal(map[string]any{
+		"count":        count,
+		"start_time":   start.UTC(),
+		"end_time":     end.UTC(),
+		"expires_by":   expiresBy.UTC(),
+		"message_days": messageDays,
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	_, err := rs.db.ExecContext(ctx, `
+        INSERT INTO retention_audit_log (user_id, action, details) VALUES ($1, $2, $3)
+    `, userID, RetentionMessageExpiryScheduled, details)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record message expiry", "user_id", userID, "error", err)
+	}
+}
+
+// AuditLog は監査ログを新しい順に返す。userID が空なら全ユーザー分
+func (rs *RetentionService) AuditLog(ctx context.Context, userID string, limit int) (_ []models.RetentionAuditEntry, err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.AuditLog")
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        SELECT id, user_id, action, COALESCE(target_id, ''), details, created_at
+        FROM retention_audit_log
+        WHERE $1 = '' OR user_id = $1
+        ORDER BY created_at DESC
+        LIMIT $2
+    `, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query retention audit log: %v", err)
+	}
+	defer rows.Close()
+
+	entries := make([]models.RetentionAuditEntry, 0)
+	for rows.Next() {
+		var e models.RetentionAuditEntry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.TargetID, &details, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		e.Details = json.RawMessage(details)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration failed: %v", err)
+	}
+	return entries, nil
+}
+
+// ListMemories はユーザーの要約を新しい順に返す。level を指定するとその粒度だけにする
+func (rs *RetentionService) ListMemories(ctx context.Context, userID, level string, limit int) (_ []models.ConversationSummary, err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.ListMemories", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := rs.db.QueryContext(ctx, `
+        SELECT id, user_id, summary, start_time, end_time, created_at, level, COALESCE(topic, ''), pinned
+        FROM conversation_summaries
+        WHERE user_id = $1 AND ($2 = '' OR level = $2)
+        ORDER BY end_time DESC
+        LIMIT $3
+    `, userID, level, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list memories: %v", err)
+	}
+	defer rows.Close()
+
+	memories := make([]models.ConversationSummary, 0)
+	for rows.Next() {
+		var m models.ConversationSummary
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Summary, &m.StartTime, &m.EndTime, &m.CreatedAt, &m.Level, &m.Topic, &m.Pinned); err != nil {
+			return nil, fmt.Errorf("row scan failed: %v", err)
+		}
+		memories = append(memories, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration failed: %v", err)
+	}
+	return memories, nil
+}
+
+// SetMemoryPinned は要約のピン留めを切り替える
+func (rs *RetentionService) SetMemoryPinned(ctx context.Context, userID, id string, pinned bool) (err error) {
+	ctx, span := tracing.Start(ctx, "RetentionService.SetMemoryPinned", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrMemoryNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	result, err := rs.db.ExecContext(ctx, `
+        UPDATE conversation_summaries SET pinned = $3 WHERE id = $1 AND user_id = $2
+    `, id, userID, pinned)
+	if err != nil {
+		return fmt.Errorf("failed to update memory: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMemoryNotFound
+	}
+	return nil
+}
+
+// applyRetentionPolicy は区分の設定とユーザーの上書きから実際の日数を求める
+func applyRetentionPolicy(settings *models.RetentionSettings) {
+	policy := config.GetRetentionPolicy(settings.Tier)
+	settings.EffectiveMessageDays = policy.MessageDays
+	settings.EffectiveSummaryDays = policy.SummaryDays
+	if settings.MessageDays != nil {
+		settings.EffectiveMessageDays = *settings.MessageDays
+	}
+	if settings.SummaryDays != nil {
+		settings.EffectiveSummaryDays = *settings.SummaryDays
+	}
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
@@ -0,0 +1,264 @@
+package services
+
+import (
+	"back/config"
+	"back/i18n"
+	"back/models"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// LocaleAuto はメッセージから判定した言語を使う設定
+const LocaleAuto = "auto"
+
+// アシスタントの設定の上限
+const (
+	// maxPersonaLength はアシスタントの人格・指示の最大文字数
+	maxPersonaLength = 2000
+	// maxTemperature は OpenAI が受け付ける temperature の上限
+	maxTemperature = 2.0
+)
+
+// ErrInvalidSettings はユーザーの設定が不正であることを表す
+var ErrInvalidSettings = errors.New("invalid user settings")
+
+// SettingsService はユーザーごとの設定を管理する
+type SettingsService struct {
+	db *sql.DB
+}
+
+// NewSettingsService コンストラクタ
+func NewSettingsService(db *sql.DB) *SettingsService {
+	return &SettingsService{db: db}
+}
+
+// Settings はユーザーの設定を返す。設定がなければ既定の値を返す
+func (ss *SettingsService) Settings(ctx context.Context, userID string) (_ models.UserSettings, err error) {
+	ctx, span := tracing.Start(ctx, "SettingsService.Settings", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	settings := models.UserSettings{UserID: userID, MemoryEnabled: true, SummarizationEnabled: true}
+	var locale, detected, model sql.NullString
+	var temperature sql.NullFloat64
+	var historyWindow sql.NullInt64
+	var updatedAt sql.NullTime
+	err = ss.db.QueryRowContext(ctx, `
+        SELECT locale, detected_locale, persona, model, temperature, history_window,
+               memory_enabled, summarization_enabled, updated_at
+        FROM user_settings WHERE user_id = $1
+    `, userID).Scan(&locale, &detected, &settings.Persona, &model, &temperature, &historyWindow,
+		&settings.MemoryEnabled, &settings.SummarizationEnabled, &updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.UserSettings{}, fmt.Errorf("failed to get user settings: %v", err)
+	}
+	settings.Locale = locale.String
+	settings.DetectedLocale = detected.String
+	if model.Valid {
+		settings.Model = &model.String
+	}
+	if temperature.Valid {
+		settings.Temperature = &temperature.Float64
+	}
+	settings.HistoryWindow = nullIntPtr(historyWindow)
+	settings.UpdatedAt = updatedAt.Time
+
+	applySettingsDefaults(&settings)
+	return settings, nil
+}
+
+// SettingsOrDefault はユーザーの設定を返す。取得に失敗したら既定の設定を使う
+func (ss *SettingsService) SettingsOrDefault(ctx context.Context, userID string) models.UserSettings {
+	settings, err := ss.Settings(ctx, userID)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get user settings, using defaults", "user_id", userID, "error", err)
+		settings = models.UserSettings{UserID: userID, MemoryEnabled: true, SummarizationEnabled: true}
+		applySettingsDefaults(&settings)
+	}
+	return settings
+}
+
+// UpdateSettings はユーザーの設定を変える。省略した項目は今の設定を残す。
+// locale を auto にするとメッセージから判定した言語に、model などを null にすると既定の値に戻す
+func (ss *SettingsService) UpdateSettings(ctx context.Context, userID string, update models.UserSettingsUpdate) (_ models.UserSettings, err error) {
+	ctx, span := tracing.Start(ctx, "SettingsService.UpdateSettings", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	settings, err := ss.Settings(ctx, userID)
+	if err != nil {
+		return models.UserSettings{}, err
+	}
+	if err := applySettingsUpdate(&settings, update); err != nil {
+		return models.UserSettings{}, err
+	}
+
+	var locale sql.NullString
+	if settings.Locale != LocaleAuto {
+		locale = sql.NullString{String: settings.Locale, Valid: true}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	_, err = ss.db.ExecContext(ctx, `
+        INSERT INTO user_settings (user_id, locale, persona, model, temperature, history_window,
+                                   memory_enabled, summarization_enabled, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        ON CONFLICT (user_id) DO UPDATE
+        SET locale = EXCLUDED.locale,
+            persona = EXCLUDED.persona,
+            model = EXCLUDED.model,
+            temperature = EXCLUDED.temperature,
+            history_window = EXCLUDED.history_window,
+            memory_enabled = EXCLUDED.memory_enabled,
+            summarization_enabled = EXCLUDED.summarization_enabled,
+            updated_at = EXCLUDED.updated_at
+    `, userID, locale, settings.Persona, settings.Model, settings.Temperature, settings.HistoryWindow,
+		settings.MemoryEnabled, settings.SummarizationEnabled, time.Now().UTC())
+	if err != nil {
+		return models.UserSettings{}, fmt.Errorf("failed to save user settings: %v", err)
+	}
+	return ss.Settings(ctx, userID)
+}
+
+// Locale はユーザーの応答や要約に使う言語を返す。取得に失敗したら既定の言語を使う
+func (ss *SettingsService) Locale(ctx context.Context, userID string) string {
+	return ss.SettingsOrDefault(ctx, userID).EffectiveLocale
+}
+
+// ResolveLocale はメッセージに返答する言語を決める。ユーザーが選んだ言語 > メッセージから判定した言語 >
+// 以前に判定した言語 > 既定の言語 の順に使い、判定した言語は次のメッセージのために保存する
+func (ss *SettingsService) ResolveLocale(ctx context.Context, settings models.UserSettings, message string) string {
+	detected := i18n.Detect(message)
+	if detected != "" && detected != settings.DetectedLocale {
+		if err := ss.recordDetectedLocale(ctx, settings.UserID, detected); err != nil {
+			slog.WarnContext(ctx, "Failed to record detected locale", "user_id", settings.UserID, "locale", detected, "error", err)
+		}
+	}
+
+	if settings.Locale != LocaleAuto || detected == "" {
+		return settings.EffectiveLocale
+	}
+	return detected
+}
+
+func (ss *SettingsService) recordDetectedLocale(ctx context.Context, userID, locale string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	_, err := ss.db.ExecContext(ctx, `
+        INSERT INTO user_settings (user_id, detected_locale, updated_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE
+        SET detected_locale = EXCLUDED.detected_locale, updated_at = EXCLUDED.updated_at
+    `, userID, locale, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to save detected locale: %v", err)
+	}
+	return nil
+}
+
+// applySettingsUpdate は変更を検証して設定に反映する
+func applySettingsUpdate(settings *models.UserSettings, update models.UserSettingsUpdate) error {
+	if update.Locale != nil {
+		value := strings.TrimSpace(*update.Locale)
+		switch {
+		case value == "" || strings.EqualFold(value, LocaleAuto):
+			settings.Locale = LocaleAuto
+		case i18n.Normalize(value) != "":
+			settings.Locale = i18n.Normalize(value)
+		default:
+			return fmt.Errorf("%w: locale must be one of %s or %s", ErrInvalidSettings, strings.Join(i18n.Supported, ", "), LocaleAuto)
+		}
+	}
+
+	if update.Persona != nil {
+		persona := strings.TrimSpace(*update.Persona)
+		if len([]rune(persona)) > maxPersonaLength {
+			return fmt.Errorf("%w: persona must be at most %d characters", ErrInvalidSettings, maxPersonaLength)
+		}
+		settings.Persona = persona
+	}
+
+	if update.Model.Set {
+		if update.Model.Value != nil && !containsString(config.GetChatModels(), *update.Model.Value) {
+			return fmt.Errorf("%w: model must be one of %s", ErrInvalidSettings, strings.Join(config.GetChatModels(), ", "))
+		}
+		settings.Model = update.Model.Value
+	}
+
+	if update.Temperature.Set {
+		if t := update.Temperature.Value; t != nil && (*t < 0 || *t > maxTemperature) {
+			return fmt.Errorf("%w: temperature must be between 0 and %g", ErrInvalidSettings, maxTemperature)
+		}
+		settings.Temperature = update.Temperature.Value
+	}
+
+	if update.HistoryWindow.Set {
+		max := config.GetChatMaxHistoryWindow()
+		if n := update.HistoryWindow.Value; n != nil && (*n < 1 || *n > max) {
+			return fmt.Errorf("%w: history_window must be between 1 and %d", ErrInvalidSettings, max)
+		}
+		settings.HistoryWindow = update.HistoryWindow.Value
+	}
+
+	if update.MemoryEnabled != nil {
+		settings.MemoryEnabled = *update.MemoryEnabled
+	}
+	if update.SummarizationEnabled != nil {
+		settings.SummarizationEnabled = *update.SummarizationEnabled
+	}
+	return nil
+}
+
+// applySettingsDefaults は設定から実際に使う値を決める
+func applySettingsDefaults(settings *models.UserSettings) {
+	switch {
+	case settings.Locale != "" && settings.Locale != LocaleAuto:
+		settings.EffectiveLocale = settings.Locale
+	case settings.DetectedLocale != "":
+		settings.EffectiveLocale = settings.DetectedLocale
+	default:
+		settings.EffectiveLocale = defaultLocale()
+	}
+	if settings.Locale == "" {
+		settings.Locale = LocaleAuto
+	}
+
+	// 許可リストから外されたモデルは既定のモデルに戻す
+	settings.EffectiveModel = defaultChatModel()
+	if settings.Model != nil && containsString(config.GetChatModels(), *settings.Model) {
+		settings.EffectiveModel = *settings.Model
+	}
+
+	settings.EffectiveHistoryWindow = config.GetChatHistoryWindow()
+	if settings.HistoryWindow != nil {
+		settings.EffectiveHistoryWindow = min(*settings.HistoryWindow, config.GetChatMaxHistoryWindow())
+	}
+}
+
+// defaultLocale は設定も判定もできないときの言語。DEFAULT_LOCALE が対応していなければ日本語
+func defaultLocale() string {
+	if locale := i18n.Normalize(config.GetDefaultLocale()); locale != "" {
+		return locale
+	}
+	return i18n.Japanese
+}
+
+// defaultChatModel はユーザーがモデルを選んでいないときのチャットのモデル
+func defaultChatModel() string {
+	if allowed := config.GetChatModels(); len(allowed) > 0 {
+		return allowed[0]
+	}
+	return chatModel
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// ErrInvalidToolArguments はLLMが生成したツール引数がスキーマに合わないことを表す
+var ErrInvalidToolArguments = errors.New("invalid tool arguments")
+
+// JSONSchema はツール引数のスキーマ。OpenAIに渡す定義と引数の検証の両方に使う。
+// 対応しているのは object/string/integer/number/boolean/array と基本的な制約のみ
+type JSONSchema struct {
+	Type                 string                 `json:"type"`
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+// Validate は値がスキーマを満たすかを確認する。path はエラーメッセージ用の位置
+func (s *JSONSchema) Validate(path string, value interface{}) error {
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, v := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := prop.Validate(path+"."+name, v); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", path, *s.MaxLength)
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			return fmt.Errorf("%s must be one of %v", path, s.Enum)
+		}
+	case "integer", "number":
+		num, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+		if s.Type == "integer" && num != float64(int64(num)) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			return fmt.Errorf("%s must be >= %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && num > *s.Maximum {
+			return fmt.Errorf("%s must be <= %v", path, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, v := range arr {
+				if err := s.Items.Validate(fmt.Sprintf("%s[%d]", path, i), v); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("%s has unsupported schema type %q", path, s.Type)
+	}
+	return nil
+}
+
+// Tool はチャットアシスタントが呼び出せる機能
+type Tool interface {
+	// Name はLLMに見せる関数名 (^[a-zA-Z0-9_-]+$)
+	Name() string
+	Description() string
+	// Parameters は引数のスキーマ。type は object にする
+	Parameters() *JSONSchema
+	// Call はスキーマ検証済みの引数で実行し、LLMに返す結果を返す
+	Call(ctx context.Context, userID string, args json.RawMessage) (string, error)
+}
+
+// ToolRegistry は利用できるツールの一覧
+type ToolRegistry struct {
+	tools map[string]Tool
+}
+
+// NewToolRegistry コンストラクタ
+func NewToolRegistry(tools ...Tool) *ToolRegistry {
+	r := &ToolRegistry{tools: make(map[string]Tool)}
+	for _, t := range tools {
+		r.Register(t)
+	}
+	return r
+}
+
+// Register はツールを追加する。同名のツールは置き換える
+func (r *ToolRegistry) Register(tool Tool) {
+	r.tools[tool.Name()] = tool
+}
+
+// Without は names のツールを除いた一覧を返す。ユーザーの設定で使わないツールを外すのに使う
+func (r *ToolRegistry) Without(names ...string) *ToolRegistry {
+	if r == nil {
+		return nil
+	}
+	filtered := &ToolRegistry{tools: make(map[string]Tool, len(r.tools))}
+	for name, t := range r.tools {
+		if !containsString(names, name) {
+			filtered.tools[name] = t
+		}
+	}
+	return filtered
+}
+
+// Len は登録されたツールの数を返す
+func (r *ToolRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.tools)
+}
+
+// Definitions はChat Completions APIの tools パラメーターを名前順で返す
+func (r *ToolRegistry) Definitions() []map[string]interface{} {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		t := r.tools[name]
+		defs = append(defs, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        t.Name(),
+				"description": t.Description(),
+				"parameters":  t.Parameters(),
+			},
+		})
+	}
+	return defs
+}
+
+// Call は引数をスキーマで検証してからツールを実行する
+func (r *ToolRegistry) Call(ctx context.Context, userID, name string, arguments string) (string, error) {
+	tool, ok := r.tools[name]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown tool %q", ErrInvalidToolArguments, name)
+	}
+
+	if arguments == "" {
+		arguments = "{}"
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(arguments), &decoded); err != nil {
+		return "", fmt.Errorf("%w: arguments are not valid JSON: %v", ErrInvalidToolArguments, err)
+	}
+	if err := tool.Parameters().Validate("arguments", decoded); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToolArguments, err)
+	}
+
+	return tool.Call(ctx, userID, json.RawMessage(arguments))
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// スキーマ定義用のヘルパー
+func intPtr(n int) *int    { return &n }
+func boolPtr(b bool) *bool { return &b }
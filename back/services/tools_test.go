@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema := &JSONSchema{
+		Type: "object",
+		Properties: map[string]*JSONSchema{
+			"query": {Type: "string", MinLength: intPtr(1), MaxLength: intPtr(5)},
+			"kind":  {Type: "string", Enum: []string{"daily", "weekly"}},
+			"limit": {Type: "integer", Minimum: floatPtr(1), Maximum: floatPtr(10)},
+			"score": {Type: "number", Minimum: floatPtr(0), Maximum: floatPtr(1)},
+			"exact": {Type: "boolean"},
+			"tags": {
+				Type:     "array",
+				MaxItems: intPtr(2),
+				Items: &JSONSchema{
+					Type:  "array",
+					Items: &JSONSchema{Type: "string", MaxLength: intPtr(3)},
+				},
+			},
+			"filter": {
+				Type:                 "object",
+				Properties:           map[string]*JSONSchema{"from": {Type: "string"}},
+				Required:             []string{"from"},
+				AdditionalProperties: boolPtr(false),
+			},
+		},
+		Required:             []string{"query"},
+		AdditionalProperties: boolPtr(false),
+	}
+
+	tests := []struct {
+		name    string
+		args    string
+		wantErr string
+	}{
+		{name: "minimal", args: `{"query":"a"}`},
+		{name: "all fields", args: `{"query":"abc","kind":"daily","limit":3,"score":0.5,"exact":true,"tags":[["a","bc"],[]],"filter":{"from":"x"}}`},
+		{name: "multibyte length counts runes", args: `{"query":"あいうえお"}`},
+		{name: "integer written as float", args: `{"query":"a","limit":2.0}`},
+
+		{name: "not an object", args: `[]`, wantErr: "arguments must be an object"},
+		{name: "missing required", args: `{}`, wantErr: "arguments.query is required"},
+		{name: "missing nested required", args: `{"query":"a","filter":{}}`, wantErr: "arguments.filter.from is required"},
+		{name: "additional property", args: `{"query":"a","other":1}`, wantErr: "arguments.other is not allowed"},
+		{name: "nested additional property", args: `{"query":"a","filter":{"from":"x","to":"y"}}`, wantErr: "arguments.filter.to is not allowed"},
+		{name: "wrong string type", args: `{"query":1}`, wantErr: "arguments.query must be a string"},
+		{name: "too short", args: `{"query":""}`, wantErr: "arguments.query must be at least 1 characters"},
+		{name: "too long", args: `{"query":"abcdef"}`, wantErr: "arguments.query must be at most 5 characters"},
+		{name: "not in enum", args: `{"query":"a","kind":"monthly"}`, wantErr: "arguments.kind must be one of [daily weekly]"},
+		{name: "float for integer", args: `{"query":"a","limit":2.5}`, wantErr: "arguments.limit must be an integer"},
+		{name: "string for integer", args: `{"query":"a","limit":"2"}`, wantErr: "arguments.limit must be a number"},
+		{name: "below minimum", args: `{"query":"a","limit":0}`, wantErr: "arguments.limit must be >= 1"},
+		{name: "above maximum", args: `{"query":"a","score":1.5}`, wantErr: "arguments.score must be <= 1"},
+		{name: "wrong boolean type", args: `{"query":"a","exact":"true"}`, wantErr: "arguments.exact must be a boolean"},
+		{name: "not an array", args: `{"query":"a","tags":"x"}`, wantErr: "arguments.tags must be an array"},
+		{name: "too many items", args: `{"query":"a","tags":[[],[],[]]}`, wantErr: "arguments.tags must have at most 2 items"},
+		{name: "nested array item type", args: `{"query":"a","tags":[["a"],"b"]}`, wantErr: "arguments.tags[1] must be an array"},
+		{name: "nested array item constraint", args: `{"query":"a","tags":[[],["a","abcd"]]}`, wantErr: "arguments.tags[1][1] must be at most 3 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.args), &value); err != nil {
+				t.Fatalf("invalid test input: %v", err)
+			}
+			err := schema.Validate("arguments", value)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("Validate error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaValidateUnsupportedType(t *testing.T) {
+	err := (&JSONSchema{Type: "null"}).Validate("arguments", nil)
+	if err == nil || !strings.Contains(err.Error(), `unsupported schema type "null"`) {
+		t.Fatalf("Validate error = %v, want unsupported schema type", err)
+	}
+}
+
+// echoTool は受け取った引数をそのまま返す
+type echoTool struct {
+	calls int
+}
+
+func (t *echoTool) Name() string        { return "echo" }
+func (t *echoTool) Description() string { return "echo" }
+func (t *echoTool) Parameters() *JSONSchema {
+	return &JSONSchema{
+		Type:                 "object",
+		Properties:           map[string]*JSONSchema{"text": {Type: "string"}},
+		AdditionalProperties: boolPtr(false),
+	}
+}
+func (t *echoTool) Call(_ context.Context, _ string, args json.RawMessage) (string, error) {
+	t.calls++
+	return string(args), nil
+}
+
+func TestToolRegistryCall(t *testing.T) {
+	tests := []struct {
+		name      string
+		tool      string
+		arguments string
+		want      string
+		wantErr   string
+	}{
+		{name: "valid arguments", tool: "echo", arguments: `{"text":"hi"}`, want: `{"text":"hi"}`},
+		{name: "empty arguments", tool: "echo", arguments: "", want: "{}"},
+		{name: "unknown tool", tool: "missing", arguments: `{}`, wantErr: `unknown tool "missing"`},
+		{name: "invalid JSON", tool: "echo", arguments: `{"text":`, wantErr: "arguments are not valid JSON"},
+		{name: "schema violation", tool: "echo", arguments: `{"text":1}`, wantErr: "arguments.text must be a string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool := &echoTool{}
+			registry := NewToolRegistry(tool)
+
+			got, err := registry.Call(context.Background(), "user", tt.tool, tt.arguments)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Call returned error: %v", err)
+				}
+				if got != tt.want {
+					t.Fatalf("Call = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidToolArguments) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Call error = %v, want ErrInvalidToolArguments containing %q", err, tt.wantErr)
+			}
+			if tool.calls != 0 {
+				t.Fatal("tool was called with invalid arguments")
+			}
+		})
+	}
+}
+
+func TestToolRegistryWithout(t *testing.T) {
+	registry := NewToolRegistry(&echoTool{})
+	if n := registry.Without("echo").Len(); n != 0 {
+		t.Fatalf("Without(echo).Len() = %d, want 0", n)
+	}
+	if n := registry.Len(); n != 1 {
+		t.Fatalf("Without modified the original registry: Len() = %d", n)
+	}
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"back/config"
+	"back/tracing"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// トークン使用量を集計する機能の区分
+const (
+	FeatureChat     = "chat"
+	FeatureSummary  = "summary"
+	FeatureResearch = "research"
+	// FeatureAttachment は添付ファイルの画像の説明とチャンクの埋め込み
+	FeatureAttachment = "attachment"
+	// FeatureDocument はナレッジベースの資料の埋め込み
+	FeatureDocument = "document"
+)
+
+// クォータの期間
+const (
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodMonthly = "monthly"
+)
+
+// ErrQuotaExceeded はユーザーのトークン上限に達したことを表す。controllers は errors.Is で判定して429を返す
+var ErrQuotaExceeded = errors.New("token quota exceeded")
+
+// QuotaError はどの期間の上限を超えたかを表す
+type QuotaError struct {
+	Period  string
+	Limit   int
+	Used    int
+	ResetAt time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s (used %d of %d, resets at %s)", e.Period, ErrQuotaExceeded, e.Used, e.Limit, e.ResetAt.Format(time.RFC3339))
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// UsageRecord はLLM・埋め込み呼び出し1回分の使用量
+type UsageRecord struct {
+	UserID           string
+	Feature          string
+	Provider         string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// UsageTotal は集計結果1行分
+type UsageTotal struct {
+	UserID           string  `json:"user_id,omitempty"`
+	Feature          string  `json:"feature,omitempty"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// QuotaStatus は1期間分の上限と使用量
+type QuotaStatus struct {
+	Period  string    `json:"period"`
+	Limit   int       `json:"limit"`
+	Used    int       `json:"used"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// UsageService はトークン使用量の記録・集計とクォータ判定を行う
+type UsageService struct {
+	db *sql.DB
+}
+
+// NewUsageService コンストラクタ
+func NewUsageService(db *sql.DB) *UsageService {
+	return &UsageService{db: db}
+}
+
+// EstimateCost は料金表からコスト(USD)を見積もる。料金表にないモデルは0
+func EstimateCost(model string, promptTokens, completionTokens int) float64 {
+	price, ok := config.GetModelPrice(model)
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.PromptPerMillion + float64(completionTokens)*price.CompletionPerMillion) / 1e6
+}
+
+// Record は使用量を保存する。記録の失敗でユーザーへの応答を失敗させないよう、エラーはログに残すだけにする
+func (us *UsageService) Record(ctx context.Context, rec UsageRecord) {
+	if us == nil || rec.PromptTokens+rec.CompletionTokens == 0 {
+		return
+	}
+
+	// 呼び出し元がキャンセルされても、消費済みのトークンは記録する
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.GetStorageTimeout())
+	defer cancel()
+
+	_, err := us.db.ExecContext(ctx, `
+        INSERT INTO token_usage
+        (user_id, feature, provider, model, prompt_tokens, completion_tokens, cost_usd, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `, rec.UserID, rec.Feature, rec.Provider, rec.Model, rec.PromptTokens, rec.CompletionTokens,
+		EstimateCost(rec.Model, rec.PromptTokens, rec.CompletionTokens), time.Now().UTC())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record token usage", "user_id", rec.UserID, "feature", rec.Feature, "model", rec.Model, "error", err)
+	}
+}
+
+// Quotas はユーザーの日次・月次の上限と現在の使用量を返す
+func (us *UsageService) Quotas(ctx context.Context, userID string) (_ []QuotaStatus, err error) {
+	ctx, span := tracing.Start(ctx, "UsageService.Quotas", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	var daily, monthly int
+	err = us.db.QueryRowContext(ctx, `
+        SELECT
+            COALESCE(SUM(prompt_tokens + completion_tokens) FILTER (WHERE created_at >= $2), 0),
+            COALESCE(SUM(prompt_tokens + completion_tokens), 0)
+        FROM token_usage
+        WHERE user_id = $1 AND created_at >= $3
+    `, userID, dayStart, monthStart).Scan(&daily, &monthly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token usage: %v", err)
+	}
+
+	return []QuotaStatus{
+		{Period: QuotaPeriodDaily, Limit: config.GetDailyTokenQuota(), Used: daily, ResetAt: dayStart.AddDate(0, 0, 1)},
+		{Period: QuotaPeriodMonthly, Limit: config.GetMonthlyTokenQuota(), Used: monthly, ResetAt: monthStart.AddDate(0, 1, 0)},
+	}, nil
+}
+
+// CheckQuota は上限に達していれば *QuotaError を返す
+func (us *UsageService) CheckQuota(ctx context.Context, userID string) error {
+	quotas, err := us.Quotas(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range quotas {
+		if q.Limit > 0 && q.Used >= q.Limit {
+			return &QuotaError{Period: q.Period, Limit: q.Limit, Used: q.Used, ResetAt: q.ResetAt}
+		}
+	}
+	return nil
+}
+
+// UserUsage はユーザーの since 以降の使用量を機能別に集計する
+func (us *UsageService) UserUsage(ctx context.Context, userID string, since time.Time) (_ []UsageTotal, err error) {
+	ctx, span := tracing.Start(ctx, "UsageService.UserUsage", attribute.String("user.id", userID))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := us.db.QueryContext(ctx, `
+        SELECT feature, COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(cost_usd), 0)::float8
+        FROM token_usage
+        WHERE user_id = $1 AND created_at >= $2
+        GROUP BY feature
+        ORDER BY feature
+    `, userID, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token usage: %v", err)
+	}
+	defer rows.Close()
+
+	totals := make([]UsageTotal, 0)
+	for rows.Next() {
+		var t UsageTotal
+		if err := rows.Scan(&t.Feature, &t.Requests, &t.PromptTokens, &t.CompletionTokens, &t.CostUSD); err != nil {
+			return nil, fmt.Errorf("failed to scan token usage: %v", err)
+		}
+		t.TotalTokens = t.PromptTokens + t.CompletionTokens
+		totals = append(totals, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token usage: %v", err)
+	}
+
+	return totals, nil
+}
+
+// Report は [from, to) の使用量をユーザー・機能別に集計する管理者向けレポート
+func (us *UsageService) Report(ctx context.Context, from, to time.Time) (_ []UsageTotal, err error) {
+	ctx, span := tracing.Start(ctx, "UsageService.Report")
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, config.GetStorageTimeout())
+	defer cancel()
+
+	rows, err := us.db.QueryContext(ctx, `
+        SELECT user_id, feature, COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(cost_usd), 0)::float8
+        FROM token_usage
+        WHERE created_at >= $1 AND created_at < $2
+        GROUP BY user_id, feature
+        ORDER BY SUM(cost_usd) DESC, user_id, feature
+    `, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage report: %v", err)
+	}
+	defer rows.Close()
+
+	totals := make([]UsageTotal, 0)
+	for rows.Next() {
+		var t UsageTotal
+		if err := rows.Scan(&t.UserID, &t.Feature, &t.Requests, &t.PromptTokens, &t.CompletionTokens, &t.CostUSD); err != nil {
+			return nil, fmt.Errorf("failed to scan usage report: %v", err)
+		}
+		t.TotalTokens = t.PromptTokens + t.CompletionTokens
+		totals = append(totals, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage report: %v", err)
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,20 @@
+-- LLM・埋め込み呼び出しごとのトークン使用量（ユーザー・機能別の集計とクォータ判定用）
+CREATE TABLE token_usage (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id VARCHAR(255) NOT NULL,
+    feature VARCHAR(32) NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    model VARCHAR(64) NOT NULL,
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    cost_usd NUMERIC(12, 6) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- クォータ判定・ユーザー別集計用のインデックス
+CREATE INDEX idx_token_usage_user_created
+ON token_usage (user_id, created_at);
+
+-- 管理者向けレポート（期間集計）用のインデックス
+CREATE INDEX idx_token_usage_created
+ON token_usage (created_at);
@@ -0,0 +1,21 @@
+-- リマインダー（会話やAPIから登録し、期限が来たらバッチが会話に投稿する）
+CREATE TABLE reminders (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id VARCHAR(255) NOT NULL,
+    message TEXT NOT NULL,
+    due_at TIMESTAMP NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    source VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP,
+    CONSTRAINT reminders_status_check CHECK (status IN ('pending', 'sent', 'canceled'))
+);
+
+-- 期限の来たリマインダーの取得用のインデックス
+CREATE INDEX idx_reminders_pending_due
+ON reminders (due_at) WHERE status = 'pending';
+
+-- ユーザーごとの一覧用のインデックス
+CREATE INDEX idx_reminders_user_due
+ON reminders (user_id, due_at);
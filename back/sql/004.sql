@@ -0,0 +1,40 @@
+-- 通知の送信先（Webhook URL またはプッシュ通知のデバイストークン）
+CREATE TABLE notification_endpoints (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    target TEXT NOT NULL,
+    platform VARCHAR(16),
+    secret VARCHAR(128) NOT NULL,
+    events TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT notification_endpoints_kind_check CHECK (kind IN ('webhook', 'push')),
+    CONSTRAINT notification_endpoints_target_unique UNIQUE (user_id, kind, target)
+);
+
+CREATE INDEX idx_notification_endpoints_user
+ON notification_endpoints (user_id);
+
+-- 通知の配信キュー。失敗したものは next_attempt_at まで待って再送し、上限を超えたら dead（デッドレター）にする
+CREATE TABLE notification_deliveries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    endpoint_id UUID NOT NULL REFERENCES notification_endpoints (id) ON DELETE CASCADE,
+    event_id UUID NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP,
+    CONSTRAINT notification_deliveries_status_check CHECK (status IN ('pending', 'delivered', 'dead'))
+);
+
+-- 送信待ちの取得用のインデックス
+CREATE INDEX idx_notification_deliveries_pending
+ON notification_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- デッドレターの一覧用のインデックス
+CREATE INDEX idx_notification_deliveries_dead
+ON notification_deliveries (created_at) WHERE status = 'dead';
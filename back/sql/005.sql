@@ -0,0 +1,35 @@
+-- チャットの添付ファイル（本体はblobストアに保存する）
+CREATE TABLE attachments (
+    id UUID PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(128) NOT NULL,
+    size BIGINT NOT NULL,
+    blob_key TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'processing',
+    error TEXT,
+    text_chars INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT attachments_status_check CHECK (status IN ('processing', 'ready', 'failed'))
+);
+
+CREATE INDEX idx_attachments_user
+ON attachments (user_id, created_at);
+
+-- 添付ファイルから抽出したテキストのチャンク（ベクトル検索用）
+CREATE TABLE attachment_chunks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    attachment_id UUID NOT NULL REFERENCES attachments (id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    chunk_index INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    vector vector(1536) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_attachment_chunk UNIQUE (attachment_id, chunk_index)
+);
+
+CREATE INDEX ON attachment_chunks USING ivfflat (vector vector_cosine_ops)
+WITH (lists = 100);
+
+CREATE INDEX idx_attachment_chunks_user
+ON attachment_chunks (user_id);
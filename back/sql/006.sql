@@ -0,0 +1,32 @@
+-- ナレッジベースの資料（メモ、Markdown、マニュアルなど）
+CREATE TABLE documents (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id VARCHAR(255) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    -- 取り込み元（ファイルパスやURL）。同じ取り込み元は上書きする
+    source TEXT NOT NULL,
+    content_hash CHAR(64) NOT NULL,
+    chars INTEGER NOT NULL,
+    chunk_count INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_user_document_source UNIQUE (user_id, source)
+);
+
+-- 資料のチャンク（ベクトル検索用）
+CREATE TABLE document_chunks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    document_id UUID NOT NULL REFERENCES documents (id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    chunk_index INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    vector vector(1536) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_document_chunk UNIQUE (document_id, chunk_index)
+);
+
+CREATE INDEX ON document_chunks USING ivfflat (vector vector_cosine_ops)
+WITH (lists = 100);
+
+CREATE INDEX idx_document_chunks_user
+ON document_chunks (user_id);
@@ -0,0 +1,29 @@
+-- 要約の階層化（3時間ごとの要約 → 日 → 週、日の要約を束ねた話題）
+ALTER TABLE conversation_summaries
+    ADD COLUMN level VARCHAR(16) NOT NULL DEFAULT 'window',
+    -- 話題の要約のみ。話題の短い名前
+    ADD COLUMN topic VARCHAR(255),
+    -- 上位の要約（日・週）にまとめた日時。まとめた要約は上位から辿って検索する
+    ADD COLUMN consolidated_at TIMESTAMP,
+    ADD CONSTRAINT conversation_summaries_level_check CHECK (level IN ('window', 'daily', 'weekly', 'topic'));
+
+-- 同じ期間の要約でもレベルが違えば別の行にする。話題の期間はメンバーから決まるため一意にしない
+ALTER TABLE conversation_summaries DROP CONSTRAINT unique_user_timerange;
+CREATE UNIQUE INDEX unique_user_level_timerange
+ON conversation_summaries (user_id, level, start_time, end_time)
+WHERE level <> 'topic';
+
+-- まだ上位にまとめていない要約の検索用のインデックス
+CREATE INDEX idx_conversation_summaries_unconsolidated
+ON conversation_summaries (user_id, level, start_time)
+WHERE consolidated_at IS NULL;
+
+-- 上位の要約とその元になった要約の対応（週→日、日→3時間、話題→日）
+CREATE TABLE conversation_summary_links (
+    parent_id UUID NOT NULL REFERENCES conversation_summaries (id) ON DELETE CASCADE,
+    child_id UUID NOT NULL REFERENCES conversation_summaries (id) ON DELETE CASCADE,
+    PRIMARY KEY (parent_id, child_id)
+);
+
+CREATE INDEX idx_conversation_summary_links_child
+ON conversation_summary_links (child_id);
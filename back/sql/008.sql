@@ -0,0 +1,30 @@
+-- ピン留めした要約は保持期間を過ぎても削除しない
+ALTER TABLE conversation_summaries
+    ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- ユーザーごとの保持期間。日数が NULL なら区分の設定を使う
+CREATE TABLE user_retention (
+    user_id VARCHAR(255) PRIMARY KEY,
+    tier VARCHAR(32) NOT NULL DEFAULT 'default',
+    message_days INTEGER,
+    summary_days INTEGER,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT user_retention_days_check CHECK (message_days >= 0 AND summary_days >= 0)
+);
+
+-- 保持期間による削除の監査ログ
+CREATE TABLE retention_audit_log (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id VARCHAR(255) NOT NULL,
+    -- summary_deleted: 要約を削除 / message_expiry_scheduled: メッセージにTTLを設定
+    action VARCHAR(32) NOT NULL,
+    target_id VARCHAR(255),
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_retention_audit_log_user
+ON retention_audit_log (user_id, created_at);
+
+CREATE INDEX idx_retention_audit_log_created
+ON retention_audit_log (created_at);
@@ -0,0 +1,25 @@
+-- 埋め込みモデルとバージョン。検索は現在のバージョンの行だけを対象にする
+-- (異なるモデルのベクトル同士は比較できないため)。モデルを変えたら cmd/reindex で作り直す
+ALTER TABLE conversation_summaries
+    ADD COLUMN embedding_model VARCHAR(64) NOT NULL DEFAULT 'text-embedding-ada-002',
+    ADD COLUMN embedding_version INTEGER NOT NULL DEFAULT 1,
+    -- 要約の指示のバージョン。指示を変えたら cmd/reindex -resummarize で作り直せる
+    ADD COLUMN summary_version INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE attachment_chunks
+    ADD COLUMN embedding_model VARCHAR(64) NOT NULL DEFAULT 'text-embedding-ada-002',
+    ADD COLUMN embedding_version INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE document_chunks
+    ADD COLUMN embedding_model VARCHAR(64) NOT NULL DEFAULT 'text-embedding-ada-002',
+    ADD COLUMN embedding_version INTEGER NOT NULL DEFAULT 1;
+
+-- 作り直しが必要な行の検索用のインデックス
+CREATE INDEX idx_conversation_summaries_embedding_version
+ON conversation_summaries (embedding_version, id);
+
+CREATE INDEX idx_attachment_chunks_embedding_version
+ON attachment_chunks (embedding_version, id);
+
+CREATE INDEX idx_document_chunks_embedding_version
+ON document_chunks (embedding_version, id);
@@ -0,0 +1,27 @@
+-- ユーザーごとに固定するプロンプトのバージョン。実験や既定のバージョンより優先する
+CREATE TABLE user_prompt_versions (
+    user_id VARCHAR(255) NOT NULL,
+    prompt VARCHAR(64) NOT NULL,
+    version INTEGER NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, prompt),
+    CONSTRAINT user_prompt_versions_version_check CHECK (version >= 1)
+);
+
+-- プロンプトの実験。ユーザーIDから決まる traffic_percent の割合のユーザーに version を使う
+CREATE TABLE prompt_experiments (
+    name VARCHAR(64) PRIMARY KEY,
+    prompt VARCHAR(64) NOT NULL,
+    version INTEGER NOT NULL,
+    traffic_percent INTEGER NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT prompt_experiments_version_check CHECK (version >= 1),
+    CONSTRAINT prompt_experiments_traffic_check CHECK (traffic_percent BETWEEN 0 AND 100)
+);
+
+CREATE INDEX idx_prompt_experiments_prompt
+ON prompt_experiments (prompt)
+WHERE enabled;
+
@@ -0,0 +1,7 @@
+-- ユーザーごとの設定。locale が NULL なら、メッセージから判定した detected_locale を使う
+CREATE TABLE user_settings (
+    user_id VARCHAR(255) PRIMARY KEY,
+    locale VARCHAR(16),
+    detected_locale VARCHAR(16),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
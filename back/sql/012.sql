@@ -0,0 +1,10 @@
+-- ユーザーごとのアシスタントの設定。NULL の項目は既定の値を使う
+ALTER TABLE user_settings
+    ADD COLUMN persona TEXT NOT NULL DEFAULT '',
+    ADD COLUMN model VARCHAR(64),
+    ADD COLUMN temperature DOUBLE PRECISION,
+    ADD COLUMN history_window INTEGER,
+    ADD COLUMN memory_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN summarization_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD CONSTRAINT user_settings_temperature_check CHECK (temperature BETWEEN 0 AND 2),
+    ADD CONSTRAINT user_settings_history_window_check CHECK (history_window >= 1);
@@ -0,0 +1,8 @@
+-- 配信中のリマインダー。バッチが取得してから会話に投稿し終えるまでの状態
+ALTER TABLE reminders DROP CONSTRAINT reminders_status_check;
+ALTER TABLE reminders
+    ADD CONSTRAINT reminders_status_check CHECK (status IN ('pending', 'sending', 'sent', 'canceled'));
+
+-- 止まったバッチが残した配信中のリマインダーの取得用のインデックス
+CREATE INDEX idx_reminders_sending_updated
+ON reminders (updated_at) WHERE status = 'sending';
@@ -0,0 +1,61 @@
+// Package webhook は送信する通知の署名・検証と、動作確認用のスタブ受信サーバー
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 通知リクエストに付けるヘッダー
+const (
+	// SignatureHeader は "sha256=<hex>" 形式の署名
+	SignatureHeader = "X-Memorai-Signature"
+	// TimestampHeader は署名に含めた送信時刻(Unix秒)
+	TimestampHeader = "X-Memorai-Timestamp"
+	EventHeader     = "X-Memorai-Event"
+	// DeliveryHeader は配信ID。リトライでも同じ値になるので受信側の重複排除に使える
+	DeliveryHeader = "X-Memorai-Delivery"
+)
+
+const signaturePrefix = "sha256="
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrStaleTimestamp は署名の時刻が許容範囲外(リプレイの可能性)であることを表す
+	ErrStaleTimestamp = errors.New("stale webhook timestamp")
+)
+
+// Sign は "<Unix秒>.<本文>" のHMAC-SHA256署名を SignatureHeader の形式で返す
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify は受信したリクエストの署名を検証する。tolerance が正なら now との時刻差も確認する
+func Verify(secret, signature, timestamp string, body []byte, tolerance time.Duration, now time.Time) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	sentAt := time.Unix(unix, 0)
+	if tolerance > 0 && (now.Sub(sentAt) > tolerance || sentAt.Sub(now) > tolerance) {
+		return ErrStaleTimestamp
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	expected := Sign(secret, sentAt, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	const secret = "s3cret"
+	sentAt := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"reminder.sent"}`)
+	signature := Sign(secret, sentAt, body)
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		timestamp string
+		body      []byte
+		tolerance time.Duration
+		now       time.Time
+		wantErr   error
+	}{
+		{name: "valid", secret: secret, signature: signature, timestamp: timestamp, body: body, tolerance: 5 * time.Minute, now: sentAt.Add(time.Minute)},
+		{name: "valid without tolerance", secret: secret, signature: signature, timestamp: timestamp, body: body, now: sentAt.Add(24 * time.Hour)},
+		{name: "tampered body", secret: secret, signature: signature, timestamp: timestamp, body: []byte(`{"type":"reminder.canceled"}`), tolerance: 5 * time.Minute, now: sentAt, wantErr: ErrInvalidSignature},
+		{name: "wrong secret", secret: "other", signature: signature, timestamp: timestamp, body: body, tolerance: 5 * time.Minute, now: sentAt, wantErr: ErrInvalidSignature},
+		{name: "tampered timestamp", secret: secret, signature: signature, timestamp: strconv.FormatInt(sentAt.Unix()+1, 10), body: body, tolerance: 5 * time.Minute, now: sentAt, wantErr: ErrInvalidSignature},
+		{name: "missing prefix", secret: secret, signature: signature[len(signaturePrefix):], timestamp: timestamp, body: body, now: sentAt, wantErr: ErrInvalidSignature},
+		{name: "malformed timestamp", secret: secret, signature: signature, timestamp: "yesterday", body: body, now: sentAt, wantErr: ErrInvalidSignature},
+		{name: "stale timestamp", secret: secret, signature: signature, timestamp: timestamp, body: body, tolerance: 5 * time.Minute, now: sentAt.Add(6 * time.Minute), wantErr: ErrStaleTimestamp},
+		{name: "future timestamp", secret: secret, signature: signature, timestamp: timestamp, body: body, tolerance: 5 * time.Minute, now: sentAt.Add(-6 * time.Minute), wantErr: ErrStaleTimestamp},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.signature, tt.timestamp, tt.body, tt.tolerance, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignIsDeterministic(t *testing.T) {
+	sentAt := time.Unix(1700000000, 0)
+	a := Sign("secret", sentAt, []byte("body"))
+	if b := Sign("secret", sentAt, []byte("body")); a != b {
+		t.Fatalf("Sign returned %q and %q for the same input", a, b)
+	}
+	if b := Sign("secret", sentAt.Add(time.Second), []byte("body")); a == b {
+		t.Fatal("Sign ignored the timestamp")
+	}
+}
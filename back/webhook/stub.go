@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Received はスタブが受け取った通知1件
+type Received struct {
+	Event      string
+	DeliveryID string
+	Header     http.Header
+	Body       []byte
+	ReceivedAt time.Time
+}
+
+// StubReceiver は通知を受け取って記録するだけの受信サーバー。
+// httptest.NewServer に渡してテストで使うか、cmd/webhook-stub でローカルに起動する
+type StubReceiver struct {
+	// Secret が空でなければ署名を検証し、不正なものは401を返す
+	Secret string
+	// Tolerance は署名の時刻の許容差。0なら時刻は確認しない
+	Tolerance time.Duration
+
+	mu       sync.Mutex
+	received []Received
+	failNext int
+}
+
+// NewStubReceiver コンストラクタ
+func NewStubReceiver(secret string) *StubReceiver {
+	return &StubReceiver{Secret: secret, Tolerance: 5 * time.Minute}
+}
+
+// FailNext は次の n 件に500を返すようにする。送信側のリトライの確認用
+func (s *StubReceiver) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+// Received は受け取った通知を受信順に返す
+func (s *StubReceiver) Received() []Received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Received(nil), s.received...)
+}
+
+func (s *StubReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if s.Secret != "" {
+		err := Verify(s.Secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, s.Tolerance, time.Now())
+		if err != nil {
+			slog.Warn("Rejected webhook", "delivery_id", r.Header.Get(DeliveryHeader), "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if s.failNext > 0 {
+		s.failNext--
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.received = append(s.received, Received{
+		Event:      r.Header.Get(EventHeader),
+		DeliveryID: r.Header.Get(DeliveryHeader),
+		Header:     r.Header.Clone(),
+		Body:       body,
+		ReceivedAt: time.Now(),
+	})
+	s.mu.Unlock()
+
+	slog.Info("Received webhook", "event", r.Header.Get(EventHeader), "delivery_id", r.Header.Get(DeliveryHeader), "bytes", len(body))
+	w.WriteHeader(http.StatusNoContent)
+}
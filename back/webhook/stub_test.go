@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postSigned(t *testing.T, url, secret string, sentAt time.Time, body []byte) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(EventHeader, "reminder.sent")
+	req.Header.Set(DeliveryHeader, "delivery-1")
+	req.Header.Set(TimestampHeader, fmt.Sprint(sentAt.Unix()))
+	req.Header.Set(SignatureHeader, Sign(secret, sentAt, body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestStubReceiver(t *testing.T) {
+	stub := NewStubReceiver("secret")
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	body := []byte(`{"id":"1"}`)
+	if code := postSigned(t, server.URL, "secret", time.Now(), body); code != http.StatusNoContent {
+		t.Fatalf("signed request: status %d, want 204", code)
+	}
+	if code := postSigned(t, server.URL, "wrong", time.Now(), body); code != http.StatusUnauthorized {
+		t.Fatalf("wrongly signed request: status %d, want 401", code)
+	}
+	if code := postSigned(t, server.URL, "secret", time.Now().Add(-time.Hour), body); code != http.StatusUnauthorized {
+		t.Fatalf("stale request: status %d, want 401", code)
+	}
+
+	stub.FailNext(1)
+	if code := postSigned(t, server.URL, "secret", time.Now(), body); code != http.StatusInternalServerError {
+		t.Fatalf("request after FailNext: status %d, want 500", code)
+	}
+	if code := postSigned(t, server.URL, "secret", time.Now(), body); code != http.StatusNoContent {
+		t.Fatalf("request after the failure: status %d, want 204", code)
+	}
+
+	received := stub.Received()
+	if len(received) != 2 {
+		t.Fatalf("received %d notifications, want 2", len(received))
+	}
+	if r := received[0]; r.Event != "reminder.sent" || r.DeliveryID != "delivery-1" || !bytes.Equal(r.Body, body) {
+		t.Fatalf("received %+v", r)
+	}
+}